@@ -4,6 +4,8 @@ go 1.15
 
 require (
 	github.com/Shopify/sarama v1.27.0
+	github.com/cloudevents/sdk-go/protocol/kafka_sarama/v2 v2.2.0
+	github.com/cloudevents/sdk-go/v2 v2.2.0
 	github.com/cpuguy83/go-md2man/v2 v2.0.0 // indirect
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/gorilla/mux v1.8.0
@@ -12,6 +14,6 @@ require (
 	github.com/tidepool-org/go-common v0.8.2
 	github.com/urfave/cli v1.22.4
 	go.mongodb.org/mongo-driver v1.4.1
-	golang.org/x/crypto v0.0.0-20201002170205-7f63de1d35b0 // indirect
+	golang.org/x/crypto v0.0.0-20201002170205-7f63de1d35b0
 	golang.org/x/sync v0.0.0-20200930132711-30421366ff76 // indirect
 )
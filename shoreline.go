@@ -8,6 +8,8 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -67,9 +69,15 @@ func main() {
 	current.EncodeKey = privateKey
 	current.DecodeKey = publicKey
 	current.Algorithm = "RS256"
+	if algorithm, found := os.LookupEnv("TOKEN_ALGORITHM"); found {
+		current.Algorithm = algorithm
+	}
 	current.Audience = apiHost
 	current.Issuer = apiHost
 	current.DurationSecs = 60 * 60 * 24 * 30
+	if extraAudiences, found := os.LookupEnv("EXTRA_AUDIENCES"); found {
+		current.ExtraAudiences = strings.Fields(extraAudiences)
+	}
 
 	previous := &config.User.TokenConfigs[1]
 	previousPrivateKey, _ := os.LookupEnv("PREVIOUS_PRIVATE_KEY")
@@ -78,9 +86,56 @@ func main() {
 	previous.EncodeKey = previousPrivateKey
 	previous.DecodeKey = previousPublicKey
 	previous.Algorithm = "RS256"
+	if previousAlgorithm, found := os.LookupEnv("PREVIOUS_TOKEN_ALGORITHM"); found {
+		previous.Algorithm = previousAlgorithm
+	}
 	previous.Audience = previousApiHost
 	previous.Issuer = previousApiHost
 	previous.DurationSecs = 60 * 60 * 24 * 30
+	if previousExtraAudiences, found := os.LookupEnv("PREVIOUS_EXTRA_AUDIENCES"); found {
+		previous.ExtraAudiences = strings.Fields(previousExtraAudiences)
+	}
+
+	if clockSkew, found := os.LookupEnv("TOKEN_CLOCK_SKEW"); found {
+		if clockSkewDuration, err := time.ParseDuration(clockSkew); err != nil {
+			logger.Fatalf("Invalid TOKEN_CLOCK_SKEW %q: %v", clockSkew, err)
+		} else {
+			current.ClockSkewSecs = int64(clockSkewDuration.Seconds())
+			previous.ClockSkewSecs = current.ClockSkewSecs
+		}
+	}
+
+	// a key directory replaces the keys above and is reloaded without a restart
+	if keyDirectory, found := os.LookupEnv("KEY_DIRECTORY"); found {
+		config.User.KeyDirectory = keyDirectory
+	}
+	if keyReloadInterval, found := os.LookupEnv("KEY_RELOAD_INTERVAL"); found {
+		if keyReloadDuration, err := time.ParseDuration(keyReloadInterval); err != nil {
+			logger.Fatalf("Invalid KEY_RELOAD_INTERVAL %q: %v", keyReloadInterval, err)
+		} else {
+			config.User.KeyReloadIntervalSecs = int64(keyReloadDuration.Seconds())
+		}
+	}
+
+	// key rotation replaces the keys above as signing keys once its first key is active
+	if keyRotationInterval, found := os.LookupEnv("KEY_ROTATION_INTERVAL"); found {
+		if keyRotationDuration, err := time.ParseDuration(keyRotationInterval); err != nil {
+			logger.Fatalf("Invalid KEY_ROTATION_INTERVAL %q: %v", keyRotationInterval, err)
+		} else {
+			config.User.KeyRotation.IntervalSecs = int64(keyRotationDuration.Seconds())
+		}
+	}
+	if keyEncryptionKey, found := os.LookupEnv("KEY_ENCRYPTION_KEY"); found {
+		config.User.KeyRotation.EncryptionKey = keyEncryptionKey
+	}
+
+	if tokenCacheStaleness, found := os.LookupEnv("TOKEN_CACHE_STALENESS"); found {
+		if tokenCacheDuration, err := time.ParseDuration(tokenCacheStaleness); err != nil {
+			logger.Fatalf("Invalid TOKEN_CACHE_STALENESS %q: %v", tokenCacheStaleness, err)
+		} else {
+			config.User.TokenCache.MaxStalenessSecs = int64(tokenCacheDuration.Seconds())
+		}
+	}
 
 	longTermKey, found := os.LookupEnv("LONG_TERM_KEY")
 	if found {
@@ -91,6 +146,14 @@ func main() {
 	if found {
 		config.User.VerificationSecret = verificationSecret
 	}
+	// the verification secret skips email verification, which only test environments may allow
+	if allowVerificationSecret, found := os.LookupEnv("ALLOW_VERIFICATION_SECRET"); found {
+		if allowed, err := strconv.ParseBool(allowVerificationSecret); err != nil {
+			logger.Fatalf("Invalid ALLOW_VERIFICATION_SECRET %q: %v", allowVerificationSecret, err)
+		} else {
+			config.User.AllowVerificationSecret = allowed
+		}
+	}
 	clinicDemoUserID, found := os.LookupEnv("DEMO_CLINIC_USER_ID")
 	if found {
 		config.User.ClinicDemoUserID = clinicDemoUserID
@@ -169,7 +232,10 @@ func main() {
 		WithHttpClient(httpClient).
 		Build()
 
-	userapi := user.InitApi(config.User, logger, clientStore, notifier, seagull)
+	userapi, err := user.InitApi(config.User, logger, clientStore, notifier, seagull)
+	if err != nil {
+		log.Fatalln(err)
+	}
 	logger.Print("installing handlers")
 	userapi.SetHandlers("", rtr)
 
@@ -184,6 +250,17 @@ func main() {
 
 	userapi.AttachPerms(permsClient)
 
+	// every replica drops the revoked tokens from its own token cache, so each consumes all revocations
+	var revocationConsumer events.EventConsumer
+	if revocationHandler := userapi.TokenRevocationHandler(); revocationHandler != nil {
+		revocationConfig := events.NewConfig()
+		if err := revocationConfig.LoadFromEnv(); err != nil {
+			log.Fatalln(err)
+		}
+		revocationConsumer = user.NewTokenRevocationConsumer(revocationConfig)
+		revocationConsumer.RegisterHandler(revocationHandler)
+	}
+
 	/*
 	 * Serve it up
 	 */
@@ -195,6 +272,21 @@ func main() {
 
 	shutdown := make(chan string)
 
+	keysCtx, keysCancel := context.WithCancel(context.Background())
+	defer keysCancel()
+	go userapi.WatchKeyDirectory(keysCtx)
+	go userapi.WatchKeyRotation(keysCtx)
+
+	go func() {
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		for range reload {
+			if err := userapi.ReloadKeys(); err != nil {
+				logger.Printf("Error reloading the token keys, keeping the current keys: %v", err)
+			}
+		}
+	}()
+
 	go func() {
 		log.Println("Starting Kafka consumer")
 		if err := consumer.Start(); err != nil {
@@ -202,6 +294,15 @@ func main() {
 		}
 	}()
 
+	if revocationConsumer != nil {
+		go func() {
+			log.Println("Starting Kafka token revocation consumer")
+			if err := revocationConsumer.Start(); err != nil {
+				shutdown <- "Error while starting token revocation consumer:" + err.Error()
+			}
+		}()
+	}
+
 	go func() {
 		logger.Print("starting http server")
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
@@ -228,4 +329,9 @@ func main() {
 	if consumerErr := consumer.Stop(); consumerErr != nil {
 		log.Printf("Error while stopping the Kafka consumer: %v", err)
 	}
+	if revocationConsumer != nil {
+		if consumerErr := revocationConsumer.Stop(); consumerErr != nil {
+			log.Printf("Error while stopping the Kafka token revocation consumer: %v", consumerErr)
+		}
+	}
 }
@@ -5,17 +5,21 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"reflect"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
 
 	"github.com/tidepool-org/go-common/clients"
 	"github.com/tidepool-org/go-common/clients/status"
+	"github.com/tidepool-org/go-common/events"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -42,6 +46,11 @@ type (
 		logger             *log.Logger
 		userEventsNotifier EventsNotifier
 		sessionToken       *SessionToken
+		passwordPolicy     PasswordPolicy
+		trustedProxies     []*net.IPNet // parsed from ApiConfig.TrustedProxies
+		keyRing            atomic.Value // *KeyRing, swapped by ReloadKeys and RotateKeys
+		tokenCache         *TokenCache  // nil when disabled
+		clientSecrets      *serviceClientSecretCache
 	}
 	ApiConfig struct {
 		ServerSecret         string        `json:"serverSercret"`
@@ -51,6 +60,69 @@ type (
 		Salt                 string        `json:"salt"`
 		VerificationSecret   string        `json:"verificationSecret"`
 		ClinicDemoUserID     string        `json:"clinicDemoUserId"`
+		// AllowVerificationSecret marks new users whose username or email contains VerificationSecret as verified,
+		// it must only be enabled in test environments
+		AllowVerificationSecret bool `json:"allowVerificationSecret"`
+		// PasswordHash configures how new password hashes are generated; legacy hashes are upgraded on login
+		PasswordHash PasswordHashConfig `json:"passwordHash"`
+		// PasswordPolicy configures the rules new passwords must satisfy
+		PasswordPolicy PasswordPolicyConfig `json:"passwordPolicy"`
+		// PasswordHistorySize is how many previous passwords of a user, besides the current one, cannot be reused; 0 disables the history
+		PasswordHistorySize int `json:"passwordHistorySize"`
+		// PasswordResetDurationSecs is how long a password reset token stays valid
+		PasswordResetDurationSecs int64 `json:"passwordResetDurationSecs"`
+		// EmailVerificationDurationSecs is how long an email verification token stays valid
+		EmailVerificationDurationSecs int64 `json:"emailVerificationDurationSecs"`
+		// EmailVerificationResendIntervalSecs is the minimum time between two verification emails for the same user
+		EmailVerificationResendIntervalSecs int64 `json:"emailVerificationResendIntervalSecs"`
+		// LoginLockout configures the backoff and lockout applied after failed logins
+		LoginLockout LoginLockoutConfig `json:"loginLockout"`
+		// MfaIssuer is the name authenticator apps show next to the account
+		MfaIssuer string `json:"mfaIssuer"`
+		// MfaTokenDurationSecs is how long the token handed out by a login that still needs a second factor stays valid
+		MfaTokenDurationSecs int64 `json:"mfaTokenDurationSecs"`
+		// MfaRequiredRoles are the roles that must enable multi-factor authentication before they can login
+		MfaRequiredRoles []string `json:"mfaRequiredRoles"`
+		// RefreshToken configures the short-lived session tokens and rotating refresh tokens handed out to clients that ask for them
+		RefreshToken RefreshTokenConfig `json:"refreshToken"`
+		// Oidc configures shoreline as an OpenID Connect provider for web apps
+		Oidc OidcConfig `json:"oidc"`
+		// ServiceClients are the services that obtain server tokens with the client credentials grant
+		ServiceClients []ServiceClient `json:"serviceClients"`
+		// DisableLegacyServerLogin rejects server logins with the shared ServerSecret once all services use the client credentials grant
+		DisableLegacyServerLogin bool `json:"disableLegacyServerLogin"`
+		// ImpersonationDurationSecs is how long the token handed out to support staff impersonating a user stays valid
+		ImpersonationDurationSecs int64 `json:"impersonationDurationSecs"`
+		// TrustedProxies are the addresses and CIDR ranges of the proxies whose X-Forwarded-For header gives the client address
+		TrustedProxies []string `json:"trustedProxies"`
+		// KeyDirectory is a directory of token keys that replace TokenConfigs, see LoadKeyDirectory. The keys are
+		// reloaded by ReloadKeys, for example on SIGHUP, and every KeyReloadIntervalSecs if it is set.
+		KeyDirectory          string `json:"keyDirectory"`
+		KeyReloadIntervalSecs int64  `json:"keyReloadIntervalSecs"`
+		// KeyRotation generates and rotates the token signing keys, stored encrypted, instead of signing with TokenConfigs
+		KeyRotation KeyRotationConfig `json:"keyRotation"`
+		// TokenCache caches the session tokens found in storage, so that checking a token does not hit the database every time
+		TokenCache TokenCacheConfig `json:"tokenCache"`
+	}
+	// mfaChallenge is the error response of a login that needs a second factor, mfaToken authenticates the next step
+	mfaChallenge struct {
+		Code      int       `json:"code"`
+		Reason    string    `json:"reason"`
+		MfaToken  string    `json:"mfaToken"`
+		ExpiresAt time.Time `json:"expiresAt"`
+	}
+	// passwordRejected is the error response when the password policy rejects a new password
+	passwordRejected struct {
+		Code       int                 `json:"code"`
+		Reason     string              `json:"reason"`
+		Rejections []PasswordRejection `json:"rejections"`
+	}
+	mfaEnrollment struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}
+	mfaRecoveryCodes struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
 	}
 	varsHandler func(http.ResponseWriter, *http.Request, map[string]string)
 )
@@ -62,6 +134,8 @@ const (
 	TP_SERVER_NAME   = "x-tidepool-server-name"
 	TP_SERVER_SECRET = "x-tidepool-server-secret"
 	TP_SESSION_TOKEN = "x-tidepool-session-token"
+	TP_REFRESH_TOKEN = "x-tidepool-refresh-token"
+	TP_CLIENT_NAME   = "x-tidepool-client-name"
 
 	STATUS_NO_USR_DETAILS        = "No user details were given"
 	STATUS_INVALID_USER_DETAILS  = "Invalid user details were given"
@@ -74,6 +148,7 @@ const (
 	STATUS_ERR_UPDATING_TOKEN    = "Error updating token"
 	STATUS_MISSING_USR_DETAILS   = "Not all required details were given"
 	STATUS_ERROR_UPDATING_PW     = "Error updating password"
+	STATUS_ERR_CHECKING_PW       = "Error checking password"
 	STATUS_MISSING_ID_PW         = "Missing id and/or password"
 	STATUS_NO_MATCH              = "No user matched the given details"
 	STATUS_NOT_VERIFIED          = "The user hasn't verified this account yet"
@@ -91,16 +166,87 @@ const (
 	STATUS_ONE_QUERY_PARAM       = "Only one query parameter is allowed"
 	STATUS_INVALID_QUERY_PARAM   = "Invalid query parameter: "
 	STATUS_INVALID_ROLE          = "The role specified is invalid"
+	STATUS_INVALID_RESET_TOKEN   = "The password reset token is invalid or has expired"
+	STATUS_INVALID_VERIFICATION  = "The email verification token is invalid or has expired"
+	STATUS_TOO_MANY_REQUESTS     = "Too many requests, try again later"
+	STATUS_ACCOUNT_LOCKED        = "The account is temporarily locked after too many failed logins"
+	STATUS_MFA_REQUIRED          = "A second authentication factor is required"
+	STATUS_MFA_ENROLL_REQUIRED   = "Multi-factor authentication must be enabled for this account"
+	STATUS_MFA_ALREADY_ENABLED   = "Multi-factor authentication is already enabled"
+	STATUS_MFA_NOT_PENDING       = "No multi-factor authentication enrollment is pending"
+	STATUS_MFA_NOT_ENABLED       = "Multi-factor authentication is not enabled"
+	STATUS_INVALID_MFA_TOKEN     = "The multi-factor authentication token is invalid or has expired"
+	STATUS_INVALID_MFA_CODE      = "The authentication code is invalid"
+	STATUS_PASSWORD_REUSED       = "The password has been used recently and cannot be reused"
+	STATUS_NO_REFRESH_TOKEN      = "No x-tidepool-refresh-token was found"
+	STATUS_INVALID_REFRESH_TOKEN = "The refresh token is invalid or has expired"
+	STATUS_REFRESH_TOKEN_REUSED  = "The refresh token has already been used, all sessions issued with it are revoked"
+	STATUS_USE_REFRESH_TOKEN     = "Sessions issued with a refresh token must be refreshed via POST /login/refresh"
+	STATUS_OIDC_DISABLED         = "OpenID Connect is not enabled"
+	STATUS_INVALID_OIDC_CLIENT   = "Unknown client or redirect URI"
+	STATUS_SERVER_LOGIN_DISABLED = "Server login with the shared secret is disabled, use the client credentials grant"
+	STATUS_CLIENT_TOKEN_REQUIRED = "A server token of a service client is required"
+	STATUS_SESSION_NOT_FOUND     = "Session not found"
+	STATUS_INVALID_SCOPE         = "The scope is unknown or was not granted"
+	STATUS_INSUFFICIENT_SCOPE    = "The token does not have the scope required for the operation"
+	STATUS_IMPERSONATED          = "The operation is not allowed while impersonating the user"
 )
 
-func InitApi(cfg ApiConfig, logger *log.Logger, store Storage, userEventsNotifier EventsNotifier, seagull clients.Seagull) *Api {
-	return &Api{
+const (
+	defaultPasswordResetDurationSecs           = 60 * 60
+	defaultEmailVerificationDurationSecs       = 60 * 60 * 24 * 7
+	defaultEmailVerificationResendIntervalSecs = 60
+	defaultMfaIssuer                           = "Tidepool"
+	defaultMfaTokenDurationSecs                = 5 * 60
+	defaultImpersonationDurationSecs           = 60 * 60
+)
+
+func InitApi(cfg ApiConfig, logger *log.Logger, store Storage, userEventsNotifier EventsNotifier, seagull clients.Seagull) (*Api, error) {
+	passwordPolicy, err := NewPasswordPolicy(cfg.PasswordPolicy)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Oidc.Validate(); err != nil {
+		return nil, err
+	}
+	if err := validateServiceClients(cfg.ServiceClients); err != nil {
+		return nil, err
+	}
+	trustedProxies, err := parseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.KeyRotation.Validate(); err != nil {
+		return nil, err
+	} else if cfg.KeyRotation.IsEnabled() && cfg.KeyDirectory != "" {
+		return nil, errors.New("key rotation cannot be used with a key directory")
+	}
+	if cfg.KeyDirectory != "" {
+		if cfg.TokenConfigs, err = LoadKeyDirectory(cfg.KeyDirectory); err != nil {
+			return nil, err
+		}
+	}
+	keyRing, err := NewKeyRing(cfg.TokenConfigs...)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Oidc.ValidateKeyRing(keyRing); err != nil {
+		return nil, err
+	}
+
+	api := &Api{
 		Store:              store,
 		ApiConfig:          cfg,
 		logger:             logger,
 		userEventsNotifier: userEventsNotifier,
 		seagull:            seagull,
+		passwordPolicy:     passwordPolicy,
+		trustedProxies:     trustedProxies,
+		tokenCache:         NewTokenCache(cfg.TokenCache),
+		clientSecrets:      newServiceClientSecretCache(),
 	}
+	api.keyRing.Store(keyRing)
+	return api, nil
 }
 
 func (a *Api) AttachPerms(perms clients.Gatekeeper) {
@@ -112,6 +258,14 @@ func (a *Api) SetHandlers(prefix string, rtr *mux.Router) {
 
 	rtr.HandleFunc("/status", a.GetStatus).Methods("GET")
 
+	rtr.HandleFunc("/.well-known/jwks.json", a.GetJSONWebKeySet).Methods("GET")
+	rtr.HandleFunc("/.well-known/openid-configuration", a.GetOidcConfiguration).Methods("GET")
+	rtr.HandleFunc("/oauth/authorize", a.OidcAuthorize).Methods("GET", "POST")
+	rtr.HandleFunc("/oauth/token", a.OauthToken).Methods("POST")
+	rtr.HandleFunc("/oauth/introspect", a.IntrospectToken).Methods("POST")
+	rtr.HandleFunc("/oauth/revoke", a.RevokeToken).Methods("POST")
+	rtr.HandleFunc("/userinfo", a.OidcUserInfo).Methods("GET", "POST")
+
 	rtr.HandleFunc("/users", a.GetUsers).Methods("GET")
 
 	rtr.Handle("/user", varsHandler(a.GetUserInfo)).Methods("GET")
@@ -125,8 +279,24 @@ func (a *Api) SetHandlers(prefix string, rtr *mux.Router) {
 
 	rtr.Handle("/user/{userid}/user", varsHandler(a.CreateCustodialUser)).Methods("POST")
 
+	rtr.Handle("/user/{userid}/password", varsHandler(a.ChangePassword)).Methods("POST")
+	rtr.Handle("/user/{userid}/unlock", varsHandler(a.UnlockUser)).Methods("POST")
+	rtr.Handle("/user/{userid}/logout-all", varsHandler(a.LogoutAll)).Methods("POST")
+	rtr.Handle("/user/{userid}/sessions", varsHandler(a.GetSessions)).Methods("GET")
+	rtr.Handle("/user/{userid}/sessions/{sessionid}", varsHandler(a.RevokeSession)).Methods("DELETE")
+
+	rtr.Handle("/user/{userid}/mfa", varsHandler(a.EnrollMfa)).Methods("POST")
+	rtr.Handle("/user/{userid}/mfa/confirm", varsHandler(a.ConfirmMfa)).Methods("POST")
+	rtr.Handle("/user/{userid}/mfa", varsHandler(a.DisableMfa)).Methods("DELETE")
+	rtr.Handle("/user/{userid}/mfa/recoverycodes", varsHandler(a.RegenerateMfaRecoveryCodes)).Methods("POST")
+
+	rtr.Handle("/user/{userid}/audit", varsHandler(a.GetAuditRecords)).Methods("GET")
+	rtr.Handle("/user/{userid}/impersonate", varsHandler(a.ImpersonateUser)).Methods("POST")
+
 	rtr.HandleFunc("/login", a.Login).Methods("POST")
 	rtr.HandleFunc("/login", a.RefreshSession).Methods("GET")
+	rtr.HandleFunc("/login/mfa", a.LoginMfa).Methods("POST")
+	rtr.HandleFunc("/login/refresh", a.RefreshAccessToken).Methods("POST")
 	rtr.Handle("/login/{longtermkey}", varsHandler(a.LongtermLogin)).Methods("POST")
 
 	rtr.HandleFunc("/serverlogin", a.ServerLogin).Methods("POST")
@@ -136,6 +306,12 @@ func (a *Api) SetHandlers(prefix string, rtr *mux.Router) {
 
 	rtr.HandleFunc("/logout", a.Logout).Methods("POST")
 
+	rtr.HandleFunc("/passwordreset", a.RequestPasswordReset).Methods("POST")
+	rtr.HandleFunc("/passwordreset/confirm", a.ConfirmPasswordReset).Methods("POST")
+
+	rtr.HandleFunc("/emailverification", a.ResendEmailVerification).Methods("POST")
+	rtr.HandleFunc("/emailverification/confirm", a.ConfirmEmailVerification).Methods("POST")
+
 	rtr.HandleFunc("/private", a.AnonymousIdHashPair).Methods("GET")
 }
 
@@ -156,10 +332,19 @@ func (a *Api) GetStatus(res http.ResponseWriter, req *http.Request) {
 	return
 }
 
+// GetJSONWebKeySet publishes the public keys session tokens are signed with, including the previous key
+// during a rotation. Tokens carry the kid of their key in the header.
+// status: 200 JSONWebKeySet
+func (a *Api) GetJSONWebKeySet(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Cache-Control", "public, max-age=300")
+	sendModelAsRes(res, a.keys().JSONWebKeySet())
+}
+
 // GetUsers returns all users
 // status: 200
 // status: 400 STATUS_NO_QUERY, STATUS_PARAMETER_UNKNOWN
 // status: 401 STATUS_SERVER_TOKEN_REQUIRED
+// status: 403 STATUS_INSUFFICIENT_SCOPE
 // status: 500 STATUS_ERR_FINDING_USR
 func (a *Api) GetUsers(res http.ResponseWriter, req *http.Request) {
 	sessionToken := req.Header.Get(TP_SESSION_TOKEN)
@@ -169,6 +354,9 @@ func (a *Api) GetUsers(res http.ResponseWriter, req *http.Request) {
 	} else if !tokenData.IsServer {
 		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED)
 
+	} else if !tokenData.HasServiceScope(ServiceScopeUsersRead) {
+		a.sendError(res, http.StatusForbidden, STATUS_INSUFFICIENT_SCOPE, ServiceScopeUsersRead)
+
 	} else if len(req.URL.Query()) == 0 {
 		a.sendError(res, http.StatusBadRequest, STATUS_NO_QUERY)
 
@@ -215,14 +403,15 @@ func (a *Api) GetUsers(res http.ResponseWriter, req *http.Request) {
 // CreateUser creates a new user
 // status: 201 User
 // status: 400 STATUS_MISSING_USR_DETAILS
+// status: 400 STATUS_INVALID_USER_DETAILS passwordRejected
 // status: 409 STATUS_USR_ALREADY_EXISTS
-// status: 500 STATUS_ERR_GENERATING_TOKEN
+// status: 500 STATUS_ERR_GENERATING_TOKEN, STATUS_ERR_CHECKING_PW
 func (a *Api) CreateUser(res http.ResponseWriter, req *http.Request) {
 	if newUserDetails, err := ParseNewUserDetails(req.Body); err != nil {
 		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_USER_DETAILS, err)
-	} else if err := newUserDetails.Validate(); err != nil { // TODO: Fix this duplicate work!
-		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_USER_DETAILS, err)
-	} else if newUser, err := NewUser(newUserDetails, a.ApiConfig.Salt); err != nil {
+	} else if err := newUserDetails.Validate(a.getPasswordPolicy()); err != nil { // TODO: Fix this duplicate work!
+		a.sendInvalidUserDetails(res, err)
+	} else if newUser, err := NewUser(newUserDetails, a.ApiConfig.Salt, a.ApiConfig.PasswordHash, a.getPasswordPolicy()); err != nil {
 		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_CREATING_USR, err)
 	} else if existingUser, err := a.Store.WithContext(req.Context()).FindUsers(newUser); err != nil {
 		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_CREATING_USR, err)
@@ -231,7 +420,7 @@ func (a *Api) CreateUser(res http.ResponseWriter, req *http.Request) {
 		a.sendError(res, http.StatusConflict, STATUS_USR_ALREADY_EXISTS)
 
 	} else {
-		if newUser.IsEmailVerified(a.ApiConfig.VerificationSecret) {
+		if a.ApiConfig.AllowVerificationSecret && newUser.HasVerificationSecret(a.ApiConfig.VerificationSecret) {
 			newUser.EmailVerified = true
 			a.logger.Printf("User email %s contains %v, setting email verified to %v", newUser.Username, a.ApiConfig.VerificationSecret, newUser.EmailVerified)
 		}
@@ -247,10 +436,15 @@ func (a *Api) CreateUser(res http.ResponseWriter, req *http.Request) {
 				}
 			}
 		}
+		if !newUser.EmailVerified {
+			// The user can request another verification email, so this must not fail the signup
+			if err := a.sendEmailVerification(req.Context(), newUser); err != nil {
+				a.logger.Printf("Unable to send email verification for user %s: %v", newUser.Id, err)
+			}
+		}
 
 		tokenData := TokenData{DurationSecs: extractTokenDuration(req), UserId: newUser.Id, IsServer: false}
-		tokenConfig := a.ApiConfig.TokenConfigs[0]
-		if sessionToken, err := CreateSessionTokenAndSave(&tokenData, tokenConfig, a.Store.WithContext(req.Context())); err != nil {
+		if sessionToken, err := a.keys().CreateSessionTokenAndSave(&tokenData, a.Store.WithContext(req.Context())); err != nil {
 			a.sendError(res, http.StatusInternalServerError, STATUS_ERR_GENERATING_TOKEN, err)
 		} else {
 			a.logMetricForUser(newUser.Id, "usercreated", sessionToken.ID, map[string]string{"server": "false"})
@@ -264,6 +458,7 @@ func (a *Api) CreateUser(res http.ResponseWriter, req *http.Request) {
 // status: 201 User
 // status: 400 STATUS_MISSING_USR_DETAILS
 // status: 401 STATUS_UNAUTHORIZED
+// status: 403 STATUS_INSUFFICIENT_SCOPE
 // status: 409 STATUS_USR_ALREADY_EXISTS
 // status: 500 STATUS_ERR_GENERATING_TOKEN
 func (a *Api) CreateCustodialUser(res http.ResponseWriter, req *http.Request, vars map[string]string) {
@@ -276,6 +471,12 @@ func (a *Api) CreateCustodialUser(res http.ResponseWriter, req *http.Request, va
 	} else if custodianUserID := vars["userid"]; !tokenData.IsServer && custodianUserID != tokenData.UserId {
 		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED, "Token user id must match custodian user id or server")
 
+	} else if !tokenData.HasScope(ScopeAccountWrite) {
+		a.sendError(res, http.StatusForbidden, STATUS_INSUFFICIENT_SCOPE, ScopeAccountWrite)
+
+	} else if tokenData.IsServer && !tokenData.HasServiceScope(ServiceScopeUsersWrite) {
+		a.sendError(res, http.StatusForbidden, STATUS_INSUFFICIENT_SCOPE, ServiceScopeUsersWrite)
+
 	} else if newCustodialUserDetails, err := ParseNewCustodialUserDetails(req.Body); err != nil {
 		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_USER_DETAILS, err)
 
@@ -305,8 +506,11 @@ func (a *Api) CreateCustodialUser(res http.ResponseWriter, req *http.Request, va
 // UpdateUser updates a user
 // status: 200
 // status: 400 STATUS_INVALID_USER_DETAILS
+// status: 400 STATUS_INVALID_USER_DETAILS passwordRejected
+// status: 400 STATUS_PASSWORD_REUSED
+// status: 403 STATUS_INSUFFICIENT_SCOPE, STATUS_IMPERSONATED
 // status: 409 STATUS_USR_ALREADY_EXISTS
-// status: 500 STATUS_ERR_FINDING_USR
+// status: 500 STATUS_ERR_FINDING_USR, STATUS_ERR_CHECKING_PW
 // status: 500 STATUS_ERR_UPDATING_USR
 func (a *Api) UpdateUser(res http.ResponseWriter, req *http.Request, vars map[string]string) {
 	a.logger.Printf("UpdateUser %v", req)
@@ -314,11 +518,17 @@ func (a *Api) UpdateUser(res http.ResponseWriter, req *http.Request, vars map[st
 	if tokenData, err := a.authenticateSessionToken(req.Context(), sessionToken); err != nil {
 		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED, err)
 
+	} else if !tokenData.HasScope(ScopeAccountWrite) {
+		a.sendError(res, http.StatusForbidden, STATUS_INSUFFICIENT_SCOPE, ScopeAccountWrite)
+
+	} else if tokenData.IsServer && !tokenData.HasServiceScope(ServiceScopeUsersWrite) {
+		a.sendError(res, http.StatusForbidden, STATUS_INSUFFICIENT_SCOPE, ServiceScopeUsersWrite)
+
 	} else if updateUserDetails, err := ParseUpdateUserDetails(req.Body); err != nil {
 		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_USER_DETAILS, err)
 
-	} else if err := updateUserDetails.Validate(); err != nil {
-		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_USER_DETAILS, err)
+	} else if tokenData.IsImpersonated() && (updateUserDetails.Password != nil || updateUserDetails.Username != nil || updateUserDetails.Emails != nil) {
+		a.sendError(res, http.StatusForbidden, STATUS_IMPERSONATED)
 
 	} else if originalUser, err := a.Store.WithContext(req.Context()).FindUser(&User{Id: firstStringNotEmpty(vars["userid"], tokenData.UserId)}); err != nil {
 		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
@@ -335,9 +545,15 @@ func (a *Api) UpdateUser(res http.ResponseWriter, req *http.Request, vars map[st
 	} else if (updateUserDetails.Roles != nil || updateUserDetails.EmailVerified != nil) && !tokenData.IsServer {
 		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED, "User does not have permissions")
 
+	} else if (updateUserDetails.Roles != nil || updateUserDetails.EmailVerified != nil) && !tokenData.HasScope(ScopeAdmin) {
+		a.sendError(res, http.StatusForbidden, STATUS_INSUFFICIENT_SCOPE, ScopeAdmin)
+
 	} else if (updateUserDetails.Password != nil || updateUserDetails.TermsAccepted != nil) && permissions["root"] == nil {
 		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED, "User does not have permissions")
 
+	} else if err := updateUserDetails.Validate(a.getPasswordPolicy(), append([]string{originalUser.Username}, originalUser.Emails...)...); err != nil {
+		a.sendInvalidUserDetails(res, err)
+
 	} else {
 		updatedUser := originalUser.DeepClone()
 
@@ -364,7 +580,16 @@ func (a *Api) UpdateUser(res http.ResponseWriter, req *http.Request, vars map[st
 		}
 
 		if updateUserDetails.Password != nil {
-			if err := updatedUser.HashPassword(*updateUserDetails.Password, a.ApiConfig.Salt); err != nil {
+			if reused, err := a.isPasswordReused(req.Context(), originalUser, *updateUserDetails.Password); err != nil {
+				a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_USR, err)
+				return
+			} else if reused {
+				a.sendError(res, http.StatusBadRequest, STATUS_PASSWORD_REUSED)
+				return
+			} else if err := updatedUser.HashPasswordWithConfig(*updateUserDetails.Password, a.ApiConfig.Salt, a.ApiConfig.PasswordHash); err != nil {
+				a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_USR, err)
+				return
+			} else if err := a.addPasswordHistory(req.Context(), originalUser); err != nil {
 				a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_USR, err)
 				return
 			}
@@ -406,11 +631,14 @@ func (a *Api) UpdateUser(res http.ResponseWriter, req *http.Request, vars map[st
 // GetUserInfo returns user info
 // status: 200
 // status: 401 STATUS_UNAUTHORIZED
+// status: 403 STATUS_INSUFFICIENT_SCOPE
 // status: 500 STATUS_ERR_FINDING_USR
 func (a *Api) GetUserInfo(res http.ResponseWriter, req *http.Request, vars map[string]string) {
 	sessionToken := req.Header.Get(TP_SESSION_TOKEN)
 	if tokenData, err := a.authenticateSessionToken(req.Context(), sessionToken); err != nil {
 		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED, err)
+	} else if tokenData.IsServer && !tokenData.HasServiceScope(ServiceScopeUsersRead) {
+		a.sendError(res, http.StatusForbidden, STATUS_INSUFFICIENT_SCOPE, ServiceScopeUsersRead)
 	} else {
 		var user *User
 		if userID := vars["userid"]; userID != "" {
@@ -454,6 +682,16 @@ func (a *Api) DeleteUser(res http.ResponseWriter, req *http.Request, vars map[st
 		res.WriteHeader(http.StatusUnauthorized)
 		return
 	}
+	if tokenData.IsImpersonated() {
+		// custodians delete custodial accounts without their password, support must not do so on their behalf
+		a.sendError(res, http.StatusForbidden, STATUS_IMPERSONATED)
+		return
+	}
+	if !tokenData.HasScope(ScopeAccountWrite) || (tokenData.IsServer && !tokenData.HasServiceScope(ServiceScopeUsersWrite)) {
+		a.logger.Println(http.StatusForbidden, STATUS_INSUFFICIENT_SCOPE)
+		res.WriteHeader(http.StatusForbidden)
+		return
+	}
 
 	var requiresPassword bool
 	if !tokenData.IsServer {
@@ -514,7 +752,7 @@ func (a *Api) getUserProfile(ctx context.Context, userID string) (*Profile, erro
 		var err error
 		duration := int64(60 * 60 * 30)
 		tokenData := &TokenData{DurationSecs: duration, UserId: "shoreline", IsServer: true}
-		a.sessionToken, err = CreateSessionTokenAndSave(tokenData, a.ApiConfig.TokenConfigs[0], a.Store.WithContext(ctx))
+		a.sessionToken, err = a.keys().CreateSessionTokenAndSave(tokenData, a.Store.WithContext(ctx))
 		if err != nil {
 			return nil, err
 		}
@@ -527,10 +765,18 @@ func (a *Api) getUserProfile(ctx context.Context, userID string) (*Profile, erro
 	return profile, nil
 }
 
-// status: 200 TP_SESSION_TOKEN,
+// Login creates a session for the user. With the query parameter refresh_token=true the session token is
+// short-lived and a refresh token is returned as well, see RefreshAccessToken. The query parameter scope limits
+// the session to the given session scopes.
+// status: 200 TP_SESSION_TOKEN, TP_REFRESH_TOKEN
 // status: 400 STATUS_MISSING_ID_PW
+// status: 400 STATUS_INVALID_SCOPE
 // status: 401 STATUS_NO_MATCH
+// status: 401 STATUS_MFA_REQUIRED, mfaToken
 // status: 403 STATUS_NOT_VERIFIED
+// status: 403 STATUS_MFA_ENROLL_REQUIRED, mfaToken
+// status: 423 STATUS_ACCOUNT_LOCKED
+// status: 429 STATUS_TOO_MANY_REQUESTS
 // status: 500 STATUS_ERR_FINDING_USR, STATUS_ERR_UPDATING_TOKEN
 func (a *Api) Login(res http.ResponseWriter, req *http.Request) {
 	if user, password := unpackAuth(req.Header.Get("Authorization")); user == nil {
@@ -548,209 +794,2084 @@ func (a *Api) Login(res http.ResponseWriter, req *http.Request) {
 	} else if result.IsDeleted() {
 		a.sendError(res, http.StatusUnauthorized, STATUS_NO_MATCH, "User is marked deleted")
 
+	} else if result.IsLocked() {
+		setRetryAfter(res, result.LockedUntil)
+		a.sendError(res, http.StatusLocked, STATUS_ACCOUNT_LOCKED, "User is locked")
+
+	} else if nextLogin := a.ApiConfig.LoginLockout.NextLoginAllowedAt(result); time.Now().Before(nextLogin) {
+		setRetryAfter(res, nextLogin)
+		a.sendError(res, http.StatusTooManyRequests, STATUS_TOO_MANY_REQUESTS, fmt.Sprintf("Login attempted within backoff after %d failures", result.FailedLogins))
+
 	} else if !result.PasswordsMatch(password, a.ApiConfig.Salt) {
+		a.recordFailedLogin(req.Context(), result)
 		a.sendError(res, http.StatusUnauthorized, STATUS_NO_MATCH, "Passwords do not match")
 
-	} else if !result.IsEmailVerified(a.ApiConfig.VerificationSecret) {
+	} else if !result.EmailVerified {
 		a.sendError(res, http.StatusForbidden, STATUS_NOT_VERIFIED)
 
 	} else {
-		tokenData := &TokenData{DurationSecs: extractTokenDuration(req), UserId: result.Id}
-		tokenConfig := a.ApiConfig.TokenConfigs[0]
-		if sessionToken, err := CreateSessionTokenAndSave(tokenData, tokenConfig, a.Store.WithContext(req.Context())); err != nil {
-			a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_TOKEN, err)
-
+		a.upgradePasswordHash(req.Context(), result, password)
+
+		// Failed logins are only reset once all factors are verified, otherwise a known password
+		// would allow unlimited guesses of the second factor
+		if a.isMfaEnrollmentRequired(result) {
+			a.sendMfaChallenge(req.Context(), res, http.StatusForbidden, STATUS_MFA_ENROLL_REQUIRED, result, ConfirmationPurposeMfaEnrollment)
+		} else if result.IsMfaEnabled() {
+			a.sendMfaChallenge(req.Context(), res, http.StatusUnauthorized, STATUS_MFA_REQUIRED, result, ConfirmationPurposeMfaLogin)
 		} else {
-			a.logMetric("userlogin", sessionToken.ID, nil)
-			res.Header().Set(TP_SESSION_TOKEN, sessionToken.ID)
-			a.sendUser(res, result, false)
+			a.resetFailedLogins(req.Context(), result)
+			a.completeLogin(res, req, result)
 		}
 	}
 }
 
-// status: 200 TP_SESSION_TOKEN
-// status: 400 STATUS_MISSING_ID_PW
-// status: 401 STATUS_PW_WRONG
-// status: 500 STATUS_ERR_GENERATING_TOKEN
-func (a *Api) ServerLogin(res http.ResponseWriter, req *http.Request) {
-
-	server, pw := req.Header.Get(TP_SERVER_NAME), req.Header.Get(TP_SERVER_SECRET)
-
-	if server == "" || pw == "" {
-		a.logger.Println(http.StatusBadRequest, STATUS_MISSING_ID_PW)
-		sendModelAsResWithStatus(res, status.NewStatus(http.StatusBadRequest, STATUS_MISSING_ID_PW), http.StatusBadRequest)
+// completeLogin creates the session of a user whose credentials have all been verified. The query parameter
+// scope limits the session to the space separated session scopes, see SessionScopes.
+func (a *Api) completeLogin(res http.ResponseWriter, req *http.Request, user *User) {
+	scopes, ok := grantSessionScopes(nil, req.URL.Query().Get("scope"))
+	if !ok {
+		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_SCOPE, req.URL.Query().Get("scope"))
 		return
 	}
-	if pw == a.ApiConfig.ServerSecret {
-		//generate new token
-		if sessionToken, err := CreateSessionTokenAndSave(
-			&TokenData{DurationSecs: extractTokenDuration(req), UserId: server, IsServer: true},
-			a.ApiConfig.TokenConfigs[0],
-			a.Store.WithContext(req.Context()),
-		); err != nil {
-			a.logger.Println(http.StatusInternalServerError, STATUS_ERR_GENERATING_TOKEN, err.Error())
-			sendModelAsResWithStatus(res, status.NewStatus(http.StatusInternalServerError, STATUS_ERR_GENERATING_TOKEN), http.StatusInternalServerError)
-			return
+
+	if req.URL.Query().Get("refresh_token") == "true" {
+		if sessionToken, err := a.createRefreshableSession(req, res, user.Id, "", scopes); err != nil {
+			a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_TOKEN, err)
 		} else {
-			a.logMetricAsServer("serverlogin", sessionToken.ID, nil)
-			res.Header().Set(TP_SESSION_TOKEN, sessionToken.ID)
-			return
+			a.logMetric("userlogin", sessionToken.ID, map[string]string{"refreshToken": "true"})
+			a.sendUser(res, user, false)
 		}
+		return
+	}
+
+	tokenData := &TokenData{DurationSecs: extractTokenDuration(req), UserId: user.Id, Scopes: scopes, Metadata: a.sessionMetadata(req)}
+	if sessionToken, err := a.keys().CreateSessionTokenAndSave(tokenData, a.Store.WithContext(req.Context())); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_TOKEN, err)
+
+	} else {
+		a.logMetric("userlogin", sessionToken.ID, nil)
+		res.Header().Set(TP_SESSION_TOKEN, sessionToken.ID)
+		a.sendUser(res, user, false)
 	}
-	a.logger.Println(http.StatusUnauthorized, STATUS_PW_WRONG)
-	sendModelAsResWithStatus(res, status.NewStatus(http.StatusUnauthorized, STATUS_PW_WRONG), http.StatusUnauthorized)
-	return
 }
 
-// status: 200 TP_SESSION_TOKEN, TokenData
-// status: 401 STATUS_NO_TOKEN
-// status: 500 STATUS_ERR_GENERATING_TOKEN
-func (a *Api) RefreshSession(res http.ResponseWriter, req *http.Request) {
+// createRefreshableSession creates a short-lived session token and a refresh token of the given family, an empty
+// family starts a new one, and sets both on the response. Both are limited to the session scopes.
+func (a *Api) createRefreshableSession(req *http.Request, res http.ResponseWriter, userID string, familyID string, scopes []string) (*SessionToken, error) {
+	ctx := req.Context()
+	config := a.ApiConfig.RefreshToken.withDefaults()
 
-	td, err := a.authenticateSessionToken(req.Context(), req.Header.Get(TP_SESSION_TOKEN))
+	refreshToken, value, err := NewRefreshToken(userID, familyID, config.RefreshTokenDurationSecs)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken.Scopes = scopes
 
+	tokenData := &TokenData{DurationSecs: config.AccessTokenDurationSecs, UserId: userID, FamilyID: refreshToken.FamilyID, Scopes: scopes, Metadata: a.sessionMetadata(req)}
+	sessionToken, err := a.keys().CreateSessionTokenAndSave(tokenData, a.Store.WithContext(ctx))
 	if err != nil {
-		a.logger.Println(http.StatusUnauthorized, err.Error())
-		res.WriteHeader(http.StatusUnauthorized)
-		return
+		return nil, err
+	}
+	if err := a.Store.WithContext(ctx).AddRefreshToken(refreshToken); err != nil {
+		return nil, err
 	}
 
-	const two_hours_in_secs = 60 * 60 * 2
+	res.Header().Set(TP_SESSION_TOKEN, sessionToken.ID)
+	res.Header().Set(TP_REFRESH_TOKEN, value)
+	return sessionToken, nil
+}
 
-	if td.IsServer == false && td.DurationSecs > two_hours_in_secs {
-		//long-duration let us know detail and keep it rolling
-		//a.logger.Println("long-duration token set for ", fmt.Sprint(time.Duration(td.DurationSecs)*time.Second))
-	}
-	//refresh
-	if sessionToken, err := CreateSessionTokenAndSave(
-		td,
-		a.ApiConfig.TokenConfigs[0],
-		a.Store.WithContext(req.Context()),
-	); err != nil {
-		a.logger.Println(http.StatusInternalServerError, STATUS_ERR_GENERATING_TOKEN, err.Error())
-		sendModelAsResWithStatus(res, status.NewStatus(http.StatusInternalServerError, STATUS_ERR_GENERATING_TOKEN), http.StatusInternalServerError)
+// RefreshAccessToken exchanges a refresh token for a new session token and a new refresh token. Every refresh
+// token can be used once; presenting it again revokes all tokens of its family, as it has likely been stolen.
+// The query parameter scope narrows the session scopes of the new tokens to some of those of the refresh token.
+// status: 200 TP_SESSION_TOKEN, TP_REFRESH_TOKEN, User
+// status: 400 STATUS_INVALID_SCOPE
+// status: 401 STATUS_NO_REFRESH_TOKEN, STATUS_INVALID_REFRESH_TOKEN, STATUS_REFRESH_TOKEN_REUSED
+// status: 500 STATUS_ERR_FINDING_USR, STATUS_ERR_UPDATING_TOKEN
+func (a *Api) RefreshAccessToken(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	value := req.Header.Get(TP_REFRESH_TOKEN)
+	if value == "" {
+		a.sendError(res, http.StatusUnauthorized, STATUS_NO_REFRESH_TOKEN)
 		return
-	} else {
-		res.Header().Set(TP_SESSION_TOKEN, sessionToken.ID)
-		sendModelAsRes(res, td)
+	}
+	// unknown scopes are rejected before the refresh token is used up
+	if _, ok := grantSessionScopes(nil, req.URL.Query().Get("scope")); !ok {
+		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_SCOPE, req.URL.Query().Get("scope"))
 		return
 	}
-}
 
-// Set the longeterm duration and then process as per Login
-// note: see Login for return codes
-func (a *Api) LongtermLogin(res http.ResponseWriter, req *http.Request, vars map[string]string) {
+	refreshToken, reused, err := a.Store.WithContext(ctx).UseRefreshToken(HashRefreshToken(value))
+	if err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_TOKEN, err)
 
-	const day_as_secs = 1 * 24 * 60 * 60
+	} else if refreshToken == nil {
+		a.sendError(res, http.StatusUnauthorized, STATUS_INVALID_REFRESH_TOKEN, "Refresh token not found")
 
-	duration := a.ApiConfig.LongTermDaysDuration * day_as_secs
-	longtermkey := vars["longtermkey"]
+	} else if reused {
+		if err := a.Store.WithContext(ctx).RemoveRefreshTokenFamily(refreshToken.FamilyID); err != nil {
+			a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_TOKEN, err)
+			return
+		}
+		a.revokeCachedTokens(ctx, TokensRevokedEvent{UserID: refreshToken.UserID, FamilyID: refreshToken.FamilyID})
+		a.audit(req, AuditTypeRefreshTokenReused, refreshToken.UserID, map[string]string{"familyId": refreshToken.FamilyID})
+		a.sendError(res, http.StatusUnauthorized, STATUS_REFRESH_TOKEN_REUSED, "Refresh token family revoked")
 
-	if longtermkey == a.ApiConfig.LongTermKey {
-		a.logger.Println("token duration is ", fmt.Sprint(time.Duration(duration)*time.Second))
-		req.Header.Add(TOKEN_DURATION_KEY, strconv.FormatFloat(float64(duration), 'f', -1, 64))
-	} else {
-		//tell us there was no match
-		a.logger.Println("tried to login using the longtermkey but it didn't match the stored key")
-	}
+	} else if refreshToken.IsExpired() {
+		a.sendError(res, http.StatusUnauthorized, STATUS_INVALID_REFRESH_TOKEN, "Refresh token expired")
 
-	a.Login(res, req)
+	} else if user, err := a.Store.WithContext(ctx).FindUser(&User{Id: refreshToken.UserID}); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
 
-	// TODO: Does not actually add the TOKEN_DURATION_KEY to the response on success (as the old unittests would imply)
-}
+	} else if user == nil || user.IsDeleted() {
+		a.sendError(res, http.StatusUnauthorized, STATUS_INVALID_REFRESH_TOKEN, "User not found or deleted")
 
-// status: 200 TP_SESSION_TOKEN, TokenData
-// status: 401 STATUS_NO_TOKEN
-// status: 404 STATUS_NO_TOKEN_MATCH
-func (a *Api) ServerCheckToken(res http.ResponseWriter, req *http.Request, vars map[string]string) {
+	} else if scopes, ok := grantSessionScopes(refreshToken.Scopes, req.URL.Query().Get("scope")); !ok {
+		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_SCOPE, "Scope not granted to the refresh token")
 
-	if hasServerToken(req.Header.Get(TP_SESSION_TOKEN), a.ApiConfig.TokenConfigs...) {
-		td, err := a.authenticateSessionToken(req.Context(), vars["token"])
-		if err != nil {
-			a.logger.Printf("failed request: %v", req)
-			a.logger.Println(http.StatusUnauthorized, STATUS_NO_TOKEN, err.Error())
-			sendModelAsResWithStatus(res, status.NewStatus(http.StatusUnauthorized, STATUS_NO_TOKEN), http.StatusUnauthorized)
-			return
-		}
+	} else if sessionToken, err := a.createRefreshableSession(req, res, user.Id, refreshToken.FamilyID, scopes); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_TOKEN, err)
 
-		sendModelAsRes(res, td)
-		return
+	} else {
+		a.logMetric("refreshtoken", sessionToken.ID, nil)
+		a.sendUser(res, user, false)
 	}
-	a.logger.Println(http.StatusUnauthorized, STATUS_NO_TOKEN)
-	a.logger.Printf("header session token: %v", req.Header.Get(TP_SESSION_TOKEN))
-	sendModelAsResWithStatus(res, status.NewStatus(http.StatusUnauthorized, STATUS_NO_TOKEN), http.StatusUnauthorized)
-	return
 }
 
-// status: 200 TP_SESSION_TOKEN, TokenData
-// status: 401 STATUS_NO_TOKEN
-func (a *Api) CheckToken(res http.ResponseWriter, req *http.Request) {
-	token := req.Header.Get(TP_SESSION_TOKEN)
-	td, err := a.authenticateSessionToken(req.Context(), token)
-	if err != nil {
-		a.logger.Printf("failed request: %v", req)
-		a.logger.Println(http.StatusUnauthorized, STATUS_NO_TOKEN, err.Error())
-		sendModelAsResWithStatus(res, status.NewStatus(http.StatusUnauthorized, STATUS_NO_TOKEN), http.StatusUnauthorized)
-		return
+func (a *Api) resetFailedLogins(ctx context.Context, user *User) {
+	if user.FailedLogins > 0 || !user.LockedUntil.IsZero() {
+		if err := a.Store.WithContext(ctx).ResetFailedLogins(user.Id); err != nil {
+			a.logger.Printf("failed to reset failed logins for user %s: %v", user.Id, err)
+		}
 	}
-
-	sendModelAsRes(res, td)
-	return
 }
 
-// status: 200
-func (a *Api) Logout(res http.ResponseWriter, req *http.Request) {
-	if id := req.Header.Get(TP_SESSION_TOKEN); id != "" {
-		if err := a.Store.WithContext(req.Context()).RemoveTokenByID(id); err != nil {
-			//silently fail but still log it
-			a.logger.Println("Logout was unable to delete token", err.Error())
+// recordFailedLogin counts the failed login against the user and locks the account once the configured
+// threshold is reached. Failures are logged rather than returned so the caller still answers with 401.
+func (a *Api) recordFailedLogin(ctx context.Context, user *User) {
+	failedLogins, err := a.Store.WithContext(ctx).IncrementFailedLogins(user.Id)
+	if err != nil {
+		a.logger.Printf("failed to record failed login for user %s: %v", user.Id, err)
+		return
+	}
+	if a.ApiConfig.LoginLockout.ShouldLock(failedLogins) {
+		lockedUntil := time.Now().Add(a.ApiConfig.LoginLockout.LockoutDuration())
+		if err := a.Store.WithContext(ctx).LockUser(user.Id, lockedUntil); err != nil {
+			a.logger.Printf("failed to lock user %s: %v", user.Id, err)
+			return
 		}
+		a.logMetricForUser(user.Id, "userlocked", "", map[string]string{"failedLogins": strconv.Itoa(failedLogins)})
 	}
-	//otherwise all good
-	res.WriteHeader(http.StatusOK)
-	return
 }
 
-// status: 200 AnonIdHashPair
-func (a *Api) AnonymousIdHashPair(res http.ResponseWriter, req *http.Request) {
-	idHashPair := NewAnonIdHashPair([]string{a.ApiConfig.Salt}, req.URL.Query())
-	sendModelAsRes(res, idHashPair)
-	return
+// verifyPassword checks the password a signed in user re-enters to confirm a sensitive change. The lockout and
+// backoff of logins apply, so that a session token does not allow unthrottled guesses of the password. The error
+// response is sent unless the password matches.
+func (a *Api) verifyPassword(res http.ResponseWriter, req *http.Request, user *User, password string) bool {
+	if user.IsLocked() {
+		setRetryAfter(res, user.LockedUntil)
+		a.sendError(res, http.StatusLocked, STATUS_ACCOUNT_LOCKED, "User is locked")
+	} else if nextLogin := a.ApiConfig.LoginLockout.NextLoginAllowedAt(user); time.Now().Before(nextLogin) {
+		setRetryAfter(res, nextLogin)
+		a.sendError(res, http.StatusTooManyRequests, STATUS_TOO_MANY_REQUESTS, fmt.Sprintf("Password entered within backoff after %d failures", user.FailedLogins))
+	} else if !user.PasswordsMatch(password, a.ApiConfig.Salt) {
+		a.recordFailedLogin(req.Context(), user)
+		a.sendError(res, http.StatusForbidden, STATUS_PW_WRONG)
+	} else {
+		a.resetFailedLogins(req.Context(), user)
+		return true
+	}
+	return false
 }
 
-func (a *Api) sendError(res http.ResponseWriter, statusCode int, reason string, extras ...interface{}) {
-	_, file, line, ok := runtime.Caller(1)
-	if ok {
-		segments := strings.Split(file, "/")
-		file = segments[len(segments)-1]
+// status: 200 User
+// status: 401 STATUS_UNAUTHORIZED, STATUS_SERVER_TOKEN_REQUIRED
+// status: 403 STATUS_INSUFFICIENT_SCOPE
+// status: 404 STATUS_USER_NOT_FOUND
+// status: 500 STATUS_ERR_FINDING_USR, STATUS_ERR_UPDATING_USR
+func (a *Api) UnlockUser(res http.ResponseWriter, req *http.Request, vars map[string]string) {
+	if tokenData, err := a.authenticateSessionToken(req.Context(), req.Header.Get(TP_SESSION_TOKEN)); err != nil {
+		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED, err)
+
+	} else if !tokenData.IsServer {
+		a.sendError(res, http.StatusUnauthorized, STATUS_SERVER_TOKEN_REQUIRED)
+
+	} else if !tokenData.HasServiceScope(ServiceScopeUsersWrite) {
+		a.sendError(res, http.StatusForbidden, STATUS_INSUFFICIENT_SCOPE, ServiceScopeUsersWrite)
+
+	} else if user, err := a.Store.WithContext(req.Context()).FindUser(&User{Id: vars["userid"]}); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if user == nil {
+		a.sendError(res, http.StatusNotFound, STATUS_USER_NOT_FOUND)
+
+	} else if err := a.Store.WithContext(req.Context()).ResetFailedLogins(user.Id); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_USR, err)
+
 	} else {
-		file = "???"
-		line = 0
+		a.logMetricForUser(user.Id, "userunlocked", req.Header.Get(TP_SESSION_TOKEN), map[string]string{"server": tokenData.UserId})
+		user.FailedLogins = 0
+		user.LastFailedLoginTime = time.Time{}
+		user.LockedUntil = time.Time{}
+		a.sendUser(res, user, true)
 	}
+}
 
-	messages := make([]string, len(extras))
-	for index, extra := range extras {
-		messages[index] = fmt.Sprintf("%v", extra)
+// status: 200 TP_SESSION_TOKEN, User
+// status: 400 STATUS_MISSING_ID_PW, STATUS_INVALID_SCOPE
+// status: 401 STATUS_INVALID_MFA_TOKEN, STATUS_INVALID_MFA_CODE
+// status: 423 STATUS_ACCOUNT_LOCKED
+// status: 429 STATUS_TOO_MANY_REQUESTS
+// status: 500 STATUS_ERR_FINDING_USR, STATUS_ERR_UPDATING_TOKEN
+func (a *Api) LoginMfa(res http.ResponseWriter, req *http.Request) {
+	details := getGivenDetail(req)
+
+	if details["mfaToken"] == "" || (details["code"] == "" && details["recoveryCode"] == "") {
+		a.sendError(res, http.StatusBadRequest, STATUS_MISSING_ID_PW)
+
+	} else if unpacked, err := UnpackConfirmationToken(details["mfaToken"], ConfirmationPurposeMfaLogin, a.keys()); err != nil {
+		a.sendError(res, http.StatusUnauthorized, STATUS_INVALID_MFA_TOKEN, err)
+
+	} else if user, err := a.Store.WithContext(req.Context()).FindUser(&User{Id: unpacked.UserID}); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if user == nil || user.IsDeleted() || !user.IsMfaEnabled() {
+		a.sendError(res, http.StatusUnauthorized, STATUS_INVALID_MFA_TOKEN, "User not found or multi-factor authentication not enabled")
+
+	} else if user.IsLocked() {
+		setRetryAfter(res, user.LockedUntil)
+		a.sendError(res, http.StatusLocked, STATUS_ACCOUNT_LOCKED, "User is locked")
+
+	} else if nextLogin := a.ApiConfig.LoginLockout.NextLoginAllowedAt(user); time.Now().Before(nextLogin) {
+		setRetryAfter(res, nextLogin)
+		a.sendError(res, http.StatusTooManyRequests, STATUS_TOO_MANY_REQUESTS, fmt.Sprintf("Login attempted within backoff after %d failures", user.FailedLogins))
+
+	} else if verified, err := a.verifySecondFactor(req, user, details["code"], details["recoveryCode"]); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_TOKEN, err)
+
+	} else if !verified {
+		a.recordFailedLogin(req.Context(), user)
+		a.sendError(res, http.StatusUnauthorized, STATUS_INVALID_MFA_CODE, "Code does not match or was already used")
+
+	} else if mfaToken, err := a.Store.WithContext(req.Context()).ConsumeConfirmationToken(unpacked.ID, ConfirmationPurposeMfaLogin); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_TOKEN, err)
+
+	} else if mfaToken == nil || mfaToken.UserID != user.Id {
+		a.sendError(res, http.StatusUnauthorized, STATUS_INVALID_MFA_TOKEN, "Token not found")
+
+	} else {
+		a.resetFailedLogins(req.Context(), user)
+		a.completeLogin(res, req, user)
 	}
+}
 
-	statusCount.WithLabelValues(reason, strconv.Itoa(statusCode)).Inc()
+// status: 200 mfaEnrollment
+// status: 401 STATUS_UNAUTHORIZED
+// status: 403 STATUS_PW_WRONG, STATUS_IMPERSONATED, STATUS_INSUFFICIENT_SCOPE
+// status: 404 STATUS_USER_NOT_FOUND
+// status: 409 STATUS_MFA_ALREADY_ENABLED
+// status: 423 STATUS_ACCOUNT_LOCKED
+// status: 429 STATUS_TOO_MANY_REQUESTS
+// status: 500 STATUS_ERR_FINDING_USR, STATUS_ERR_UPDATING_USR
+func (a *Api) EnrollMfa(res http.ResponseWriter, req *http.Request, vars map[string]string) {
+	userID := vars["userid"]
+	details := getGivenDetail(req)
 
-	a.logger.Printf("%s:%d RESPONSE ERROR: [%d %s] %s", file, line, statusCode, reason, strings.Join(messages, "; "))
-	sendModelAsResWithStatus(res, status.NewStatus(statusCode, reason), statusCode)
+	if enrollmentToken, err := a.authorizeMfaEnrollment(req, userID, details["mfaToken"]); err == errImpersonationForbidden {
+		a.sendError(res, http.StatusForbidden, STATUS_IMPERSONATED)
+
+	} else if err == errInsufficientScope {
+		a.sendError(res, http.StatusForbidden, STATUS_INSUFFICIENT_SCOPE, ScopeAccountWrite)
+
+	} else if err != nil {
+		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED, err)
+
+	} else if user, err := a.Store.WithContext(req.Context()).FindUser(&User{Id: userID}); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if user == nil || user.IsDeleted() {
+		a.sendError(res, http.StatusNotFound, STATUS_USER_NOT_FOUND)
+
+	} else if enrollmentToken == nil && !a.verifyPassword(res, req, user, details["password"]) {
+		// the error response has been sent
+
+	} else if user.IsMfaEnabled() {
+		a.sendError(res, http.StatusConflict, STATUS_MFA_ALREADY_ENABLED)
+
+	} else if secret, err := NewTotpSecret(); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_USR, err)
+
+	} else if err := a.Store.WithContext(req.Context()).UpdateMfa(user.Id, &MfaSettings{Secret: secret}); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_USR, err)
+
+	} else {
+		issuer := firstStringNotEmpty(a.ApiConfig.MfaIssuer, defaultMfaIssuer)
+		sendModelAsRes(res, mfaEnrollment{Secret: secret, URI: TotpURI(issuer, firstStringNotEmpty(user.Email(), user.Id), secret)})
+	}
 }
 
-func (a *Api) authenticateSessionToken(ctx context.Context, sessionToken string) (*TokenData, error) {
-	if sessionToken == "" {
+// status: 200 User, recoveryCodes
+// status: 400 STATUS_MISSING_USR_DETAILS
+// status: 401 STATUS_UNAUTHORIZED, STATUS_INVALID_MFA_CODE, STATUS_INVALID_MFA_TOKEN
+// status: 403 STATUS_PW_WRONG, STATUS_IMPERSONATED, STATUS_INSUFFICIENT_SCOPE
+// status: 404 STATUS_USER_NOT_FOUND
+// status: 409 STATUS_MFA_ALREADY_ENABLED, STATUS_MFA_NOT_PENDING
+// status: 423 STATUS_ACCOUNT_LOCKED
+// status: 429 STATUS_TOO_MANY_REQUESTS
+// status: 500 STATUS_ERR_FINDING_USR, STATUS_ERR_UPDATING_USR
+func (a *Api) ConfirmMfa(res http.ResponseWriter, req *http.Request, vars map[string]string) {
+	userID := vars["userid"]
+	details := getGivenDetail(req)
+
+	if details["code"] == "" {
+		a.sendError(res, http.StatusBadRequest, STATUS_MISSING_USR_DETAILS)
+
+	} else if enrollmentToken, err := a.authorizeMfaEnrollment(req, userID, details["mfaToken"]); err == errImpersonationForbidden {
+		a.sendError(res, http.StatusForbidden, STATUS_IMPERSONATED)
+
+	} else if err == errInsufficientScope {
+		a.sendError(res, http.StatusForbidden, STATUS_INSUFFICIENT_SCOPE, ScopeAccountWrite)
+
+	} else if err != nil {
+		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED, err)
+
+	} else if user, err := a.Store.WithContext(req.Context()).FindUser(&User{Id: userID}); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if user == nil || user.IsDeleted() {
+		a.sendError(res, http.StatusNotFound, STATUS_USER_NOT_FOUND)
+
+	} else if enrollmentToken == nil && !a.verifyPassword(res, req, user, details["password"]) {
+		// the error response has been sent
+
+	} else if user.IsMfaEnabled() {
+		a.sendError(res, http.StatusConflict, STATUS_MFA_ALREADY_ENABLED)
+
+	} else if user.Mfa == nil {
+		a.sendError(res, http.StatusConflict, STATUS_MFA_NOT_PENDING)
+
+	} else if step, ok := ValidateTotpCode(user.Mfa.Secret, details["code"], time.Now()); !ok {
+		a.sendError(res, http.StatusUnauthorized, STATUS_INVALID_MFA_CODE, "Code does not match")
+
+	} else if err := a.consumeMfaEnrollmentToken(req.Context(), enrollmentToken); err != nil {
+		a.sendError(res, http.StatusUnauthorized, STATUS_INVALID_MFA_TOKEN, err)
+
+	} else if recoveryCodes, recoveryCodeHashes, err := NewRecoveryCodes(a.ApiConfig.Salt); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_USR, err)
+
+	} else {
+		mfa := &MfaSettings{
+			Secret:        user.Mfa.Secret,
+			Enabled:       true,
+			EnabledTime:   time.Now().Format(time.RFC3339),
+			LastUsedStep:  step,
+			RecoveryCodes: recoveryCodeHashes,
+		}
+		if err := a.Store.WithContext(req.Context()).UpdateMfa(user.Id, mfa); err != nil {
+			a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_USR, err)
+		} else {
+			a.logMetricForUser(user.Id, "mfaenabled", req.Header.Get(TP_SESSION_TOKEN), nil)
+			user.Mfa = mfa
+			// The recovery codes are only ever shown once
+			serializable := a.asSerializableUser(user, false).(map[string]interface{})
+			serializable["recoveryCodes"] = recoveryCodes
+			sendModelAsRes(res, serializable)
+		}
+	}
+}
+
+// status: 200 mfaRecoveryCodes
+// status: 401 STATUS_UNAUTHORIZED
+// status: 403 STATUS_PW_WRONG, STATUS_IMPERSONATED, STATUS_INSUFFICIENT_SCOPE
+// status: 404 STATUS_USER_NOT_FOUND
+// status: 409 STATUS_MFA_NOT_ENABLED
+// status: 423 STATUS_ACCOUNT_LOCKED
+// status: 429 STATUS_TOO_MANY_REQUESTS
+// status: 500 STATUS_ERR_FINDING_USR, STATUS_ERR_UPDATING_USR
+func (a *Api) RegenerateMfaRecoveryCodes(res http.ResponseWriter, req *http.Request, vars map[string]string) {
+	userID := vars["userid"]
+
+	if tokenData, err := a.authenticateSessionToken(req.Context(), req.Header.Get(TP_SESSION_TOKEN)); err != nil {
+		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED, err)
+
+	} else if tokenData.IsServer || tokenData.UserId != userID {
+		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED, "Token user id must match user id")
+
+	} else if tokenData.IsImpersonated() {
+		a.sendError(res, http.StatusForbidden, STATUS_IMPERSONATED)
+
+	} else if !tokenData.HasScope(ScopeAccountWrite) {
+		a.sendError(res, http.StatusForbidden, STATUS_INSUFFICIENT_SCOPE, ScopeAccountWrite)
+
+	} else if user, err := a.Store.WithContext(req.Context()).FindUser(&User{Id: userID}); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if user == nil || user.IsDeleted() {
+		a.sendError(res, http.StatusNotFound, STATUS_USER_NOT_FOUND)
+
+	} else if !a.verifyPassword(res, req, user, getGivenDetail(req)["password"]) {
+		// the error response has been sent
+
+	} else if !user.IsMfaEnabled() {
+		a.sendError(res, http.StatusConflict, STATUS_MFA_NOT_ENABLED)
+
+	} else if recoveryCodes, recoveryCodeHashes, err := NewRecoveryCodes(a.ApiConfig.Salt); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_USR, err)
+
+	} else if err := a.Store.WithContext(req.Context()).UpdateMfaRecoveryCodes(user.Id, recoveryCodeHashes); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_USR, err)
+
+	} else {
+		a.audit(req, AuditTypeMfaRecoveryCodesRegenerated, user.Id, nil)
+		sendModelAsRes(res, mfaRecoveryCodes{RecoveryCodes: recoveryCodes})
+	}
+}
+
+// status: 200 []AuditRecord
+// status: 401 STATUS_UNAUTHORIZED, STATUS_SERVER_TOKEN_REQUIRED
+// status: 403 STATUS_INSUFFICIENT_SCOPE
+// status: 500 STATUS_ERR_FINDING_USR
+func (a *Api) GetAuditRecords(res http.ResponseWriter, req *http.Request, vars map[string]string) {
+	if tokenData, err := a.authenticateSessionToken(req.Context(), req.Header.Get(TP_SESSION_TOKEN)); err != nil {
+		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED, err)
+
+	} else if !tokenData.IsServer {
+		a.sendError(res, http.StatusUnauthorized, STATUS_SERVER_TOKEN_REQUIRED)
+
+	} else if !tokenData.HasServiceScope(ServiceScopeUsersRead) {
+		a.sendError(res, http.StatusForbidden, STATUS_INSUFFICIENT_SCOPE, ServiceScopeUsersRead)
+
+	} else if records, err := a.Store.WithContext(req.Context()).FindAuditRecords(vars["userid"]); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else {
+		sendModelAsRes(res, records)
+	}
+}
+
+// ImpersonateUser lets support staff act as the user without their password. A server creates the token on
+// behalf of the support agent, who is named in its act claim. The token expires after ImpersonationDurationSecs,
+// or the shorter tokenduration header, cannot be refreshed and cannot change the password, multi-factor
+// authentication or emails of the user. Every impersonation is recorded with its reason before the token is
+// handed out. Only service clients with the impersonate scope may do so, the client is recorded along with the
+// actor it names.
+// status: 200 TP_SESSION_TOKEN, TokenData
+// status: 400 STATUS_MISSING_USR_DETAILS
+// status: 401 STATUS_UNAUTHORIZED, STATUS_SERVER_TOKEN_REQUIRED
+// status: 403 STATUS_CLIENT_TOKEN_REQUIRED, STATUS_INSUFFICIENT_SCOPE
+// status: 404 STATUS_USER_NOT_FOUND
+// status: 500 STATUS_ERR_FINDING_USR, STATUS_ERR_GENERATING_TOKEN
+func (a *Api) ImpersonateUser(res http.ResponseWriter, req *http.Request, vars map[string]string) {
+	details := getGivenDetail(req)
+	actor, reason := strings.TrimSpace(details["actor"]), strings.TrimSpace(details["reason"])
+
+	if tokenData, err := a.authenticateSessionToken(req.Context(), req.Header.Get(TP_SESSION_TOKEN)); err != nil {
+		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED, err)
+
+	} else if !tokenData.IsServer {
+		a.sendError(res, http.StatusUnauthorized, STATUS_SERVER_TOKEN_REQUIRED)
+
+	} else if tokenData.ClientID == "" {
+		// the legacy server login shares one secret between all services, none of which can be held accountable
+		a.sendError(res, http.StatusForbidden, STATUS_CLIENT_TOKEN_REQUIRED)
+
+	} else if !tokenData.HasServiceScope(ServiceScopeImpersonate) {
+		a.sendError(res, http.StatusForbidden, STATUS_INSUFFICIENT_SCOPE, ServiceScopeImpersonate)
+
+	} else if actor == "" || reason == "" {
+		a.sendError(res, http.StatusBadRequest, STATUS_MISSING_USR_DETAILS, "The actor and the reason are required")
+
+	} else if user, err := a.Store.WithContext(req.Context()).FindUser(&User{Id: vars["userid"]}); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if user == nil || user.IsDeleted() {
+		a.sendError(res, http.StatusNotFound, STATUS_USER_NOT_FOUND)
+
+	} else {
+		impersonation := &TokenData{
+			UserId:       user.Id,
+			DurationSecs: impersonationDuration(a.ApiConfig.ImpersonationDurationSecs, extractTokenDuration(req)),
+			Actor:        &TokenActor{Subject: actor},
+			Metadata:     a.sessionMetadata(req),
+		}
+		if sessionToken, err := a.keys().CreateSessionToken(impersonation); err != nil {
+			a.sendError(res, http.StatusInternalServerError, STATUS_ERR_GENERATING_TOKEN, err)
+		} else if err := a.auditImpersonation(req, sessionToken, reason, tokenData); err != nil {
+			a.sendError(res, http.StatusInternalServerError, STATUS_ERR_GENERATING_TOKEN, err)
+		} else if err := a.Store.WithContext(req.Context()).AddToken(sessionToken); err != nil {
+			a.sendError(res, http.StatusInternalServerError, STATUS_ERR_GENERATING_TOKEN, err)
+		} else {
+			a.logMetricForUser(user.Id, "impersonation", sessionToken.ID, map[string]string{"actor": actor, "client": tokenData.ClientID})
+			res.Header().Set(TP_SESSION_TOKEN, sessionToken.ID)
+			sendModelAsRes(res, impersonation)
+		}
+	}
+}
+
+// auditImpersonation records the impersonation token. Unlike audit, failures are returned, as the token must not
+// be handed out unrecorded.
+func (a *Api) auditImpersonation(req *http.Request, sessionToken *SessionToken, reason string, server *TokenData) error {
+	record, err := newImpersonationAuditRecord(sessionToken, reason, server)
+	if err != nil {
+		return err
+	}
+	return a.Store.WithContext(req.Context()).AddAuditRecord(record)
+}
+
+// status: 204
+// status: 401 STATUS_UNAUTHORIZED
+// status: 403 STATUS_PW_WRONG, STATUS_IMPERSONATED, STATUS_INSUFFICIENT_SCOPE
+// status: 404 STATUS_USER_NOT_FOUND
+// status: 423 STATUS_ACCOUNT_LOCKED
+// status: 429 STATUS_TOO_MANY_REQUESTS
+// status: 500 STATUS_ERR_FINDING_USR, STATUS_ERR_UPDATING_USR
+func (a *Api) DisableMfa(res http.ResponseWriter, req *http.Request, vars map[string]string) {
+	userID := vars["userid"]
+
+	if tokenData, err := a.authenticateSessionToken(req.Context(), req.Header.Get(TP_SESSION_TOKEN)); err != nil {
+		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED, err)
+
+	} else if !tokenData.IsServer && tokenData.UserId != userID {
+		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED, "Token user id must match user id or server")
+
+	} else if tokenData.IsImpersonated() {
+		a.sendError(res, http.StatusForbidden, STATUS_IMPERSONATED)
+
+	} else if !tokenData.HasScope(ScopeAccountWrite) {
+		a.sendError(res, http.StatusForbidden, STATUS_INSUFFICIENT_SCOPE, ScopeAccountWrite)
+
+	} else if tokenData.IsServer && !tokenData.HasServiceScope(ServiceScopeUsersWrite) {
+		a.sendError(res, http.StatusForbidden, STATUS_INSUFFICIENT_SCOPE, ServiceScopeUsersWrite)
+
+	} else if user, err := a.Store.WithContext(req.Context()).FindUser(&User{Id: userID}); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if user == nil || user.IsDeleted() {
+		a.sendError(res, http.StatusNotFound, STATUS_USER_NOT_FOUND)
+
+	} else if !tokenData.IsServer && !a.verifyPassword(res, req, user, getGivenDetail(req)["password"]) {
+		// the error response has been sent
+
+	} else if err := a.Store.WithContext(req.Context()).UpdateMfa(user.Id, nil); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_USR, err)
+
+	} else {
+		a.logMetricForUser(user.Id, "mfadisabled", req.Header.Get(TP_SESSION_TOKEN), map[string]string{"server": strconv.FormatBool(tokenData.IsServer)})
+		res.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// verifySecondFactor checks either a TOTP code or a recovery code of the user; both can only be used once
+func (a *Api) verifySecondFactor(req *http.Request, user *User, code string, recoveryCode string) (bool, error) {
+	ctx := req.Context()
+	if recoveryCode != "" {
+		used, err := a.Store.WithContext(ctx).UseMfaRecoveryCode(user.Id, HashRecoveryCode(recoveryCode, a.ApiConfig.Salt))
+		if used {
+			remaining := strconv.Itoa(len(user.Mfa.RecoveryCodes) - 1)
+			a.audit(req, AuditTypeMfaRecoveryCodeUsed, user.Id, map[string]string{"remaining": remaining})
+		}
+		return used, err
+	}
+
+	step, ok := ValidateTotpCode(user.Mfa.Secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+	return a.Store.WithContext(ctx).UseMfaStep(user.Id, step)
+}
+
+// audit records a security relevant action on the account of the user. Failures are logged
+// rather than returned since the action itself has already happened.
+func (a *Api) audit(req *http.Request, auditType string, userID string, details map[string]string) {
+	record, err := NewAuditRecord(auditType, userID, details)
+	if err == nil {
+		record.SessionMetadata = a.sessionMetadata(req)
+		err = a.Store.WithContext(req.Context()).AddAuditRecord(record)
+	}
+	if err != nil {
+		a.logger.Printf("Unable to record %s for user %s: %v", auditType, userID, err)
+		return
+	}
+	a.logMetricForUser(userID, auditType, "", details)
+}
+
+func (a *Api) isMfaEnrollmentRequired(user *User) bool {
+	if user.IsMfaEnabled() {
+		return false
+	}
+	for _, role := range a.ApiConfig.MfaRequiredRoles {
+		if user.HasRole(role) {
+			return true
+		}
+	}
+	return false
+}
+
+// sendMfaChallenge answers a login whose password was correct but that still needs a second factor. The response
+// carries a short-lived token that replaces the password in the next step, any earlier token is invalidated.
+func (a *Api) sendMfaChallenge(ctx context.Context, res http.ResponseWriter, statusCode int, reason string, user *User, purpose string) {
+	durationSecs := a.ApiConfig.MfaTokenDurationSecs
+	if durationSecs == 0 {
+		durationSecs = defaultMfaTokenDurationSecs
+	}
+
+	if err := a.Store.WithContext(ctx).RemoveConfirmationTokensForUser(user.Id, purpose); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_GENERATING_TOKEN, err)
+	} else if mfaToken, err := NewConfirmationToken(purpose, user.Id, user.Email(), durationSecs); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_GENERATING_TOKEN, err)
+	} else if signedMfaToken, err := mfaToken.Sign(a.keys()); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_GENERATING_TOKEN, err)
+	} else if err := a.Store.WithContext(ctx).AddConfirmationToken(mfaToken); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_GENERATING_TOKEN, err)
+	} else {
+		statusCount.WithLabelValues(reason, strconv.Itoa(statusCode)).Inc()
+		sendModelAsResWithStatus(res, mfaChallenge{Code: statusCode, Reason: reason, MfaToken: signedMfaToken, ExpiresAt: mfaToken.ExpiresAt}, statusCode)
+	}
+}
+
+// authorizeMfaEnrollment allows users to enroll their own second factor, either with a session token or with the
+// enrollment token that Login hands out when their role requires multi-factor authentication. The enrollment
+// token is returned so that it can be consumed once the enrollment is confirmed. It is nil for a session token,
+// in which case the caller must verify the password, as a stolen session must not bind another authenticator.
+func (a *Api) authorizeMfaEnrollment(req *http.Request, userID string, mfaToken string) (*ConfirmationToken, error) {
+	if sessionToken := req.Header.Get(TP_SESSION_TOKEN); sessionToken != "" {
+		if tokenData, err := a.authenticateSessionToken(req.Context(), sessionToken); err != nil {
+			return nil, err
+		} else if tokenData.IsServer || tokenData.UserId != userID {
+			return nil, errors.New("Token user id must match user id")
+		} else if tokenData.IsImpersonated() {
+			return nil, errImpersonationForbidden
+		} else if !tokenData.HasScope(ScopeAccountWrite) {
+			return nil, errInsufficientScope
+		}
+		return nil, nil
+	}
+
+	unpacked, err := UnpackConfirmationToken(mfaToken, ConfirmationPurposeMfaEnrollment, a.keys())
+	if err != nil {
+		return nil, err
+	} else if unpacked.UserID != userID {
+		return nil, ConfirmationToken_invalid
+	}
+
+	// Only the most recently issued enrollment token is valid
+	if latest, err := a.Store.WithContext(req.Context()).FindLatestConfirmationToken(userID, ConfirmationPurposeMfaEnrollment); err != nil {
+		return nil, err
+	} else if latest == nil || latest.ID != unpacked.ID {
+		return nil, ConfirmationToken_invalid
+	}
+	return unpacked, nil
+}
+
+func (a *Api) consumeMfaEnrollmentToken(ctx context.Context, enrollmentToken *ConfirmationToken) error {
+	if enrollmentToken == nil {
+		return nil
+	}
+	if consumed, err := a.Store.WithContext(ctx).ConsumeConfirmationToken(enrollmentToken.ID, ConfirmationPurposeMfaEnrollment); err != nil {
+		return err
+	} else if consumed == nil {
+		return ConfirmationToken_invalid
+	}
+	return nil
+}
+
+// ServerLogin is the legacy login of services with the shared ServerSecret, superseded by the client
+// credentials grant of OauthToken
+// status: 200 TP_SESSION_TOKEN
+// status: 400 STATUS_MISSING_ID_PW
+// status: 401 STATUS_PW_WRONG
+// status: 403 STATUS_SERVER_LOGIN_DISABLED
+// status: 500 STATUS_ERR_GENERATING_TOKEN
+func (a *Api) ServerLogin(res http.ResponseWriter, req *http.Request) {
+
+	server, pw := req.Header.Get(TP_SERVER_NAME), req.Header.Get(TP_SERVER_SECRET)
+
+	if a.ApiConfig.DisableLegacyServerLogin {
+		a.sendError(res, http.StatusForbidden, STATUS_SERVER_LOGIN_DISABLED, fmt.Sprintf("server %q", server))
+		return
+	}
+	if server == "" || pw == "" {
+		a.logger.Println(http.StatusBadRequest, STATUS_MISSING_ID_PW)
+		sendModelAsResWithStatus(res, status.NewStatus(http.StatusBadRequest, STATUS_MISSING_ID_PW), http.StatusBadRequest)
+		return
+	}
+	if pw == a.ApiConfig.ServerSecret {
+		//generate new token
+		if sessionToken, err := a.keys().CreateSessionTokenAndSave(
+			&TokenData{DurationSecs: extractTokenDuration(req), UserId: server, IsServer: true},
+			a.Store.WithContext(req.Context()),
+		); err != nil {
+			a.logger.Println(http.StatusInternalServerError, STATUS_ERR_GENERATING_TOKEN, err.Error())
+			sendModelAsResWithStatus(res, status.NewStatus(http.StatusInternalServerError, STATUS_ERR_GENERATING_TOKEN), http.StatusInternalServerError)
+			return
+		} else {
+			a.logMetricAsServer("serverlogin", sessionToken.ID, nil)
+			res.Header().Set(TP_SESSION_TOKEN, sessionToken.ID)
+			return
+		}
+	}
+	a.logger.Println(http.StatusUnauthorized, STATUS_PW_WRONG)
+	sendModelAsResWithStatus(res, status.NewStatus(http.StatusUnauthorized, STATUS_PW_WRONG), http.StatusUnauthorized)
+	return
+}
+
+// RefreshSession replaces a long-lived session token with a new one. The presented token is revoked once the new
+// one is saved, so that a failure leaves the user logged in.
+// status: 200 TP_SESSION_TOKEN, TokenData
+// status: 401 STATUS_NO_TOKEN
+// status: 403 STATUS_IMPERSONATED, STATUS_USE_REFRESH_TOKEN
+// status: 500 STATUS_ERR_UPDATING_TOKEN, STATUS_ERR_GENERATING_TOKEN
+func (a *Api) RefreshSession(res http.ResponseWriter, req *http.Request) {
+
+	presented := req.Header.Get(TP_SESSION_TOKEN)
+	td, err := a.authenticateSessionToken(req.Context(), presented)
+
+	if err != nil {
+		a.logger.Println(http.StatusUnauthorized, err.Error())
+		res.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if td.IsImpersonated() {
+		// impersonation tokens must not outlive their time box
+		a.sendError(res, http.StatusForbidden, STATUS_IMPERSONATED)
+		return
+	}
+	if td.FamilyID != "" {
+		// short-lived access tokens must not outlive their refresh token family and its reuse detection
+		a.sendError(res, http.StatusForbidden, STATUS_USE_REFRESH_TOKEN)
+		return
+	}
+
+	const two_hours_in_secs = 60 * 60 * 2
+
+	if td.IsServer == false && td.DurationSecs > two_hours_in_secs {
+		//long-duration let us know detail and keep it rolling
+		//a.logger.Println("long-duration token set for ", fmt.Sprint(time.Duration(td.DurationSecs)*time.Second))
+	}
+	//refresh
+	td.Metadata = a.sessionMetadata(req)
+	sessionToken, err := a.keys().CreateSessionTokenAndSave(
+		td,
+		a.Store.WithContext(req.Context()),
+	)
+	if err != nil {
+		a.logger.Println(http.StatusInternalServerError, STATUS_ERR_GENERATING_TOKEN, err.Error())
+		sendModelAsResWithStatus(res, status.NewStatus(http.StatusInternalServerError, STATUS_ERR_GENERATING_TOKEN), http.StatusInternalServerError)
+		return
+	}
+	if sessionToken.ID != presented {
+		// a token refreshed within the second it was issued is signed identically and must be kept
+		if err := a.revokeSessionToken(req.Context(), presented); err != nil {
+			a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_TOKEN, err)
+			return
+		}
+	}
+	res.Header().Set(TP_SESSION_TOKEN, sessionToken.ID)
+	sendModelAsRes(res, td)
+}
+
+// Set the longeterm duration and then process as per Login
+// note: see Login for return codes
+func (a *Api) LongtermLogin(res http.ResponseWriter, req *http.Request, vars map[string]string) {
+
+	const day_as_secs = 1 * 24 * 60 * 60
+
+	duration := a.ApiConfig.LongTermDaysDuration * day_as_secs
+	longtermkey := vars["longtermkey"]
+
+	if longtermkey == a.ApiConfig.LongTermKey {
+		a.logger.Println("token duration is ", fmt.Sprint(time.Duration(duration)*time.Second))
+		req.Header.Add(TOKEN_DURATION_KEY, strconv.FormatFloat(float64(duration), 'f', -1, 64))
+	} else {
+		//tell us there was no match
+		a.logger.Println("tried to login using the longtermkey but it didn't match the stored key")
+	}
+
+	a.Login(res, req)
+
+	// TODO: Does not actually add the TOKEN_DURATION_KEY to the response on success (as the old unittests would imply)
+}
+
+// status: 200 TP_SESSION_TOKEN, TokenData
+// status: 401 STATUS_NO_TOKEN
+// status: 403 STATUS_INSUFFICIENT_SCOPE
+// status: 404 STATUS_NO_TOKEN_MATCH
+func (a *Api) ServerCheckToken(res http.ResponseWriter, req *http.Request, vars map[string]string) {
+
+	if serverToken, err := a.keys().UnpackSessionTokenAndVerify(req.Header.Get(TP_SESSION_TOKEN)); err == nil && serverToken.IsServer {
+		if !serverToken.HasServiceScope(ServiceScopeTokensRead) {
+			a.sendError(res, http.StatusForbidden, STATUS_INSUFFICIENT_SCOPE, ServiceScopeTokensRead)
+			return
+		}
+		td, err := a.authenticateSessionToken(req.Context(), vars["token"])
+		if err != nil {
+			a.logger.Printf("failed request: %v", req)
+			a.logger.Println(http.StatusUnauthorized, STATUS_NO_TOKEN, err.Error())
+			sendModelAsResWithStatus(res, status.NewStatus(http.StatusUnauthorized, STATUS_NO_TOKEN), http.StatusUnauthorized)
+			return
+		}
+
+		sendModelAsRes(res, td)
+		return
+	}
+	a.logger.Println(http.StatusUnauthorized, STATUS_NO_TOKEN)
+	a.logger.Printf("header session token: %v", req.Header.Get(TP_SESSION_TOKEN))
+	sendModelAsResWithStatus(res, status.NewStatus(http.StatusUnauthorized, STATUS_NO_TOKEN), http.StatusUnauthorized)
+	return
+}
+
+// status: 200 TP_SESSION_TOKEN, TokenData
+// status: 401 STATUS_NO_TOKEN
+func (a *Api) CheckToken(res http.ResponseWriter, req *http.Request) {
+	token := req.Header.Get(TP_SESSION_TOKEN)
+	td, err := a.authenticateSessionToken(req.Context(), token)
+	if err != nil {
+		a.logger.Printf("failed request: %v", req)
+		a.logger.Println(http.StatusUnauthorized, STATUS_NO_TOKEN, err.Error())
+		sendModelAsResWithStatus(res, status.NewStatus(http.StatusUnauthorized, STATUS_NO_TOKEN), http.StatusUnauthorized)
+		return
+	}
+
+	sendModelAsRes(res, td)
+	return
+}
+
+// Logout ends the session of the token, including the refresh tokens issued along with it
+// status: 200
+// status: 500 STATUS_ERR_UPDATING_TOKEN
+func (a *Api) Logout(res http.ResponseWriter, req *http.Request) {
+	if id := req.Header.Get(TP_SESSION_TOKEN); id != "" {
+		if err := a.revokeSessionToken(req.Context(), id); err != nil {
+			a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_TOKEN, err)
+			return
+		}
+	}
+	//otherwise all good
+	res.WriteHeader(http.StatusOK)
+	return
+}
+
+// RevokeToken revokes a session token or a refresh token, see RFC 7009. Either way the whole session ends,
+// including the refresh tokens issued along with it. Holding the token is enough to revoke it, and unknown or
+// invalid tokens are answered as if they had been revoked.
+// status: 200
+// status: 400 oauthError invalid_request
+// status: 500 oauthError server_error
+func (a *Api) RevokeToken(res http.ResponseWriter, req *http.Request) {
+	if token := req.PostFormValue("token"); token == "" {
+		a.sendOauthError(res, http.StatusBadRequest, oauthErrorInvalidRequest, "The token is required")
+
+	} else if err := a.revokeToken(req.Context(), token); err != nil {
+		a.sendOauthError(res, http.StatusInternalServerError, oauthErrorServerError, "The token could not be revoked", err)
+
+	} else {
+		a.logMetric("revoketoken", "", nil)
+		res.WriteHeader(http.StatusOK)
+	}
+}
+
+// revokeToken revokes a session token or a refresh token. Session tokens are JWTs while refresh tokens are
+// opaque, so the token_type_hint of RFC 7009 is not needed to tell them apart.
+func (a *Api) revokeToken(ctx context.Context, token string) error {
+	if strings.Count(token, ".") == 2 {
+		return a.revokeSessionToken(ctx, token)
+	}
+
+	refreshToken, err := a.Store.WithContext(ctx).FindRefreshToken(HashRefreshToken(token))
+	if err != nil || refreshToken == nil {
+		return err
+	}
+	if err := a.Store.WithContext(ctx).RemoveRefreshTokenFamily(refreshToken.FamilyID); err != nil {
+		return err
+	}
+	a.revokeCachedTokens(ctx, TokensRevokedEvent{UserID: refreshToken.UserID, FamilyID: refreshToken.FamilyID})
+	return nil
+}
+
+// revokeSessionToken deletes the session token along with the refresh tokens issued with it, which must not
+// outlive the session
+func (a *Api) revokeSessionToken(ctx context.Context, id string) error {
+	if err := a.Store.WithContext(ctx).RemoveTokenByID(id); err != nil {
+		return err
+	}
+	revocation := TokensRevokedEvent{SessionIDs: []string{SessionID(id)}}
+	if td, err := a.keys().UnpackSessionTokenAndVerify(id); err == nil {
+		revocation.UserID = td.UserId
+		if td.FamilyID != "" {
+			if err := a.Store.WithContext(ctx).RemoveRefreshTokenFamily(td.FamilyID); err != nil {
+				return err
+			}
+			revocation.FamilyID = td.FamilyID
+		}
+	}
+	a.revokeCachedTokens(ctx, revocation)
+	return nil
+}
+
+// GetSessions lists the active sessions of the user. The user and servers may do so.
+// status: 200 []Session
+// status: 401 STATUS_UNAUTHORIZED
+// status: 403 STATUS_INSUFFICIENT_SCOPE
+// status: 500 STATUS_ERR_FINDING_USR
+func (a *Api) GetSessions(res http.ResponseWriter, req *http.Request, vars map[string]string) {
+	userID := vars["userid"]
+	sessionToken := req.Header.Get(TP_SESSION_TOKEN)
+
+	if tokenData, err := a.authenticateSessionToken(req.Context(), sessionToken); err != nil {
+		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED, err)
+
+	} else if !tokenData.IsServer && tokenData.UserId != userID {
+		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED, "Token user id must match user id or server")
+
+	} else if tokenData.IsServer && !tokenData.HasServiceScope(ServiceScopeUsersRead) {
+		a.sendError(res, http.StatusForbidden, STATUS_INSUFFICIENT_SCOPE, ServiceScopeUsersRead)
+
+	} else if tokens, err := a.Store.WithContext(req.Context()).FindTokensForUser(userID); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else {
+		sessions := make([]Session, 0, len(tokens))
+		for _, token := range tokens {
+			sessions = append(sessions, NewSession(token, sessionToken))
+		}
+		sendModelAsRes(res, sessions)
+	}
+}
+
+// RevokeSession ends one session of the user, along with the refresh tokens issued with it. The user and
+// servers may do so.
+// status: 204
+// status: 401 STATUS_UNAUTHORIZED
+// status: 403 STATUS_INSUFFICIENT_SCOPE
+// status: 404 STATUS_SESSION_NOT_FOUND
+// status: 500 STATUS_ERR_FINDING_USR, STATUS_ERR_UPDATING_TOKEN
+func (a *Api) RevokeSession(res http.ResponseWriter, req *http.Request, vars map[string]string) {
+	userID := vars["userid"]
+	sessionToken := req.Header.Get(TP_SESSION_TOKEN)
+
+	if tokenData, err := a.authenticateSessionToken(req.Context(), sessionToken); err != nil {
+		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED, err)
+
+	} else if !tokenData.IsServer && tokenData.UserId != userID {
+		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED, "Token user id must match user id or server")
+
+	} else if !tokenData.HasScope(ScopeAccountWrite) {
+		a.sendError(res, http.StatusForbidden, STATUS_INSUFFICIENT_SCOPE, ScopeAccountWrite)
+
+	} else if tokenData.IsServer && !tokenData.HasServiceScope(ServiceScopeUsersWrite) {
+		a.sendError(res, http.StatusForbidden, STATUS_INSUFFICIENT_SCOPE, ServiceScopeUsersWrite)
+
+	} else if tokens, err := a.Store.WithContext(req.Context()).FindTokensForUser(userID); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if token := findSession(tokens, vars["sessionid"]); token == nil {
+		a.sendError(res, http.StatusNotFound, STATUS_SESSION_NOT_FOUND)
+
+	} else if err := a.revokeSessionToken(req.Context(), token.ID); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_TOKEN, err)
+
+	} else {
+		a.logMetricForUser(userID, "revokesession", sessionToken, map[string]string{"revokedBy": tokenData.UserId})
+		res.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// LogoutAll revokes every session and refresh token of the user, e.g. once the account may be compromised.
+// The user, their custodians and servers may do so.
+// status: 200
+// status: 401 STATUS_UNAUTHORIZED
+// status: 403 STATUS_INSUFFICIENT_SCOPE
+// status: 404 STATUS_USER_NOT_FOUND
+// status: 500 STATUS_ERR_FINDING_USR, STATUS_ERR_UPDATING_TOKEN
+func (a *Api) LogoutAll(res http.ResponseWriter, req *http.Request, vars map[string]string) {
+	ctx := req.Context()
+	userID := vars["userid"]
+	sessionToken := req.Header.Get(TP_SESSION_TOKEN)
+	ownerOrCustodian := clients.Permissions{"root": clients.Allowed, "custodian": clients.Allowed}
+
+	if tokenData, err := a.authenticateSessionToken(ctx, sessionToken); err != nil {
+		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED, err)
+
+	} else if !tokenData.HasScope(ScopeAccountWrite) {
+		a.sendError(res, http.StatusForbidden, STATUS_INSUFFICIENT_SCOPE, ScopeAccountWrite)
+
+	} else if tokenData.IsServer && !tokenData.HasServiceScope(ServiceScopeUsersWrite) {
+		a.sendError(res, http.StatusForbidden, STATUS_INSUFFICIENT_SCOPE, ServiceScopeUsersWrite)
+
+	} else if permissions, err := a.tokenUserHasRequestedPermissions(tokenData, userID, ownerOrCustodian); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if permissions["root"] == nil && permissions["custodian"] == nil {
+		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED, "User does not have permissions")
+
+	} else if user, err := a.Store.WithContext(ctx).FindUser(&User{Id: userID}); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if user == nil || user.IsDeleted() {
+		a.sendError(res, http.StatusNotFound, STATUS_USER_NOT_FOUND)
+
+	} else if err := a.Store.WithContext(ctx).RemoveTokensForUser(user.Id); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_TOKEN, err)
+
+	} else {
+		a.revokeCachedTokens(ctx, TokensRevokedEvent{UserID: user.Id})
+		// the sessions are gone at this point, so a failed notification must not be reported as a failure
+		if err := a.userEventsNotifier.NotifySessionsRevoked(ctx, *user, tokenData.UserId, time.Now()); err != nil {
+			a.logger.Println(http.StatusInternalServerError, err.Error())
+			failedUserEventCount.Inc()
+		}
+		a.logMetricForUser(user.Id, "logoutall", sessionToken, map[string]string{"revokedBy": tokenData.UserId})
+		res.WriteHeader(http.StatusOK)
+	}
+}
+
+// GetOidcConfiguration serves the OpenID Connect discovery document
+// status: 200 oidcDiscovery
+// status: 404 STATUS_OIDC_DISABLED
+func (a *Api) GetOidcConfiguration(res http.ResponseWriter, req *http.Request) {
+	if config := a.ApiConfig.Oidc.withDefaults(); !config.IsEnabled() {
+		a.sendError(res, http.StatusNotFound, STATUS_OIDC_DISABLED)
+	} else {
+		sendModelAsRes(res, newOidcDiscovery(config, a.keys().Algorithm(), len(a.ApiConfig.ServiceClients) > 0))
+	}
+}
+
+// OidcAuthorize is the authorization endpoint of the authorization code flow. Users log in with the login form
+// served here, first-party clients that already have a session may forward its token instead. Either way the
+// response is a redirect to the client carrying the authorization code.
+// status: 200 login form
+// status: 302 redirect_uri with code and state, or with error and state
+// status: 400 STATUS_INVALID_OIDC_CLIENT, login form
+// status: 401 STATUS_NO_TOKEN, STATUS_UNAUTHORIZED, login form
+// status: 403 STATUS_IMPERSONATED, login form
+// status: 404 STATUS_OIDC_DISABLED
+// status: 423 login form
+// status: 429 login form
+// status: 500 STATUS_ERR_FINDING_USR, STATUS_ERR_UPDATING_TOKEN
+func (a *Api) OidcAuthorize(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	config := a.ApiConfig.Oidc.withDefaults()
+	clientID, redirectURI, state := req.FormValue("client_id"), req.FormValue("redirect_uri"), req.FormValue("state")
+	sessionToken := req.Header.Get(TP_SESSION_TOKEN)
+
+	if !config.IsEnabled() {
+		a.sendError(res, http.StatusNotFound, STATUS_OIDC_DISABLED)
+
+	} else if client := config.Client(clientID); client == nil || !client.HasRedirectURI(redirectURI) {
+		// never redirect to an unregistered URI
+		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_OIDC_CLIENT, fmt.Sprintf("client %q, redirect URI %q", clientID, redirectURI))
+
+	} else if req.FormValue("response_type") != "code" {
+		a.redirectOauthError(res, req, redirectURI, state, oauthErrorUnsupportedResponseType, "Only the code response type is supported")
+
+	} else if scope := grantedOidcScope(req.FormValue("scope")); scope == "" {
+		a.redirectOauthError(res, req, redirectURI, state, oauthErrorInvalidScope, "The openid scope is required")
+
+	} else if codeChallenge := req.FormValue("code_challenge"); codeChallenge == "" || req.FormValue("code_challenge_method") != pkceMethodS256 {
+		a.redirectOauthError(res, req, redirectURI, state, oauthErrorInvalidRequest, "PKCE with the S256 method is required")
+
+	} else if sessionToken == "" && req.Method != http.MethodPost {
+		a.sendOidcLoginForm(res, req, client, http.StatusOK, "")
+
+	} else if user, sessionScopes := a.authenticateOidcAuthorization(res, req, client, sessionToken); user == nil {
+		// the error response has been sent
+
+	} else if scopes, ok := grantSessionScopes(sessionScopes, strings.Join(oidcAccessTokenScopes, " ")); !ok {
+		a.redirectOauthError(res, req, redirectURI, state, oauthErrorAccessDenied, "The session does not allow reading the account")
+
+	} else if code, value, err := NewAuthorizationCode(clientID, user.Id, redirectURI, scope, scopes, req.FormValue("nonce"), codeChallenge, config.AuthorizationCodeDurationSecs); err != nil {
+		a.redirectOauthError(res, req, redirectURI, state, oauthErrorServerError, "Unable to create the authorization code", err)
+
+	} else if err := a.Store.WithContext(ctx).AddAuthorizationCode(code); err != nil {
+		a.redirectOauthError(res, req, redirectURI, state, oauthErrorServerError, "Unable to create the authorization code", err)
+
+	} else {
+		a.logMetricForUser(user.Id, "oidcauthorize", sessionToken, map[string]string{"client": clientID})
+		http.Redirect(res, req, oidcRedirectURI(redirectURI, map[string]string{"code": value, "state": state}), http.StatusFound)
+	}
+}
+
+// authenticateOidcAuthorization returns the user that authorizes the client, either the user of the forwarded
+// session token or the one logging in with the login form, along with the scopes of the forwarded session, which
+// the access token cannot exceed, or nil for the login form. The error response has been sent if there is no user.
+func (a *Api) authenticateOidcAuthorization(res http.ResponseWriter, req *http.Request, client *OidcClient, sessionToken string) (*User, []string) {
+	if sessionToken == "" {
+		return a.authenticateOidcLogin(res, req, client), nil
+	}
+
+	if tokenData, err := a.authenticateSessionToken(req.Context(), sessionToken); err != nil {
+		a.sendError(res, http.StatusUnauthorized, STATUS_NO_TOKEN, err)
+
+	} else if tokenData.IsServer {
+		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED, "Server tokens cannot authorize clients")
+
+	} else if tokenData.IsImpersonated() {
+		a.sendError(res, http.StatusForbidden, STATUS_IMPERSONATED)
+
+	} else if user, err := a.Store.WithContext(req.Context()).FindUser(&User{Id: tokenData.UserId}); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if user == nil || user.IsDeleted() {
+		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED, "User not found or deleted")
+
+	} else {
+		return user, tokenData.Scopes
+	}
+	return nil, nil
+}
+
+// authenticateOidcLogin checks the credentials posted with the login form, applying the lockout and the second
+// factor of Login. Failures are answered with the login form and a message for the user.
+func (a *Api) authenticateOidcLogin(res http.ResponseWriter, req *http.Request, client *OidcClient) *User {
+	ctx := req.Context()
+	username, password, code := req.PostFormValue("username"), req.PostFormValue("password"), req.PostFormValue("code")
+
+	if username == "" || password == "" {
+		a.sendOidcLoginForm(res, req, client, http.StatusBadRequest, oidcLoginMissingCredentials)
+
+	} else if results, err := a.Store.WithContext(ctx).FindUsers(&User{Id: username, Username: username, Emails: []string{username}}); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if len(results) != 1 {
+		a.sendOidcLoginForm(res, req, client, http.StatusUnauthorized, oidcLoginWrongCredentials)
+
+	} else if user := results[0]; user == nil || user.IsDeleted() {
+		a.sendOidcLoginForm(res, req, client, http.StatusUnauthorized, oidcLoginWrongCredentials)
+
+	} else if user.IsLocked() {
+		setRetryAfter(res, user.LockedUntil)
+		a.sendOidcLoginForm(res, req, client, http.StatusLocked, STATUS_ACCOUNT_LOCKED)
+
+	} else if nextLogin := a.ApiConfig.LoginLockout.NextLoginAllowedAt(user); time.Now().Before(nextLogin) {
+		setRetryAfter(res, nextLogin)
+		a.sendOidcLoginForm(res, req, client, http.StatusTooManyRequests, STATUS_TOO_MANY_REQUESTS)
+
+	} else if !user.PasswordsMatch(password, a.ApiConfig.Salt) {
+		a.recordFailedLogin(ctx, user)
+		a.sendOidcLoginForm(res, req, client, http.StatusUnauthorized, oidcLoginWrongCredentials)
+
+	} else if !user.EmailVerified {
+		a.sendOidcLoginForm(res, req, client, http.StatusForbidden, STATUS_NOT_VERIFIED)
+
+	} else if a.isMfaEnrollmentRequired(user) {
+		a.sendOidcLoginForm(res, req, client, http.StatusForbidden, STATUS_MFA_ENROLL_REQUIRED)
+
+	} else if !user.IsMfaEnabled() {
+		a.upgradePasswordHash(ctx, user, password)
+		a.resetFailedLogins(ctx, user)
+		return user
+
+	} else if code == "" {
+		a.sendOidcLoginForm(res, req, client, http.StatusUnauthorized, oidcLoginCodeRequired)
+
+	} else if verified, err := a.verifySecondFactor(req, user, code, ""); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_TOKEN, err)
+
+	} else if !verified {
+		a.recordFailedLogin(ctx, user)
+		a.sendOidcLoginForm(res, req, client, http.StatusUnauthorized, STATUS_INVALID_MFA_CODE)
+
+	} else {
+		a.upgradePasswordHash(ctx, user, password)
+		a.resetFailedLogins(ctx, user)
+		return user
+	}
+	return nil
+}
+
+// OauthToken is the token endpoint of the authorization code grant of OpenID Connect clients and of the client
+// credentials grant of service clients
+// status: 200 oauthTokenResponse
+// status: 400 oauthError invalid_request, invalid_grant, invalid_scope, unsupported_grant_type
+// status: 401 oauthError invalid_client
+// status: 404 STATUS_OIDC_DISABLED
+// status: 500 oauthError server_error
+func (a *Api) OauthToken(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Cache-Control", "no-store")
+	res.Header().Set("Pragma", "no-cache")
+
+	switch grantType := req.PostFormValue("grant_type"); grantType {
+	case "authorization_code":
+		a.exchangeAuthorizationCode(res, req)
+	case "client_credentials":
+		a.issueClientCredentialsToken(res, req)
+	default:
+		a.sendOauthError(res, http.StatusBadRequest, oauthErrorUnsupportedGrantType, fmt.Sprintf("Grant type %q is not supported", grantType))
+	}
+}
+
+// exchangeAuthorizationCode exchanges an authorization code for a session token, used as the access token, and an ID token
+func (a *Api) exchangeAuthorizationCode(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	config := a.ApiConfig.Oidc.withDefaults()
+
+	if !config.IsEnabled() {
+		a.sendError(res, http.StatusNotFound, STATUS_OIDC_DISABLED)
+
+	} else if client := config.Client(req.PostFormValue("client_id")); client == nil {
+		a.sendOauthError(res, http.StatusUnauthorized, oauthErrorInvalidClient, "Unknown client")
+
+	} else if value := req.PostFormValue("code"); value == "" {
+		a.sendOauthError(res, http.StatusBadRequest, oauthErrorInvalidRequest, "The code is required")
+
+	} else if code, err := a.Store.WithContext(ctx).ConsumeAuthorizationCode(HashAuthorizationCode(value)); err != nil {
+		a.sendOauthError(res, http.StatusInternalServerError, oauthErrorServerError, "", err)
+
+	} else if code == nil {
+		a.sendOauthError(res, http.StatusBadRequest, oauthErrorInvalidGrant, "The authorization code is invalid or has expired")
+
+	} else if code.ClientID != client.ID || code.RedirectURI != req.PostFormValue("redirect_uri") {
+		a.sendOauthError(res, http.StatusBadRequest, oauthErrorInvalidGrant, "The authorization code was issued to another client or redirect URI")
+
+	} else if !code.VerifyCodeVerifier(req.PostFormValue("code_verifier")) {
+		a.sendOauthError(res, http.StatusBadRequest, oauthErrorInvalidGrant, "The code verifier does not match the code challenge")
+
+	} else if user, err := a.Store.WithContext(ctx).FindUser(&User{Id: code.UserID}); err != nil {
+		a.sendOauthError(res, http.StatusInternalServerError, oauthErrorServerError, "", err)
+
+	} else if user == nil || user.IsDeleted() {
+		a.sendOauthError(res, http.StatusBadRequest, oauthErrorInvalidGrant, "The user no longer exists")
+
+	} else if sessionToken, err := a.keys().CreateSessionTokenAndSave(&TokenData{UserId: user.Id, ClientID: client.ID, Scopes: code.Scopes, Metadata: a.sessionMetadata(req)}, a.Store.WithContext(ctx)); err != nil {
+		a.sendOauthError(res, http.StatusInternalServerError, oauthErrorServerError, "", err)
+
+	} else if idToken, err := NewIDToken(code, a.userInfoClaims(user), config.Issuer, config.IDTokenDurationSecs, a.keys()); err != nil {
+		a.sendOauthError(res, http.StatusInternalServerError, oauthErrorServerError, "", err)
+
+	} else {
+		a.logMetricForUser(user.Id, "oidctoken", sessionToken.ID, map[string]string{"client": client.ID})
+		sendModelAsRes(res, &oauthTokenResponse{
+			AccessToken: sessionToken.ID,
+			TokenType:   "Bearer",
+			ExpiresIn:   sessionToken.Duration,
+			IDToken:     idToken,
+			Scope:       code.Scope,
+		})
+	}
+}
+
+// issueClientCredentialsToken issues a server token to a service client that authenticates with its secret,
+// either with HTTP Basic authentication or in the form, see RFC 6749 section 2.3.1
+func (a *Api) issueClientCredentialsToken(res http.ResponseWriter, req *http.Request) {
+	clientID, secret, basic := req.BasicAuth()
+	if basic {
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID, secret = req.PostFormValue("client_id"), req.PostFormValue("client_secret")
+	}
+
+	if client := findServiceClient(a.ApiConfig.ServiceClients, clientID); client == nil || !a.clientSecrets.verify(client, secret) {
+		if basic {
+			res.Header().Set("WWW-Authenticate", `Basic realm="shoreline"`)
+		}
+		a.sendOauthError(res, http.StatusUnauthorized, oauthErrorInvalidClient, "Unknown client or wrong secret", fmt.Sprintf("client %q", clientID))
+
+	} else if scopes, ok := client.GrantedScopes(req.PostFormValue("scope")); !ok {
+		a.sendOauthError(res, http.StatusBadRequest, oauthErrorInvalidScope, "A requested scope is not allowed for the client")
+
+	} else if sessionToken, err := a.keys().CreateSessionTokenAndSave(
+		&TokenData{UserId: client.ID, IsServer: true, ClientID: client.ID, Scopes: scopes},
+		a.Store.WithContext(req.Context()),
+	); err != nil {
+		a.sendOauthError(res, http.StatusInternalServerError, oauthErrorServerError, "", err)
+
+	} else {
+		a.logMetricAsServer("clientcredentials", sessionToken.ID, map[string]string{"client": client.ID})
+		sendModelAsRes(res, &oauthTokenResponse{
+			AccessToken: sessionToken.ID,
+			TokenType:   "Bearer",
+			ExpiresIn:   sessionToken.Duration,
+			Scope:       strings.Join(scopes, " "),
+		})
+	}
+}
+
+// IntrospectToken tells whether a session token is active and returns its claims, see RFC 7662. Callers
+// authenticate as a service client with HTTP Basic authentication, or with a server token.
+// status: 200 tokenIntrospection
+// status: 400 oauthError invalid_request
+// status: 401 oauthError invalid_client
+func (a *Api) IntrospectToken(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Cache-Control", "no-store")
+
+	if !a.isServerRequest(req, ServiceScopeTokensRead) {
+		res.Header().Set("WWW-Authenticate", `Basic realm="shoreline"`)
+		a.sendOauthError(res, http.StatusUnauthorized, oauthErrorInvalidClient, "A service client or server token with the "+ServiceScopeTokensRead+" scope is required")
+
+	} else if token := req.PostFormValue("token"); token == "" {
+		a.sendOauthError(res, http.StatusBadRequest, oauthErrorInvalidRequest, "The token is required")
+
+	} else if tokenData, err := a.authenticateSessionToken(req.Context(), token); err != nil {
+		sendModelAsRes(res, &tokenIntrospection{Active: false})
+
+	} else {
+		sendModelAsRes(res, &tokenIntrospection{
+			Active:    true,
+			Sub:       tokenData.UserId,
+			ClientID:  tokenData.ClientID,
+			Scope:     strings.Join(tokenData.Scopes, " "),
+			TokenType: "Bearer",
+			Exp:       tokenData.ExpiresAt,
+			Iat:       tokenData.IssuedAt,
+			Iss:       tokenData.Issuer,
+			Aud:       tokenData.Audience,
+			IsServer:  &tokenData.IsServer,
+			Act:       tokenData.Actor,
+		})
+	}
+}
+
+// isServerRequest reports whether the request is authenticated by a service client or with a server token that
+// is allowed the service scope
+func (a *Api) isServerRequest(req *http.Request, scope string) bool {
+	if clientID, secret, ok := req.BasicAuth(); ok {
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+		client := findServiceClient(a.ApiConfig.ServiceClients, clientID)
+		return client != nil && a.clientSecrets.verify(client, secret) && client.allowsScope(scope)
+	}
+
+	sessionToken := req.Header.Get(TP_SESSION_TOKEN)
+	if authorization := req.Header.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+		sessionToken = strings.TrimPrefix(authorization, "Bearer ")
+	}
+	tokenData, err := a.authenticateSessionToken(req.Context(), sessionToken)
+	return err == nil && tokenData.HasServiceScope(scope)
+}
+
+// OidcUserInfo returns the claims of the user the access token, or the session token, belongs to
+// status: 200 claims
+// status: 401 STATUS_NO_TOKEN, STATUS_UNAUTHORIZED
+// status: 404 STATUS_OIDC_DISABLED
+// status: 500 STATUS_ERR_FINDING_USR
+func (a *Api) OidcUserInfo(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	sessionToken := req.Header.Get(TP_SESSION_TOKEN)
+	if authorization := req.Header.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+		sessionToken = strings.TrimPrefix(authorization, "Bearer ")
+	}
+
+	if !a.ApiConfig.Oidc.IsEnabled() {
+		a.sendError(res, http.StatusNotFound, STATUS_OIDC_DISABLED)
+
+	} else if tokenData, err := a.authenticateSessionToken(ctx, sessionToken); err != nil {
+		res.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		a.sendError(res, http.StatusUnauthorized, STATUS_NO_TOKEN, err)
+
+	} else if tokenData.IsServer {
+		res.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED, "Server tokens do not belong to a user")
+
+	} else if user, err := a.Store.WithContext(ctx).FindUser(&User{Id: tokenData.UserId}); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if user == nil || user.IsDeleted() {
+		res.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED, "User not found or deleted")
+
+	} else {
+		sendModelAsRes(res, a.userInfoClaims(user))
+	}
+}
+
+// RequestPasswordReset sends a single-use password reset token to the user with the given email.
+// The response does not disclose whether a matching user exists.
+// status: 202
+// status: 400 STATUS_INVALID_USER_DETAILS
+// status: 500 STATUS_ERR_FINDING_USR, STATUS_ERR_GENERATING_TOKEN, STATUS_ERR_SENDING_EMAIL
+func (a *Api) RequestPasswordReset(res http.ResponseWriter, req *http.Request) {
+	email := getGivenDetail(req)["email"]
+	if !IsValidEmail(email) {
+		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_USER_DETAILS, User_error_emails_invalid)
+		return
+	}
+
+	results, err := a.Store.WithContext(req.Context()).FindUsers(&User{Username: email, Emails: []string{email}})
+	if err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+		return
+	} else if len(results) != 1 || results[0] == nil || results[0].IsDeleted() || results[0].PwHash == "" {
+		a.logger.Printf("Password reset requested for %d users matching the given email", len(results))
+		res.WriteHeader(http.StatusAccepted)
+		return
+	}
+	user := results[0]
+
+	durationSecs := a.ApiConfig.PasswordResetDurationSecs
+	if durationSecs == 0 {
+		durationSecs = defaultPasswordResetDurationSecs
+	}
+
+	// Only the most recently requested reset token stays valid
+	if err := a.Store.WithContext(req.Context()).RemoveConfirmationTokensForUser(user.Id, ConfirmationPurposePasswordReset); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_GENERATING_TOKEN, err)
+	} else if resetToken, err := NewConfirmationToken(ConfirmationPurposePasswordReset, user.Id, email, durationSecs); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_GENERATING_TOKEN, err)
+	} else if signedResetToken, err := resetToken.Sign(a.keys()); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_GENERATING_TOKEN, err)
+	} else if err := a.Store.WithContext(req.Context()).AddConfirmationToken(resetToken); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_GENERATING_TOKEN, err)
+	} else if err := a.userEventsNotifier.NotifyPasswordResetRequested(req.Context(), *user, signedResetToken, resetToken.ExpiresAt); err != nil {
+		failedUserEventCount.Inc()
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_SENDING_EMAIL, err)
+	} else {
+		res.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// ConfirmPasswordReset sets a new password using a token sent by RequestPasswordReset.
+// All existing sessions of the user are revoked and the failed logins are cleared.
+// status: 200
+// status: 400 STATUS_INVALID_USER_DETAILS passwordRejected
+// status: 400 STATUS_PASSWORD_REUSED
+// status: 401 STATUS_INVALID_RESET_TOKEN
+// status: 500 STATUS_ERR_FINDING_USR, STATUS_ERR_CHECKING_PW, STATUS_ERROR_UPDATING_PW
+func (a *Api) ConfirmPasswordReset(res http.ResponseWriter, req *http.Request) {
+	details := getGivenDetail(req)
+	password := details["password"]
+
+	if unpacked, err := UnpackConfirmationToken(details["token"], ConfirmationPurposePasswordReset, a.keys()); err != nil {
+		a.sendError(res, http.StatusUnauthorized, STATUS_INVALID_RESET_TOKEN, err)
+
+	} else if user, err := a.Store.WithContext(req.Context()).FindUser(&User{Id: unpacked.UserID}); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if user == nil || user.IsDeleted() {
+		a.sendError(res, http.StatusUnauthorized, STATUS_INVALID_RESET_TOKEN, "User not found")
+
+	} else if err := checkPasswordPolicy(a.getPasswordPolicy(), password, append([]string{user.Username}, user.Emails...)...); err != nil {
+		// checked before the token is consumed so that the user can retry with another password
+		a.sendInvalidUserDetails(res, err)
+
+	} else if reused, err := a.isPasswordReused(req.Context(), user, password); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if reused {
+		a.sendError(res, http.StatusBadRequest, STATUS_PASSWORD_REUSED)
+
+	} else if resetToken, err := a.Store.WithContext(req.Context()).ConsumeConfirmationToken(unpacked.ID, ConfirmationPurposePasswordReset); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if resetToken == nil || resetToken.UserID != user.Id {
+		a.sendError(res, http.StatusUnauthorized, STATUS_INVALID_RESET_TOKEN, "Reset token not found")
+
+	} else {
+		updatedUser := user.DeepClone()
+		if err := updatedUser.HashPasswordWithConfig(password, a.ApiConfig.Salt, a.ApiConfig.PasswordHash); err != nil {
+			a.sendError(res, http.StatusInternalServerError, STATUS_ERROR_UPDATING_PW, err)
+		} else if err := a.addPasswordHistory(req.Context(), user); err != nil {
+			a.sendError(res, http.StatusInternalServerError, STATUS_ERROR_UPDATING_PW, err)
+		} else if err := a.Store.WithContext(req.Context()).UpsertUser(updatedUser); err != nil {
+			a.sendError(res, http.StatusInternalServerError, STATUS_ERROR_UPDATING_PW, err)
+		} else if err := a.Store.WithContext(req.Context()).RemoveTokensForUser(updatedUser.Id); err != nil {
+			a.sendError(res, http.StatusInternalServerError, STATUS_ERROR_UPDATING_PW, err)
+		} else {
+			// proving control of the email unlocks the account
+			a.resetFailedLogins(req.Context(), user)
+			a.revokeCachedTokens(req.Context(), TokensRevokedEvent{UserID: updatedUser.Id})
+			a.logMetricForUser(updatedUser.Id, "passwordreset", unpacked.ID, nil)
+			res.WriteHeader(http.StatusOK)
+		}
+	}
+}
+
+// ChangePassword sets a new password for users that know their current password. All other sessions of the
+// user are revoked, while the session used for the request stays valid.
+// status: 200
+// status: 400 STATUS_INVALID_USER_DETAILS
+// status: 400 STATUS_INVALID_USER_DETAILS passwordRejected
+// status: 400 STATUS_PASSWORD_REUSED
+// status: 401 STATUS_UNAUTHORIZED
+// status: 403 STATUS_PW_WRONG, STATUS_IMPERSONATED, STATUS_INSUFFICIENT_SCOPE
+// status: 404 STATUS_USER_NOT_FOUND
+// status: 423 STATUS_ACCOUNT_LOCKED
+// status: 429 STATUS_TOO_MANY_REQUESTS
+// status: 500 STATUS_ERR_FINDING_USR, STATUS_ERR_CHECKING_PW, STATUS_ERROR_UPDATING_PW
+func (a *Api) ChangePassword(res http.ResponseWriter, req *http.Request, vars map[string]string) {
+	userID := vars["userid"]
+	sessionToken := req.Header.Get(TP_SESSION_TOKEN)
+	details := getGivenDetail(req)
+	newPassword := details["newPassword"]
+
+	if tokenData, err := a.authenticateSessionToken(req.Context(), sessionToken); err != nil {
+		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED, err)
+
+	} else if tokenData.IsServer || tokenData.UserId != userID {
+		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED, "Token user id must match user id")
+
+	} else if tokenData.IsImpersonated() {
+		a.sendError(res, http.StatusForbidden, STATUS_IMPERSONATED)
+
+	} else if !tokenData.HasScope(ScopeAccountWrite) {
+		a.sendError(res, http.StatusForbidden, STATUS_INSUFFICIENT_SCOPE, ScopeAccountWrite)
+
+	} else if newPassword == "" {
+		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_USER_DETAILS, User_error_password_missing)
+
+	} else if user, err := a.Store.WithContext(req.Context()).FindUser(&User{Id: userID}); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if user == nil || user.IsDeleted() {
+		a.sendError(res, http.StatusNotFound, STATUS_USER_NOT_FOUND)
+
+	} else if !a.verifyPassword(res, req, user, details["password"]) {
+		// the error response has been sent
+
+	} else if err := checkPasswordPolicy(a.getPasswordPolicy(), newPassword, append([]string{user.Username}, user.Emails...)...); err != nil {
+		a.sendInvalidUserDetails(res, err)
+
+	} else if reused, err := a.isPasswordReused(req.Context(), user, newPassword); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if reused {
+		a.sendError(res, http.StatusBadRequest, STATUS_PASSWORD_REUSED)
+
+	} else {
+		updatedUser := user.DeepClone()
+		if err := updatedUser.HashPasswordWithConfig(newPassword, a.ApiConfig.Salt, a.ApiConfig.PasswordHash); err != nil {
+			a.sendError(res, http.StatusInternalServerError, STATUS_ERROR_UPDATING_PW, err)
+		} else if err := a.addPasswordHistory(req.Context(), user); err != nil {
+			a.sendError(res, http.StatusInternalServerError, STATUS_ERROR_UPDATING_PW, err)
+		} else if err := a.Store.WithContext(req.Context()).UpsertUser(updatedUser); err != nil {
+			a.sendError(res, http.StatusInternalServerError, STATUS_ERROR_UPDATING_PW, err)
+		} else if err := a.Store.WithContext(req.Context()).RemoveTokensForUserExcept(updatedUser.Id, sessionToken); err != nil {
+			a.sendError(res, http.StatusInternalServerError, STATUS_ERROR_UPDATING_PW, err)
+		} else {
+			// the kept session is looked up again by this replica
+			a.revokeCachedTokens(req.Context(), TokensRevokedEvent{UserID: updatedUser.Id})
+			// the password has changed at this point, so a failed notification must not be reported as a failure
+			if err := a.userEventsNotifier.NotifyPasswordChanged(req.Context(), *updatedUser, time.Now()); err != nil {
+				a.logger.Println(http.StatusInternalServerError, err.Error())
+				failedUserEventCount.Inc()
+			}
+			a.logMetricForUser(updatedUser.Id, "passwordchanged", sessionToken, nil)
+			res.WriteHeader(http.StatusOK)
+		}
+	}
+}
+
+// ResendEmailVerification sends a new email verification token to the unverified user with the given email.
+// The response does not disclose whether a matching user exists, is already verified or was sent an email
+// within the resend interval.
+// status: 202
+// status: 400 STATUS_INVALID_USER_DETAILS
+// status: 500 STATUS_ERR_FINDING_USR, STATUS_ERR_SENDING_EMAIL
+func (a *Api) ResendEmailVerification(res http.ResponseWriter, req *http.Request) {
+	email := getGivenDetail(req)["email"]
+	if !IsValidEmail(email) {
+		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_USER_DETAILS, User_error_emails_invalid)
+		return
+	}
+
+	results, err := a.Store.WithContext(req.Context()).FindUsers(&User{Username: email, Emails: []string{email}})
+	if err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+		return
+	} else if len(results) != 1 || results[0] == nil || results[0].IsDeleted() {
+		a.logger.Printf("Email verification requested for %d users matching the given email", len(results))
+		res.WriteHeader(http.StatusAccepted)
+		return
+	}
+	user := results[0]
+
+	resendInterval := a.ApiConfig.EmailVerificationResendIntervalSecs
+	if resendInterval == 0 {
+		resendInterval = defaultEmailVerificationResendIntervalSecs
+	}
+
+	if user.EmailVerified {
+		a.logger.Printf("Email verification requested for verified user %s", user.Id)
+		res.WriteHeader(http.StatusAccepted)
+	} else if latest, err := a.Store.WithContext(req.Context()).FindLatestConfirmationToken(user.Id, ConfirmationPurposeEmailVerification); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+	} else if latest != nil && time.Since(latest.CreatedAt) < time.Duration(resendInterval)*time.Second {
+		a.logger.Printf("Email verification requested for user %s within the resend interval, last sent at %v", user.Id, latest.CreatedAt)
+		res.WriteHeader(http.StatusAccepted)
+	} else if err := a.sendEmailVerification(req.Context(), user); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_SENDING_EMAIL, err)
+	} else {
+		res.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// ConfirmEmailVerification marks the email of the user as verified using a token sent by sendEmailVerification
+// status: 200 User
+// status: 401 STATUS_INVALID_VERIFICATION
+// status: 500 STATUS_ERR_FINDING_USR, STATUS_ERR_UPDATING_USR
+func (a *Api) ConfirmEmailVerification(res http.ResponseWriter, req *http.Request) {
+	if unpacked, err := UnpackConfirmationToken(getGivenDetail(req)["token"], ConfirmationPurposeEmailVerification, a.keys()); err != nil {
+		a.sendError(res, http.StatusUnauthorized, STATUS_INVALID_VERIFICATION, err)
+
+	} else if verificationToken, err := a.Store.WithContext(req.Context()).ConsumeConfirmationToken(unpacked.ID, ConfirmationPurposeEmailVerification); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if verificationToken == nil || verificationToken.UserID != unpacked.UserID {
+		a.sendError(res, http.StatusUnauthorized, STATUS_INVALID_VERIFICATION, "Verification token not found")
+
+	} else if originalUser, err := a.Store.WithContext(req.Context()).FindUser(&User{Id: verificationToken.UserID}); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if originalUser == nil || originalUser.IsDeleted() {
+		a.sendError(res, http.StatusUnauthorized, STATUS_INVALID_VERIFICATION, "User not found")
+
+	} else if !strings.EqualFold(originalUser.Email(), verificationToken.Email) {
+		a.sendError(res, http.StatusUnauthorized, STATUS_INVALID_VERIFICATION, "Email changed since the verification token was issued")
+
+	} else {
+		updatedUser := originalUser.DeepClone()
+		updatedUser.EmailVerified = true
+
+		if err := a.Store.WithContext(req.Context()).UpsertUser(updatedUser); err != nil {
+			a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_USR, err)
+		} else if err := a.userEventsNotifier.NotifyUserUpdated(req.Context(), *originalUser, *updatedUser); err != nil {
+			failedUserEventCount.Inc()
+			a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_USR, err)
+		} else {
+			a.logMetricForUser(updatedUser.Id, "emailverified", unpacked.ID, nil)
+			a.sendUser(res, updatedUser, false)
+		}
+	}
+}
+
+// sendEmailVerification replaces any outstanding verification token of the user with a new one and
+// publishes it so that the verification email can be delivered
+func (a *Api) sendEmailVerification(ctx context.Context, user *User) error {
+	durationSecs := a.ApiConfig.EmailVerificationDurationSecs
+	if durationSecs == 0 {
+		durationSecs = defaultEmailVerificationDurationSecs
+	}
+
+	if err := a.Store.WithContext(ctx).RemoveConfirmationTokensForUser(user.Id, ConfirmationPurposeEmailVerification); err != nil {
+		return err
+	}
+	verificationToken, err := NewConfirmationToken(ConfirmationPurposeEmailVerification, user.Id, user.Email(), durationSecs)
+	if err != nil {
+		return err
+	}
+	signedVerificationToken, err := verificationToken.Sign(a.keys())
+	if err != nil {
+		return err
+	}
+	if err := a.Store.WithContext(ctx).AddConfirmationToken(verificationToken); err != nil {
+		return err
+	}
+	if err := a.userEventsNotifier.NotifyEmailVerificationRequested(ctx, *user, signedVerificationToken, verificationToken.ExpiresAt); err != nil {
+		failedUserEventCount.Inc()
+		return err
+	}
+	return nil
+}
+
+// status: 200 AnonIdHashPair
+func (a *Api) AnonymousIdHashPair(res http.ResponseWriter, req *http.Request) {
+	idHashPair := NewAnonIdHashPair([]string{a.ApiConfig.Salt}, req.URL.Query())
+	sendModelAsRes(res, idHashPair)
+	return
+}
+
+func (a *Api) sendError(res http.ResponseWriter, statusCode int, reason string, extras ...interface{}) {
+	_, file, line, ok := runtime.Caller(1)
+	if ok {
+		segments := strings.Split(file, "/")
+		file = segments[len(segments)-1]
+	} else {
+		file = "???"
+		line = 0
+	}
+
+	messages := make([]string, len(extras))
+	for index, extra := range extras {
+		messages[index] = fmt.Sprintf("%v", extra)
+	}
+
+	statusCount.WithLabelValues(reason, strconv.Itoa(statusCode)).Inc()
+
+	a.logger.Printf("%s:%d RESPONSE ERROR: [%d %s] %s", file, line, statusCode, reason, strings.Join(messages, "; "))
+	sendModelAsResWithStatus(res, status.NewStatus(statusCode, reason), statusCode)
+}
+
+// sendInvalidUserDetails responds with the reasons of a password policy rejection so that clients can show
+// the user what to fix, any other validation error is sent as is. A password that could not be checked is
+// a server error.
+func (a *Api) sendInvalidUserDetails(res http.ResponseWriter, err error) {
+	var policyErr *PasswordPolicyError
+	if errors.Is(err, errPasswordPolicyUnavailable) {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_CHECKING_PW, err)
+		return
+	} else if !errors.As(err, &policyErr) {
+		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_USER_DETAILS, err)
+		return
+	}
+
+	statusCount.WithLabelValues(STATUS_INVALID_USER_DETAILS, strconv.Itoa(http.StatusBadRequest)).Inc()
+	a.logger.Printf("RESPONSE ERROR: [%d %s] %s", http.StatusBadRequest, STATUS_INVALID_USER_DETAILS, policyErr)
+	sendModelAsResWithStatus(res, passwordRejected{Code: http.StatusBadRequest, Reason: STATUS_INVALID_USER_DETAILS, Rejections: policyErr.Rejections}, http.StatusBadRequest)
+}
+
+// sendOauthError sends the error response of RFC 6749 section 5.2
+func (a *Api) sendOauthError(res http.ResponseWriter, statusCode int, code string, description string, extras ...interface{}) {
+	messages := make([]string, len(extras))
+	for index, extra := range extras {
+		messages[index] = fmt.Sprintf("%v", extra)
+	}
+
+	statusCount.WithLabelValues(code, strconv.Itoa(statusCode)).Inc()
+
+	a.logger.Printf("RESPONSE ERROR: [%d %s] %s %s", statusCode, code, description, strings.Join(messages, "; "))
+	sendModelAsResWithStatus(res, &oauthError{Error: code, Description: description}, statusCode)
+}
+
+// redirectOauthError sends the client the error of its authorization request, see RFC 6749 section 4.1.2.1.
+// The redirect URI must have been verified.
+func (a *Api) redirectOauthError(res http.ResponseWriter, req *http.Request, redirectURI string, state string, code string, description string, extras ...interface{}) {
+	messages := make([]string, len(extras))
+	for index, extra := range extras {
+		messages[index] = fmt.Sprintf("%v", extra)
+	}
+
+	statusCount.WithLabelValues(code, strconv.Itoa(http.StatusFound)).Inc()
+
+	a.logger.Printf("RESPONSE ERROR: [%d %s] %s %s", http.StatusFound, code, description, strings.Join(messages, "; "))
+	http.Redirect(res, req, oidcRedirectURI(redirectURI, map[string]string{"error": code, "error_description": description, "state": state}), http.StatusFound)
+}
+
+// sendOidcLoginForm answers an authorization request with the login form, the message tells the user why an
+// earlier attempt failed. The parameters of the request are posted back along with the credentials.
+func (a *Api) sendOidcLoginForm(res http.ResponseWriter, req *http.Request, client *OidcClient, statusCode int, message string) {
+	if statusCode != http.StatusOK {
+		statusCount.WithLabelValues(message, strconv.Itoa(statusCode)).Inc()
+		a.logger.Printf("RESPONSE ERROR: [%d %s] login form", statusCode, message)
+	}
+
+	page := newOidcLoginPage(req, client, message)
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	res.Header().Set("Cache-Control", "no-store")
+	// the page must not be framed by other sites to trick users into logging in
+	res.Header().Set("X-Frame-Options", "DENY")
+	res.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; form-action 'self'; frame-ancestors 'none'")
+	res.WriteHeader(statusCode)
+	if err := oidcLoginTemplate.Execute(res, page); err != nil {
+		a.logger.Printf("Unable to render the login form: %v", err)
+	}
+}
+
+// userInfoClaims returns the OpenID Connect claims of the user
+func (a *Api) userInfoClaims(user *User) map[string]interface{} {
+	return userInfoClaims(a.asSerializableUser(user, false).(map[string]interface{}))
+}
+
+func (a *Api) getPasswordPolicy() PasswordPolicy {
+	if a.passwordPolicy == nil {
+		return DefaultPasswordPolicy
+	}
+	return a.passwordPolicy
+}
+
+// keys returns the key ring tokens are currently signed and verified with
+func (a *Api) keys() *KeyRing {
+	return a.keyRing.Load().(*KeyRing)
+}
+
+// ReloadKeys swaps in the keys of the key directory if they changed. Requests in flight finish with the keys
+// they started with. The current keys are kept if the directory cannot be loaded, so a half written update does
+// not break authentication.
+func (a *Api) ReloadKeys() error {
+	if a.ApiConfig.KeyDirectory == "" {
+		return nil
+	}
+	tokenConfigs, err := LoadKeyDirectory(a.ApiConfig.KeyDirectory)
+	if err != nil {
+		return err
+	}
+	if reflect.DeepEqual(tokenConfigs, a.keys().tokenConfigs) {
+		return nil
+	}
+	keyRing, err := NewKeyRing(tokenConfigs...)
+	if err != nil {
+		return err
+	} else if err := a.ApiConfig.Oidc.ValidateKeyRing(keyRing); err != nil {
+		return err
+	}
+	a.keyRing.Store(keyRing)
+	a.logger.Printf("Reloaded %d token keys, signing with %s %v", len(tokenConfigs), keyRing.Algorithm(), keyRing.KeyIDs())
+	return nil
+}
+
+// WatchKeyDirectory reloads the keys every KeyReloadIntervalSecs until the context is done
+func (a *Api) WatchKeyDirectory(ctx context.Context) {
+	if a.ApiConfig.KeyDirectory == "" || a.ApiConfig.KeyReloadIntervalSecs <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(a.ApiConfig.KeyReloadIntervalSecs) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := a.ReloadKeys(); err != nil {
+				a.logger.Printf("Error reloading the token keys, keeping the current keys: %v", err)
+			}
+		}
+	}
+}
+
+// keyRotationConfig returns the key rotation config with its defaults. Keys are retained by default as long as
+// the longest lived tokens they may have signed: session, server and long term tokens.
+func (a *Api) keyRotationConfig() KeyRotationConfig {
+	retentionSecs := a.ApiConfig.TokenConfigs[0].DurationSecs
+	if serverSecs := int64(24 * 60 * 60); serverSecs > retentionSecs {
+		retentionSecs = serverSecs
+	}
+	if longTermSecs := int64(a.ApiConfig.LongTermDaysDuration) * 24 * 60 * 60; longTermSecs > retentionSecs {
+		retentionSecs = longTermSecs
+	}
+	return a.ApiConfig.KeyRotation.withDefaults(retentionSecs)
+}
+
+// RotateKeys generates the signing key of the next rotation period once its overlap window opens, prunes the
+// keys whose tokens have all expired and swaps in the stored keys. Replicas race to store the key of a period
+// and all of them use the one stored first, so they agree on the key signing tokens.
+func (a *Api) RotateKeys(ctx context.Context) error {
+	_, err := a.rotateKeys(ctx, time.Now())
+	return err
+}
+
+// rotateKeys rotates the keys as of now and returns when the next stored key starts signing, or the zero time
+func (a *Api) rotateKeys(ctx context.Context, now time.Time) (time.Time, error) {
+	config := a.keyRotationConfig()
+	if !config.IsEnabled() {
+		return time.Time{}, nil
+	}
+	encryptionKey, err := config.encryptionKey()
+	if err != nil {
+		return time.Time{}, err
+	}
+	store := a.Store.WithContext(ctx)
+	keys, err := store.FindSigningKeys()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	overlap := time.Duration(config.OverlapSecs) * time.Second
+	generation := config.generation(now)
+	if len(keys) == 0 || (keys[len(keys)-1].Generation <= generation && !now.Before(config.generationStart(generation+1).Add(-overlap))) {
+		// a key generated late still gets the full overlap before it signs
+		activatesAt := config.generationStart(generation + 1)
+		if earliest := now.Add(overlap); activatesAt.Before(earliest) {
+			activatesAt = earliest
+		}
+		key, err := NewSigningKey(generation+1, config.Algorithm, activatesAt, encryptionKey)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if added, err := store.AddSigningKey(key); err != nil {
+			return time.Time{}, err
+		} else if added {
+			a.logger.Printf("Generated signing key %s, signing from %v", key.KeyID, key.ActivatesAt)
+		}
+		if keys, err = store.FindSigningKeys(); err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	keys, retired := partitionSigningKeys(keys, time.Duration(config.RetentionSecs)*time.Second, now)
+	for _, key := range retired {
+		if err := store.RemoveSigningKey(key.Generation); err != nil {
+			return time.Time{}, err
+		}
+		a.logger.Printf("Removed retired signing key %s", key.KeyID)
+	}
+
+	// the active key signs, the other stored keys and the configured keys only verify. Until the first stored
+	// key starts signing the configured keys keep signing.
+	active := activeSigningKey(keys, now)
+	template := a.ApiConfig.TokenConfigs[0]
+	tokenConfigs := []TokenConfig{}
+	if active == nil {
+		tokenConfigs = append(tokenConfigs, a.ApiConfig.TokenConfigs...)
+	} else if tokenConfig, err := active.tokenConfig(template, encryptionKey, true); err != nil {
+		return time.Time{}, fmt.Errorf("signing key %s: %v", active.KeyID, err)
+	} else {
+		tokenConfigs = append(tokenConfigs, tokenConfig)
+	}
+	var nextActivation time.Time
+	for _, key := range keys {
+		if key == active {
+			continue
+		}
+		tokenConfig, _ := key.tokenConfig(template, nil, false)
+		tokenConfigs = append(tokenConfigs, tokenConfig)
+		if key.ActivatesAt.After(now) && (nextActivation.IsZero() || key.ActivatesAt.Before(nextActivation)) {
+			nextActivation = key.ActivatesAt
+		}
+	}
+	if active != nil {
+		tokenConfigs = append(tokenConfigs, a.ApiConfig.TokenConfigs...)
+	}
+
+	if reflect.DeepEqual(tokenConfigs, a.keys().tokenConfigs) {
+		return nextActivation, nil
+	}
+	keyRing, err := NewKeyRing(tokenConfigs...)
+	if err != nil {
+		return time.Time{}, err
+	} else if err := a.ApiConfig.Oidc.ValidateKeyRing(keyRing); err != nil {
+		return time.Time{}, err
+	}
+	a.keyRing.Store(keyRing)
+	a.logger.Printf("Rotated token keys, signing with %s %v", keyRing.Algorithm(), keyRing.KeyIDs())
+	return nextActivation, nil
+}
+
+// WatchKeyRotation rotates the keys every CheckIntervalSecs, and as soon as a stored key starts signing, until the
+// context is done
+func (a *Api) WatchKeyRotation(ctx context.Context) {
+	config := a.keyRotationConfig()
+	if !config.IsEnabled() {
+		return
+	}
+	checkInterval := time.Duration(config.CheckIntervalSecs) * time.Second
+	for {
+		wait := checkInterval
+		nextActivation, err := a.rotateKeys(ctx, time.Now())
+		if err != nil {
+			a.logger.Printf("Error rotating the token keys, keeping the current keys: %v", err)
+		} else if untilActivation := time.Until(nextActivation); !nextActivation.IsZero() && untilActivation < wait {
+			wait = untilActivation
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+func (a *Api) authenticateSessionToken(ctx context.Context, sessionToken string) (*TokenData, error) {
+	if sessionToken == "" {
 		return nil, errors.New("Session token is empty")
-	} else if tokenData, err := UnpackSessionTokenAndVerify(sessionToken, a.ApiConfig.TokenConfigs...); err != nil {
+	} else if tokenData, err := a.keys().UnpackSessionTokenAndVerify(sessionToken); err != nil {
 		return nil, err
-	} else if _, err := a.Store.WithContext(ctx).FindTokenByID(sessionToken); err != nil {
+	} else if token, err := a.findSessionToken(ctx, sessionToken); err != nil {
 		return nil, err
 	} else {
+		a.updateLastUsed(ctx, token)
 		return tokenData, nil
 	}
 }
 
+// updateLastUsed records the use of the session token, at most every sessionLastUsedInterval so that
+// authentication does not write on every request. Failures are only logged.
+func (a *Api) updateLastUsed(ctx context.Context, token *SessionToken) {
+	if token == nil {
+		return
+	}
+	if now := time.Now(); now.Sub(token.LastUsed()) >= sessionLastUsedInterval {
+		if err := a.Store.WithContext(ctx).UpdateTokenLastUsed(token.ID, now); err != nil {
+			a.logger.Printf("Unable to update the last use of a token of %s: %v", token.UserID, err)
+		} else if a.tokenCache != nil {
+			a.tokenCache.MarkUsed(token.ID, now)
+		}
+	}
+}
+
+// findSessionToken returns the stored session token, from the token cache if it is enabled and holds the token
+func (a *Api) findSessionToken(ctx context.Context, id string) (*SessionToken, error) {
+	if a.tokenCache == nil {
+		return a.Store.WithContext(ctx).FindTokenByID(id)
+	}
+	now := time.Now()
+	if token := a.tokenCache.Get(id, now); token != nil {
+		return token, nil
+	}
+	token, err := a.Store.WithContext(ctx).FindTokenByID(id)
+	if err == nil && token != nil {
+		a.tokenCache.Add(token, now)
+	}
+	return token, err
+}
+
+// TokenRevocationHandler returns the handler of the revocations broadcast to the token cache, or nil if the
+// token cache is disabled
+func (a *Api) TokenRevocationHandler() events.EventHandler {
+	if a.tokenCache == nil {
+		return nil
+	}
+	return NewTokenRevocationHandler(a.tokenCache)
+}
+
+// revokeCachedTokens drops the revoked session tokens from the token cache and broadcasts the revocation to the
+// token caches of the other replicas, see TokensRevokedEvent. Without a broadcast they see it once their
+// cached tokens go stale.
+func (a *Api) revokeCachedTokens(ctx context.Context, revocation TokensRevokedEvent) {
+	if a.tokenCache == nil {
+		return
+	}
+	a.tokenCache.Revoke(revocation)
+	revocation.RevokedAt = time.Now()
+	if err := a.userEventsNotifier.NotifyTokensRevoked(ctx, revocation); err != nil {
+		a.logger.Printf("Unable to broadcast the revocation of tokens of %s: %v", revocation.UserID, err)
+		failedUserEventCount.Inc()
+	}
+}
+
+// sessionMetadata describes the client of the request for the session tokens and audit records it creates
+func (a *Api) sessionMetadata(req *http.Request) SessionMetadata {
+	return newSessionMetadata(req, a.trustedProxies)
+}
+
+// isPasswordReused reports whether the password matches the current password of the user or one of the
+// previous passwords in the history, it is always false when the history is disabled
+func (a *Api) isPasswordReused(ctx context.Context, user *User, password string) (bool, error) {
+	if a.ApiConfig.PasswordHistorySize <= 0 {
+		return false, nil
+	} else if user.PasswordsMatch(password, a.ApiConfig.Salt) {
+		return true, nil
+	}
+
+	hashes, err := a.Store.WithContext(ctx).FindPasswordHistory(user.Id)
+	if err != nil {
+		return false, err
+	}
+	for _, hash := range hashes {
+		if VerifyPasswordHash(hash, user.Id, password, a.ApiConfig.Salt) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// addPasswordHistory records the password hash that the user is about to replace
+func (a *Api) addPasswordHistory(ctx context.Context, user *User) error {
+	if a.ApiConfig.PasswordHistorySize <= 0 || user.PwHash == "" {
+		return nil
+	}
+	return a.Store.WithContext(ctx).AddPasswordHistory(user.Id, user.PwHash, a.ApiConfig.PasswordHistorySize)
+}
+
+// upgradePasswordHash replaces a legacy or outdated password hash after a successful login.
+// Failures are logged only, the login itself must still succeed.
+func (a *Api) upgradePasswordHash(ctx context.Context, user *User, password string) {
+	if !user.PasswordNeedsRehash(a.ApiConfig.PasswordHash) {
+		return
+	}
+	upgradedUser := user.DeepClone()
+	if err := upgradedUser.HashPasswordWithConfig(password, a.ApiConfig.Salt, a.ApiConfig.PasswordHash); err != nil {
+		a.logger.Printf("Unable to rehash password for user %s: %v", user.Id, err)
+	} else if err := a.Store.WithContext(ctx).UpsertUser(upgradedUser); err != nil {
+		a.logger.Printf("Unable to store rehashed password for user %s: %v", user.Id, err)
+	} else {
+		user.PwHash = upgradedUser.PwHash
+	}
+}
+
 func (a *Api) tokenUserHasRequestedPermissions(tokenData *TokenData, groupId string, requestedPermissions clients.Permissions) (clients.Permissions, error) {
 	if tokenData.IsServer {
 		return requestedPermissions, nil
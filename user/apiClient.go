@@ -4,6 +4,7 @@ package user
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -116,16 +117,19 @@ func (client *UserClient) CheckToken(token string) *commonUserApi.TokenData {
 
 func (client *UserClient) TokenProvide() string {
 
-	request, _ := http.NewRequest("GET", "", nil)
-	request.Header.Set(TP_SERVER_NAME, "shoreline")
-	request.Header.Set(TP_SERVER_SECRET, client.userapi.ApiConfig.ServerSecret)
-	response := httptest.NewRecorder()
-
-	client.userapi.ServerLogin(response, request)
+	// shoreline creates its own server token, so this keeps working once the legacy server login is disabled
+	sessionToken, err := client.userapi.keys().CreateSessionTokenAndSave(
+		&TokenData{UserId: "shoreline", IsServer: true},
+		client.userapi.Store.WithContext(context.Background()),
+	)
 
 	log.Print(USER_API_PREFIX, "UserClient.TokenProvide")
 
-	return response.Header().Get(TP_SESSION_TOKEN)
+	if err != nil {
+		log.Printf("Error creating server token [%s]", err.Error())
+		return ""
+	}
+	return sessionToken.ID
 }
 
 // FIXME: Not required for OAUTH API, but still...
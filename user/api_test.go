@@ -7,18 +7,22 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/mux"
 	"github.com/tidepool-org/go-common/clients"
 	"github.com/tidepool-org/go-common/clients/highwater"
@@ -30,13 +34,19 @@ const (
 )
 
 func InitAPITest(cfg ApiConfig, logger *log.Logger, store Storage, userEventsNotifier EventsNotifier, seagull clients.Seagull) *Api {
-	return &Api{
+	keyRing, err := NewKeyRing(cfg.TokenConfigs...)
+	if err != nil {
+		panic(err)
+	}
+	api := &Api{
 		Store:              store,
 		ApiConfig:          cfg,
 		logger:             logger,
 		userEventsNotifier: userEventsNotifier,
 		seagull:            seagull,
 	}
+	api.keyRing.Store(keyRing)
+	return api
 }
 
 var (
@@ -147,6 +157,48 @@ func createSessionToken(t *testing.T, userID string, isServer bool, duration int
 	return sessionToken
 }
 
+func createScopedSessionToken(t *testing.T, userID string, scopes ...string) *SessionToken {
+	sessionToken, err := CreateSessionToken(&TokenData{UserId: userID, DurationSecs: tokenDuration, Scopes: scopes}, fakeConfig.TokenConfigs[0])
+	if err != nil {
+		t.Fatalf("Error creating session token: %#v", err)
+	}
+	return sessionToken
+}
+
+func createImpersonationToken(t *testing.T, userID string, actor string) *SessionToken {
+	sessionToken, err := CreateSessionToken(&TokenData{UserId: userID, DurationSecs: tokenDuration, Actor: &TokenActor{Subject: actor}}, fakeConfig.TokenConfigs[0])
+	if err != nil {
+		t.Fatalf("Error creating session token: %#v", err)
+	}
+	return sessionToken
+}
+
+func createServiceClientToken(t *testing.T, clientID string, scopes ...string) *SessionToken {
+	sessionToken, err := CreateSessionToken(&TokenData{UserId: clientID, IsServer: true, DurationSecs: tokenDuration, ClientID: clientID, Scopes: scopes}, fakeConfig.TokenConfigs[0])
+	if err != nil {
+		t.Fatalf("Error creating session token: %#v", err)
+	}
+	return sessionToken
+}
+
+// createEarlierSessionToken creates a session token issued a minute ago, so that it differs from the tokens
+// created during the test
+func createEarlierSessionToken(t *testing.T, userID string) *SessionToken {
+	keyRing := newKeyRing(t, fakeConfig.TokenConfigs[0])
+	token, err := keyRing.verify(createSessionToken(t, userID, false, tokenDuration).ID)
+	if err != nil {
+		t.Fatalf("Error verifying session token: %v", err)
+	}
+	issuedAt := time.Now().Add(-time.Minute)
+	claims := token.Claims.(jwt.MapClaims)
+	claims["iat"], claims["exp"] = issuedAt.Unix(), issuedAt.Add(time.Duration(tokenDuration)*time.Second).Unix()
+	signed, err := keyRing.sign(claims)
+	if err != nil {
+		t.Fatalf("Error signing session token: %v", err)
+	}
+	return &SessionToken{ID: signed, UserID: userID, Duration: tokenDuration, CreatedAt: issuedAt, ExpiresAt: issuedAt.Add(time.Duration(tokenDuration) * time.Second)}
+}
+
 func performRequest(t *testing.T, method string, url string) *httptest.ResponseRecorder {
 	return performRequestBodyHeaders(t, method, url, "", nil)
 }
@@ -205,6 +257,31 @@ func expectErrorResponse(t *testing.T, response *httptest.ResponseRecorder, expe
 	}
 }
 
+func expectPasswordRejections(t *testing.T, response *httptest.ResponseRecorder, expectedCodes ...string) {
+	if response.Code != http.StatusBadRequest {
+		t.Fatalf("Unexpected response status code: %d", response.Code)
+	}
+
+	var rejectedResponse passwordRejected
+	if err := json.NewDecoder(response.Body).Decode(&rejectedResponse); err != nil {
+		t.Fatalf("Error parsing response body: %#v", err)
+	}
+
+	if rejectedResponse.Code != http.StatusBadRequest || rejectedResponse.Reason != STATUS_INVALID_USER_DETAILS {
+		t.Fatalf("Unexpected response error: %d %s", rejectedResponse.Code, rejectedResponse.Reason)
+	}
+	codes := []string{}
+	for _, rejection := range rejectedResponse.Rejections {
+		if rejection.Message == "" {
+			t.Fatalf("Missing message for password rejection %s", rejection.Code)
+		}
+		codes = append(codes, rejection.Code)
+	}
+	if !reflect.DeepEqual(codes, expectedCodes) {
+		t.Fatalf("Actual password rejections %v do not match expected %v", codes, expectedCodes)
+	}
+}
+
 func expectSuccessResponse(t *testing.T, response *httptest.ResponseRecorder, expectedCode int) string {
 	if response.Code != expectedCode {
 		t.Fatalf("Unexpected response status code: %d", response.Code)
@@ -297,18 +374,99 @@ func expectResponsablesEmpty(t *testing.T) {
 		if len(responsableStore.RemoveUserResponses) > 0 {
 			t.Logf("RemoveUserResponses still available")
 		}
+		if len(responsableStore.IncrementFailedLoginsResponses) > 0 {
+			t.Logf("IncrementFailedLoginsResponses still available")
+		}
+		if len(responsableStore.LockUserResponses) > 0 {
+			t.Logf("LockUserResponses still available")
+		}
+		if len(responsableStore.ResetFailedLoginsResponses) > 0 {
+			t.Logf("ResetFailedLoginsResponses still available")
+		}
+		if len(responsableStore.UpdateMfaResponses) > 0 {
+			t.Logf("UpdateMfaResponses still available")
+		}
+		if len(responsableStore.UseMfaStepResponses) > 0 {
+			t.Logf("UseMfaStepResponses still available")
+		}
+		if len(responsableStore.UpdateMfaRecoveryCodesResponses) > 0 {
+			t.Logf("UpdateMfaRecoveryCodesResponses still available")
+		}
+		if len(responsableStore.UseMfaRecoveryCodeResponses) > 0 {
+			t.Logf("UseMfaRecoveryCodeResponses still available")
+		}
+		if len(responsableStore.FindPasswordHistoryResponses) > 0 {
+			t.Logf("FindPasswordHistoryResponses still available")
+		}
+		if len(responsableStore.AddPasswordHistoryResponses) > 0 {
+			t.Logf("AddPasswordHistoryResponses still available")
+		}
+		if len(responsableStore.AddAuditRecordResponses) > 0 {
+			t.Logf("AddAuditRecordResponses still available")
+		}
+		if len(responsableStore.FindAuditRecordsResponses) > 0 {
+			t.Logf("FindAuditRecordsResponses still available")
+		}
 		if len(responsableStore.AddTokenResponses) > 0 {
 			t.Logf("AddTokenResponses still available")
 		}
 		if len(responsableStore.FindTokenByIDResponses) > 0 {
 			t.Logf("FindTokenByIDResponses still available")
 		}
+		if len(responsableStore.FindTokensForUserResponses) > 0 {
+			t.Logf("FindTokensForUserResponses still available")
+		}
+		if len(responsableStore.UpdateTokenLastUsedResponses) > 0 {
+			t.Logf("UpdateTokenLastUsedResponses still available")
+		}
 		if len(responsableStore.RemoveTokenByIDResponses) > 0 {
 			t.Logf("RemoveTokenByIDResponses still available")
 		}
 		if len(responsableStore.RemoveTokensForUserResponses) > 0 {
 			t.Logf("RemoveTokensForUserResponses still available")
 		}
+		if len(responsableStore.RemoveTokensForUserExceptResponses) > 0 {
+			t.Logf("RemoveTokensForUserExceptResponses still available")
+		}
+		if len(responsableStore.AddRefreshTokenResponses) > 0 {
+			t.Logf("AddRefreshTokenResponses still available")
+		}
+		if len(responsableStore.UseRefreshTokenResponses) > 0 {
+			t.Logf("UseRefreshTokenResponses still available")
+		}
+		if len(responsableStore.FindRefreshTokenResponses) > 0 {
+			t.Logf("FindRefreshTokenResponses still available")
+		}
+		if len(responsableStore.RemoveRefreshTokenFamilyResponses) > 0 {
+			t.Logf("RemoveRefreshTokenFamilyResponses still available")
+		}
+		if len(responsableStore.AddAuthorizationCodeResponses) > 0 {
+			t.Logf("AddAuthorizationCodeResponses still available")
+		}
+		if len(responsableStore.ConsumeAuthorizationCodeResponses) > 0 {
+			t.Logf("ConsumeAuthorizationCodeResponses still available")
+		}
+		if len(responsableStore.AddSigningKeyResponses) > 0 {
+			t.Logf("AddSigningKeyResponses still available")
+		}
+		if len(responsableStore.FindSigningKeysResponses) > 0 {
+			t.Logf("FindSigningKeysResponses still available")
+		}
+		if len(responsableStore.RemoveSigningKeyResponses) > 0 {
+			t.Logf("RemoveSigningKeyResponses still available")
+		}
+		if len(responsableStore.AddConfirmationTokenResponses) > 0 {
+			t.Logf("AddConfirmationTokenResponses still available")
+		}
+		if len(responsableStore.ConsumeConfirmationTokenResponses) > 0 {
+			t.Logf("ConsumeConfirmationTokenResponses still available")
+		}
+		if len(responsableStore.FindLatestConfirmationTokenResponses) > 0 {
+			t.Logf("FindLatestConfirmationTokenResponses still available")
+		}
+		if len(responsableStore.RemoveConfirmationTokensForUserResponses) > 0 {
+			t.Logf("RemoveConfirmationTokensForUserResponses still available")
+		}
 		responsableStore.Reset()
 		t.Fail()
 	}
@@ -335,6 +493,21 @@ func expectResponsablesEmpty(t *testing.T) {
 		if len(mockNotifier.NotifyUserUpdatedResponses) > 0 {
 			t.Logf("NotifyUserUpdatedResponses still available")
 		}
+		if len(mockNotifier.NotifyPasswordResetRequestedResponses) > 0 {
+			t.Logf("NotifyPasswordResetRequestedResponses still available")
+		}
+		if len(mockNotifier.NotifyEmailVerificationRequestedResponses) > 0 {
+			t.Logf("NotifyEmailVerificationRequestedResponses still available")
+		}
+		if len(mockNotifier.NotifyPasswordChangedResponses) > 0 {
+			t.Logf("NotifyPasswordChangedResponses still available")
+		}
+		if len(mockNotifier.NotifySessionsRevokedResponses) > 0 {
+			t.Logf("NotifySessionsRevokedResponses still available")
+		}
+		if len(mockNotifier.NotifyTokensRevokedResponses) > 0 {
+			t.Logf("NotifyTokensRevokedResponses still available")
+		}
 		mockNotifier.Reset()
 		t.Fail()
 	}
@@ -342,6 +515,27 @@ func expectResponsablesEmpty(t *testing.T) {
 
 ////////////////////////////////////////////////////////////////////////////////
 
+func TestInitApi_TrustedProxies(t *testing.T) {
+	config := fakeConfig
+	config.TrustedProxies = []string{"10.0.0.0/8"}
+	api, err := InitApi(config, logger, mockStore, mockNotifier, mockSeagull)
+	if err != nil {
+		t.Fatalf("Error initializing the api: %v", err)
+	}
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	if metadata := api.sessionMetadata(req); metadata.ClientIP != "198.51.100.1" {
+		t.Fatalf("The client address should be taken from the trusted proxy, got %q", metadata.ClientIP)
+	}
+
+	config.TrustedProxies = []string{"not a proxy"}
+	if _, err := InitApi(config, logger, mockStore, mockNotifier, mockSeagull); err == nil {
+		t.Fatal("Invalid trusted proxies should be rejected")
+	}
+}
+
 func TestGetStatus_StatusOk(t *testing.T) {
 
 	request, _ := http.NewRequest("GET", "/status", nil)
@@ -378,6 +572,26 @@ func TestGetStatus_StatusInternalServerError(t *testing.T) {
 
 }
 
+func TestGetJSONWebKeySet(t *testing.T) {
+	response := performRequest(t, "GET", "/.well-known/jwks.json")
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+
+	kid, err := fakeConfig.TokenConfigs[0].KeyID()
+	if err != nil {
+		t.Fatalf("Error determining key id: %v", err)
+	}
+	keys, ok := successResponse["keys"].([]interface{})
+	if !ok || len(keys) != 1 {
+		t.Fatalf("Unexpected keys %v", successResponse["keys"])
+	}
+	key := keys[0].(map[string]interface{})
+	expectElementMatch(t, key, "n", `\A[A-Za-z0-9_-]{342}\z`, true)
+	expectEqualsMap(t, key, map[string]interface{}{"kty": "RSA", "use": "sig", "alg": "RS256", "kid": kid, "e": "AQAB"})
+	if response.Header().Get("Cache-Control") == "" {
+		t.Fatalf("Missing expected Cache-Control header")
+	}
+}
+
 func TestGetMetrics_StatusCount(t *testing.T) {
 
 	performRequest(t, "GET", "/users?role=clinic")
@@ -426,6 +640,17 @@ func Test_GetUsers_Error_NotServerToken(t *testing.T) {
 	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
 }
 
+func Test_GetUsers_Error_InsufficientServiceScope(t *testing.T) {
+	sessionToken := createServiceClientToken(t, "data", ServiceScopeUsersWrite)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/users?role=clinic", headers)
+	expectErrorResponse(t, response, 403, STATUS_INSUFFICIENT_SCOPE)
+}
+
 func Test_GetUsers_Error_InvalidRole(t *testing.T) {
 	sessionToken := createSessionToken(t, "abcdef1234", true, tokenDuration)
 	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
@@ -535,7 +760,7 @@ func Test_GetUsers_Error_FindUsersByRoleSuccess(t *testing.T) {
 	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
 	response := performRequestHeaders(t, "GET", "/users?role=clinic", headers)
 	successResponse := expectSuccessResponseWithJSONArray(t, response, 200)
-	expectEqualsArray(t, successResponse, []interface{}{map[string]interface{}{"userid": "0000000000", "passwordExists": false}, map[string]interface{}{"userid": "1111111111", "passwordExists": false}})
+	expectEqualsArray(t, successResponse, []interface{}{map[string]interface{}{"userid": "0000000000", "passwordExists": false, "locked": false}, map[string]interface{}{"userid": "1111111111", "passwordExists": false, "locked": false}})
 }
 
 func Test_GetUsers_FindUsersByRoleAndDateSuccess(t *testing.T) {
@@ -551,7 +776,7 @@ func Test_GetUsers_FindUsersByRoleAndDateSuccess(t *testing.T) {
 	createdToQuery := time.Now().Format("2006-01-02")
 	response := performRequestHeaders(t, "GET", "/users?role=clinic&createdFrom="+createdFromQuery+"&createdTo="+createdToQuery, headers)
 	successResponse := expectSuccessResponseWithJSONArray(t, response, 200)
-	expectEqualsArray(t, successResponse, []interface{}{map[string]interface{}{"userid": "0000000000", "passwordExists": false}, map[string]interface{}{"userid": "1111111111", "passwordExists": false}})
+	expectEqualsArray(t, successResponse, []interface{}{map[string]interface{}{"userid": "0000000000", "passwordExists": false, "locked": false}, map[string]interface{}{"userid": "1111111111", "passwordExists": false, "locked": false}})
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -576,6 +801,11 @@ func Test_CreateUser_Error_InvalidUserDetails(t *testing.T) {
 	expectErrorResponse(t, response, 400, "Invalid user details were given")
 }
 
+func Test_CreateUser_Error_PasswordPolicy(t *testing.T) {
+	response := performRequestBody(t, "POST", "/user", "{\"username\": \"jessica@z.co\", \"emails\": [\"jessica@z.co\"], \"password\": \"Jessica 2016\"}")
+	expectPasswordRejections(t, response, PasswordRejectionWhitespace, PasswordRejectionSimilarToIdentity)
+}
+
 func Test_CreateUser_Error_ErrorFindingUsers(t *testing.T) {
 	responsableStore.FindUsersResponses = []FindUsersResponse{{nil, errors.New("ERROR")}}
 	defer expectResponsablesEmpty(t)
@@ -618,6 +848,9 @@ func Test_CreateUser_Error_ErrorSettingPermissions(t *testing.T) {
 func Test_CreateUser_Error_ErrorAddingToken(t *testing.T) {
 	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
 	responsableStore.UpsertUserResponses = []error{nil}
+	responsableStore.RemoveConfirmationTokensForUserResponses = []error{nil}
+	responsableStore.AddConfirmationTokenResponses = []error{nil}
+	mockNotifier.NotifyEmailVerificationRequestedResponses = []error{nil}
 	responsableStore.AddTokenResponses = []error{errors.New("ERROR")}
 	defer expectResponsablesEmpty(t)
 
@@ -630,6 +863,9 @@ func Test_CreateUser_Success(t *testing.T) {
 	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
 	responsableStore.UpsertUserResponses = []error{nil}
 	responsableGatekeeper.SetPermissionsResponses = []PermissionsResponse{{clients.Permissions{}, nil}}
+	responsableStore.RemoveConfirmationTokensForUserResponses = []error{nil}
+	responsableStore.AddConfirmationTokenResponses = []error{nil}
+	mockNotifier.NotifyEmailVerificationRequestedResponses = []error{nil}
 	responsableStore.AddTokenResponses = []error{nil}
 	defer expectResponsablesEmpty(t)
 
@@ -645,6 +881,19 @@ func Test_CreateUser_Success(t *testing.T) {
 
 ////////////////////////////////////////////////////////////////////////////////
 
+func Test_CreateUser_Success_EmailVerificationError(t *testing.T) {
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableStore.RemoveConfirmationTokensForUserResponses = []error{nil}
+	responsableStore.AddConfirmationTokenResponses = []error{errors.New("ERROR")}
+	responsableStore.AddTokenResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"password\": \"12345678\"}"
+	response := performRequestBody(t, "POST", "/user", body)
+	expectSuccessResponseWithJSONMap(t, response, 201)
+}
+
 func Test_CreateCustodialUser_Error_MissingSessionToken(t *testing.T) {
 	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"]}"
 	response := performRequestBody(t, "POST", "/user/abcdef1234/user", body)
@@ -785,7 +1034,7 @@ func Test_CreateCustodialUser_Success_Anonymous_Server(t *testing.T) {
 	response := performRequestBodyHeaders(t, "POST", "/user/0000000000/user", body, headers)
 	successResponse := expectSuccessResponseWithJSONMap(t, response, 201)
 	expectElementMatch(t, successResponse, "userid", `\A[0-9a-f]{10}\z`, true)
-	expectEqualsMap(t, successResponse, map[string]interface{}{"passwordExists": false})
+	expectEqualsMap(t, successResponse, map[string]interface{}{"passwordExists": false, "locked": false})
 }
 
 func Test_CreateCustodialUser_Success_Known(t *testing.T) {
@@ -805,6 +1054,18 @@ func Test_CreateCustodialUser_Success_Known(t *testing.T) {
 	expectEqualsMap(t, successResponse, map[string]interface{}{"emailVerified": false, "emails": []interface{}{"a@z.co"}, "username": "a@z.co"})
 }
 
+func Test_CreateCustodialUser_Error_InsufficientScope(t *testing.T) {
+	sessionToken := createScopedSessionToken(t, "abcdef1234", ScopeUpload, ScopeRead)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"]}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/abcdef1234/user", body, headers)
+	expectErrorResponse(t, response, 403, STATUS_INSUFFICIENT_SCOPE)
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 
 func Test_UpdateUser_Error_MissingSessionToken(t *testing.T) {
@@ -813,6 +1074,59 @@ func Test_UpdateUser_Error_MissingSessionToken(t *testing.T) {
 	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
 }
 
+func Test_UpdateUser_Error_InsufficientScope(t *testing.T) {
+	sessionToken := createScopedSessionToken(t, "1111111111", ScopeUpload)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"updates\": {\"password\": \"newpassword\"}}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	expectErrorResponse(t, response, 403, STATUS_INSUFFICIENT_SCOPE)
+}
+
+func Test_UpdateUser_Success_AccountWriteScope(t *testing.T) {
+	sessionToken := createScopedSessionToken(t, "1111111111", ScopeAccountWrite)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	mockNotifier.NotifyUserUpdatedResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"]}}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	expectSuccessResponseWithJSONMap(t, response, 200)
+}
+
+func Test_UpdateUser_Error_InsufficientScope_Roles(t *testing.T) {
+	sessionToken, _ := CreateSessionToken(&TokenData{UserId: "0000000000", IsServer: true, DurationSecs: tokenDuration, Scopes: []string{ScopeAccountWrite}}, fakeConfig.TokenConfigs[0])
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"updates\": {\"roles\": [\"clinic\"]}}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	expectErrorResponse(t, response, 403, STATUS_INSUFFICIENT_SCOPE)
+}
+
+func Test_UpdateUser_Error_InsufficientServiceScope(t *testing.T) {
+	sessionToken := createServiceClientToken(t, "data", ServiceScopeUsersRead)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"updates\": {\"roles\": [\"clinic\"]}}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	expectErrorResponse(t, response, 403, STATUS_INSUFFICIENT_SCOPE)
+}
+
 func Test_UpdateUser_Error_MissingDetails(t *testing.T) {
 	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
 	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
@@ -828,6 +1142,8 @@ func Test_UpdateUser_Error_MissingDetails(t *testing.T) {
 func Test_UpdateUser_Error_InvalidDetails(t *testing.T) {
 	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
 	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
+	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{"custodian": clients.Allowed}, nil}}
 	defer expectResponsablesEmpty(t)
 
 	body := "{\"updates\": {\"username\": \"a\", \"emails\": [\"a\"]}}"
@@ -973,6 +1289,19 @@ func Test_UpdateUser_Error_UnauthorizedTermsAccepted_Custodian(t *testing.T) {
 	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
 }
 
+func Test_UpdateUser_Error_PasswordPolicy(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "jessica@z.co", Emails: []string{"jessica@z.co"}}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"updates\": {\"password\": \"jessica2016\"}}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	expectPasswordRejections(t, response, PasswordRejectionSimilarToIdentity)
+}
+
 func Test_UpdateUser_Error_FindUserDuplicateError(t *testing.T) {
 	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
 	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
@@ -1130,7 +1459,7 @@ func Test_UpdateUser_Success_Server_WithoutPassword(t *testing.T) {
 	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
 	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
 	expectElementMatch(t, successResponse, "userid", `\A[0-9a-f]{10}\z`, true)
-	expectEqualsMap(t, successResponse, map[string]interface{}{"emailVerified": true, "emails": []interface{}{"a@z.co"}, "username": "a@z.co", "roles": []interface{}{"clinic"}, "termsAccepted": "2016-01-01T01:23:45-08:00", "passwordExists": false})
+	expectEqualsMap(t, successResponse, map[string]interface{}{"emailVerified": true, "emails": []interface{}{"a@z.co"}, "username": "a@z.co", "roles": []interface{}{"clinic"}, "termsAccepted": "2016-01-01T01:23:45-08:00", "passwordExists": false, "locked": false})
 }
 
 func Test_UpdateUser_Success_Server_WithPassword(t *testing.T) {
@@ -1150,7 +1479,106 @@ func Test_UpdateUser_Success_Server_WithPassword(t *testing.T) {
 	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
 	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
 	expectElementMatch(t, successResponse, "userid", `\A[0-9a-f]{10}\z`, true)
-	expectEqualsMap(t, successResponse, map[string]interface{}{"emailVerified": true, "emails": []interface{}{"a@z.co"}, "username": "a@z.co", "roles": []interface{}{"clinic"}, "termsAccepted": "2016-01-01T01:23:45-08:00", "passwordExists": true})
+	expectEqualsMap(t, successResponse, map[string]interface{}{"emailVerified": true, "emails": []interface{}{"a@z.co"}, "username": "a@z.co", "roles": []interface{}{"clinic"}, "termsAccepted": "2016-01-01T01:23:45-08:00", "passwordExists": true, "locked": false})
+}
+
+func createUserWithPassword(t *testing.T, password string) *User {
+	user := &User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}}
+	if err := user.HashPassword(password, fakeConfig.Salt); err != nil {
+		t.Fatalf("Error hashing password: %v", err)
+	}
+	return user
+}
+
+func Test_UpdateUser_Error_PasswordReused_Current(t *testing.T) {
+	responsableShoreline.ApiConfig.PasswordHistorySize = 3
+	defer func() { responsableShoreline.ApiConfig.PasswordHistorySize = 0 }()
+
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{createUserWithPassword(t, "oldpassword"), nil}}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"updates\": {\"password\": \"oldpassword\"}}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	expectErrorResponse(t, response, 400, "The password has been used recently and cannot be reused")
+}
+
+func Test_UpdateUser_Error_PasswordReused_History(t *testing.T) {
+	responsableShoreline.ApiConfig.PasswordHistorySize = 3
+	defer func() { responsableShoreline.ApiConfig.PasswordHistorySize = 0 }()
+
+	previousUser := createUserWithPassword(t, "newpassword")
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{createUserWithPassword(t, "oldpassword"), nil}}
+	responsableStore.FindPasswordHistoryResponses = []FindPasswordHistoryResponse{{[]string{previousUser.PwHash}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"updates\": {\"password\": \"newpassword\"}}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	expectErrorResponse(t, response, 400, "The password has been used recently and cannot be reused")
+}
+
+func Test_UpdateUser_Error_FindPasswordHistoryError(t *testing.T) {
+	responsableShoreline.ApiConfig.PasswordHistorySize = 3
+	defer func() { responsableShoreline.ApiConfig.PasswordHistorySize = 0 }()
+
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{createUserWithPassword(t, "oldpassword"), nil}}
+	responsableStore.FindPasswordHistoryResponses = []FindPasswordHistoryResponse{{nil, errors.New("ERROR")}}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"updates\": {\"password\": \"newpassword\"}}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	expectErrorResponse(t, response, 500, "Error updating user")
+}
+
+func Test_UpdateUser_Error_AddPasswordHistoryError(t *testing.T) {
+	responsableShoreline.ApiConfig.PasswordHistorySize = 3
+	defer func() { responsableShoreline.ApiConfig.PasswordHistorySize = 0 }()
+
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{createUserWithPassword(t, "oldpassword"), nil}}
+	responsableStore.FindPasswordHistoryResponses = []FindPasswordHistoryResponse{{[]string{}, nil}}
+	responsableStore.AddPasswordHistoryResponses = []error{errors.New("ERROR")}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"updates\": {\"password\": \"newpassword\"}}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	expectErrorResponse(t, response, 500, "Error updating user")
+}
+
+func Test_UpdateUser_Success_PasswordHistory(t *testing.T) {
+	responsableShoreline.ApiConfig.PasswordHistorySize = 3
+	defer func() { responsableShoreline.ApiConfig.PasswordHistorySize = 0 }()
+
+	previousUser := createUserWithPassword(t, "olderpassword")
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{createUserWithPassword(t, "oldpassword"), nil}}
+	responsableStore.FindPasswordHistoryResponses = []FindPasswordHistoryResponse{{[]string{previousUser.PwHash}, nil}}
+	responsableStore.AddPasswordHistoryResponses = []error{nil}
+	responsableStore.UpsertUserResponses = []error{nil}
+	mockNotifier.NotifyUserUpdatedResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"updates\": {\"password\": \"newpassword\"}}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"userid": "1111111111", "emailVerified": false, "emails": []interface{}{"a@z.co"}, "username": "a@z.co"})
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -1262,7 +1690,7 @@ func Test_GetUserInfo_Success_Server(t *testing.T) {
 	response := performRequestHeaders(t, "GET", "/user/1111111111", headers)
 	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
 	expectElementMatch(t, successResponse, "userid", `\A[0-9a-f]{10}\z`, true)
-	expectEqualsMap(t, successResponse, map[string]interface{}{"emailVerified": true, "emails": []interface{}{"a@z.co"}, "username": "a@z.co", "termsAccepted": "2016-01-01T01:23:45-08:00", "passwordExists": true})
+	expectEqualsMap(t, successResponse, map[string]interface{}{"emailVerified": true, "emails": []interface{}{"a@z.co"}, "username": "a@z.co", "termsAccepted": "2016-01-01T01:23:45-08:00", "passwordExists": true, "locked": false})
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -1395,6 +1823,31 @@ func TestDeleteUser_StatusUnauthorizedWhenClinic(t *testing.T) {
 	}
 }
 
+func TestDeleteUser_StatusForbiddenWithoutScope(t *testing.T) {
+	sessionToken := createScopedSessionToken(t, "1111111111", ScopeUpload, ScopeRead)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "DELETE", "/user/1111111111", `{"password":"password"}`, headers)
+
+	if response.Code != http.StatusForbidden {
+		t.Fatalf("Non-expected status code %v:\n\tbody: %v", http.StatusForbidden, response.Code)
+	}
+}
+
+func TestDeleteUser_StatusForbidden_Impersonated(t *testing.T) {
+	sessionToken := createImpersonationToken(t, "0000000000", "support@tidepool.org")
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "DELETE", "/user/1111111111", headers)
+	expectErrorResponse(t, response, 403, STATUS_IMPERSONATED)
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 
 func Test_Login_Error_MissingAuthorization(t *testing.T) {
@@ -1453,6 +1906,7 @@ func Test_Login_Error_FindUsersNil(t *testing.T) {
 func Test_Login_Error_NoPassword(t *testing.T) {
 	authorization := createAuthorization(t, "a@b.co", "password")
 	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111"}}, nil}}
+	responsableStore.IncrementFailedLoginsResponses = []IncrementFailedLoginsResponse{{1, nil}}
 	defer expectResponsablesEmpty(t)
 
 	headers := http.Header{}
@@ -1464,6 +1918,7 @@ func Test_Login_Error_NoPassword(t *testing.T) {
 func Test_Login_Error_PasswordMismatch(t *testing.T) {
 	authorization := createAuthorization(t, "a@b.co", "MISMATCH")
 	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5"}}, nil}}
+	responsableStore.IncrementFailedLoginsResponses = []IncrementFailedLoginsResponse{{1, nil}}
 	defer expectResponsablesEmpty(t)
 
 	headers := http.Header{}
@@ -1483,9 +1938,24 @@ func Test_Login_Error_EmailNotVerified(t *testing.T) {
 	expectErrorResponse(t, response, 403, "The user hasn't verified this account yet")
 }
 
+func Test_Login_Error_EmailNotVerified_VerificationSecret(t *testing.T) {
+	responsableShoreline.ApiConfig.VerificationSecret = "+skip"
+	defer func() { responsableShoreline.ApiConfig.VerificationSecret = "" }()
+
+	authorization := createAuthorization(t, "a+skip@b.co", "password")
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", Username: "a+skip@b.co", Emails: []string{"a+skip@b.co"}, PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5"}}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login", headers)
+	expectErrorResponse(t, response, 403, "The user hasn't verified this account yet")
+}
+
 func Test_Login_Error_ErrorCreatingToken(t *testing.T) {
 	authorization := createAuthorization(t, "a@b.co", "password")
 	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", EmailVerified: true}}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
 	responsableStore.AddTokenResponses = []error{errors.New("ERROR")}
 	defer expectResponsablesEmpty(t)
 
@@ -1498,6 +1968,7 @@ func Test_Login_Error_ErrorCreatingToken(t *testing.T) {
 func Test_Login_Success(t *testing.T) {
 	authorization := createAuthorization(t, "a@b.co", "password")
 	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, TermsAccepted: "2016-01-01T01:23:45-08:00", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", EmailVerified: true}}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
 	responsableStore.AddTokenResponses = []error{nil}
 	defer expectResponsablesEmpty(t)
 
@@ -1515,6 +1986,7 @@ func Test_Login_Success(t *testing.T) {
 func Test_Login_Success_Password_Complex(t *testing.T) {
 	authorization := createAuthorization(t, "a@b.co", "`-=[]\\;',./~!@#$%^&*)(_+}{|\":<>?`¡™£¢∞§¶•ª–≠‘“æ…÷≥”’")
 	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, TermsAccepted: "2016-01-01T01:23:45-08:00", PwHash: "80464ae775ca97187d29bc4b3e391e959947138a", EmailVerified: true}}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
 	responsableStore.AddTokenResponses = []error{nil}
 	defer expectResponsablesEmpty(t)
 
@@ -1529,527 +2001,3462 @@ func Test_Login_Success_Password_Complex(t *testing.T) {
 	}
 }
 
-////////////////////////////////////////////////////////////////////////////////
+func Test_Login_Success_UpgradesLegacyPasswordHash(t *testing.T) {
+	authorization := createAuthorization(t, "a@b.co", "password")
+	legacyUser := &User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", EmailVerified: true}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{legacyUser}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableStore.AddTokenResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login", headers)
+	expectSuccessResponseWithJSONMap(t, response, 200)
+	if !strings.HasPrefix(legacyUser.PwHash, "$argon2id$") {
+		t.Fatalf("Expected password hash to be upgraded, got %s", legacyUser.PwHash)
+	}
+	if !legacyUser.PasswordsMatch("password", fakeConfig.Salt) {
+		t.Fatalf("Upgraded password hash does not match")
+	}
+}
+
+func Test_Login_Success_UpgradePasswordHashError(t *testing.T) {
+	authorization := createAuthorization(t, "a@b.co", "password")
+	legacyUser := &User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", EmailVerified: true}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{legacyUser}, nil}}
+	responsableStore.UpsertUserResponses = []error{errors.New("ERROR")}
+	responsableStore.AddTokenResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login", headers)
+	expectSuccessResponseWithJSONMap(t, response, 200)
+	if legacyUser.PwHash != "d1fef52139b0d120100726bcb43d5cc13d41e4b5" {
+		t.Fatalf("Expected legacy password hash to be kept when it could not be stored")
+	}
+}
+
+func Test_Login_Error_Locked(t *testing.T) {
+	authorization := createAuthorization(t, "a@b.co", "password")
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", EmailVerified: true, FailedLogins: 10, LockedUntil: time.Now().Add(time.Minute)}}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login", headers)
+	expectErrorResponse(t, response, 423, "The account is temporarily locked after too many failed logins")
+	if response.Header().Get("Retry-After") == "" {
+		t.Fatalf("Missing expected Retry-After header")
+	}
+}
+
+func Test_Login_Error_Backoff(t *testing.T) {
+	authorization := createAuthorization(t, "a@b.co", "password")
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", EmailVerified: true, FailedLogins: 3, LastFailedLoginTime: time.Now()}}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login", headers)
+	expectErrorResponse(t, response, 429, "Too many requests, try again later")
+	if response.Header().Get("Retry-After") == "" {
+		t.Fatalf("Missing expected Retry-After header")
+	}
+}
+
+func Test_Login_Error_PasswordMismatch_LocksUser(t *testing.T) {
+	authorization := createAuthorization(t, "a@b.co", "MISMATCH")
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", FailedLogins: 9, LastFailedLoginTime: time.Now().Add(-time.Hour)}}, nil}}
+	responsableStore.IncrementFailedLoginsResponses = []IncrementFailedLoginsResponse{{10, nil}}
+	responsableStore.LockUserResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login", headers)
+	expectErrorResponse(t, response, 401, "No user matched the given details")
+}
+
+func Test_Login_Error_PasswordMismatch_ErrorRecordingFailure(t *testing.T) {
+	authorization := createAuthorization(t, "a@b.co", "MISMATCH")
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5"}}, nil}}
+	responsableStore.IncrementFailedLoginsResponses = []IncrementFailedLoginsResponse{{0, errors.New("ERROR")}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login", headers)
+	expectErrorResponse(t, response, 401, "No user matched the given details")
+}
+
+func Test_Login_Success_ResetsFailedLogins(t *testing.T) {
+	authorization := createAuthorization(t, "a@b.co", "password")
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", EmailVerified: true, FailedLogins: 10, LastFailedLoginTime: time.Now().Add(-time.Hour), LockedUntil: time.Now().Add(-time.Minute)}}, nil}}
+	responsableStore.ResetFailedLoginsResponses = []error{nil}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableStore.AddTokenResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login", headers)
+	expectSuccessResponseWithJSONMap(t, response, 200)
+	if response.Header().Get(TP_SESSION_TOKEN) == "" {
+		t.Fatalf("Missing expected %s header", TP_SESSION_TOKEN)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func Test_UnlockUser_Error_MissingSessionToken(t *testing.T) {
+	response := performRequest(t, "POST", "/user/1111111111/unlock")
+	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
+}
+
+func Test_UnlockUser_Error_NotServerToken(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "POST", "/user/1111111111/unlock", headers)
+	expectErrorResponse(t, response, 401, "A server token is required")
+}
+
+func Test_UnlockUser_Error_InsufficientServiceScope(t *testing.T) {
+	sessionToken := createServiceClientToken(t, "data", ServiceScopeUsersRead)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "POST", "/user/1111111111/unlock", headers)
+	expectErrorResponse(t, response, 403, STATUS_INSUFFICIENT_SCOPE)
+}
+
+func Test_UnlockUser_Error_FindUserError(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{nil, errors.New("ERROR")}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "POST", "/user/1111111111/unlock", headers)
+	expectErrorResponse(t, response, 500, "Error finding user")
+}
+
+func Test_UnlockUser_Error_UserNotFound(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{nil, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "POST", "/user/1111111111/unlock", headers)
+	expectErrorResponse(t, response, 404, "User not found")
+}
+
+func Test_UnlockUser_Error_ResetError(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", LockedUntil: time.Now().Add(time.Minute)}, nil}}
+	responsableStore.ResetFailedLoginsResponses = []error{errors.New("ERROR")}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "POST", "/user/1111111111/unlock", headers)
+	expectErrorResponse(t, response, 500, "Error updating user")
+}
+
+func Test_UnlockUser_Success(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, EmailVerified: true, PwHash: "xyz", FailedLogins: 10, LockedUntil: time.Now().Add(time.Minute)}, nil}}
+	responsableStore.ResetFailedLoginsResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "POST", "/user/1111111111/unlock", headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectElementMatch(t, successResponse, "userid", `\A[0-9a-f]{10}\z`, true)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"emailVerified": true, "emails": []interface{}{"a@z.co"}, "username": "a@z.co", "passwordExists": true, "locked": false})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func createMfaSecretAndCode(t *testing.T) (string, string) {
+	secret, err := NewTotpSecret()
+	if err != nil {
+		t.Fatalf("Error creating totp secret: %#v", err)
+	}
+	code, err := TotpCode(secret, TotpStep(time.Now()))
+	if err != nil {
+		t.Fatalf("Error creating totp code: %#v", err)
+	}
+	return secret, code
+}
+
+func Test_Login_Success_RefreshToken(t *testing.T) {
+	authorization := createAuthorization(t, "a@b.co", "password")
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", EmailVerified: true}}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableStore.AddTokenResponses = []error{nil}
+	responsableStore.AddRefreshTokenResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login?refresh_token=true", headers)
+	expectSuccessResponseWithJSONMap(t, response, 200)
+	if response.Header().Get(TP_REFRESH_TOKEN) == "" {
+		t.Fatalf("Missing expected %s header", TP_REFRESH_TOKEN)
+	}
+
+	tokenData, err := UnpackSessionTokenAndVerify(response.Header().Get(TP_SESSION_TOKEN), fakeConfig.TokenConfigs...)
+	if err != nil {
+		t.Fatalf("Error unpacking session token: %v", err)
+	}
+	if tokenData.FamilyID == "" {
+		t.Fatalf("The session token should belong to a refresh token family")
+	}
+	if tokenData.DurationSecs != DefaultRefreshTokenConfig.AccessTokenDurationSecs {
+		t.Fatalf("The session token should last %d seconds, not %d", DefaultRefreshTokenConfig.AccessTokenDurationSecs, tokenData.DurationSecs)
+	}
+}
+
+func Test_Login_Success_Scope(t *testing.T) {
+	authorization := createAuthorization(t, "a@b.co", "password")
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", EmailVerified: true}}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableStore.AddTokenResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login?scope=upload%20read", headers)
+	expectSuccessResponseWithJSONMap(t, response, 200)
+
+	tokenData, err := UnpackSessionTokenAndVerify(response.Header().Get(TP_SESSION_TOKEN), fakeConfig.TokenConfigs...)
+	if err != nil {
+		t.Fatalf("Error unpacking session token: %v", err)
+	}
+	if !reflect.DeepEqual(tokenData.Scopes, []string{ScopeUpload, ScopeRead}) {
+		t.Fatalf("The session token should be limited to the requested scopes, got %v", tokenData.Scopes)
+	}
+}
+
+func Test_Login_Error_InvalidScope(t *testing.T) {
+	authorization := createAuthorization(t, "a@b.co", "password")
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", EmailVerified: true}}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login?scope=upload%20delete", headers)
+	expectErrorResponse(t, response, 400, STATUS_INVALID_SCOPE)
+}
+
+func Test_Login_Error_RefreshToken_ErrorAddingRefreshToken(t *testing.T) {
+	authorization := createAuthorization(t, "a@b.co", "password")
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", EmailVerified: true}}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableStore.AddTokenResponses = []error{nil}
+	responsableStore.AddRefreshTokenResponses = []error{errors.New("ERROR")}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login?refresh_token=true", headers)
+	expectErrorResponse(t, response, 500, "Error updating token")
+	if response.Header().Get(TP_REFRESH_TOKEN) != "" {
+		t.Fatalf("Unexpected %s header", TP_REFRESH_TOKEN)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func createRefreshToken(t *testing.T, userID string) (*RefreshToken, string) {
+	refreshToken, value, err := NewRefreshToken(userID, "", 3600)
+	if err != nil {
+		t.Fatalf("Error creating refresh token: %#v", err)
+	}
+	return refreshToken, value
+}
+
+func Test_RefreshAccessToken_Error_MissingToken(t *testing.T) {
+	response := performRequest(t, "POST", "/login/refresh")
+	expectErrorResponse(t, response, 401, STATUS_NO_REFRESH_TOKEN)
+}
+
+func Test_RefreshAccessToken_Error_UseRefreshTokenError(t *testing.T) {
+	_, value := createRefreshToken(t, "1111111111")
+	responsableStore.UseRefreshTokenResponses = []UseRefreshTokenResponse{{nil, false, errors.New("ERROR")}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_REFRESH_TOKEN, value)
+	response := performRequestHeaders(t, "POST", "/login/refresh", headers)
+	expectErrorResponse(t, response, 500, STATUS_ERR_UPDATING_TOKEN)
+}
+
+func Test_RefreshAccessToken_Error_NotFound(t *testing.T) {
+	_, value := createRefreshToken(t, "1111111111")
+	responsableStore.UseRefreshTokenResponses = []UseRefreshTokenResponse{{nil, false, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_REFRESH_TOKEN, value)
+	response := performRequestHeaders(t, "POST", "/login/refresh", headers)
+	expectErrorResponse(t, response, 401, STATUS_INVALID_REFRESH_TOKEN)
+}
+
+func Test_RefreshAccessToken_Error_Expired(t *testing.T) {
+	refreshToken, value := createRefreshToken(t, "1111111111")
+	refreshToken.ExpiresAt = time.Now().Add(-time.Minute)
+	responsableStore.UseRefreshTokenResponses = []UseRefreshTokenResponse{{refreshToken, false, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_REFRESH_TOKEN, value)
+	response := performRequestHeaders(t, "POST", "/login/refresh", headers)
+	expectErrorResponse(t, response, 401, STATUS_INVALID_REFRESH_TOKEN)
+}
+
+func Test_RefreshAccessToken_Error_Reused(t *testing.T) {
+	refreshToken, value := createRefreshToken(t, "1111111111")
+	responsableStore.UseRefreshTokenResponses = []UseRefreshTokenResponse{{refreshToken, true, nil}}
+	responsableStore.RemoveRefreshTokenFamilyResponses = []error{nil}
+	responsableStore.AddAuditRecordResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_REFRESH_TOKEN, value)
+	response := performRequestHeaders(t, "POST", "/login/refresh", headers)
+	expectErrorResponse(t, response, 401, STATUS_REFRESH_TOKEN_REUSED)
+	if response.Header().Get(TP_SESSION_TOKEN) != "" || response.Header().Get(TP_REFRESH_TOKEN) != "" {
+		t.Fatalf("Unexpected token headers %v", response.Header())
+	}
+}
+
+func Test_RefreshAccessToken_Error_Reused_RemoveFamilyError(t *testing.T) {
+	refreshToken, value := createRefreshToken(t, "1111111111")
+	responsableStore.UseRefreshTokenResponses = []UseRefreshTokenResponse{{refreshToken, true, nil}}
+	responsableStore.RemoveRefreshTokenFamilyResponses = []error{errors.New("ERROR")}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_REFRESH_TOKEN, value)
+	response := performRequestHeaders(t, "POST", "/login/refresh", headers)
+	expectErrorResponse(t, response, 500, STATUS_ERR_UPDATING_TOKEN)
+}
+
+func Test_RefreshAccessToken_Error_UserDeleted(t *testing.T) {
+	refreshToken, value := createRefreshToken(t, "1111111111")
+	responsableStore.UseRefreshTokenResponses = []UseRefreshTokenResponse{{refreshToken, false, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", DeletedTime: "2016-01-01T01:23:45-08:00"}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_REFRESH_TOKEN, value)
+	response := performRequestHeaders(t, "POST", "/login/refresh", headers)
+	expectErrorResponse(t, response, 401, STATUS_INVALID_REFRESH_TOKEN)
+}
+
+func Test_RefreshAccessToken_Success(t *testing.T) {
+	refreshToken, value := createRefreshToken(t, "1111111111")
+	responsableStore.UseRefreshTokenResponses = []UseRefreshTokenResponse{{refreshToken, false, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, EmailVerified: true}, nil}}
+	responsableStore.AddTokenResponses = []error{nil}
+	responsableStore.AddRefreshTokenResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_REFRESH_TOKEN, value)
+	response := performRequestHeaders(t, "POST", "/login/refresh", headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectElementMatch(t, successResponse, "userid", `\A1111111111\z`, true)
+
+	if rotated := response.Header().Get(TP_REFRESH_TOKEN); rotated == "" || rotated == value {
+		t.Fatalf("The refresh token should be rotated, got %q", rotated)
+	}
+	tokenData, err := UnpackSessionTokenAndVerify(response.Header().Get(TP_SESSION_TOKEN), fakeConfig.TokenConfigs...)
+	if err != nil {
+		t.Fatalf("Error unpacking session token: %v", err)
+	}
+	if tokenData.UserId != "1111111111" || tokenData.FamilyID != refreshToken.FamilyID {
+		t.Fatalf("The session token should belong to the user and the refresh token family, got %#v", tokenData)
+	}
+}
+
+func Test_RefreshAccessToken_Success_NarrowsScope(t *testing.T) {
+	refreshToken, value := createRefreshToken(t, "1111111111")
+	refreshToken.Scopes = []string{ScopeUpload, ScopeRead}
+	responsableStore.UseRefreshTokenResponses = []UseRefreshTokenResponse{{refreshToken, false, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, EmailVerified: true}, nil}}
+	responsableStore.AddTokenResponses = []error{nil}
+	responsableStore.AddRefreshTokenResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_REFRESH_TOKEN, value)
+	response := performRequestHeaders(t, "POST", "/login/refresh?scope=upload", headers)
+	expectSuccessResponseWithJSONMap(t, response, 200)
+
+	tokenData, err := UnpackSessionTokenAndVerify(response.Header().Get(TP_SESSION_TOKEN), fakeConfig.TokenConfigs...)
+	if err != nil {
+		t.Fatalf("Error unpacking session token: %v", err)
+	}
+	if !reflect.DeepEqual(tokenData.Scopes, []string{ScopeUpload}) {
+		t.Fatalf("The session token should be limited to the narrowed scopes, got %v", tokenData.Scopes)
+	}
+}
+
+func Test_RefreshAccessToken_Error_ScopeNotGranted(t *testing.T) {
+	refreshToken, value := createRefreshToken(t, "1111111111")
+	refreshToken.Scopes = []string{ScopeUpload}
+	responsableStore.UseRefreshTokenResponses = []UseRefreshTokenResponse{{refreshToken, false, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, EmailVerified: true}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_REFRESH_TOKEN, value)
+	response := performRequestHeaders(t, "POST", "/login/refresh?scope=account:write", headers)
+	expectErrorResponse(t, response, 400, STATUS_INVALID_SCOPE)
+}
+
+func Test_Login_MfaRequired(t *testing.T) {
+	secret, _ := createMfaSecretAndCode(t)
+	authorization := createAuthorization(t, "a@b.co", "password")
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", EmailVerified: true, FailedLogins: 1, Mfa: &MfaSettings{Secret: secret, Enabled: true}}}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableStore.RemoveConfirmationTokensForUserResponses = []error{nil}
+	responsableStore.AddConfirmationTokenResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login", headers)
+	challenge := expectSuccessResponseWithJSONMap(t, response, 401)
+	if challenge["reason"] != STATUS_MFA_REQUIRED {
+		t.Fatalf("Unexpected response error reason: %#v", challenge["reason"])
+	}
+	if _, err := UnpackConfirmationToken(challenge["mfaToken"].(string), ConfirmationPurposeMfaLogin, responsableShoreline.keys()); err != nil {
+		t.Fatalf("Expected a valid mfa token: %#v", err)
+	}
+	if response.Header().Get(TP_SESSION_TOKEN) != "" {
+		t.Fatalf("Unexpected %s header", TP_SESSION_TOKEN)
+	}
+}
+
+func Test_Login_MfaRequired_ErrorAddingToken(t *testing.T) {
+	secret, _ := createMfaSecretAndCode(t)
+	authorization := createAuthorization(t, "a@b.co", "password")
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", EmailVerified: true, Mfa: &MfaSettings{Secret: secret, Enabled: true}}}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableStore.RemoveConfirmationTokensForUserResponses = []error{nil}
+	responsableStore.AddConfirmationTokenResponses = []error{errors.New("ERROR")}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login", headers)
+	expectErrorResponse(t, response, 500, "Error generating the token")
+}
+
+func Test_Login_MfaEnrollmentRequired(t *testing.T) {
+	responsableShoreline.ApiConfig.MfaRequiredRoles = []string{"clinic"}
+	defer func() { responsableShoreline.ApiConfig.MfaRequiredRoles = nil }()
+
+	authorization := createAuthorization(t, "a@b.co", "password")
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", Roles: []string{"clinic"}, PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", EmailVerified: true}}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableStore.RemoveConfirmationTokensForUserResponses = []error{nil}
+	responsableStore.AddConfirmationTokenResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login", headers)
+	challenge := expectSuccessResponseWithJSONMap(t, response, 403)
+	if challenge["reason"] != STATUS_MFA_ENROLL_REQUIRED {
+		t.Fatalf("Unexpected response error reason: %#v", challenge["reason"])
+	}
+	if _, err := UnpackConfirmationToken(challenge["mfaToken"].(string), ConfirmationPurposeMfaEnrollment, responsableShoreline.keys()); err != nil {
+		t.Fatalf("Expected a valid mfa enrollment token: %#v", err)
+	}
+}
+
+func Test_Login_MfaEnrollmentRequired_OtherRole(t *testing.T) {
+	responsableShoreline.ApiConfig.MfaRequiredRoles = []string{"clinic"}
+	defer func() { responsableShoreline.ApiConfig.MfaRequiredRoles = nil }()
+
+	authorization := createAuthorization(t, "a@b.co", "password")
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", EmailVerified: true}}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableStore.AddTokenResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login", headers)
+	expectSuccessResponseWithJSONMap(t, response, 200)
+}
+
+func Test_LoginMfa_Error_MissingDetails(t *testing.T) {
+	response := performRequestBody(t, "POST", "/login/mfa", `{"code": "123456"}`)
+	expectErrorResponse(t, response, 400, "Missing id and/or password")
+}
+
+func Test_LoginMfa_Error_InvalidToken(t *testing.T) {
+	_, signed := createSignedConfirmationToken(t, ConfirmationPurposeMfaEnrollment, "1111111111")
+	response := performRequestBody(t, "POST", "/login/mfa", fmt.Sprintf(`{"mfaToken": "%s", "code": "123456"}`, signed))
+	expectErrorResponse(t, response, 401, "The multi-factor authentication token is invalid or has expired")
+}
+
+func Test_LoginMfa_Error_FindUserError(t *testing.T) {
+	_, signed := createSignedConfirmationToken(t, ConfirmationPurposeMfaLogin, "1111111111")
+	responsableStore.FindUserResponses = []FindUserResponse{{nil, errors.New("ERROR")}}
+	defer expectResponsablesEmpty(t)
+
+	response := performRequestBody(t, "POST", "/login/mfa", fmt.Sprintf(`{"mfaToken": "%s", "code": "123456"}`, signed))
+	expectErrorResponse(t, response, 500, "Error finding user")
+}
+
+func Test_LoginMfa_Error_MfaNotEnabled(t *testing.T) {
+	_, signed := createSignedConfirmationToken(t, ConfirmationPurposeMfaLogin, "1111111111")
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Mfa: &MfaSettings{Secret: "ABCDEF"}}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	response := performRequestBody(t, "POST", "/login/mfa", fmt.Sprintf(`{"mfaToken": "%s", "code": "123456"}`, signed))
+	expectErrorResponse(t, response, 401, "The multi-factor authentication token is invalid or has expired")
+}
+
+func Test_LoginMfa_Error_Locked(t *testing.T) {
+	secret, code := createMfaSecretAndCode(t)
+	_, signed := createSignedConfirmationToken(t, ConfirmationPurposeMfaLogin, "1111111111")
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", LockedUntil: time.Now().Add(time.Minute), Mfa: &MfaSettings{Secret: secret, Enabled: true}}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	response := performRequestBody(t, "POST", "/login/mfa", fmt.Sprintf(`{"mfaToken": "%s", "code": "%s"}`, signed, code))
+	expectErrorResponse(t, response, 423, "The account is temporarily locked after too many failed logins")
+}
+
+func Test_LoginMfa_Error_InvalidCode(t *testing.T) {
+	secret, code := createMfaSecretAndCode(t)
+	_, signed := createSignedConfirmationToken(t, ConfirmationPurposeMfaLogin, "1111111111")
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Mfa: &MfaSettings{Secret: secret, Enabled: true}}, nil}}
+	responsableStore.IncrementFailedLoginsResponses = []IncrementFailedLoginsResponse{{1, nil}}
+	defer expectResponsablesEmpty(t)
+
+	wrongCode := fmt.Sprintf("%06d", (mustAtoi(t, code)+1)%1000000)
+	response := performRequestBody(t, "POST", "/login/mfa", fmt.Sprintf(`{"mfaToken": "%s", "code": "%s"}`, signed, wrongCode))
+	expectErrorResponse(t, response, 401, "The authentication code is invalid")
+}
+
+func Test_LoginMfa_Error_CodeReused(t *testing.T) {
+	secret, code := createMfaSecretAndCode(t)
+	_, signed := createSignedConfirmationToken(t, ConfirmationPurposeMfaLogin, "1111111111")
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Mfa: &MfaSettings{Secret: secret, Enabled: true}}, nil}}
+	responsableStore.UseMfaStepResponses = []UseMfaStepResponse{{false, nil}}
+	responsableStore.IncrementFailedLoginsResponses = []IncrementFailedLoginsResponse{{1, nil}}
+	defer expectResponsablesEmpty(t)
+
+	response := performRequestBody(t, "POST", "/login/mfa", fmt.Sprintf(`{"mfaToken": "%s", "code": "%s"}`, signed, code))
+	expectErrorResponse(t, response, 401, "The authentication code is invalid")
+}
+
+func Test_LoginMfa_Error_TokenAlreadyUsed(t *testing.T) {
+	secret, code := createMfaSecretAndCode(t)
+	_, signed := createSignedConfirmationToken(t, ConfirmationPurposeMfaLogin, "1111111111")
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Mfa: &MfaSettings{Secret: secret, Enabled: true}}, nil}}
+	responsableStore.UseMfaStepResponses = []UseMfaStepResponse{{true, nil}}
+	responsableStore.ConsumeConfirmationTokenResponses = []ConsumeConfirmationTokenResponse{{nil, nil}}
+	defer expectResponsablesEmpty(t)
+
+	response := performRequestBody(t, "POST", "/login/mfa", fmt.Sprintf(`{"mfaToken": "%s", "code": "%s"}`, signed, code))
+	expectErrorResponse(t, response, 401, "The multi-factor authentication token is invalid or has expired")
+}
+
+func Test_LoginMfa_Success(t *testing.T) {
+	secret, code := createMfaSecretAndCode(t)
+	mfaToken, signed := createSignedConfirmationToken(t, ConfirmationPurposeMfaLogin, "1111111111")
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, EmailVerified: true, FailedLogins: 1, Mfa: &MfaSettings{Secret: secret, Enabled: true}}, nil}}
+	responsableStore.UseMfaStepResponses = []UseMfaStepResponse{{true, nil}}
+	responsableStore.ConsumeConfirmationTokenResponses = []ConsumeConfirmationTokenResponse{{mfaToken, nil}}
+	responsableStore.ResetFailedLoginsResponses = []error{nil}
+	responsableStore.AddTokenResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	response := performRequestBody(t, "POST", "/login/mfa", fmt.Sprintf(`{"mfaToken": "%s", "code": "%s"}`, signed, code))
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"userid": "1111111111", "emailVerified": true, "emails": []interface{}{"a@z.co"}, "username": "a@z.co", "mfaEnabled": true})
+	if response.Header().Get(TP_SESSION_TOKEN) == "" {
+		t.Fatalf("Missing expected %s header", TP_SESSION_TOKEN)
+	}
+}
+
+func Test_LoginMfa_Error_InvalidRecoveryCode(t *testing.T) {
+	_, signed := createSignedConfirmationToken(t, ConfirmationPurposeMfaLogin, "1111111111")
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Mfa: &MfaSettings{Secret: "ABCDEF", Enabled: true, RecoveryCodes: []string{"hash"}}}, nil}}
+	responsableStore.UseMfaRecoveryCodeResponses = []UseMfaRecoveryCodeResponse{{false, nil}}
+	responsableStore.IncrementFailedLoginsResponses = []IncrementFailedLoginsResponse{{1, nil}}
+	defer expectResponsablesEmpty(t)
+
+	response := performRequestBody(t, "POST", "/login/mfa", fmt.Sprintf(`{"mfaToken": "%s", "recoveryCode": "abcde-fghij"}`, signed))
+	expectErrorResponse(t, response, 401, "The authentication code is invalid")
+}
+
+func Test_LoginMfa_Error_RecoveryCodeError(t *testing.T) {
+	_, signed := createSignedConfirmationToken(t, ConfirmationPurposeMfaLogin, "1111111111")
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Mfa: &MfaSettings{Secret: "ABCDEF", Enabled: true, RecoveryCodes: []string{"hash"}}}, nil}}
+	responsableStore.UseMfaRecoveryCodeResponses = []UseMfaRecoveryCodeResponse{{false, errors.New("ERROR")}}
+	defer expectResponsablesEmpty(t)
+
+	response := performRequestBody(t, "POST", "/login/mfa", fmt.Sprintf(`{"mfaToken": "%s", "recoveryCode": "abcde-fghij"}`, signed))
+	expectErrorResponse(t, response, 500, "Error updating token")
+}
+
+func Test_LoginMfa_Success_RecoveryCode(t *testing.T) {
+	mfaToken, signed := createSignedConfirmationToken(t, ConfirmationPurposeMfaLogin, "1111111111")
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, EmailVerified: true, Mfa: &MfaSettings{Secret: "ABCDEF", Enabled: true, RecoveryCodes: []string{"hash", "other"}}}, nil}}
+	responsableStore.UseMfaRecoveryCodeResponses = []UseMfaRecoveryCodeResponse{{true, nil}}
+	responsableStore.AddAuditRecordResponses = []error{nil}
+	responsableStore.ConsumeConfirmationTokenResponses = []ConsumeConfirmationTokenResponse{{mfaToken, nil}}
+	responsableStore.AddTokenResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	response := performRequestBody(t, "POST", "/login/mfa", fmt.Sprintf(`{"mfaToken": "%s", "recoveryCode": "abcde-fghij"}`, signed))
+	expectSuccessResponseWithJSONMap(t, response, 200)
+	if response.Header().Get(TP_SESSION_TOKEN) == "" {
+		t.Fatalf("Missing expected %s header", TP_SESSION_TOKEN)
+	}
+}
+
+func Test_LoginMfa_Success_RecoveryCode_ErrorAuditing(t *testing.T) {
+	mfaToken, signed := createSignedConfirmationToken(t, ConfirmationPurposeMfaLogin, "1111111111")
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", EmailVerified: true, Mfa: &MfaSettings{Secret: "ABCDEF", Enabled: true, RecoveryCodes: []string{"hash"}}}, nil}}
+	responsableStore.UseMfaRecoveryCodeResponses = []UseMfaRecoveryCodeResponse{{true, nil}}
+	responsableStore.AddAuditRecordResponses = []error{errors.New("ERROR")}
+	responsableStore.ConsumeConfirmationTokenResponses = []ConsumeConfirmationTokenResponse{{mfaToken, nil}}
+	responsableStore.AddTokenResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	response := performRequestBody(t, "POST", "/login/mfa", fmt.Sprintf(`{"mfaToken": "%s", "recoveryCode": "abcde-fghij"}`, signed))
+	expectSuccessResponseWithJSONMap(t, response, 200)
+}
+
+func Test_RegenerateMfaRecoveryCodes_Error_Server(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/mfa/recoverycodes", `{"password": "password"}`, headers)
+	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
+}
+
+func Test_RegenerateMfaRecoveryCodes_Error_WrongPassword(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", Mfa: &MfaSettings{Secret: "ABCDEF", Enabled: true}}, nil}}
+	responsableStore.IncrementFailedLoginsResponses = []IncrementFailedLoginsResponse{{1, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/mfa/recoverycodes", `{"password": "MISMATCH"}`, headers)
+	expectErrorResponse(t, response, 403, "Wrong password")
+}
+
+func Test_RegenerateMfaRecoveryCodes_Error_Backoff(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", FailedLogins: 3, LastFailedLoginTime: time.Now(), Mfa: &MfaSettings{Secret: "ABCDEF", Enabled: true}}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/mfa/recoverycodes", `{"password": "password"}`, headers)
+	expectErrorResponse(t, response, 429, "Too many requests, try again later")
+}
+
+func Test_RegenerateMfaRecoveryCodes_Error_NotEnabled(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5"}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/mfa/recoverycodes", `{"password": "password"}`, headers)
+	expectErrorResponse(t, response, 409, "Multi-factor authentication is not enabled")
+}
+
+func Test_RegenerateMfaRecoveryCodes_Success(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", Mfa: &MfaSettings{Secret: "ABCDEF", Enabled: true}}, nil}}
+	responsableStore.UpdateMfaRecoveryCodesResponses = []error{nil}
+	responsableStore.AddAuditRecordResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/mfa/recoverycodes", `{"password": "password"}`, headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	if recoveryCodes, ok := successResponse["recoveryCodes"].([]interface{}); !ok || len(recoveryCodes) != recoveryCodeCount {
+		t.Fatalf("Expected %d recovery codes in %#v", recoveryCodeCount, successResponse)
+	}
+}
+
+func Test_GetAuditRecords_Error_NotServer(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/user/1111111111/audit", headers)
+	expectErrorResponse(t, response, 401, "A server token is required")
+}
+
+func Test_GetAuditRecords_Error_FindError(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindAuditRecordsResponses = []FindAuditRecordsResponse{{nil, errors.New("ERROR")}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/user/1111111111/audit", headers)
+	expectErrorResponse(t, response, 500, "Error finding user")
+}
+
+func Test_GetAuditRecords_Success(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", true, tokenDuration)
+	record := &AuditRecord{ID: "1234", Type: AuditTypeMfaRecoveryCodeUsed, UserID: "1111111111", Time: time.Date(2016, 1, 1, 1, 23, 45, 0, time.UTC), Details: map[string]string{"remaining": "9"}}
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindAuditRecordsResponses = []FindAuditRecordsResponse{{[]*AuditRecord{record}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/user/1111111111/audit", headers)
+	successResponse := expectSuccessResponseWithJSONArray(t, response, 200)
+	expectEqualsArray(t, successResponse, []interface{}{map[string]interface{}{"id": "1234", "type": "mfa_recovery_code_used", "userId": "1111111111", "time": "2016-01-01T01:23:45Z", "details": map[string]interface{}{"remaining": "9"}}})
+}
+
+func Test_ImpersonateUser_Error_NotServerToken(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/impersonate", `{"actor": "support@tidepool.org", "reason": "Upload fails"}`, headers)
+	expectErrorResponse(t, response, 401, "A server token is required")
+}
+
+func Test_ImpersonateUser_Error_LegacyServerToken(t *testing.T) {
+	sessionToken := createSessionToken(t, "shoreline", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/impersonate", `{"actor": "support@tidepool.org", "reason": "Upload fails"}`, headers)
+	expectErrorResponse(t, response, 403, STATUS_CLIENT_TOKEN_REQUIRED)
+}
+
+func Test_ImpersonateUser_Error_InsufficientServiceScope(t *testing.T) {
+	sessionToken := createServiceClientToken(t, "support", ServiceScopeUsersRead, ServiceScopeUsersWrite)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/impersonate", `{"actor": "support@tidepool.org", "reason": "Upload fails"}`, headers)
+	expectErrorResponse(t, response, 403, STATUS_INSUFFICIENT_SCOPE)
+}
+
+func Test_ImpersonateUser_Error_MissingReason(t *testing.T) {
+	sessionToken := createServiceClientToken(t, "support", ServiceScopeImpersonate)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/impersonate", `{"actor": "support@tidepool.org", "reason": " "}`, headers)
+	expectErrorResponse(t, response, 400, "Not all required details were given")
+}
+
+func Test_ImpersonateUser_Error_UserNotFound(t *testing.T) {
+	sessionToken := createServiceClientToken(t, "support", ServiceScopeImpersonate)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{nil, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/impersonate", `{"actor": "support@tidepool.org", "reason": "Upload fails"}`, headers)
+	expectErrorResponse(t, response, 404, "User not found")
+}
+
+func Test_ImpersonateUser_Error_AuditError(t *testing.T) {
+	sessionToken := createServiceClientToken(t, "support", ServiceScopeImpersonate)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
+	responsableStore.AddAuditRecordResponses = []error{errors.New("ERROR")}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/impersonate", `{"actor": "support@tidepool.org", "reason": "Upload fails"}`, headers)
+	expectErrorResponse(t, response, 500, "Error generating the token")
+	if response.Header().Get(TP_SESSION_TOKEN) != "" {
+		t.Fatalf("An unrecorded impersonation should not hand out a token")
+	}
+}
+
+func Test_ImpersonateUser_Success(t *testing.T) {
+	sessionToken := createServiceClientToken(t, "support", ServiceScopeImpersonate)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
+	responsableStore.AddAuditRecordResponses = []error{nil}
+	responsableStore.AddTokenResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	headers.Add(TOKEN_DURATION_KEY, "86400")
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/impersonate", `{"actor": "support@tidepool.org", "reason": "Upload fails"}`, headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"isserver": false, "userid": "1111111111", "act": map[string]interface{}{"sub": "support@tidepool.org"}})
+
+	tokenData, err := UnpackSessionTokenAndVerify(response.Header().Get(TP_SESSION_TOKEN), fakeConfig.TokenConfigs[0])
+	if err != nil {
+		t.Fatalf("The impersonation token should be valid: %v", err)
+	}
+	if tokenData.Actor == nil || tokenData.Actor.Subject != "support@tidepool.org" || tokenData.DurationSecs != defaultImpersonationDurationSecs {
+		t.Fatalf("The impersonation token should name the actor and not outlive the default duration, got %#v", tokenData)
+	}
+}
+
+func Test_CheckToken_ReturnsActor(t *testing.T) {
+	sessionToken := createImpersonationToken(t, "1111111111", "support@tidepool.org")
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/token", headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"isserver": false, "userid": "1111111111", "act": map[string]interface{}{"sub": "support@tidepool.org"}})
+}
+
+func Test_UpdateUser_Error_Impersonated(t *testing.T) {
+	sessionToken := createImpersonationToken(t, "1111111111", "support@tidepool.org")
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", `{"updates": {"emails": ["b@z.co"]}}`, headers)
+	expectErrorResponse(t, response, 403, "The operation is not allowed while impersonating the user")
+}
+
+func Test_RegenerateMfaRecoveryCodes_Error_Impersonated(t *testing.T) {
+	sessionToken := createImpersonationToken(t, "1111111111", "support@tidepool.org")
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/mfa/recoverycodes", `{"password": "oldpassword"}`, headers)
+	expectErrorResponse(t, response, 403, "The operation is not allowed while impersonating the user")
+}
+
+func Test_RegenerateMfaRecoveryCodes_Error_InsufficientScope(t *testing.T) {
+	sessionToken := createScopedSessionToken(t, "1111111111", ScopeUpload)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/mfa/recoverycodes", `{"password": "password"}`, headers)
+	expectErrorResponse(t, response, 403, STATUS_INSUFFICIENT_SCOPE)
+}
+
+func Test_EnrollMfa_Error_Impersonated(t *testing.T) {
+	sessionToken := createImpersonationToken(t, "1111111111", "support@tidepool.org")
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "POST", "/user/1111111111/mfa", headers)
+	expectErrorResponse(t, response, 403, "The operation is not allowed while impersonating the user")
+}
+
+func Test_EnrollMfa_Error_InsufficientScope(t *testing.T) {
+	sessionToken := createScopedSessionToken(t, "1111111111", ScopeUpload)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "POST", "/user/1111111111/mfa", headers)
+	expectErrorResponse(t, response, 403, STATUS_INSUFFICIENT_SCOPE)
+}
+
+func Test_EnrollMfa_Error_Unauthorized(t *testing.T) {
+	response := performRequest(t, "POST", "/user/1111111111/mfa")
+	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
+}
+
+func Test_EnrollMfa_Error_OtherUser(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "POST", "/user/1111111111/mfa", headers)
+	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
+}
+
+func Test_EnrollMfa_Error_WrongPassword(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5"}, nil}}
+	responsableStore.IncrementFailedLoginsResponses = []IncrementFailedLoginsResponse{{1, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "POST", "/user/1111111111/mfa", headers)
+	expectErrorResponse(t, response, 403, "Wrong password")
+}
+
+func Test_EnrollMfa_Error_AlreadyEnabled(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", Mfa: &MfaSettings{Secret: "ABCDEF", Enabled: true}}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/mfa", `{"password": "password"}`, headers)
+	expectErrorResponse(t, response, 409, "Multi-factor authentication is already enabled")
+}
+
+func Test_EnrollMfa_Success(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", Username: "a@z.co", Emails: []string{"a@z.co"}}, nil}}
+	responsableStore.UpdateMfaResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/mfa", `{"password": "password"}`, headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectElementMatch(t, successResponse, "secret", `\A[A-Z2-7]{32}\z`, false)
+	expectElementMatch(t, successResponse, "uri", `\Aotpauth://totp/Tidepool:a@z.co\?`, false)
+}
+
+func Test_EnrollMfa_Success_EnrollmentToken(t *testing.T) {
+	enrollmentToken, signed := createSignedConfirmationToken(t, ConfirmationPurposeMfaEnrollment, "1111111111")
+	responsableStore.FindLatestConfirmationTokenResponses = []FindLatestConfirmationTokenResponse{{enrollmentToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}}, nil}}
+	responsableStore.UpdateMfaResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	response := performRequestBody(t, "POST", "/user/1111111111/mfa", fmt.Sprintf(`{"mfaToken": "%s"}`, signed))
+	expectSuccessResponseWithJSONMap(t, response, 200)
+}
+
+func Test_EnrollMfa_Error_EnrollmentTokenSuperseded(t *testing.T) {
+	latestToken, _ := createSignedConfirmationToken(t, ConfirmationPurposeMfaEnrollment, "1111111111")
+	_, signed := createSignedConfirmationToken(t, ConfirmationPurposeMfaEnrollment, "1111111111")
+	responsableStore.FindLatestConfirmationTokenResponses = []FindLatestConfirmationTokenResponse{{latestToken, nil}}
+	defer expectResponsablesEmpty(t)
+
+	response := performRequestBody(t, "POST", "/user/1111111111/mfa", fmt.Sprintf(`{"mfaToken": "%s"}`, signed))
+	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
+}
+
+func Test_ConfirmMfa_Error_MissingCode(t *testing.T) {
+	response := performRequestBody(t, "POST", "/user/1111111111/mfa/confirm", `{}`)
+	expectErrorResponse(t, response, 400, "Not all required details were given")
+}
+
+func Test_ConfirmMfa_Error_InsufficientScope(t *testing.T) {
+	sessionToken := createScopedSessionToken(t, "1111111111", ScopeUpload)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/mfa/confirm", `{"code": "123456"}`, headers)
+	expectErrorResponse(t, response, 403, STATUS_INSUFFICIENT_SCOPE)
+}
+
+func Test_ConfirmMfa_Error_WrongPassword(t *testing.T) {
+	secret, code := createMfaSecretAndCode(t)
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", Mfa: &MfaSettings{Secret: secret}}, nil}}
+	responsableStore.IncrementFailedLoginsResponses = []IncrementFailedLoginsResponse{{1, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/mfa/confirm", fmt.Sprintf(`{"code": "%s", "password": "MISMATCH"}`, code), headers)
+	expectErrorResponse(t, response, 403, "Wrong password")
+}
+
+func Test_ConfirmMfa_Error_NotPending(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5"}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/mfa/confirm", `{"code": "123456", "password": "password"}`, headers)
+	expectErrorResponse(t, response, 409, "No multi-factor authentication enrollment is pending")
+}
+
+func Test_ConfirmMfa_Error_InvalidCode(t *testing.T) {
+	secret, code := createMfaSecretAndCode(t)
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", Mfa: &MfaSettings{Secret: secret}}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	wrongCode := fmt.Sprintf("%06d", (mustAtoi(t, code)+1)%1000000)
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/mfa/confirm", fmt.Sprintf(`{"code": "%s", "password": "password"}`, wrongCode), headers)
+	expectErrorResponse(t, response, 401, "The authentication code is invalid")
+}
+
+func Test_ConfirmMfa_Success(t *testing.T) {
+	secret, code := createMfaSecretAndCode(t)
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", Username: "a@z.co", Emails: []string{"a@z.co"}, EmailVerified: true, Mfa: &MfaSettings{Secret: secret}}, nil}}
+	responsableStore.UpdateMfaResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/mfa/confirm", fmt.Sprintf(`{"code": "%s", "password": "password"}`, code), headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	if recoveryCodes, ok := successResponse["recoveryCodes"].([]interface{}); !ok || len(recoveryCodes) != recoveryCodeCount {
+		t.Fatalf("Expected %d recovery codes in %#v", recoveryCodeCount, successResponse)
+	}
+	delete(successResponse, "recoveryCodes")
+	expectEqualsMap(t, successResponse, map[string]interface{}{"userid": "1111111111", "emailVerified": true, "emails": []interface{}{"a@z.co"}, "username": "a@z.co", "mfaEnabled": true})
+}
+
+func Test_ConfirmMfa_Success_EnrollmentToken(t *testing.T) {
+	secret, code := createMfaSecretAndCode(t)
+	enrollmentToken, signed := createSignedConfirmationToken(t, ConfirmationPurposeMfaEnrollment, "1111111111")
+	responsableStore.FindLatestConfirmationTokenResponses = []FindLatestConfirmationTokenResponse{{enrollmentToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Mfa: &MfaSettings{Secret: secret}}, nil}}
+	responsableStore.ConsumeConfirmationTokenResponses = []ConsumeConfirmationTokenResponse{{enrollmentToken, nil}}
+	responsableStore.UpdateMfaResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	response := performRequestBody(t, "POST", "/user/1111111111/mfa/confirm", fmt.Sprintf(`{"mfaToken": "%s", "code": "%s"}`, signed, code))
+	expectSuccessResponseWithJSONMap(t, response, 200)
+}
+
+func Test_DisableMfa_Error_InsufficientScope(t *testing.T) {
+	sessionToken := createScopedSessionToken(t, "1111111111", ScopeUpload)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "DELETE", "/user/1111111111/mfa", `{"password": "password"}`, headers)
+	expectErrorResponse(t, response, 403, STATUS_INSUFFICIENT_SCOPE)
+}
+
+func Test_DisableMfa_Error_WrongPassword(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", Mfa: &MfaSettings{Secret: "ABCDEF", Enabled: true}}, nil}}
+	responsableStore.IncrementFailedLoginsResponses = []IncrementFailedLoginsResponse{{1, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "DELETE", "/user/1111111111/mfa", `{"password": "MISMATCH"}`, headers)
+	expectErrorResponse(t, response, 403, "Wrong password")
+}
+
+func Test_DisableMfa_Error_WrongPassword_LocksUser(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", FailedLogins: 9, LastFailedLoginTime: time.Now().Add(-time.Hour), Mfa: &MfaSettings{Secret: "ABCDEF", Enabled: true}}, nil}}
+	responsableStore.IncrementFailedLoginsResponses = []IncrementFailedLoginsResponse{{10, nil}}
+	responsableStore.LockUserResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "DELETE", "/user/1111111111/mfa", `{"password": "MISMATCH"}`, headers)
+	expectErrorResponse(t, response, 403, "Wrong password")
+}
+
+func Test_DisableMfa_Error_Locked(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", FailedLogins: 10, LockedUntil: time.Now().Add(time.Minute), Mfa: &MfaSettings{Secret: "ABCDEF", Enabled: true}}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "DELETE", "/user/1111111111/mfa", `{"password": "password"}`, headers)
+	expectErrorResponse(t, response, 423, "The account is temporarily locked after too many failed logins")
+}
+
+func Test_DisableMfa_Success(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", Mfa: &MfaSettings{Secret: "ABCDEF", Enabled: true}}, nil}}
+	responsableStore.UpdateMfaResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "DELETE", "/user/1111111111/mfa", `{"password": "password"}`, headers)
+	expectSuccessResponse(t, response, 204)
+}
+
+func Test_DisableMfa_Success_Server(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Mfa: &MfaSettings{Secret: "ABCDEF", Enabled: true}}, nil}}
+	responsableStore.UpdateMfaResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "DELETE", "/user/1111111111/mfa", headers)
+	expectSuccessResponse(t, response, 204)
+}
+
+func mustAtoi(t *testing.T, value string) int {
+	result, err := strconv.Atoi(value)
+	if err != nil {
+		t.Fatalf("Error converting %s to int: %#v", value, err)
+	}
+	return result
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func TestServerLogin_StatusBadRequest_WhenNoNameOrSecret(t *testing.T) {
+	request, _ := http.NewRequest("POST", "/", nil)
+	response := httptest.NewRecorder()
+
+	shoreline.SetHandlers("", rtr)
+
+	shoreline.ServerLogin(response, request)
+
+	if response.Code != http.StatusBadRequest {
+		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusBadRequest, response.Code)
+	}
+
+	body, _ := ioutil.ReadAll(response.Body)
+
+	if string(body) != `{"code":400,"reason":"Missing id and/or password"}` {
+		t.Fatalf("Message given [%s] expected [%s] ", string(body), STATUS_MISSING_ID_PW)
+	}
+}
+
+func TestServerLogin_StatusBadRequest_WhenNoName(t *testing.T) {
+	request, _ := http.NewRequest("POST", "/", nil)
+	request.Header.Set(TP_SERVER_SECRET, theSecret)
+	response := httptest.NewRecorder()
+
+	shoreline.SetHandlers("", rtr)
+
+	shoreline.ServerLogin(response, request)
+
+	if response.Code != http.StatusBadRequest {
+		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusBadRequest, response.Code)
+	}
+
+	body, _ := ioutil.ReadAll(response.Body)
+
+	if string(body) != `{"code":400,"reason":"Missing id and/or password"}` {
+		t.Fatalf("Message given [%s] expected [%s] ", string(body), STATUS_MISSING_ID_PW)
+	}
+}
+
+func TestServerLogin_StatusBadRequest_WhenNoSecret(t *testing.T) {
+	request, _ := http.NewRequest("POST", "/", nil)
+	request.Header.Set(TP_SERVER_NAME, "shoreline")
+	response := httptest.NewRecorder()
+
+	shoreline.SetHandlers("", rtr)
+
+	shoreline.ServerLogin(response, request)
+
+	if response.Code != http.StatusBadRequest {
+		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusBadRequest, response.Code)
+	}
+
+	body, _ := ioutil.ReadAll(response.Body)
+
+	if string(body) != `{"code":400,"reason":"Missing id and/or password"}` {
+		t.Fatalf("Message given [%s] expected [%s] ", string(body), STATUS_MISSING_ID_PW)
+	}
+}
+
+func TestServerLogin_StatusOK(t *testing.T) {
+	request, _ := http.NewRequest("POST", "/serverlogin", nil)
+	request.Header.Set(TP_SERVER_NAME, "shoreline")
+	request.Header.Set(TP_SERVER_SECRET, theSecret)
+	response := httptest.NewRecorder()
+
+	shoreline.SetHandlers("", rtr)
+
+	shoreline.ServerLogin(response, request)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusOK, response.Code)
+	}
+
+	if response.Header().Get(TP_SESSION_TOKEN) == "" {
+		t.Fatal("The session token should have been set")
+	}
+
+}
+
+func TestServerLogin_Failure(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/", nil)
+	req.Header.Set(TP_SERVER_NAME, "shoreline")
+	req.Header.Set(TP_SERVER_SECRET, theSecret)
+	resp := httptest.NewRecorder()
+
+	shorelineFails.SetHandlers("", rtr)
+
+	shorelineFails.ServerLogin(resp, req)
+
+	if resp.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected [%v] and got [%v]", http.StatusInternalServerError, resp.Code)
+	}
+}
+
+func TestServerLogin_StatusUnauthorized_WhenSecretWrong(t *testing.T) {
+	request, _ := http.NewRequest("POST", "/", nil)
+	request.Header.Set(TP_SERVER_NAME, "shoreline")
+	request.Header.Set(TP_SERVER_SECRET, "wrong secret")
+	response := httptest.NewRecorder()
+
+	shoreline.SetHandlers("", rtr)
+
+	shoreline.ServerLogin(response, request)
+
+	if response.Code != http.StatusUnauthorized {
+		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusUnauthorized, response.Code)
+	}
+
+	body, _ := ioutil.ReadAll(response.Body)
+
+	if string(body) != `{"code":401,"reason":"Wrong password"}` {
+		t.Fatalf("Message given [%s] expected [%s] ", string(body), STATUS_PW_WRONG)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func TestRefreshSession_StatusUnauthorized_WithNoToken(t *testing.T) {
+	request, _ := http.NewRequest("GET", "/", nil)
+	response := httptest.NewRecorder()
+
+	shoreline.SetHandlers("", rtr)
+
+	shoreline.RefreshSession(response, request)
+
+	if response.Code != http.StatusUnauthorized {
+		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusUnauthorized, response.Code)
+	}
+}
+
+func TestRefreshSession_StatusUnauthorized_WithWrongToken(t *testing.T) {
+	request, _ := http.NewRequest("GET", "/", nil)
+	request.Header.Set(TP_SESSION_TOKEN, "not this token")
+	response := httptest.NewRecorder()
+
+	shoreline.SetHandlers("", rtr)
+
+	shoreline.RefreshSession(response, request)
+
+	if response.Code != http.StatusUnauthorized {
+		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusUnauthorized, response.Code)
+	}
+}
+
+func TestRefreshSession_StatusOK(t *testing.T) {
+
+	shoreline.SetHandlers("", rtr)
+
+	refreshRequest, _ := http.NewRequest("GET", "/", nil)
+	refreshRequest.Header.Set(TP_SESSION_TOKEN, userToken.ID)
+	response := httptest.NewRecorder()
+
+	shoreline.RefreshSession(response, refreshRequest)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusOK, response.Code)
+	}
+
+	tokenString := response.Header().Get(TP_SESSION_TOKEN)
+
+	if tokenString == "" {
+		t.Fatal("A session token should have been returned")
+	}
+
+	if response.Body == nil {
+		t.Fatal("A Body should have been returned")
+	}
+
+	body, _ := ioutil.ReadAll(response.Body)
+
+	var tokenData TokenData
+	_ = json.Unmarshal(body, &tokenData)
+
+	if tokenData.UserId != user.Id {
+		t.Fatalf("should have had a user id of `%v` but was %v", user.Id, tokenData.UserId)
+	}
+}
+
+func TestRefreshSession_StatusForbidden_Impersonated(t *testing.T) {
+	sessionToken := createImpersonationToken(t, "1111111111", "support@tidepool.org")
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/login", headers)
+	expectErrorResponse(t, response, 403, "The operation is not allowed while impersonating the user")
+}
+
+func TestRefreshSession_StatusForbidden_RefreshTokenFamily(t *testing.T) {
+	sessionToken, err := CreateSessionToken(&TokenData{UserId: "1111111111", DurationSecs: tokenDuration, FamilyID: "family"}, fakeConfig.TokenConfigs[0])
+	if err != nil {
+		t.Fatalf("Error creating session token: %#v", err)
+	}
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/login", headers)
+	expectErrorResponse(t, response, 403, "Sessions issued with a refresh token must be refreshed via POST /login/refresh")
+}
+
+func TestRefreshSession_StatusInternalServerError_CreateError(t *testing.T) {
+	sessionToken := createEarlierSessionToken(t, "1111111111")
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.AddTokenResponses = []error{errors.New("ERROR")}
+	// the presented token must survive, RemoveTokenByID would panic without a response
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/login", headers)
+	expectErrorResponse(t, response, 500, STATUS_ERR_GENERATING_TOKEN)
+}
+
+func TestRefreshSession_StatusInternalServerError_RevokeError(t *testing.T) {
+	sessionToken := createEarlierSessionToken(t, "1111111111")
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.AddTokenResponses = []error{nil}
+	responsableStore.RemoveTokenByIDResponses = []error{errors.New("ERROR")}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/login", headers)
+	expectErrorResponse(t, response, 500, "Error updating token")
+}
+
+func TestRefreshSession_StatusOK_RevokesPresentedToken(t *testing.T) {
+	sessionToken := createEarlierSessionToken(t, "1111111111")
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.AddTokenResponses = []error{nil}
+	responsableStore.RemoveTokenByIDResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/login", headers)
+	if response.Code != http.StatusOK {
+		t.Fatalf("Unexpected status code %d", response.Code)
+	}
+	if token := response.Header().Get(TP_SESSION_TOKEN); token == "" || token == sessionToken.ID {
+		t.Fatal("A new session token should have been returned")
+	}
+}
+
+func TestRefreshSession_Failure(t *testing.T) {
+
+	shorelineFails.SetHandlers("", rtr)
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set(TP_SESSION_TOKEN, userToken.ID)
+	resp := httptest.NewRecorder()
+
+	shorelineFails.RefreshSession(resp, req)
+
+	if resp.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected [%v] and got [%v]", http.StatusUnauthorized, resp.Code)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func Test_LongTermLogin_Error_MissingAuthorization(t *testing.T) {
+	response := performRequest(t, "POST", "/login/thelongtermkey")
+	expectErrorResponse(t, response, 400, "Missing id and/or password")
+}
+
+func Test_LongTermLogin_Error_EmptyAuthorization(t *testing.T) {
+	headers := http.Header{}
+	headers.Add("Authorization", "")
+	response := performRequestHeaders(t, "POST", "/login/thelongtermkey", headers)
+	expectErrorResponse(t, response, 400, "Missing id and/or password")
+}
+
+func Test_LongTermLogin_Error_InvalidAuthorization(t *testing.T) {
+	authorization := createAuthorization(t, "", "")
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login/thelongtermkey", headers)
+	expectErrorResponse(t, response, 400, "Missing id and/or password")
+}
+
+func Test_LongTermLogin_Error_FindUsersError(t *testing.T) {
+	authorization := createAuthorization(t, "a@b.co", "password")
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, errors.New("ERROR")}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login/thelongtermkey", headers)
+	expectErrorResponse(t, response, 500, "Error finding user")
+}
+
+func Test_LongTermLogin_Error_FindUsersMissing(t *testing.T) {
+	authorization := createAuthorization(t, "a@b.co", "password")
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login/thelongtermkey", headers)
+	expectErrorResponse(t, response, 401, "No user matched the given details")
+}
+
+func Test_LongTermLogin_Error_FindUsersNil(t *testing.T) {
+	authorization := createAuthorization(t, "a@b.co", "password")
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{nil}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login/thelongtermkey", headers)
+	expectErrorResponse(t, response, 401, "No user matched the given details")
+}
+
+func Test_LongTermLogin_Error_NoPassword(t *testing.T) {
+	authorization := createAuthorization(t, "a@b.co", "password")
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111"}}, nil}}
+	responsableStore.IncrementFailedLoginsResponses = []IncrementFailedLoginsResponse{{1, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login/thelongtermkey", headers)
+	expectErrorResponse(t, response, 401, "No user matched the given details")
+}
+
+func Test_LongTermLogin_Error_PasswordMismatch(t *testing.T) {
+	authorization := createAuthorization(t, "a@b.co", "MISMATCH")
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5"}}, nil}}
+	responsableStore.IncrementFailedLoginsResponses = []IncrementFailedLoginsResponse{{1, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login/thelongtermkey", headers)
+	expectErrorResponse(t, response, 401, "No user matched the given details")
+}
+
+func Test_LongTermLogin_Error_EmailNotVerified(t *testing.T) {
+	authorization := createAuthorization(t, "a@b.co", "password")
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5"}}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login/thelongtermkey", headers)
+	expectErrorResponse(t, response, 403, "The user hasn't verified this account yet")
+}
+
+func Test_LongTermLogin_Error_ErrorCreatingToken(t *testing.T) {
+	authorization := createAuthorization(t, "a@b.co", "password")
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", EmailVerified: true}}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableStore.AddTokenResponses = []error{errors.New("ERROR")}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login/thelongtermkey", headers)
+	expectErrorResponse(t, response, 500, "Error updating token")
+}
+
+func Test_LongTermLogin_Success(t *testing.T) {
+	authorization := createAuthorization(t, "a@b.co", "password")
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, TermsAccepted: "2016-01-01T01:23:45-08:00", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", EmailVerified: true}}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableStore.AddTokenResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login/thelongtermkey", headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectElementMatch(t, successResponse, "userid", `\A[0-9a-f]{10}\z`, true)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"emailVerified": true, "emails": []interface{}{"a@z.co"}, "username": "a@z.co", "termsAccepted": "2016-01-01T01:23:45-08:00"})
+	if response.Header().Get(TP_SESSION_TOKEN) == "" {
+		t.Fatalf("Missing expected %s header", TP_SESSION_TOKEN)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func TestHasServerToken_True(t *testing.T) {
+
+	shoreline.SetHandlers("", rtr)
+
+	//login as server
+	svrLoginRequest, _ := http.NewRequest("POST", "/", nil)
+	svrLoginRequest.Header.Set(TP_SERVER_NAME, "shoreline")
+	svrLoginRequest.Header.Set(TP_SERVER_SECRET, theSecret)
+	response := httptest.NewRecorder()
+
+	shoreline.ServerLogin(response, svrLoginRequest)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusOK, response.Code)
+	}
+
+	if response.Header().Get(TP_SESSION_TOKEN) == "" {
+		t.Fatal("The session token should have been set")
+	}
+
+	if shoreline.keys().hasServerToken(response.Header().Get(TP_SESSION_TOKEN)) == false {
+		t.Fatal("The token should have been a valid server token")
+	}
+}
+
+func TestServerCheckToken_StatusOK(t *testing.T) {
+
+	//the api
+
+	shoreline.SetHandlers("", rtr)
+
+	//step 1 - login as server
+	request, _ := http.NewRequest("POST", "/serverlogin", nil)
+	request.Header.Set(TP_SERVER_NAME, "shoreline")
+	request.Header.Set(TP_SERVER_SECRET, theSecret)
+	response := httptest.NewRecorder()
+
+	shoreline.ServerLogin(response, request)
+
+	svrTokenToUse := response.Header().Get(TP_SESSION_TOKEN)
+
+	if svrTokenToUse == "" {
+		t.Fatalf("we expected to get a token back from login")
+	}
+
+	//step 2 - do the check
+	checkTokenRequest, _ := http.NewRequest("GET", "/", nil)
+	checkTokenRequest.Header.Set(TP_SESSION_TOKEN, svrTokenToUse)
+	checkTokenResponse := httptest.NewRecorder()
+
+	shoreline.ServerCheckToken(checkTokenResponse, checkTokenRequest, map[string]string{"token": svrTokenToUse})
+
+	if checkTokenResponse.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusOK, checkTokenResponse.Code)
+	}
+
+	if checkTokenResponse.Header().Get("content-type") != "application/json" {
+		t.Fatal("the resp should be json")
+	}
+
+	body, _ := ioutil.ReadAll(checkTokenResponse.Body)
+
+	var tokenData TokenData
+	_ = json.Unmarshal(body, &tokenData)
+
+	t.Log("token data returned ", tokenData)
+
+	if tokenData.UserId != "shoreline" {
+		t.Fatalf("should have had a server id of `shoreline` but was %v", tokenData.UserId)
+	}
+
+	if tokenData.IsServer != true {
+		t.Fatalf("should have been a server token but was %v", tokenData.IsServer)
+	}
+}
+
+func TestServerCheckToken_StatusUnauthorized_WhenNoSvrToken(t *testing.T) {
+
+	//the api
+
+	shoreline.SetHandlers("", rtr)
+
+	request, _ := http.NewRequest("GET", "/", nil)
+	response := httptest.NewRecorder()
+
+	shoreline.ServerCheckToken(response, request, noParams)
+
+	if response.Code != http.StatusUnauthorized {
+		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusUnauthorized, response.Code)
+	}
+}
+
+func TestServerCheckToken_StatusForbidden_InsufficientServiceScope(t *testing.T) {
+	serverToken := createServiceClientToken(t, "data", ServiceScopeUsersRead)
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, serverToken.ID)
+	response := performRequestHeaders(t, "GET", "/token/"+sessionToken.ID, headers)
+	expectErrorResponse(t, response, 403, STATUS_INSUFFICIENT_SCOPE)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func TestCheckToken_StatusOK(t *testing.T) {
+
+	//the api
+
+	shoreline.SetHandlers("", rtr)
+
+	//step 1 - login as server
+	request, _ := http.NewRequest("POST", "/serverlogin", nil)
+	request.Header.Set(TP_SERVER_NAME, "shoreline")
+	request.Header.Set(TP_SERVER_SECRET, theSecret)
+	response := httptest.NewRecorder()
+
+	shoreline.ServerLogin(response, request)
+
+	svrTokenToUse := response.Header().Get(TP_SESSION_TOKEN)
+
+	if svrTokenToUse == "" {
+		t.Fatalf("we expected to get a token back from login")
+	}
+
+	//step 2 - do the check
+	checkTokenRequest, _ := http.NewRequest("GET", "/", nil)
+	checkTokenRequest.Header.Set(TP_SESSION_TOKEN, svrTokenToUse)
+	checkTokenResponse := httptest.NewRecorder()
+
+	shoreline.CheckToken(checkTokenResponse, checkTokenRequest)
+
+	if checkTokenResponse.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusOK, checkTokenResponse.Code)
+	}
+
+	if checkTokenResponse.Header().Get("content-type") != "application/json" {
+		t.Fatal("the resp should be json")
+	}
+
+	body, _ := ioutil.ReadAll(checkTokenResponse.Body)
+
+	var tokenData TokenData
+	_ = json.Unmarshal(body, &tokenData)
+
+	t.Log("token data returned ", tokenData)
+
+	if tokenData.UserId != "shoreline" {
+		t.Fatalf("should have had a server id of `shoreline` but was %v", tokenData.UserId)
+	}
+
+	if tokenData.IsServer != true {
+		t.Fatalf("should have been a server token but was %v", tokenData.IsServer)
+	}
+}
+
+func TestReloadKeys(t *testing.T) {
+	directory := t.TempDir()
+	api := InitAPITest(fakeConfig, logger, responsableStore, mockNotifier, mockSeagull)
+	api.ApiConfig.KeyDirectory = directory
+	previousToken, _ := api.keys().CreateSessionToken(&TokenData{UserId: "1111111111", DurationSecs: tokenDuration})
+
+	current := generateTokenConfig(t, "EdDSA")
+	previous := fakeConfig.TokenConfigs[0]
+	previous.EncodeKey = ""
+	writeKeyDirectory(t, directory,
+		map[string]string{"current.pem": current.EncodeKey, "current.pub.pem": current.DecodeKey, "previous.pub.pem": previous.DecodeKey},
+		KeyFile{Algorithm: "EdDSA", PrivateKeyFile: "current.pem", PublicKeyFile: "current.pub.pem", Issuer: "localhost", Audience: "localhost", DurationSecs: tokenDuration},
+		KeyFile{Algorithm: "RS256", PublicKeyFile: "previous.pub.pem", Issuer: previous.Issuer, Audience: previous.Audience},
+	)
+	if err := api.ReloadKeys(); err != nil {
+		t.Fatalf("Unexpected error reloading the keys: %v", err)
+	}
+	keyRing := api.keys()
+	if keyRing.Algorithm() != "EdDSA" || len(keyRing.JSONWebKeySet().Keys) != 2 {
+		t.Fatalf("The reloaded keys should sign with EdDSA and publish both keys, got %v", keyRing.KeyIDs())
+	}
+	if _, err := keyRing.UnpackSessionTokenAndVerify(previousToken.ID); err != nil {
+		t.Fatalf("Tokens of the previous key should stay valid: %v", err)
+	}
+
+	if err := api.ReloadKeys(); err != nil || api.keys() != keyRing {
+		t.Fatalf("Unchanged keys should not be reloaded, got %v", err)
+	}
+
+	// a private key replaced without its public key
+	writeKeyDirectory(t, directory, map[string]string{"current.pem": generateTokenConfig(t, "EdDSA").EncodeKey})
+	writeKeyDirectory(t, directory, nil,
+		KeyFile{Algorithm: "EdDSA", PrivateKeyFile: "current.pem", PublicKeyFile: "current.pub.pem", Issuer: "localhost", Audience: "localhost", DurationSecs: tokenDuration},
+	)
+	if err := api.ReloadKeys(); err == nil || api.keys() != keyRing {
+		t.Fatalf("The current keys should be kept when the new keys are invalid, got %v", err)
+	}
+}
+
+func TestRotateKeys(t *testing.T) {
+	config := fakeConfig
+	config.KeyRotation = KeyRotationConfig{IntervalSecs: 86400, OverlapSecs: 3600, RetentionSecs: 7200, EncryptionKey: testEncryptionKeyValue}
+	api := InitAPITest(config, logger, responsableStore, mockNotifier, mockSeagull)
+	defer expectResponsablesEmpty(t)
+	staticToken, _ := api.keys().CreateSessionToken(&TokenData{UserId: "1111111111", DurationSecs: tokenDuration})
+	periodStart := time.Unix(101*86400, 0)
+
+	// another replica stores its key of the next period first
+	winner := newSigningKey(t, 101, "ES256", periodStart)
+	responsableStore.FindSigningKeysResponses = []FindSigningKeysResponse{{[]*SigningKey{}, nil}, {[]*SigningKey{winner}, nil}}
+	responsableStore.AddSigningKeyResponses = []AddSigningKeyResponse{{false, nil}}
+	nextActivation, err := api.rotateKeys(context.Background(), periodStart.Add(-2*time.Hour))
+	if err != nil {
+		t.Fatalf("Unexpected error generating the first key: %v", err)
+	}
+	if !nextActivation.Equal(periodStart) || api.keys().Algorithm() != "RS256" {
+		t.Fatalf("The configured key should sign until the stored key activates at %v, got %v", nextActivation, api.keys().KeyIDs())
+	}
+	if !containsString(api.keys().KeyIDs(), winner.KeyID) {
+		t.Fatalf("The stored key should be published before it signs, got %v", api.keys().KeyIDs())
+	}
+
+	// the stored key signs once its period started, the configured key still verifies
+	responsableStore.FindSigningKeysResponses = []FindSigningKeysResponse{{[]*SigningKey{winner}, nil}}
+	if _, err := api.rotateKeys(context.Background(), periodStart.Add(time.Minute)); err != nil {
+		t.Fatalf("Unexpected error promoting the stored key: %v", err)
+	}
+	if kids := api.keys().KeyIDs(); api.keys().Algorithm() != "ES256" || kids[0] != winner.KeyID {
+		t.Fatalf("The stored key should sign, got %v", kids)
+	}
+	if _, err := api.keys().UnpackSessionTokenAndVerify(staticToken.ID); err != nil {
+		t.Fatalf("Tokens of the configured key should stay valid: %v", err)
+	}
+
+	// the next key is generated in the overlap window and the previous key is pruned after the retention
+	successor := newSigningKey(t, 102, "ES256", periodStart.Add(24*time.Hour))
+	responsableStore.FindSigningKeysResponses = []FindSigningKeysResponse{{[]*SigningKey{winner}, nil}, {[]*SigningKey{winner, successor}, nil}}
+	responsableStore.AddSigningKeyResponses = []AddSigningKeyResponse{{true, nil}}
+	if _, err := api.rotateKeys(context.Background(), periodStart.Add(23*time.Hour+30*time.Minute)); err != nil {
+		t.Fatalf("Unexpected error generating the next key: %v", err)
+	}
+	if kids := api.keys().KeyIDs(); kids[0] != winner.KeyID || len(kids) != 3 {
+		t.Fatalf("The next key should be published while the current key signs, got %v", kids)
+	}
+	responsableStore.FindSigningKeysResponses = []FindSigningKeysResponse{{[]*SigningKey{winner, successor}, nil}}
+	responsableStore.RemoveSigningKeyResponses = []error{nil}
+	if _, err := api.rotateKeys(context.Background(), periodStart.Add(26*time.Hour)); err != nil {
+		t.Fatalf("Unexpected error pruning the retired key: %v", err)
+	}
+	if kids := api.keys().KeyIDs(); kids[0] != successor.KeyID || len(kids) != 2 {
+		t.Fatalf("The next key should sign and the retired key be removed, got %v", kids)
+	}
+
+	// a key that cannot be decrypted does not replace the current keys
+	keyRing := api.keys()
+	undecryptable := newSigningKey(t, 103, "ES256", periodStart.Add(48*time.Hour))
+	undecryptable.EncryptedPrivateKey = successor.EncryptedPrivateKey
+	responsableStore.FindSigningKeysResponses = []FindSigningKeysResponse{{[]*SigningKey{successor, undecryptable}, nil}}
+	if _, err := api.rotateKeys(context.Background(), periodStart.Add(48*time.Hour+time.Minute)); err == nil || api.keys() != keyRing {
+		t.Fatalf("The current keys should be kept when the stored key cannot be decrypted, got %v", err)
+	}
+}
+
+// BenchmarkCheckToken measures the token checks of other services, by far the most frequent request
+func BenchmarkCheckToken(b *testing.B) {
+	sessionToken, err := CreateSessionToken(&TokenData{UserId: "shoreline", IsServer: true, DurationSecs: tokenDuration}, fakeConfig.TokenConfigs[0])
+	if err != nil {
+		b.Fatal(err)
+	}
+	request, _ := http.NewRequest("GET", "/token", nil)
+	request.Header.Set(TP_SESSION_TOKEN, sessionToken.ID)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		response := httptest.NewRecorder()
+		shoreline.CheckToken(response, request)
+		if response.Code != http.StatusOK {
+			b.Fatalf("unexpected status %d", response.Code)
+		}
+	}
+}
+func TestCheckToken_StatusUnauthorized_WhenNoToken(t *testing.T) {
+
+	//the api
+
+	shoreline.SetHandlers("", rtr)
+
+	request, _ := http.NewRequest("GET", "/", nil)
+	response := httptest.NewRecorder()
+
+	shoreline.CheckToken(response, request)
+
+	if response.Code != http.StatusUnauthorized {
+		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusUnauthorized, response.Code)
+	}
+}
+
+func Test_CheckToken_ReturnsScopes(t *testing.T) {
+	sessionToken := createScopedSessionToken(t, "1111111111", ScopeUpload, ScopeRead)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/token", headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	if !reflect.DeepEqual(successResponse["scopes"], []interface{}{ScopeUpload, ScopeRead}) {
+		t.Fatalf("The scopes of the token should be returned, got %v", successResponse["scopes"])
+	}
+}
+
+func Test_CheckToken_TokenCache(t *testing.T) {
+	config := fakeConfig
+	config.TokenCache = TokenCacheConfig{MaxStalenessSecs: 60}
+	api := InitAPITest(config, logger, responsableStore, mockNotifier, mockSeagull)
+	api.tokenCache = NewTokenCache(config.TokenCache)
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
+
+	checkToken := func() int {
+		request, _ := http.NewRequest("GET", "/token", nil)
+		request.Header.Set(TP_SESSION_TOKEN, sessionToken.ID)
+		response := httptest.NewRecorder()
+		api.CheckToken(response, request)
+		return response.Code
+	}
+	// the second check is answered from the cache
+	if checkToken() != http.StatusOK || checkToken() != http.StatusOK {
+		t.Fatalf("The token should be valid")
+	}
+
+	responsableStore.RemoveTokenByIDResponses = []error{nil}
+	mockNotifier.NotifyTokensRevokedResponses = []error{nil}
+	request, _ := http.NewRequest("POST", "/logout", nil)
+	request.Header.Set(TP_SESSION_TOKEN, sessionToken.ID)
+	api.Logout(httptest.NewRecorder(), request)
+
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{nil, errors.New("mongo: no documents in result")}}
+	if code := checkToken(); code != http.StatusUnauthorized {
+		t.Fatalf("The logged out token should be looked up again and be invalid, got %d", code)
+	}
+}
+
+func Test_CheckToken_UpdatesLastUsed(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	sessionToken.CreatedAt = sessionToken.CreatedAt.Add(-sessionLastUsedInterval)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.UpdateTokenLastUsedResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/token", headers)
+	expectSuccessResponse(t, response, 200)
+}
+
+func Test_CheckToken_UpdatesLastUsed_Throttled(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	sessionToken.CreatedAt = sessionToken.CreatedAt.Add(-sessionLastUsedInterval)
+	lastUsedAt := time.Now().Add(-time.Minute)
+	sessionToken.LastUsedAt = &lastUsedAt
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/token", headers)
+	expectSuccessResponse(t, response, 200)
+}
+
+func Test_CheckToken_UpdatesLastUsed_Error(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	sessionToken.CreatedAt = sessionToken.CreatedAt.Add(-sessionLastUsedInterval)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.UpdateTokenLastUsedResponses = []error{errors.New("ERROR")}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/token", headers)
+	expectSuccessResponse(t, response, 200)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func TestLogout_StatusOK_WhenNoToken(t *testing.T) {
+	request, _ := http.NewRequest("POST", "/", nil)
+	response := httptest.NewRecorder()
+
+	shoreline.SetHandlers("", rtr)
+
+	shoreline.Logout(response, request)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusOK, response.Code)
+	}
+}
+
+func TestLogout_StatusOK(t *testing.T) {
+
+	shoreline.SetHandlers("", rtr)
+	//now logout with valid token
+	request, _ := http.NewRequest("POST", "/", nil)
+	request.Header.Set(TP_SESSION_TOKEN, userToken.ID)
+	response := httptest.NewRecorder()
+
+	shoreline.Logout(response, request)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusOK, response.Code)
+	}
+}
+
+func TestLogout_RemovesRefreshTokenFamily(t *testing.T) {
+	sessionToken, err := CreateSessionToken(&TokenData{UserId: "1111111111", DurationSecs: 900, FamilyID: "family"}, fakeConfig.TokenConfigs[0])
+	if err != nil {
+		t.Fatalf("Error creating session token: %#v", err)
+	}
+	responsableStore.RemoveTokenByIDResponses = []error{nil}
+	responsableStore.RemoveRefreshTokenFamilyResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "POST", "/logout", headers)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusOK, response.Code)
+	}
+}
+
+func TestLogout_Failure(t *testing.T) {
+
+	shorelineFails.SetHandlers("", rtr)
+	//now logout with valid token
+	req, _ := http.NewRequest("POST", "/", nil)
+	req.Header.Set(TP_SESSION_TOKEN, userToken.ID)
+	resp := httptest.NewRecorder()
+
+	shorelineFails.Logout(resp, req)
+
+	if resp.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected [%v] and got [%v]", http.StatusInternalServerError, resp.Code)
+	}
+}
+
+func TestLogout_StatusInternalServerError_RemoveRefreshTokenFamilyError(t *testing.T) {
+	sessionToken, err := CreateSessionToken(&TokenData{UserId: "1111111111", DurationSecs: 900, FamilyID: "family"}, fakeConfig.TokenConfigs[0])
+	if err != nil {
+		t.Fatalf("Error creating session token: %#v", err)
+	}
+	responsableStore.RemoveTokenByIDResponses = []error{nil}
+	responsableStore.RemoveRefreshTokenFamilyResponses = []error{errors.New("ERROR")}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "POST", "/logout", headers)
+	expectErrorResponse(t, response, 500, STATUS_ERR_UPDATING_TOKEN)
+}
+
+func performRevokeRequest(t *testing.T, form url.Values) *httptest.ResponseRecorder {
+	headers := http.Header{}
+	headers.Add("Content-Type", "application/x-www-form-urlencoded")
+	return performRequestBodyHeaders(t, "POST", "/oauth/revoke", form.Encode(), headers)
+}
+
+func Test_RevokeToken_Error_MissingToken(t *testing.T) {
+	response := performRevokeRequest(t, url.Values{})
+	expectOauthError(t, response, 400, "invalid_request")
+}
+
+func Test_RevokeToken_Error_RemoveTokenError(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.RemoveTokenByIDResponses = []error{errors.New("ERROR")}
+	defer expectResponsablesEmpty(t)
+
+	response := performRevokeRequest(t, url.Values{"token": {sessionToken.ID}})
+	expectOauthError(t, response, 500, "server_error")
+}
+
+func Test_RevokeToken_Success_SessionToken(t *testing.T) {
+	sessionToken, err := CreateSessionToken(&TokenData{UserId: "1111111111", DurationSecs: 900, FamilyID: "family"}, fakeConfig.TokenConfigs[0])
+	if err != nil {
+		t.Fatalf("Error creating session token: %#v", err)
+	}
+	responsableStore.RemoveTokenByIDResponses = []error{nil}
+	responsableStore.RemoveRefreshTokenFamilyResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	response := performRevokeRequest(t, url.Values{"token": {sessionToken.ID}, "token_type_hint": {"access_token"}})
+	expectSuccessResponse(t, response, 200)
+}
+
+func Test_RevokeToken_Success_RefreshToken(t *testing.T) {
+	refreshToken, value, err := NewRefreshToken("1111111111", "", 3600)
+	if err != nil {
+		t.Fatalf("Error creating refresh token: %#v", err)
+	}
+	responsableStore.FindRefreshTokenResponses = []FindRefreshTokenResponse{{refreshToken, nil}}
+	responsableStore.RemoveRefreshTokenFamilyResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	response := performRevokeRequest(t, url.Values{"token": {value}, "token_type_hint": {"refresh_token"}})
+	expectSuccessResponse(t, response, 200)
+}
+
+func Test_RevokeToken_Success_UnknownToken(t *testing.T) {
+	responsableStore.FindRefreshTokenResponses = []FindRefreshTokenResponse{{nil, nil}}
+	defer expectResponsablesEmpty(t)
+
+	response := performRevokeRequest(t, url.Values{"token": {"unknown"}})
+	expectSuccessResponse(t, response, 200)
+}
+
+func Test_GetSessions_Error_OtherUser(t *testing.T) {
+	sessionToken := createSessionToken(t, "abcdef1234", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/user/1111111111/sessions", headers)
+	expectErrorResponse(t, response, 401, STATUS_UNAUTHORIZED)
+}
+
+func Test_GetSessions_Error_FindTokensError(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindTokensForUserResponses = []FindTokensForUserResponse{{nil, errors.New("ERROR")}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/user/1111111111/sessions", headers)
+	expectErrorResponse(t, response, 500, STATUS_ERR_FINDING_USR)
+}
+
+func Test_GetSessions_Success(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	otherToken := createSessionToken(t, "1111111111", false, tokenDuration*2)
+	otherToken.SessionMetadata = SessionMetadata{UserAgent: "uploader/2.0", ClientIP: "203.0.113.1", ClientName: "uploader"}
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindTokensForUserResponses = []FindTokensForUserResponse{{[]*SessionToken{otherToken, sessionToken}, nil}}
+	defer expectResponsablesEmpty(t)
 
-func TestServerLogin_StatusBadRequest_WhenNoNameOrSecret(t *testing.T) {
-	request, _ := http.NewRequest("POST", "/", nil)
-	response := httptest.NewRecorder()
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/user/1111111111/sessions", headers)
+	if response.Code != http.StatusOK {
+		t.Fatalf("Unexpected response status code: %d", response.Code)
+	}
+	var sessions []Session
+	if err := json.NewDecoder(response.Body).Decode(&sessions); err != nil {
+		t.Fatalf("Error decoding response: %v", err)
+	}
+	if len(sessions) != 2 || sessions[0].ID != SessionID(otherToken.ID) || sessions[0].Current || sessions[1].ID != SessionID(sessionToken.ID) || !sessions[1].Current {
+		t.Fatalf("Unexpected sessions %#v", sessions)
+	}
+	if sessions[0].SessionMetadata != otherToken.SessionMetadata || !sessions[0].LastUsedAt.Equal(otherToken.CreatedAt) {
+		t.Fatalf("Unexpected session metadata %#v", sessions[0])
+	}
+	if strings.Contains(response.Body.String(), sessionToken.ID) {
+		t.Fatalf("The session tokens must not be exposed")
+	}
+}
 
-	shoreline.SetHandlers("", rtr)
+func Test_RevokeSession_Error_InsufficientScope(t *testing.T) {
+	sessionToken := createScopedSessionToken(t, "1111111111", ScopeUpload)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
 
-	shoreline.ServerLogin(response, request)
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "DELETE", "/user/1111111111/sessions/"+SessionID("unknown"), headers)
+	expectErrorResponse(t, response, 403, STATUS_INSUFFICIENT_SCOPE)
+}
 
-	if response.Code != http.StatusBadRequest {
-		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusBadRequest, response.Code)
+func Test_RevokeSession_Error_NotFound(t *testing.T) {
+	sessionToken := createSessionToken(t, "shoreline", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindTokensForUserResponses = []FindTokensForUserResponse{{[]*SessionToken{}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "DELETE", "/user/1111111111/sessions/"+SessionID("unknown"), headers)
+	expectErrorResponse(t, response, 404, STATUS_SESSION_NOT_FOUND)
+}
+
+func Test_RevokeSession_Error_RemoveTokenError(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	otherToken := createSessionToken(t, "1111111111", false, tokenDuration*2)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindTokensForUserResponses = []FindTokensForUserResponse{{[]*SessionToken{otherToken, sessionToken}, nil}}
+	responsableStore.RemoveTokenByIDResponses = []error{errors.New("ERROR")}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "DELETE", "/user/1111111111/sessions/"+SessionID(otherToken.ID), headers)
+	expectErrorResponse(t, response, 500, STATUS_ERR_UPDATING_TOKEN)
+}
+
+func Test_RevokeSession_Success(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	otherToken := createSessionToken(t, "1111111111", false, tokenDuration*2)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindTokensForUserResponses = []FindTokensForUserResponse{{[]*SessionToken{otherToken, sessionToken}, nil}}
+	responsableStore.RemoveTokenByIDResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "DELETE", "/user/1111111111/sessions/"+SessionID(otherToken.ID), headers)
+	expectSuccessResponse(t, response, 204)
+}
+
+func Test_LogoutAll_Error_MissingSessionToken(t *testing.T) {
+	response := performRequest(t, "POST", "/user/1111111111/logout-all")
+	expectErrorResponse(t, response, 401, STATUS_UNAUTHORIZED)
+}
+
+func Test_LogoutAll_Error_InsufficientScope(t *testing.T) {
+	sessionToken := createScopedSessionToken(t, "1111111111", ScopeUpload)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "POST", "/user/1111111111/logout-all", headers)
+	expectErrorResponse(t, response, 403, STATUS_INSUFFICIENT_SCOPE)
+}
+
+func Test_LogoutAll_Error_NoPermissions(t *testing.T) {
+	sessionToken := createSessionToken(t, "abcdef1234", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{"view": clients.Allowed}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "POST", "/user/1111111111/logout-all", headers)
+	expectErrorResponse(t, response, 401, STATUS_UNAUTHORIZED)
+}
+
+func Test_LogoutAll_Error_UserNotFound(t *testing.T) {
+	sessionToken := createSessionToken(t, "shoreline", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{nil, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "POST", "/user/1111111111/logout-all", headers)
+	expectErrorResponse(t, response, 404, STATUS_USER_NOT_FOUND)
+}
+
+func Test_LogoutAll_Error_RemoveTokensError(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}}, nil}}
+	responsableStore.RemoveTokensForUserResponses = []error{errors.New("ERROR")}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "POST", "/user/1111111111/logout-all", headers)
+	expectErrorResponse(t, response, 500, STATUS_ERR_UPDATING_TOKEN)
+}
+
+func Test_LogoutAll_Success_Owner(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}}, nil}}
+	responsableStore.RemoveTokensForUserResponses = []error{nil}
+	mockNotifier.NotifySessionsRevokedResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "POST", "/user/1111111111/logout-all", headers)
+	expectSuccessResponse(t, response, 200)
+}
+
+func Test_LogoutAll_Success_Custodian_NotifyError(t *testing.T) {
+	sessionToken := createSessionToken(t, "abcdef1234", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{"custodian": clients.Allowed}, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}}, nil}}
+	responsableStore.RemoveTokensForUserResponses = []error{nil}
+	mockNotifier.NotifySessionsRevokedResponses = []error{errors.New("ERROR")}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "POST", "/user/1111111111/logout-all", headers)
+	expectSuccessResponse(t, response, 200)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+var fakeOidcConfig = OidcConfig{
+	Issuer:  "https://tidepool.test/auth",
+	Clients: []OidcClient{{ID: "app", RedirectURIs: []string{"https://app.test/callback"}}},
+}
+
+func oidcAuthorizeURL(params map[string]string) string {
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {"app"},
+		"redirect_uri":          {"https://app.test/callback"},
+		"scope":                 {"openid email"},
+		"state":                 {"xyz"},
+		"nonce":                 {"n-0S6_WzA2Mj"},
+		"code_challenge":        {pkceTestChallenge},
+		"code_challenge_method": {"S256"},
 	}
+	for key, value := range params {
+		query.Set(key, value)
+	}
+	return "/oauth/authorize?" + query.Encode()
+}
 
-	body, _ := ioutil.ReadAll(response.Body)
+func expectOidcRedirect(t *testing.T, response *httptest.ResponseRecorder) url.Values {
+	if response.Code != http.StatusFound {
+		t.Fatalf("Unexpected response status code: %d", response.Code)
+	}
+	location, err := url.Parse(response.Header().Get("Location"))
+	if err != nil || !strings.HasPrefix(location.String(), "https://app.test/callback?") {
+		t.Fatalf("Unexpected redirect location %q", response.Header().Get("Location"))
+	}
+	query := location.Query()
+	if query.Get("state") != "xyz" {
+		t.Fatalf("The redirect should carry the state, got %v", query)
+	}
+	return query
+}
 
-	if string(body) != `{"code":400,"reason":"Missing id and/or password"}` {
-		t.Fatalf("Message given [%s] expected [%s] ", string(body), STATUS_MISSING_ID_PW)
+func performOidcLoginRequest(t *testing.T, credentials map[string]string) *httptest.ResponseRecorder {
+	form := url.Values{}
+	for key, value := range credentials {
+		form.Set(key, value)
 	}
+	headers := http.Header{}
+	headers.Add("Content-Type", "application/x-www-form-urlencoded")
+	return performRequestBodyHeaders(t, "POST", oidcAuthorizeURL(nil), form.Encode(), headers)
 }
 
-func TestServerLogin_StatusBadRequest_WhenNoName(t *testing.T) {
-	request, _ := http.NewRequest("POST", "/", nil)
-	request.Header.Set(TP_SERVER_SECRET, theSecret)
-	response := httptest.NewRecorder()
+func expectOidcLoginForm(t *testing.T, response *httptest.ResponseRecorder, expectedCode int, expectedMessage string) string {
+	if response.Code != expectedCode {
+		t.Fatalf("Unexpected response status code: %d", response.Code)
+	}
+	if contentType := response.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/html") {
+		t.Fatalf("Unexpected content type %q", contentType)
+	}
+	if response.Header().Get("X-Frame-Options") != "DENY" {
+		t.Fatal("The login form must not be framed")
+	}
+	body := response.Body.String()
+	if expectedMessage != "" && !strings.Contains(body, html.EscapeString(expectedMessage)) {
+		t.Fatalf("The login form should show %q", expectedMessage)
+	}
+	return body
+}
 
-	shoreline.SetHandlers("", rtr)
+func performOidcTokenRequest(t *testing.T, params map[string]string) *httptest.ResponseRecorder {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {"app"},
+		"code":          {"code"},
+		"redirect_uri":  {"https://app.test/callback"},
+		"code_verifier": {pkceTestVerifier},
+	}
+	for key, value := range params {
+		form.Set(key, value)
+	}
+	headers := http.Header{}
+	headers.Add("Content-Type", "application/x-www-form-urlencoded")
+	return performRequestBodyHeaders(t, "POST", "/oauth/token", form.Encode(), headers)
+}
 
-	shoreline.ServerLogin(response, request)
+func expectOauthError(t *testing.T, response *httptest.ResponseRecorder, expectedCode int, expectedError string) {
+	if response.Code != expectedCode {
+		t.Fatalf("Unexpected response status code: %d", response.Code)
+	}
+	var oauthError oauthError
+	if err := json.NewDecoder(response.Body).Decode(&oauthError); err != nil {
+		t.Fatalf("Error decoding response: %v", err)
+	}
+	if oauthError.Error != expectedError {
+		t.Fatalf("Unexpected error %q, expected %q", oauthError.Error, expectedError)
+	}
+}
 
-	if response.Code != http.StatusBadRequest {
-		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusBadRequest, response.Code)
+func Test_GetOidcConfiguration_Disabled(t *testing.T) {
+	response := performRequest(t, "GET", "/.well-known/openid-configuration")
+	expectErrorResponse(t, response, 404, STATUS_OIDC_DISABLED)
+}
+
+func Test_GetOidcConfiguration_Success(t *testing.T) {
+	responsableShoreline.ApiConfig.Oidc = fakeOidcConfig
+	defer func() { responsableShoreline.ApiConfig.Oidc = OidcConfig{} }()
+
+	response := performRequest(t, "GET", "/.well-known/openid-configuration")
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	for key, value := range map[string]interface{}{
+		"issuer":                 "https://tidepool.test/auth",
+		"authorization_endpoint": "https://tidepool.test/auth/oauth/authorize",
+		"token_endpoint":         "https://tidepool.test/auth/oauth/token",
+		"userinfo_endpoint":      "https://tidepool.test/auth/userinfo",
+		"jwks_uri":               "https://tidepool.test/auth/.well-known/jwks.json",
+	} {
+		if successResponse[key] != value {
+			t.Fatalf("Unexpected %s %v, expected %v", key, successResponse[key], value)
+		}
 	}
+	expectEqualsArray(t, successResponse["code_challenge_methods_supported"].([]interface{}), []interface{}{"S256"})
+	expectEqualsArray(t, successResponse["id_token_signing_alg_values_supported"].([]interface{}), []interface{}{"RS256"})
+}
 
-	body, _ := ioutil.ReadAll(response.Body)
+func Test_OidcAuthorize_Error_UnknownClient(t *testing.T) {
+	responsableShoreline.ApiConfig.Oidc = fakeOidcConfig
+	defer func() { responsableShoreline.ApiConfig.Oidc = OidcConfig{} }()
 
-	if string(body) != `{"code":400,"reason":"Missing id and/or password"}` {
-		t.Fatalf("Message given [%s] expected [%s] ", string(body), STATUS_MISSING_ID_PW)
+	response := performRequest(t, "GET", oidcAuthorizeURL(map[string]string{"client_id": "other"}))
+	expectErrorResponse(t, response, 400, STATUS_INVALID_OIDC_CLIENT)
+}
+
+func Test_OidcAuthorize_Error_UnregisteredRedirectURI(t *testing.T) {
+	responsableShoreline.ApiConfig.Oidc = fakeOidcConfig
+	defer func() { responsableShoreline.ApiConfig.Oidc = OidcConfig{} }()
+
+	response := performRequest(t, "GET", oidcAuthorizeURL(map[string]string{"redirect_uri": "https://evil.test/callback"}))
+	expectErrorResponse(t, response, 400, STATUS_INVALID_OIDC_CLIENT)
+}
+
+func Test_OidcAuthorize_Success_LoginForm(t *testing.T) {
+	responsableShoreline.ApiConfig.Oidc = fakeOidcConfig
+	defer func() { responsableShoreline.ApiConfig.Oidc = OidcConfig{} }()
+
+	response := performRequest(t, "GET", oidcAuthorizeURL(nil))
+	body := expectOidcLoginForm(t, response, 200, "")
+	for _, expected := range []string{`action="authorize"`, `name="password"`, `name="code_challenge" value="` + pkceTestChallenge + `"`, `name="state" value="xyz"`} {
+		if !strings.Contains(body, expected) {
+			t.Fatalf("The login form should contain %s", expected)
+		}
 	}
 }
 
-func TestServerLogin_StatusBadRequest_WhenNoSecret(t *testing.T) {
-	request, _ := http.NewRequest("POST", "/", nil)
-	request.Header.Set(TP_SERVER_NAME, "shoreline")
-	response := httptest.NewRecorder()
+func Test_OidcAuthorize_Error_LoginForm_MissingCredentials(t *testing.T) {
+	responsableShoreline.ApiConfig.Oidc = fakeOidcConfig
+	defer func() { responsableShoreline.ApiConfig.Oidc = OidcConfig{} }()
 
-	shoreline.SetHandlers("", rtr)
+	response := performOidcLoginRequest(t, map[string]string{"username": "a@z.co"})
+	expectOidcLoginForm(t, response, 400, oidcLoginMissingCredentials)
+}
 
-	shoreline.ServerLogin(response, request)
+func Test_OidcAuthorize_Error_LoginForm_WrongPassword(t *testing.T) {
+	responsableShoreline.ApiConfig.Oidc = fakeOidcConfig
+	defer func() { responsableShoreline.ApiConfig.Oidc = OidcConfig{} }()
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{{Id: "1111111111", Username: "a@z.co", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", EmailVerified: true}}, nil}}
+	responsableStore.IncrementFailedLoginsResponses = []IncrementFailedLoginsResponse{{1, nil}}
+	defer expectResponsablesEmpty(t)
 
-	if response.Code != http.StatusBadRequest {
-		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusBadRequest, response.Code)
+	response := performOidcLoginRequest(t, map[string]string{"username": "a@z.co", "password": "MISMATCH"})
+	body := expectOidcLoginForm(t, response, 401, oidcLoginWrongCredentials)
+	if !strings.Contains(body, `value="a@z.co"`) {
+		t.Fatal("The login form should keep the username")
 	}
+}
 
-	body, _ := ioutil.ReadAll(response.Body)
+func Test_OidcAuthorize_Error_LoginForm_Locked(t *testing.T) {
+	responsableShoreline.ApiConfig.Oidc = fakeOidcConfig
+	defer func() { responsableShoreline.ApiConfig.Oidc = OidcConfig{} }()
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{{Id: "1111111111", Username: "a@z.co", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", EmailVerified: true, FailedLogins: 10, LockedUntil: time.Now().Add(time.Minute)}}, nil}}
+	defer expectResponsablesEmpty(t)
 
-	if string(body) != `{"code":400,"reason":"Missing id and/or password"}` {
-		t.Fatalf("Message given [%s] expected [%s] ", string(body), STATUS_MISSING_ID_PW)
+	response := performOidcLoginRequest(t, map[string]string{"username": "a@z.co", "password": "password"})
+	expectOidcLoginForm(t, response, 423, STATUS_ACCOUNT_LOCKED)
+}
+
+func Test_OidcAuthorize_Error_LoginForm_CodeRequired(t *testing.T) {
+	responsableShoreline.ApiConfig.Oidc = fakeOidcConfig
+	defer func() { responsableShoreline.ApiConfig.Oidc = OidcConfig{} }()
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{{Id: "1111111111", Username: "a@z.co", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", EmailVerified: true, Mfa: &MfaSettings{Secret: "ABCDEF", Enabled: true}}}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	response := performOidcLoginRequest(t, map[string]string{"username": "a@z.co", "password": "password"})
+	expectOidcLoginForm(t, response, 401, oidcLoginCodeRequired)
+}
+
+func Test_OidcAuthorize_Success_LoginForm_Credentials(t *testing.T) {
+	responsableShoreline.ApiConfig.Oidc = fakeOidcConfig
+	defer func() { responsableShoreline.ApiConfig.Oidc = OidcConfig{} }()
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{{Id: "1111111111", Username: "a@z.co", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", EmailVerified: true}}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableStore.AddAuthorizationCodeResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	response := performOidcLoginRequest(t, map[string]string{"username": "a@z.co", "password": "password"})
+	if query := expectOidcRedirect(t, response); query.Get("code") == "" || query.Get("error") != "" {
+		t.Fatalf("Unexpected redirect parameters %v", query)
 	}
 }
 
-func TestServerLogin_StatusOK(t *testing.T) {
-	request, _ := http.NewRequest("POST", "/serverlogin", nil)
-	request.Header.Set(TP_SERVER_NAME, "shoreline")
-	request.Header.Set(TP_SERVER_SECRET, theSecret)
+func Test_OidcAuthorize_Error_LoginForm_AccessTokenCannotChangeAccount(t *testing.T) {
+	responsableShoreline.ApiConfig.Oidc = fakeOidcConfig
+	defer func() { responsableShoreline.ApiConfig.Oidc = OidcConfig{} }()
+	responsableStore.AddedAuthorizationCodes = nil
+	defer func() { responsableStore.AddedAuthorizationCodes = nil }()
+	user := &User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", EmailVerified: true}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{user}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableStore.AddAuthorizationCodeResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	response := performOidcLoginRequest(t, map[string]string{"username": "a@z.co", "password": "password"})
+	query := expectOidcRedirect(t, response)
+	if len(responsableStore.AddedAuthorizationCodes) != 1 {
+		t.Fatalf("Expected one authorization code, got %d", len(responsableStore.AddedAuthorizationCodes))
+	}
+	responsableStore.ConsumeAuthorizationCodeResponses = []ConsumeAuthorizationCodeResponse{{responsableStore.AddedAuthorizationCodes[0], nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{user, nil}}
+	responsableStore.AddTokenResponses = []error{nil}
+	response = performOidcTokenRequest(t, map[string]string{"code": query.Get("code")})
+	accessToken := expectSuccessResponseWithJSONMap(t, response, 200)["access_token"].(string)
+
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	sessionToken.ID = accessToken
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, accessToken)
+	response = performRequestBodyHeaders(t, "PUT", "/user/1111111111", `{"updates": {"password": "n3wP4ssw0rd!"}}`, headers)
+	expectErrorResponse(t, response, 403, STATUS_INSUFFICIENT_SCOPE)
+}
+
+func Test_OidcAuthorize_Error_ScopedSessionCannotRead(t *testing.T) {
+	responsableShoreline.ApiConfig.Oidc = fakeOidcConfig
+	defer func() { responsableShoreline.ApiConfig.Oidc = OidcConfig{} }()
+	sessionToken := createScopedSessionToken(t, "1111111111", ScopeUpload)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", oidcAuthorizeURL(nil), headers)
+	if query := expectOidcRedirect(t, response); query.Get("error") != "access_denied" || query.Get("code") != "" {
+		t.Fatalf("Unexpected redirect parameters %v", query)
+	}
+}
+
+func Test_OidcAuthorize_Error_MissingCodeChallenge(t *testing.T) {
+	responsableShoreline.ApiConfig.Oidc = fakeOidcConfig
+	defer func() { responsableShoreline.ApiConfig.Oidc = OidcConfig{} }()
+
+	response := performRequest(t, "GET", oidcAuthorizeURL(map[string]string{"code_challenge_method": "plain"}))
+	query := expectOidcRedirect(t, response)
+	if query.Get("error") != "invalid_request" || query.Get("code") != "" {
+		t.Fatalf("Unexpected redirect parameters %v", query)
+	}
+}
+
+func Test_OidcAuthorize_Error_MissingOpenIDScope(t *testing.T) {
+	responsableShoreline.ApiConfig.Oidc = fakeOidcConfig
+	defer func() { responsableShoreline.ApiConfig.Oidc = OidcConfig{} }()
+
+	response := performRequest(t, "GET", oidcAuthorizeURL(map[string]string{"scope": "email"}))
+	if query := expectOidcRedirect(t, response); query.Get("error") != "invalid_scope" {
+		t.Fatalf("Unexpected redirect parameters %v", query)
+	}
+}
+
+func Test_OidcAuthorize_Success(t *testing.T) {
+	responsableShoreline.ApiConfig.Oidc = fakeOidcConfig
+	defer func() { responsableShoreline.ApiConfig.Oidc = OidcConfig{} }()
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}}, nil}}
+	responsableStore.AddAuthorizationCodeResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", oidcAuthorizeURL(map[string]string{"scope": "openid email offline_access"}), headers)
+	if query := expectOidcRedirect(t, response); query.Get("code") == "" || query.Get("error") != "" {
+		t.Fatalf("Unexpected redirect parameters %v", query)
+	}
+}
+
+func Test_OidcAuthorize_Success_ScopedSession(t *testing.T) {
+	sessionToken := createScopedSessionToken(t, "1111111111", ScopeUpload)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	request, _ := http.NewRequest("GET", oidcAuthorizeURL(nil), nil)
 	response := httptest.NewRecorder()
+	user, scopes := responsableShoreline.authenticateOidcAuthorization(response, request, fakeOidcConfig.Client("app"), sessionToken.ID)
+	if user == nil || !reflect.DeepEqual(scopes, []string{ScopeUpload}) {
+		t.Fatalf("The authorization should keep the scopes of the session, got %v %v", user, scopes)
+	}
+}
 
-	shoreline.SetHandlers("", rtr)
+func Test_OidcToken_Error_UnsupportedGrantType(t *testing.T) {
+	responsableShoreline.ApiConfig.Oidc = fakeOidcConfig
+	defer func() { responsableShoreline.ApiConfig.Oidc = OidcConfig{} }()
+
+	response := performOidcTokenRequest(t, map[string]string{"grant_type": "password"})
+	expectOauthError(t, response, 400, "unsupported_grant_type")
+}
+
+func Test_OidcToken_Error_UnknownClient(t *testing.T) {
+	responsableShoreline.ApiConfig.Oidc = fakeOidcConfig
+	defer func() { responsableShoreline.ApiConfig.Oidc = OidcConfig{} }()
+
+	response := performOidcTokenRequest(t, map[string]string{"client_id": "other"})
+	expectOauthError(t, response, 401, "invalid_client")
+}
+
+func Test_OidcToken_Error_InvalidCode(t *testing.T) {
+	responsableShoreline.ApiConfig.Oidc = fakeOidcConfig
+	defer func() { responsableShoreline.ApiConfig.Oidc = OidcConfig{} }()
+	responsableStore.ConsumeAuthorizationCodeResponses = []ConsumeAuthorizationCodeResponse{{nil, nil}}
+	defer expectResponsablesEmpty(t)
+
+	response := performOidcTokenRequest(t, nil)
+	expectOauthError(t, response, 400, "invalid_grant")
+}
+
+func Test_OidcToken_Error_RedirectURIMismatch(t *testing.T) {
+	responsableShoreline.ApiConfig.Oidc = fakeOidcConfig
+	defer func() { responsableShoreline.ApiConfig.Oidc = OidcConfig{} }()
+	code, value, _ := NewAuthorizationCode("app", "1111111111", "https://app.test/callback", "openid", nil, "", pkceTestChallenge, 60)
+	responsableStore.ConsumeAuthorizationCodeResponses = []ConsumeAuthorizationCodeResponse{{code, nil}}
+	defer expectResponsablesEmpty(t)
+
+	response := performOidcTokenRequest(t, map[string]string{"code": value, "redirect_uri": "https://app.test/other"})
+	expectOauthError(t, response, 400, "invalid_grant")
+}
+
+func Test_OidcToken_Error_CodeVerifierMismatch(t *testing.T) {
+	responsableShoreline.ApiConfig.Oidc = fakeOidcConfig
+	defer func() { responsableShoreline.ApiConfig.Oidc = OidcConfig{} }()
+	code, value, _ := NewAuthorizationCode("app", "1111111111", "https://app.test/callback", "openid", nil, "", pkceTestChallenge, 60)
+	responsableStore.ConsumeAuthorizationCodeResponses = []ConsumeAuthorizationCodeResponse{{code, nil}}
+	defer expectResponsablesEmpty(t)
+
+	response := performOidcTokenRequest(t, map[string]string{"code": value, "code_verifier": strings.Repeat("a", 43)})
+	expectOauthError(t, response, 400, "invalid_grant")
+}
+
+func Test_OidcToken_Error_ConsumeError(t *testing.T) {
+	responsableShoreline.ApiConfig.Oidc = fakeOidcConfig
+	defer func() { responsableShoreline.ApiConfig.Oidc = OidcConfig{} }()
+	responsableStore.ConsumeAuthorizationCodeResponses = []ConsumeAuthorizationCodeResponse{{nil, errors.New("ERROR")}}
+	defer expectResponsablesEmpty(t)
+
+	response := performOidcTokenRequest(t, nil)
+	expectOauthError(t, response, 500, "server_error")
+}
+
+func Test_OidcToken_Success(t *testing.T) {
+	responsableShoreline.ApiConfig.Oidc = fakeOidcConfig
+	defer func() { responsableShoreline.ApiConfig.Oidc = OidcConfig{} }()
+	code, value, _ := NewAuthorizationCode("app", "1111111111", "https://app.test/callback", "openid email", nil, "n-0S6_WzA2Mj", pkceTestChallenge, 60)
+	responsableStore.ConsumeAuthorizationCodeResponses = []ConsumeAuthorizationCodeResponse{{code, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, EmailVerified: true}, nil}}
+	responsableStore.AddTokenResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	response := performOidcTokenRequest(t, map[string]string{"code": value})
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	if response.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("The token response must not be cached")
+	}
+	if successResponse["token_type"] != "Bearer" || successResponse["scope"] != "openid email" {
+		t.Fatalf("Unexpected token response %v", successResponse)
+	}
+
+	if tokenData, err := UnpackSessionTokenAndVerify(successResponse["access_token"].(string), fakeConfig.TokenConfigs...); err != nil || tokenData.UserId != "1111111111" {
+		t.Fatalf("The access token should be a session token of the user, got %v %v", tokenData, err)
+	}
+	verifier := fakeConfig.TokenConfigs[0]
+	verifier.Issuer, verifier.Audience = "https://tidepool.test/auth", "app"
+	idToken, err := newKeyRing(t, verifier).verify(successResponse["id_token"].(string))
+	if err != nil {
+		t.Fatalf("Error verifying ID token: %v", err)
+	}
+	claims := idToken.Claims.(jwt.MapClaims)
+	if claims["iss"] != "https://tidepool.test/auth" || claims["aud"] != "app" || claims["sub"] != "1111111111" || claims["nonce"] != "n-0S6_WzA2Mj" || claims["email"] != "a@z.co" {
+		t.Fatalf("Unexpected ID token claims %v", claims)
+	}
+}
 
-	shoreline.ServerLogin(response, request)
+func Test_OidcToken_Success_Scopes(t *testing.T) {
+	responsableShoreline.ApiConfig.Oidc = fakeOidcConfig
+	defer func() { responsableShoreline.ApiConfig.Oidc = OidcConfig{} }()
+	code, value, _ := NewAuthorizationCode("app", "1111111111", "https://app.test/callback", "openid", []string{ScopeUpload}, "", pkceTestChallenge, 60)
+	responsableStore.ConsumeAuthorizationCodeResponses = []ConsumeAuthorizationCodeResponse{{code, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, EmailVerified: true}, nil}}
+	responsableStore.AddTokenResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
 
-	if response.Code != http.StatusOK {
-		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusOK, response.Code)
+	response := performOidcTokenRequest(t, map[string]string{"code": value})
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	tokenData, err := UnpackSessionTokenAndVerify(successResponse["access_token"].(string), fakeConfig.TokenConfigs...)
+	if err != nil {
+		t.Fatalf("Error unpacking access token: %v", err)
 	}
+	if !reflect.DeepEqual(tokenData.Scopes, []string{ScopeUpload}) {
+		t.Fatalf("The access token should keep the scopes of the authorization code, got %v", tokenData.Scopes)
+	}
+}
 
-	if response.Header().Get(TP_SESSION_TOKEN) == "" {
-		t.Fatal("The session token should have been set")
+func performClientCredentialsRequest(t *testing.T, form url.Values, clientID string, secret string) *httptest.ResponseRecorder {
+	form.Set("grant_type", "client_credentials")
+	headers := http.Header{}
+	headers.Add("Content-Type", "application/x-www-form-urlencoded")
+	if clientID != "" {
+		headers.Add("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(url.QueryEscape(clientID)+":"+url.QueryEscape(secret))))
 	}
+	return performRequestBodyHeaders(t, "POST", "/oauth/token", form.Encode(), headers)
+}
 
+func Test_OauthToken_ClientCredentials_Error_UnknownClient(t *testing.T) {
+	response := performClientCredentialsRequest(t, url.Values{}, "data", "secret")
+	expectOauthError(t, response, 401, "invalid_client")
+	if response.Header().Get("WWW-Authenticate") == "" {
+		t.Fatalf("Missing expected WWW-Authenticate header")
+	}
 }
 
-func TestServerLogin_Failure(t *testing.T) {
-	req, _ := http.NewRequest("POST", "/", nil)
-	req.Header.Set(TP_SERVER_NAME, "shoreline")
-	req.Header.Set(TP_SERVER_SECRET, theSecret)
-	resp := httptest.NewRecorder()
+func Test_OauthToken_ClientCredentials_Error_WrongSecret(t *testing.T) {
+	responsableShoreline.ApiConfig.ServiceClients = []ServiceClient{createServiceClient(t, "data", "secret", "users:read")}
+	defer func() { responsableShoreline.ApiConfig.ServiceClients = nil }()
 
-	shorelineFails.SetHandlers("", rtr)
+	response := performClientCredentialsRequest(t, url.Values{}, "data", "wrong")
+	expectOauthError(t, response, 401, "invalid_client")
+}
 
-	shorelineFails.ServerLogin(resp, req)
+func Test_OauthToken_ClientCredentials_Error_InvalidScope(t *testing.T) {
+	responsableShoreline.ApiConfig.ServiceClients = []ServiceClient{createServiceClient(t, "data", "secret", "users:read")}
+	defer func() { responsableShoreline.ApiConfig.ServiceClients = nil }()
 
-	if resp.Code != http.StatusInternalServerError {
-		t.Fatalf("Expected [%v] and got [%v]", http.StatusInternalServerError, resp.Code)
-	}
+	response := performClientCredentialsRequest(t, url.Values{"scope": {"users:write"}}, "data", "secret")
+	expectOauthError(t, response, 400, "invalid_scope")
 }
 
-func TestServerLogin_StatusUnauthorized_WhenSecretWrong(t *testing.T) {
-	request, _ := http.NewRequest("POST", "/", nil)
-	request.Header.Set(TP_SERVER_NAME, "shoreline")
-	request.Header.Set(TP_SERVER_SECRET, "wrong secret")
-	response := httptest.NewRecorder()
+func Test_OauthToken_ClientCredentials_Error_AddTokenError(t *testing.T) {
+	responsableShoreline.ApiConfig.ServiceClients = []ServiceClient{createServiceClient(t, "data", "secret", "users:read")}
+	defer func() { responsableShoreline.ApiConfig.ServiceClients = nil }()
+	responsableStore.AddTokenResponses = []error{errors.New("ERROR")}
+	defer expectResponsablesEmpty(t)
 
-	shoreline.SetHandlers("", rtr)
+	response := performClientCredentialsRequest(t, url.Values{}, "data", "secret")
+	expectOauthError(t, response, 500, "server_error")
+}
 
-	shoreline.ServerLogin(response, request)
+func Test_OauthToken_ClientCredentials_Success(t *testing.T) {
+	responsableShoreline.ApiConfig.ServiceClients = []ServiceClient{createServiceClient(t, "data", "s3cret:&", "users:read", "users:write")}
+	defer func() { responsableShoreline.ApiConfig.ServiceClients = nil }()
+	responsableStore.AddTokenResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
 
-	if response.Code != http.StatusUnauthorized {
-		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusUnauthorized, response.Code)
+	response := performClientCredentialsRequest(t, url.Values{"scope": {"users:read"}}, "data", "s3cret:&")
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	if successResponse["token_type"] != "Bearer" || successResponse["scope"] != "users:read" {
+		t.Fatalf("Unexpected token response %v", successResponse)
+	}
+	if _, ok := successResponse["id_token"]; ok {
+		t.Fatalf("Unexpected ID token in %v", successResponse)
 	}
 
-	body, _ := ioutil.ReadAll(response.Body)
-
-	if string(body) != `{"code":401,"reason":"Wrong password"}` {
-		t.Fatalf("Message given [%s] expected [%s] ", string(body), STATUS_PW_WRONG)
+	tokenData, err := UnpackSessionTokenAndVerify(successResponse["access_token"].(string), fakeConfig.TokenConfigs...)
+	if err != nil {
+		t.Fatalf("Error unpacking access token: %v", err)
+	}
+	if !tokenData.IsServer || tokenData.UserId != "data" || tokenData.ClientID != "data" || !reflect.DeepEqual(tokenData.Scopes, []string{"users:read"}) {
+		t.Fatalf("The access token should be a server token of the client, got %#v", tokenData)
 	}
 }
 
-////////////////////////////////////////////////////////////////////////////////
+func Test_OauthToken_ClientCredentials_Success_FormAuthentication(t *testing.T) {
+	responsableShoreline.ApiConfig.ServiceClients = []ServiceClient{createServiceClient(t, "data", "secret", "users:read")}
+	defer func() { responsableShoreline.ApiConfig.ServiceClients = nil }()
+	responsableStore.AddTokenResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
 
-func TestRefreshSession_StatusUnauthorized_WithNoToken(t *testing.T) {
-	request, _ := http.NewRequest("GET", "/", nil)
-	response := httptest.NewRecorder()
+	response := performClientCredentialsRequest(t, url.Values{"client_id": {"data"}, "client_secret": {"secret"}}, "", "")
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	if successResponse["scope"] != "users:read" {
+		t.Fatalf("Unexpected token response %v", successResponse)
+	}
+}
 
-	shoreline.SetHandlers("", rtr)
+func Test_ServerLogin_Error_LegacyDisabled(t *testing.T) {
+	responsableShoreline.ApiConfig.DisableLegacyServerLogin = true
+	defer func() { responsableShoreline.ApiConfig.DisableLegacyServerLogin = false }()
 
-	shoreline.RefreshSession(response, request)
+	headers := http.Header{}
+	headers.Add(TP_SERVER_NAME, "shoreline")
+	headers.Add(TP_SERVER_SECRET, theSecret)
+	response := performRequestHeaders(t, "POST", "/serverlogin", headers)
+	expectErrorResponse(t, response, 403, STATUS_SERVER_LOGIN_DISABLED)
+}
 
-	if response.Code != http.StatusUnauthorized {
-		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusUnauthorized, response.Code)
+func performIntrospectionRequest(t *testing.T, token string, headers http.Header) *httptest.ResponseRecorder {
+	headers.Add("Content-Type", "application/x-www-form-urlencoded")
+	return performRequestBodyHeaders(t, "POST", "/oauth/introspect", url.Values{"token": {token}}.Encode(), headers)
+}
+
+func Test_IntrospectToken_Error_NoCaller(t *testing.T) {
+	response := performIntrospectionRequest(t, "token", http.Header{})
+	expectOauthError(t, response, 401, "invalid_client")
+	if response.Header().Get("WWW-Authenticate") == "" {
+		t.Fatalf("Missing expected WWW-Authenticate header")
 	}
 }
 
-func TestRefreshSession_StatusUnauthorized_WithWrongToken(t *testing.T) {
-	request, _ := http.NewRequest("GET", "/", nil)
-	request.Header.Set(TP_SESSION_TOKEN, "not this token")
-	response := httptest.NewRecorder()
+func Test_IntrospectToken_Error_UserCaller(t *testing.T) {
+	callerToken := createSessionToken(t, "abc", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{callerToken, nil}}
+	defer expectResponsablesEmpty(t)
 
-	shoreline.SetHandlers("", rtr)
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, callerToken.ID)
+	response := performIntrospectionRequest(t, "token", headers)
+	expectOauthError(t, response, 401, "invalid_client")
+}
 
-	shoreline.RefreshSession(response, request)
+func Test_IntrospectToken_Error_InsufficientServiceScope(t *testing.T) {
+	responsableShoreline.ApiConfig.ServiceClients = []ServiceClient{createServiceClient(t, "data", "secret", ServiceScopeUsersRead)}
+	defer func() { responsableShoreline.ApiConfig.ServiceClients = nil }()
 
-	if response.Code != http.StatusUnauthorized {
-		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusUnauthorized, response.Code)
-	}
+	headers := http.Header{}
+	headers.Add("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("data:secret")))
+	response := performIntrospectionRequest(t, "token", headers)
+	expectOauthError(t, response, 401, "invalid_client")
 }
 
-func TestRefreshSession_StatusOK(t *testing.T) {
+func Test_IntrospectToken_Error_MissingToken(t *testing.T) {
+	responsableShoreline.ApiConfig.ServiceClients = []ServiceClient{createServiceClient(t, "data", "secret", "tokens:read")}
+	defer func() { responsableShoreline.ApiConfig.ServiceClients = nil }()
 
-	shoreline.SetHandlers("", rtr)
+	headers := http.Header{}
+	headers.Add("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("data:secret")))
+	response := performIntrospectionRequest(t, "", headers)
+	expectOauthError(t, response, 400, "invalid_request")
+}
 
-	refreshRequest, _ := http.NewRequest("GET", "/", nil)
-	refreshRequest.Header.Set(TP_SESSION_TOKEN, userToken.ID)
-	response := httptest.NewRecorder()
+func Test_IntrospectToken_Success_Inactive(t *testing.T) {
+	responsableShoreline.ApiConfig.ServiceClients = []ServiceClient{createServiceClient(t, "data", "secret", "tokens:read")}
+	defer func() { responsableShoreline.ApiConfig.ServiceClients = nil }()
+	sessionToken := createSessionToken(t, "abc", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{nil, errors.New("ERROR")}}
+	defer expectResponsablesEmpty(t)
 
-	shoreline.RefreshSession(response, refreshRequest)
+	headers := http.Header{}
+	headers.Add("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("data:secret")))
+	response := performIntrospectionRequest(t, sessionToken.ID, headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"active": false})
+}
 
-	if response.Code != http.StatusOK {
-		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusOK, response.Code)
-	}
+func Test_IntrospectToken_Success_Invalid(t *testing.T) {
+	serverToken := createSessionToken(t, "shoreline", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{serverToken, nil}}
+	defer expectResponsablesEmpty(t)
 
-	tokenString := response.Header().Get(TP_SESSION_TOKEN)
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, serverToken.ID)
+	response := performIntrospectionRequest(t, "not a token", headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"active": false})
+}
 
-	if tokenString == "" {
-		t.Fatal("A session token should have been returned")
+func Test_IntrospectToken_Success_Active(t *testing.T) {
+	serverToken := createSessionToken(t, "shoreline", true, tokenDuration)
+	sessionToken, err := CreateSessionToken(&TokenData{UserId: "abc", DurationSecs: tokenDuration, ClientID: "app", Scopes: []string{"openid", "profile"}}, fakeConfig.TokenConfigs[0])
+	if err != nil {
+		t.Fatalf("Error creating session token: %#v", err)
 	}
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{serverToken, nil}, {sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
 
-	if response.Body == nil {
-		t.Fatal("A Body should have been returned")
+	headers := http.Header{}
+	headers.Add("Authorization", "Bearer "+serverToken.ID)
+	response := performIntrospectionRequest(t, sessionToken.ID, headers)
+	if response.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("Unexpected Cache-Control header %q", response.Header().Get("Cache-Control"))
 	}
-
-	body, _ := ioutil.ReadAll(response.Body)
-
-	var tokenData TokenData
-	_ = json.Unmarshal(body, &tokenData)
-
-	if tokenData.UserId != user.Id {
-		t.Fatalf("should have had a user id of `%v` but was %v", user.Id, tokenData.UserId)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	if exp, iat := successResponse["exp"].(float64), successResponse["iat"].(float64); exp-iat != float64(tokenDuration) {
+		t.Fatalf("Unexpected token lifetime in %v", successResponse)
 	}
+	delete(successResponse, "exp")
+	delete(successResponse, "iat")
+	expectEqualsMap(t, successResponse, map[string]interface{}{
+		"active":     true,
+		"sub":        "abc",
+		"client_id":  "app",
+		"scope":      "openid profile",
+		"token_type": "Bearer",
+		"iss":        fakeConfig.TokenConfigs[0].Issuer,
+		"aud":        fakeConfig.TokenConfigs[0].Audience,
+		"isserver":   false,
+	})
 }
 
-func TestRefreshSession_Failure(t *testing.T) {
-
-	shorelineFails.SetHandlers("", rtr)
-
-	req, _ := http.NewRequest("GET", "/", nil)
-	req.Header.Set(TP_SESSION_TOKEN, userToken.ID)
-	resp := httptest.NewRecorder()
-
-	shorelineFails.RefreshSession(resp, req)
+func Test_OidcUserInfo_Error_MissingToken(t *testing.T) {
+	responsableShoreline.ApiConfig.Oidc = fakeOidcConfig
+	defer func() { responsableShoreline.ApiConfig.Oidc = OidcConfig{} }()
 
-	if resp.Code != http.StatusUnauthorized {
-		t.Fatalf("Expected [%v] and got [%v]", http.StatusUnauthorized, resp.Code)
+	response := performRequest(t, "GET", "/userinfo")
+	expectErrorResponse(t, response, 401, STATUS_NO_TOKEN)
+	if response.Header().Get("WWW-Authenticate") == "" {
+		t.Fatalf("Missing expected WWW-Authenticate header")
 	}
 }
 
-////////////////////////////////////////////////////////////////////////////////
+func Test_OidcUserInfo_Success(t *testing.T) {
+	responsableShoreline.ApiConfig.Oidc = fakeOidcConfig
+	defer func() { responsableShoreline.ApiConfig.Oidc = OidcConfig{} }()
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, EmailVerified: true, TermsAccepted: "2016-01-01T01:23:45-08:00"}, nil}}
+	defer expectResponsablesEmpty(t)
 
-func Test_LongTermLogin_Error_MissingAuthorization(t *testing.T) {
-	response := performRequest(t, "POST", "/login/thelongtermkey")
-	expectErrorResponse(t, response, 400, "Missing id and/or password")
+	headers := http.Header{}
+	headers.Add("Authorization", "Bearer "+sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/userinfo", headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{
+		"sub":                "1111111111",
+		"preferred_username": "a@z.co",
+		"email":              "a@z.co",
+		"emails":             []interface{}{"a@z.co"},
+		"email_verified":     true,
+		"terms_accepted":     "2016-01-01T01:23:45-08:00",
+	})
 }
 
-func Test_LongTermLogin_Error_EmptyAuthorization(t *testing.T) {
-	headers := http.Header{}
-	headers.Add("Authorization", "")
-	response := performRequestHeaders(t, "POST", "/login/thelongtermkey", headers)
-	expectErrorResponse(t, response, 400, "Missing id and/or password")
+////////////////////////////////////////////////////////////////////////////////
+
+func createSignedConfirmationToken(t *testing.T, purpose string, userID string) (*ConfirmationToken, string) {
+	confirmationToken, err := NewConfirmationToken(purpose, userID, "a@z.co", 3600)
+	if err != nil {
+		t.Fatalf("Error creating confirmation token: %#v", err)
+	}
+	signed, err := confirmationToken.Sign(responsableShoreline.keys())
+	if err != nil {
+		t.Fatalf("Error signing confirmation token: %#v", err)
+	}
+	return confirmationToken, signed
 }
 
-func Test_LongTermLogin_Error_InvalidAuthorization(t *testing.T) {
-	authorization := createAuthorization(t, "", "")
-	headers := http.Header{}
-	headers.Add("Authorization", authorization)
-	response := performRequestHeaders(t, "POST", "/login/thelongtermkey", headers)
-	expectErrorResponse(t, response, 400, "Missing id and/or password")
+func Test_RequestPasswordReset_Error_InvalidEmail(t *testing.T) {
+	response := performRequestBody(t, "POST", "/passwordreset", `{"email": "not an email"}`)
+	expectErrorResponse(t, response, 400, "Invalid user details were given")
 }
 
-func Test_LongTermLogin_Error_FindUsersError(t *testing.T) {
-	authorization := createAuthorization(t, "a@b.co", "password")
+func Test_RequestPasswordReset_Error_FindUsersError(t *testing.T) {
 	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, errors.New("ERROR")}}
 	defer expectResponsablesEmpty(t)
 
-	headers := http.Header{}
-	headers.Add("Authorization", authorization)
-	response := performRequestHeaders(t, "POST", "/login/thelongtermkey", headers)
+	response := performRequestBody(t, "POST", "/passwordreset", `{"email": "a@z.co"}`)
 	expectErrorResponse(t, response, 500, "Error finding user")
 }
 
-func Test_LongTermLogin_Error_FindUsersMissing(t *testing.T) {
-	authorization := createAuthorization(t, "a@b.co", "password")
+func Test_RequestPasswordReset_Success_UnknownEmail(t *testing.T) {
 	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
 	defer expectResponsablesEmpty(t)
 
-	headers := http.Header{}
-	headers.Add("Authorization", authorization)
-	response := performRequestHeaders(t, "POST", "/login/thelongtermkey", headers)
-	expectErrorResponse(t, response, 401, "No user matched the given details")
+	response := performRequestBody(t, "POST", "/passwordreset", `{"email": "a@z.co"}`)
+	expectSuccessResponse(t, response, 202)
 }
 
-func Test_LongTermLogin_Error_FindUsersNil(t *testing.T) {
-	authorization := createAuthorization(t, "a@b.co", "password")
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{nil}, nil}}
+func Test_RequestPasswordReset_Success_CustodialUser(t *testing.T) {
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}}}, nil}}
 	defer expectResponsablesEmpty(t)
 
-	headers := http.Header{}
-	headers.Add("Authorization", authorization)
-	response := performRequestHeaders(t, "POST", "/login/thelongtermkey", headers)
-	expectErrorResponse(t, response, 401, "No user matched the given details")
+	response := performRequestBody(t, "POST", "/passwordreset", `{"email": "a@z.co"}`)
+	expectSuccessResponse(t, response, 202)
 }
 
-func Test_LongTermLogin_Error_NoPassword(t *testing.T) {
-	authorization := createAuthorization(t, "a@b.co", "password")
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111"}}, nil}}
+func Test_RequestPasswordReset_Error_AddConfirmationTokenError(t *testing.T) {
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, PwHash: "xyz"}}, nil}}
+	responsableStore.RemoveConfirmationTokensForUserResponses = []error{nil}
+	responsableStore.AddConfirmationTokenResponses = []error{errors.New("ERROR")}
 	defer expectResponsablesEmpty(t)
 
-	headers := http.Header{}
-	headers.Add("Authorization", authorization)
-	response := performRequestHeaders(t, "POST", "/login/thelongtermkey", headers)
-	expectErrorResponse(t, response, 401, "No user matched the given details")
+	response := performRequestBody(t, "POST", "/passwordreset", `{"email": "a@z.co"}`)
+	expectErrorResponse(t, response, 500, "Error generating the token")
 }
 
-func Test_LongTermLogin_Error_PasswordMismatch(t *testing.T) {
-	authorization := createAuthorization(t, "a@b.co", "MISMATCH")
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5"}}, nil}}
+func Test_RequestPasswordReset_Error_NotifyError(t *testing.T) {
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, PwHash: "xyz"}}, nil}}
+	responsableStore.RemoveConfirmationTokensForUserResponses = []error{nil}
+	responsableStore.AddConfirmationTokenResponses = []error{nil}
+	mockNotifier.NotifyPasswordResetRequestedResponses = []error{errors.New("ERROR")}
 	defer expectResponsablesEmpty(t)
 
-	headers := http.Header{}
-	headers.Add("Authorization", authorization)
-	response := performRequestHeaders(t, "POST", "/login/thelongtermkey", headers)
-	expectErrorResponse(t, response, 401, "No user matched the given details")
+	response := performRequestBody(t, "POST", "/passwordreset", `{"email": "a@z.co"}`)
+	expectErrorResponse(t, response, 500, "Error sending email")
 }
 
-func Test_LongTermLogin_Error_EmailNotVerified(t *testing.T) {
-	authorization := createAuthorization(t, "a@b.co", "password")
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5"}}, nil}}
+func Test_RequestPasswordReset_Success(t *testing.T) {
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, PwHash: "xyz"}}, nil}}
+	responsableStore.RemoveConfirmationTokensForUserResponses = []error{nil}
+	responsableStore.AddConfirmationTokenResponses = []error{nil}
+	mockNotifier.NotifyPasswordResetRequestedResponses = []error{nil}
 	defer expectResponsablesEmpty(t)
 
-	headers := http.Header{}
-	headers.Add("Authorization", authorization)
-	response := performRequestHeaders(t, "POST", "/login/thelongtermkey", headers)
-	expectErrorResponse(t, response, 403, "The user hasn't verified this account yet")
+	response := performRequestBody(t, "POST", "/passwordreset", `{"email": "a@z.co"}`)
+	expectSuccessResponse(t, response, 202)
 }
 
-func Test_LongTermLogin_Error_ErrorCreatingToken(t *testing.T) {
-	authorization := createAuthorization(t, "a@b.co", "password")
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", EmailVerified: true}}, nil}}
-	responsableStore.AddTokenResponses = []error{errors.New("ERROR")}
+func Test_ConfirmPasswordReset_Error_InvalidPassword(t *testing.T) {
+	_, signed := createSignedConfirmationToken(t, ConfirmationPurposePasswordReset, "1111111111")
+	body := fmt.Sprintf(`{"token": "%s", "password": "short"}`, signed)
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, PwHash: "xyz"}, nil}}
 	defer expectResponsablesEmpty(t)
 
-	headers := http.Header{}
-	headers.Add("Authorization", authorization)
-	response := performRequestHeaders(t, "POST", "/login/thelongtermkey", headers)
-	expectErrorResponse(t, response, 500, "Error updating token")
+	response := performRequestBody(t, "POST", "/passwordreset/confirm", body)
+	expectPasswordRejections(t, response, PasswordRejectionTooShort)
 }
 
-func Test_LongTermLogin_Success(t *testing.T) {
-	authorization := createAuthorization(t, "a@b.co", "password")
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, TermsAccepted: "2016-01-01T01:23:45-08:00", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", EmailVerified: true}}, nil}}
-	responsableStore.AddTokenResponses = []error{nil}
+func Test_ConfirmPasswordReset_Error_InvalidToken(t *testing.T) {
+	response := performRequestBody(t, "POST", "/passwordreset/confirm", `{"token": "invalid", "password": "n3wP4ssw0rd"}`)
+	expectErrorResponse(t, response, 401, "The password reset token is invalid or has expired")
+}
+
+func Test_ConfirmPasswordReset_Error_WrongPurpose(t *testing.T) {
+	_, signed := createSignedConfirmationToken(t, "other_purpose", "1111111111")
+	body := fmt.Sprintf(`{"token": "%s", "password": "n3wP4ssw0rd"}`, signed)
+
+	response := performRequestBody(t, "POST", "/passwordreset/confirm", body)
+	expectErrorResponse(t, response, 401, "The password reset token is invalid or has expired")
+}
+
+func Test_ConfirmPasswordReset_Error_TokenAlreadyUsed(t *testing.T) {
+	_, signed := createSignedConfirmationToken(t, ConfirmationPurposePasswordReset, "1111111111")
+	body := fmt.Sprintf(`{"token": "%s", "password": "n3wP4ssw0rd"}`, signed)
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, PwHash: "xyz"}, nil}}
+	responsableStore.ConsumeConfirmationTokenResponses = []ConsumeConfirmationTokenResponse{{nil, nil}}
 	defer expectResponsablesEmpty(t)
 
-	headers := http.Header{}
-	headers.Add("Authorization", authorization)
-	response := performRequestHeaders(t, "POST", "/login/thelongtermkey", headers)
-	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
-	expectElementMatch(t, successResponse, "userid", `\A[0-9a-f]{10}\z`, true)
-	expectEqualsMap(t, successResponse, map[string]interface{}{"emailVerified": true, "emails": []interface{}{"a@z.co"}, "username": "a@z.co", "termsAccepted": "2016-01-01T01:23:45-08:00"})
-	if response.Header().Get(TP_SESSION_TOKEN) == "" {
-		t.Fatalf("Missing expected %s header", TP_SESSION_TOKEN)
+	response := performRequestBody(t, "POST", "/passwordreset/confirm", body)
+	expectErrorResponse(t, response, 401, "The password reset token is invalid or has expired")
+}
+
+func Test_ConfirmPasswordReset_Error_PasswordPolicy(t *testing.T) {
+	passwordPolicy, err := NewPasswordPolicy(PasswordPolicyConfig{MinCharacterClasses: 3})
+	if err != nil {
+		t.Fatalf("Unexpected error creating the password policy: %v", err)
 	}
+	responsableShoreline.passwordPolicy = passwordPolicy
+	defer func() { responsableShoreline.passwordPolicy = nil }()
+
+	_, signed := createSignedConfirmationToken(t, ConfirmationPurposePasswordReset, "1111111111")
+	body := fmt.Sprintf(`{"token": "%s", "password": "newpassword"}`, signed)
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, PwHash: "xyz"}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	response := performRequestBody(t, "POST", "/passwordreset/confirm", body)
+	expectPasswordRejections(t, response, PasswordRejectionCharacterClasses)
 }
 
-////////////////////////////////////////////////////////////////////////////////
+type unavailablePasswordPolicy struct{}
 
-func TestHasServerToken_True(t *testing.T) {
+func (unavailablePasswordPolicy) Check(password string, identifiers ...string) ([]PasswordRejection, error) {
+	return nil, errors.New("ERROR")
+}
 
-	shoreline.SetHandlers("", rtr)
+func Test_ConfirmPasswordReset_Error_PasswordPolicyUnavailable(t *testing.T) {
+	responsableShoreline.passwordPolicy = unavailablePasswordPolicy{}
+	defer func() { responsableShoreline.passwordPolicy = nil }()
 
-	//login as server
-	svrLoginRequest, _ := http.NewRequest("POST", "/", nil)
-	svrLoginRequest.Header.Set(TP_SERVER_NAME, "shoreline")
-	svrLoginRequest.Header.Set(TP_SERVER_SECRET, theSecret)
-	response := httptest.NewRecorder()
+	_, signed := createSignedConfirmationToken(t, ConfirmationPurposePasswordReset, "1111111111")
+	body := fmt.Sprintf(`{"token": "%s", "password": "n3wP4ssw0rd"}`, signed)
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, PwHash: "xyz"}, nil}}
+	defer expectResponsablesEmpty(t)
 
-	shoreline.ServerLogin(response, svrLoginRequest)
+	response := performRequestBody(t, "POST", "/passwordreset/confirm", body)
+	expectErrorResponse(t, response, 500, STATUS_ERR_CHECKING_PW)
+}
 
-	if response.Code != http.StatusOK {
-		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusOK, response.Code)
-	}
+func Test_ConfirmPasswordReset_Error_PasswordReused(t *testing.T) {
+	responsableShoreline.ApiConfig.PasswordHistorySize = 3
+	defer func() { responsableShoreline.ApiConfig.PasswordHistorySize = 0 }()
 
-	if response.Header().Get(TP_SESSION_TOKEN) == "" {
-		t.Fatal("The session token should have been set")
-	}
+	previousUser := createUserWithPassword(t, "n3wP4ssw0rd")
+	_, signed := createSignedConfirmationToken(t, ConfirmationPurposePasswordReset, "1111111111")
+	body := fmt.Sprintf(`{"token": "%s", "password": "n3wP4ssw0rd"}`, signed)
+	responsableStore.FindUserResponses = []FindUserResponse{{createUserWithPassword(t, "oldpassword"), nil}}
+	responsableStore.FindPasswordHistoryResponses = []FindPasswordHistoryResponse{{[]string{previousUser.PwHash}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	response := performRequestBody(t, "POST", "/passwordreset/confirm", body)
+	expectErrorResponse(t, response, 400, "The password has been used recently and cannot be reused")
+}
+
+func Test_ConfirmPasswordReset_Error_UpsertUserError(t *testing.T) {
+	resetToken, signed := createSignedConfirmationToken(t, ConfirmationPurposePasswordReset, "1111111111")
+	body := fmt.Sprintf(`{"token": "%s", "password": "n3wP4ssw0rd"}`, signed)
+	responsableStore.ConsumeConfirmationTokenResponses = []ConsumeConfirmationTokenResponse{{resetToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, PwHash: "xyz"}, nil}}
+	responsableStore.UpsertUserResponses = []error{errors.New("ERROR")}
+	defer expectResponsablesEmpty(t)
+
+	response := performRequestBody(t, "POST", "/passwordreset/confirm", body)
+	expectErrorResponse(t, response, 500, "Error updating password")
+}
+
+func Test_ConfirmPasswordReset_Success(t *testing.T) {
+	resetToken, signed := createSignedConfirmationToken(t, ConfirmationPurposePasswordReset, "1111111111")
+	body := fmt.Sprintf(`{"token": "%s", "password": "n3wP4ssw0rd"}`, signed)
+	responsableStore.ConsumeConfirmationTokenResponses = []ConsumeConfirmationTokenResponse{{resetToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, PwHash: "xyz"}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableStore.RemoveTokensForUserResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	response := performRequestBody(t, "POST", "/passwordreset/confirm", body)
+	expectSuccessResponse(t, response, 200)
+}
 
-	if hasServerToken(response.Header().Get(TP_SESSION_TOKEN), shoreline.ApiConfig.TokenConfigs[0]) == false {
-		t.Fatal("The token should have been a valid server token")
-	}
+func Test_ConfirmPasswordReset_Success_ResetsFailedLogins(t *testing.T) {
+	resetToken, signed := createSignedConfirmationToken(t, ConfirmationPurposePasswordReset, "1111111111")
+	body := fmt.Sprintf(`{"token": "%s", "password": "n3wP4ssw0rd"}`, signed)
+	lockedUser := &User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, PwHash: "xyz", FailedLogins: 5, LockedUntil: time.Now().Add(time.Hour)}
+	responsableStore.ConsumeConfirmationTokenResponses = []ConsumeConfirmationTokenResponse{{resetToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{lockedUser, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableStore.RemoveTokensForUserResponses = []error{nil}
+	responsableStore.ResetFailedLoginsResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	response := performRequestBody(t, "POST", "/passwordreset/confirm", body)
+	expectSuccessResponse(t, response, 200)
 }
 
-func TestServerCheckToken_StatusOK(t *testing.T) {
+func Test_ConfirmPasswordReset_Success_PasswordHistory(t *testing.T) {
+	responsableShoreline.ApiConfig.PasswordHistorySize = 3
+	defer func() { responsableShoreline.ApiConfig.PasswordHistorySize = 0 }()
 
-	//the api
+	resetToken, signed := createSignedConfirmationToken(t, ConfirmationPurposePasswordReset, "1111111111")
+	body := fmt.Sprintf(`{"token": "%s", "password": "n3wP4ssw0rd"}`, signed)
+	responsableStore.FindUserResponses = []FindUserResponse{{createUserWithPassword(t, "oldpassword"), nil}}
+	responsableStore.FindPasswordHistoryResponses = []FindPasswordHistoryResponse{{[]string{}, nil}}
+	responsableStore.ConsumeConfirmationTokenResponses = []ConsumeConfirmationTokenResponse{{resetToken, nil}}
+	responsableStore.AddPasswordHistoryResponses = []error{nil}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableStore.RemoveTokensForUserResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
 
-	shoreline.SetHandlers("", rtr)
+	response := performRequestBody(t, "POST", "/passwordreset/confirm", body)
+	expectSuccessResponse(t, response, 200)
+}
 
-	//step 1 - login as server
-	request, _ := http.NewRequest("POST", "/serverlogin", nil)
-	request.Header.Set(TP_SERVER_NAME, "shoreline")
-	request.Header.Set(TP_SERVER_SECRET, theSecret)
-	response := httptest.NewRecorder()
+////////////////////////////////////////////////////////////////////////////////
 
-	shoreline.ServerLogin(response, request)
+func Test_ChangePassword_Error_MissingSessionToken(t *testing.T) {
+	response := performRequestBody(t, "POST", "/user/1111111111/password", `{"password": "oldpassword", "newPassword": "n3wP4ssw0rd"}`)
+	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
+}
 
-	svrTokenToUse := response.Header().Get(TP_SESSION_TOKEN)
+func Test_ChangePassword_Error_OtherUser(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
 
-	if svrTokenToUse == "" {
-		t.Fatalf("we expected to get a token back from login")
-	}
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/password", `{"password": "oldpassword", "newPassword": "n3wP4ssw0rd"}`, headers)
+	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
+}
 
-	//step 2 - do the check
-	checkTokenRequest, _ := http.NewRequest("GET", "/", nil)
-	checkTokenRequest.Header.Set(TP_SESSION_TOKEN, svrTokenToUse)
-	checkTokenResponse := httptest.NewRecorder()
+func Test_ChangePassword_Error_Server(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
 
-	shoreline.ServerCheckToken(checkTokenResponse, checkTokenRequest, map[string]string{"token": svrTokenToUse})
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/password", `{"password": "oldpassword", "newPassword": "n3wP4ssw0rd"}`, headers)
+	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
+}
 
-	if checkTokenResponse.Code != http.StatusOK {
-		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusOK, checkTokenResponse.Code)
-	}
+func Test_ChangePassword_Error_Impersonated(t *testing.T) {
+	sessionToken := createImpersonationToken(t, "1111111111", "support@tidepool.org")
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
 
-	if checkTokenResponse.Header().Get("content-type") != "application/json" {
-		t.Fatal("the resp should be json")
-	}
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/password", `{"password": "oldpassword", "newPassword": "n3wP4ssw0rd"}`, headers)
+	expectErrorResponse(t, response, 403, "The operation is not allowed while impersonating the user")
+}
 
-	body, _ := ioutil.ReadAll(checkTokenResponse.Body)
+func Test_ChangePassword_Error_InsufficientScope(t *testing.T) {
+	sessionToken := createScopedSessionToken(t, "1111111111", ScopeUpload)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
 
-	var tokenData TokenData
-	_ = json.Unmarshal(body, &tokenData)
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/password", `{"password": "password", "newPassword": "n3wP4ssw0rd"}`, headers)
+	expectErrorResponse(t, response, 403, STATUS_INSUFFICIENT_SCOPE)
+}
 
-	t.Log("token data returned ", tokenData)
+func Test_ChangePassword_Error_MissingNewPassword(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
 
-	if tokenData.UserId != "shoreline" {
-		t.Fatalf("should have had a server id of `shoreline` but was %v", tokenData.UserId)
-	}
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/password", `{"password": "oldpassword"}`, headers)
+	expectErrorResponse(t, response, 400, "Invalid user details were given")
+}
 
-	if tokenData.IsServer != true {
-		t.Fatalf("should have been a server token but was %v", tokenData.IsServer)
-	}
+func Test_ChangePassword_Error_FindUserError(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{nil, errors.New("ERROR")}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/password", `{"password": "oldpassword", "newPassword": "n3wP4ssw0rd"}`, headers)
+	expectErrorResponse(t, response, 500, "Error finding user")
 }
 
-func TestServerCheckToken_StatusUnauthorized_WhenNoSvrToken(t *testing.T) {
+func Test_ChangePassword_Error_WrongPassword(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{createUserWithPassword(t, "oldpassword"), nil}}
+	responsableStore.IncrementFailedLoginsResponses = []IncrementFailedLoginsResponse{{1, nil}}
+	defer expectResponsablesEmpty(t)
 
-	//the api
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/password", `{"password": "wrongpassword", "newPassword": "n3wP4ssw0rd"}`, headers)
+	expectErrorResponse(t, response, 403, "Wrong password")
+}
 
-	shoreline.SetHandlers("", rtr)
+func Test_ChangePassword_Error_WrongPassword_LocksUser(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	user := createUserWithPassword(t, "oldpassword")
+	user.FailedLogins, user.LastFailedLoginTime = 9, time.Now().Add(-time.Hour)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{user, nil}}
+	responsableStore.IncrementFailedLoginsResponses = []IncrementFailedLoginsResponse{{10, nil}}
+	responsableStore.LockUserResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
 
-	request, _ := http.NewRequest("GET", "/", nil)
-	response := httptest.NewRecorder()
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/password", `{"password": "wrongpassword", "newPassword": "n3wP4ssw0rd"}`, headers)
+	expectErrorResponse(t, response, 403, "Wrong password")
+}
 
-	shoreline.ServerCheckToken(response, request, noParams)
+func Test_ChangePassword_Error_Locked(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	user := createUserWithPassword(t, "oldpassword")
+	user.FailedLogins, user.LockedUntil = 10, time.Now().Add(time.Minute)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{user, nil}}
+	defer expectResponsablesEmpty(t)
 
-	if response.Code != http.StatusUnauthorized {
-		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusUnauthorized, response.Code)
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/password", `{"password": "oldpassword", "newPassword": "n3wP4ssw0rd"}`, headers)
+	expectErrorResponse(t, response, 423, "The account is temporarily locked after too many failed logins")
+	if response.Header().Get("Retry-After") == "" {
+		t.Fatal("Retry-After header should be set for a locked account")
 	}
 }
 
-////////////////////////////////////////////////////////////////////////////////
+func Test_ChangePassword_Error_Backoff(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	user := createUserWithPassword(t, "oldpassword")
+	user.FailedLogins, user.LastFailedLoginTime = 5, time.Now()
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{user, nil}}
+	defer expectResponsablesEmpty(t)
 
-func TestCheckToken_StatusOK(t *testing.T) {
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/password", `{"password": "oldpassword", "newPassword": "n3wP4ssw0rd"}`, headers)
+	expectErrorResponse(t, response, 429, "Too many requests, try again later")
+}
 
-	//the api
+func Test_ChangePassword_Error_PasswordPolicy(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{createUserWithPassword(t, "oldpassword"), nil}}
+	defer expectResponsablesEmpty(t)
 
-	shoreline.SetHandlers("", rtr)
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/password", `{"password": "oldpassword", "newPassword": "short"}`, headers)
+	expectPasswordRejections(t, response, PasswordRejectionTooShort)
+}
 
-	//step 1 - login as server
-	request, _ := http.NewRequest("POST", "/serverlogin", nil)
-	request.Header.Set(TP_SERVER_NAME, "shoreline")
-	request.Header.Set(TP_SERVER_SECRET, theSecret)
-	response := httptest.NewRecorder()
+func Test_ChangePassword_Error_PasswordReused(t *testing.T) {
+	responsableShoreline.ApiConfig.PasswordHistorySize = 3
+	defer func() { responsableShoreline.ApiConfig.PasswordHistorySize = 0 }()
 
-	shoreline.ServerLogin(response, request)
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{createUserWithPassword(t, "oldpassword"), nil}}
+	defer expectResponsablesEmpty(t)
 
-	svrTokenToUse := response.Header().Get(TP_SESSION_TOKEN)
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/password", `{"password": "oldpassword", "newPassword": "oldpassword"}`, headers)
+	expectErrorResponse(t, response, 400, "The password has been used recently and cannot be reused")
+}
 
-	if svrTokenToUse == "" {
-		t.Fatalf("we expected to get a token back from login")
-	}
+func Test_ChangePassword_Error_UpsertUserError(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{createUserWithPassword(t, "oldpassword"), nil}}
+	responsableStore.UpsertUserResponses = []error{errors.New("ERROR")}
+	defer expectResponsablesEmpty(t)
 
-	//step 2 - do the check
-	checkTokenRequest, _ := http.NewRequest("GET", "/", nil)
-	checkTokenRequest.Header.Set(TP_SESSION_TOKEN, svrTokenToUse)
-	checkTokenResponse := httptest.NewRecorder()
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/password", `{"password": "oldpassword", "newPassword": "n3wP4ssw0rd"}`, headers)
+	expectErrorResponse(t, response, 500, "Error updating password")
+}
 
-	shoreline.CheckToken(checkTokenResponse, checkTokenRequest)
+func Test_ChangePassword_Error_RemoveTokensError(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{createUserWithPassword(t, "oldpassword"), nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableStore.RemoveTokensForUserExceptResponses = []error{errors.New("ERROR")}
+	defer expectResponsablesEmpty(t)
 
-	if checkTokenResponse.Code != http.StatusOK {
-		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusOK, checkTokenResponse.Code)
-	}
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/password", `{"password": "oldpassword", "newPassword": "n3wP4ssw0rd"}`, headers)
+	expectErrorResponse(t, response, 500, "Error updating password")
+}
 
-	if checkTokenResponse.Header().Get("content-type") != "application/json" {
-		t.Fatal("the resp should be json")
-	}
+func Test_ChangePassword_Success(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{createUserWithPassword(t, "oldpassword"), nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableStore.RemoveTokensForUserExceptResponses = []error{nil}
+	mockNotifier.NotifyPasswordChangedResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
 
-	body, _ := ioutil.ReadAll(checkTokenResponse.Body)
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/password", `{"password": "oldpassword", "newPassword": "n3wP4ssw0rd"}`, headers)
+	expectSuccessResponse(t, response, 200)
+}
 
-	var tokenData TokenData
-	_ = json.Unmarshal(body, &tokenData)
+func Test_ChangePassword_Success_ResetsFailedLogins(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	user := createUserWithPassword(t, "oldpassword")
+	user.FailedLogins, user.LastFailedLoginTime = 2, time.Now().Add(-time.Hour)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{user, nil}}
+	responsableStore.ResetFailedLoginsResponses = []error{nil}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableStore.RemoveTokensForUserExceptResponses = []error{nil}
+	mockNotifier.NotifyPasswordChangedResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
 
-	t.Log("token data returned ", tokenData)
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/password", `{"password": "oldpassword", "newPassword": "n3wP4ssw0rd"}`, headers)
+	expectSuccessResponse(t, response, 200)
+}
 
-	if tokenData.UserId != "shoreline" {
-		t.Fatalf("should have had a server id of `shoreline` but was %v", tokenData.UserId)
-	}
+func Test_ChangePassword_Success_NotifyError(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{createUserWithPassword(t, "oldpassword"), nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableStore.RemoveTokensForUserExceptResponses = []error{nil}
+	mockNotifier.NotifyPasswordChangedResponses = []error{errors.New("ERROR")}
+	defer expectResponsablesEmpty(t)
 
-	if tokenData.IsServer != true {
-		t.Fatalf("should have been a server token but was %v", tokenData.IsServer)
-	}
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/password", `{"password": "oldpassword", "newPassword": "n3wP4ssw0rd"}`, headers)
+	expectSuccessResponse(t, response, 200)
 }
 
-func TestCheckToken_StatusUnauthorized_WhenNoToken(t *testing.T) {
+////////////////////////////////////////////////////////////////////////////////
 
-	//the api
+func Test_ResendEmailVerification_Error_InvalidEmail(t *testing.T) {
+	response := performRequestBody(t, "POST", "/emailverification", `{"email": "not an email"}`)
+	expectErrorResponse(t, response, 400, "Invalid user details were given")
+}
 
-	shoreline.SetHandlers("", rtr)
+func Test_ResendEmailVerification_Success_UnknownEmail(t *testing.T) {
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
+	defer expectResponsablesEmpty(t)
 
-	request, _ := http.NewRequest("GET", "/", nil)
-	response := httptest.NewRecorder()
+	response := performRequestBody(t, "POST", "/emailverification", `{"email": "a@z.co"}`)
+	expectSuccessResponse(t, response, 202)
+}
 
-	shoreline.CheckToken(response, request)
+func Test_ResendEmailVerification_Success_AlreadyVerified(t *testing.T) {
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, EmailVerified: true}}, nil}}
+	defer expectResponsablesEmpty(t)
 
-	if response.Code != http.StatusUnauthorized {
-		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusUnauthorized, response.Code)
-	}
+	response := performRequestBody(t, "POST", "/emailverification", `{"email": "a@z.co"}`)
+	expectSuccessResponse(t, response, 202)
 }
 
-////////////////////////////////////////////////////////////////////////////////
+func Test_ResendEmailVerification_Success_WithinResendInterval(t *testing.T) {
+	latest, _ := NewConfirmationToken(ConfirmationPurposeEmailVerification, "1111111111", "a@z.co", 3600)
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}}}, nil}}
+	responsableStore.FindLatestConfirmationTokenResponses = []FindLatestConfirmationTokenResponse{{latest, nil}}
+	defer expectResponsablesEmpty(t)
 
-func TestLogout_StatusOK_WhenNoToken(t *testing.T) {
-	request, _ := http.NewRequest("POST", "/", nil)
-	response := httptest.NewRecorder()
+	response := performRequestBody(t, "POST", "/emailverification", `{"email": "a@z.co"}`)
+	expectSuccessResponse(t, response, 202)
+}
 
-	shoreline.SetHandlers("", rtr)
+func Test_ResendEmailVerification_Error_NotifyError(t *testing.T) {
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}}}, nil}}
+	responsableStore.FindLatestConfirmationTokenResponses = []FindLatestConfirmationTokenResponse{{nil, nil}}
+	responsableStore.RemoveConfirmationTokensForUserResponses = []error{nil}
+	responsableStore.AddConfirmationTokenResponses = []error{nil}
+	mockNotifier.NotifyEmailVerificationRequestedResponses = []error{errors.New("ERROR")}
+	defer expectResponsablesEmpty(t)
 
-	shoreline.Logout(response, request)
+	response := performRequestBody(t, "POST", "/emailverification", `{"email": "a@z.co"}`)
+	expectErrorResponse(t, response, 500, "Error sending email")
+}
 
-	if response.Code != http.StatusOK {
-		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusOK, response.Code)
-	}
+func Test_ResendEmailVerification_Success(t *testing.T) {
+	latest, _ := NewConfirmationToken(ConfirmationPurposeEmailVerification, "1111111111", "a@z.co", 3600)
+	latest.CreatedAt = latest.CreatedAt.Add(-time.Hour)
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}}}, nil}}
+	responsableStore.FindLatestConfirmationTokenResponses = []FindLatestConfirmationTokenResponse{{latest, nil}}
+	responsableStore.RemoveConfirmationTokensForUserResponses = []error{nil}
+	responsableStore.AddConfirmationTokenResponses = []error{nil}
+	mockNotifier.NotifyEmailVerificationRequestedResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	response := performRequestBody(t, "POST", "/emailverification", `{"email": "a@z.co"}`)
+	expectSuccessResponse(t, response, 202)
 }
 
-func TestLogout_StatusOK(t *testing.T) {
+func Test_ConfirmEmailVerification_Error_InvalidToken(t *testing.T) {
+	response := performRequestBody(t, "POST", "/emailverification/confirm", `{"token": "invalid"}`)
+	expectErrorResponse(t, response, 401, "The email verification token is invalid or has expired")
+}
 
-	shoreline.SetHandlers("", rtr)
-	//now logout with valid token
-	request, _ := http.NewRequest("POST", "/", nil)
-	request.Header.Set(TP_SESSION_TOKEN, userToken.ID)
-	response := httptest.NewRecorder()
+func Test_ConfirmEmailVerification_Error_PasswordResetToken(t *testing.T) {
+	_, signed := createSignedConfirmationToken(t, ConfirmationPurposePasswordReset, "1111111111")
+	body := fmt.Sprintf(`{"token": "%s"}`, signed)
 
-	shoreline.Logout(response, request)
+	response := performRequestBody(t, "POST", "/emailverification/confirm", body)
+	expectErrorResponse(t, response, 401, "The email verification token is invalid or has expired")
+}
 
-	if response.Code != http.StatusOK {
-		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusOK, response.Code)
-	}
+func Test_ConfirmEmailVerification_Error_TokenAlreadyUsed(t *testing.T) {
+	_, signed := createSignedConfirmationToken(t, ConfirmationPurposeEmailVerification, "1111111111")
+	body := fmt.Sprintf(`{"token": "%s"}`, signed)
+	responsableStore.ConsumeConfirmationTokenResponses = []ConsumeConfirmationTokenResponse{{nil, nil}}
+	defer expectResponsablesEmpty(t)
+
+	response := performRequestBody(t, "POST", "/emailverification/confirm", body)
+	expectErrorResponse(t, response, 401, "The email verification token is invalid or has expired")
 }
 
-func TestLogout_Failure(t *testing.T) {
+func Test_ConfirmEmailVerification_Error_EmailChanged(t *testing.T) {
+	verificationToken, signed := createSignedConfirmationToken(t, ConfirmationPurposeEmailVerification, "1111111111")
+	body := fmt.Sprintf(`{"token": "%s"}`, signed)
+	responsableStore.ConsumeConfirmationTokenResponses = []ConsumeConfirmationTokenResponse{{verificationToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "other@z.co", Emails: []string{"other@z.co"}}, nil}}
+	defer expectResponsablesEmpty(t)
 
-	shorelineFails.SetHandlers("", rtr)
-	//now logout with valid token
-	req, _ := http.NewRequest("POST", "/", nil)
-	req.Header.Set(TP_SESSION_TOKEN, userToken.ID)
-	resp := httptest.NewRecorder()
+	response := performRequestBody(t, "POST", "/emailverification/confirm", body)
+	expectErrorResponse(t, response, 401, "The email verification token is invalid or has expired")
+}
 
-	shorelineFails.Logout(resp, req)
+func Test_ConfirmEmailVerification_Success(t *testing.T) {
+	verificationToken, signed := createSignedConfirmationToken(t, ConfirmationPurposeEmailVerification, "1111111111")
+	body := fmt.Sprintf(`{"token": "%s"}`, signed)
+	responsableStore.ConsumeConfirmationTokenResponses = []ConsumeConfirmationTokenResponse{{verificationToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	mockNotifier.NotifyUserUpdatedResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
 
-	//StatusOK beccuse we `try` and delete the token but the return of that
-	if resp.Code != http.StatusOK {
-		t.Fatalf("Expected [%v] and got [%v]", http.StatusOK, resp.Code)
-	}
+	response := performRequestBody(t, "POST", "/emailverification/confirm", body)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"userid": "1111111111", "emailVerified": true, "emails": []interface{}{"a@z.co"}, "username": "a@z.co"})
 }
 
+////////////////////////////////////////////////////////////////////////////////
+
 func TestAnonymousIdHashPair_StatusOK(t *testing.T) {
 	request, _ := http.NewRequest("GET", "/", nil)
 
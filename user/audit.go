@@ -0,0 +1,44 @@
+package user
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+const (
+	AuditTypeMfaRecoveryCodeUsed         = "mfa_recovery_code_used"
+	AuditTypeMfaRecoveryCodesRegenerated = "mfa_recovery_codes_regenerated"
+	AuditTypeRefreshTokenReused          = "refresh_token_reused"
+	AuditTypeImpersonationStarted        = "impersonation_started"
+
+	auditRecordIDLength = 16
+)
+
+// AuditRecord is a security relevant action on an account that support staff may need to review later
+type AuditRecord struct {
+	ID      string            `json:"id" bson:"_id"`
+	Type    string            `json:"type" bson:"type"`
+	UserID  string            `json:"userId" bson:"userId"`
+	ActorID string            `json:"actorId,omitempty" bson:"actorId,omitempty"` // who performed the action, when it was not the user
+	Time    time.Time         `json:"time" bson:"time"`
+	Details map[string]string `json:"details,omitempty" bson:"details,omitempty"`
+	// SessionMetadata tells where the request that caused the action came from
+	SessionMetadata `bson:",inline"`
+}
+
+// NewAuditRecord creates a record of an action of the given type on the account of userID
+func NewAuditRecord(auditType string, userID string, details map[string]string) (*AuditRecord, error) {
+	id := make([]byte, auditRecordIDLength)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	return &AuditRecord{
+		ID:      hex.EncodeToString(id),
+		Type:    auditType,
+		UserID:  userID,
+		Time:    time.Now(),
+		Details: details,
+	}, nil
+}
@@ -0,0 +1,99 @@
+package user
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+type (
+	// ConfirmationToken is a short-lived, single-use token that is delivered to the user out of band
+	// (e.g. by email). Only the id is stored, the user receives it wrapped in a signed JWT.
+	ConfirmationToken struct {
+		ID        string    `json:"-" bson:"_id"`
+		Purpose   string    `json:"purpose" bson:"purpose"`
+		UserID    string    `json:"userId" bson:"userId"`
+		Email     string    `json:"email,omitempty" bson:"email,omitempty"`
+		CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+		ExpiresAt time.Time `json:"expiresAt" bson:"expiresAt"`
+	}
+)
+
+const (
+	ConfirmationPurposePasswordReset     = "password_reset"
+	ConfirmationPurposeEmailVerification = "email_verification"
+	ConfirmationPurposeMfaLogin          = "mfa_login"
+	ConfirmationPurposeMfaEnrollment     = "mfa_enrollment"
+
+	confirmationIDLength = 32
+)
+
+var (
+	ConfirmationToken_error_no_userid  = errors.New("ConfirmationToken: userId not set")
+	ConfirmationToken_error_no_purpose = errors.New("ConfirmationToken: purpose not set")
+	ConfirmationToken_invalid          = errors.New("ConfirmationToken: is invalid")
+)
+
+// NewConfirmationToken creates a confirmation token for the user that expires after durationSecs
+func NewConfirmationToken(purpose string, userID string, email string, durationSecs int64) (*ConfirmationToken, error) {
+	if purpose == "" {
+		return nil, ConfirmationToken_error_no_purpose
+	}
+	if userID == "" {
+		return nil, ConfirmationToken_error_no_userid
+	}
+
+	id := make([]byte, confirmationIDLength)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Truncate(time.Second)
+	return &ConfirmationToken{
+		ID:        hex.EncodeToString(id),
+		Purpose:   purpose,
+		UserID:    userID,
+		Email:     email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Duration(durationSecs) * time.Second),
+	}, nil
+}
+
+// Sign returns the signed representation of the confirmation token that is handed to the user
+func (c *ConfirmationToken) Sign(keyRing *KeyRing) (string, error) {
+	config := keyRing.signingConfig()
+	return keyRing.sign(jwt.MapClaims{
+		"jti": c.ID,
+		"pur": c.Purpose,
+		"sub": c.UserID,
+		"iss": config.issuer(),
+		"aud": config.audience(),
+		"iat": c.CreatedAt.Unix(),
+		"exp": c.ExpiresAt.Unix(),
+	})
+}
+
+// UnpackConfirmationToken verifies the signed confirmation token and returns the stored id and user id.
+// The caller must still consume the token from storage to guarantee it is only used once.
+func UnpackConfirmationToken(signed string, purpose string, keyRing *KeyRing) (*ConfirmationToken, error) {
+	if signed == "" {
+		return nil, ConfirmationToken_invalid
+	}
+
+	jwtToken, err := keyRing.verify(signed)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := jwtToken.Claims.(jwt.MapClaims)
+	id, _ := claims["jti"].(string)
+	userID, _ := claims["sub"].(string)
+	if id == "" || userID == "" || claims["pur"] != purpose {
+		return nil, ConfirmationToken_invalid
+	}
+
+	return &ConfirmationToken{ID: id, Purpose: purpose, UserID: userID}, nil
+}
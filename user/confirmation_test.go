@@ -0,0 +1,73 @@
+package user
+
+import (
+	"testing"
+)
+
+func Test_NewConfirmationToken_MissingPurpose(t *testing.T) {
+	if _, err := NewConfirmationToken("", "1234567890", "a@b.co", 3600); err != ConfirmationToken_error_no_purpose {
+		t.Fatalf("Unexpected error: %#v", err)
+	}
+}
+
+func Test_NewConfirmationToken_MissingUserID(t *testing.T) {
+	if _, err := NewConfirmationToken(ConfirmationPurposePasswordReset, "", "a@b.co", 3600); err != ConfirmationToken_error_no_userid {
+		t.Fatalf("Unexpected error: %#v", err)
+	}
+}
+
+func Test_ConfirmationToken_SignAndUnpack(t *testing.T) {
+	for _, tokenConfig := range tokenConfigs {
+		keyRing := newKeyRing(t, tokenConfig)
+		confirmationToken, err := NewConfirmationToken(ConfirmationPurposePasswordReset, "1234567890", "a@b.co", 3600)
+		if err != nil {
+			t.Fatalf("Unexpected error creating confirmation token: %#v", err)
+		}
+		if confirmationToken.ID == "" || !confirmationToken.ExpiresAt.After(confirmationToken.CreatedAt) {
+			t.Fatalf("Confirmation token was not initialized: %#v", confirmationToken)
+		}
+
+		signed, err := confirmationToken.Sign(keyRing)
+		if err != nil {
+			t.Fatalf("Unexpected error signing confirmation token: %#v", err)
+		}
+
+		unpacked, err := UnpackConfirmationToken(signed, ConfirmationPurposePasswordReset, keyRing)
+		if err != nil {
+			t.Fatalf("Unexpected error unpacking confirmation token: %#v", err)
+		}
+		if unpacked.ID != confirmationToken.ID || unpacked.UserID != confirmationToken.UserID {
+			t.Fatalf("Unpacked confirmation token does not match: %#v", unpacked)
+		}
+
+		if _, err := UnpackConfirmationToken(signed, "other_purpose", keyRing); err != ConfirmationToken_invalid {
+			t.Fatalf("Confirmation token should not be valid for another purpose: %#v", err)
+		}
+	}
+}
+
+func Test_UnpackConfirmationToken_Expired(t *testing.T) {
+	confirmationToken, _ := NewConfirmationToken(ConfirmationPurposePasswordReset, "1234567890", "a@b.co", -60)
+	signed, _ := confirmationToken.Sign(newKeyRing(t, tokenConfigs[0]))
+
+	if _, err := UnpackConfirmationToken(signed, ConfirmationPurposePasswordReset, newKeyRing(t, tokenConfigs[0])); err == nil {
+		t.Fatalf("Expired confirmation token should not be valid")
+	}
+}
+
+func Test_UnpackConfirmationToken_SessionToken(t *testing.T) {
+	sessionToken, _ := CreateSessionToken(&TokenData{UserId: "1234567890", DurationSecs: 3600}, tokenConfigs[0])
+
+	if _, err := UnpackConfirmationToken(sessionToken.ID, ConfirmationPurposePasswordReset, newKeyRing(t, tokenConfigs[0])); err != ConfirmationToken_invalid {
+		t.Fatalf("Session token should not be valid as a confirmation token: %#v", err)
+	}
+}
+
+func Test_UnpackSessionTokenAndVerify_ConfirmationToken(t *testing.T) {
+	confirmationToken, _ := NewConfirmationToken(ConfirmationPurposePasswordReset, "1234567890", "a@b.co", 3600)
+	signed, _ := confirmationToken.Sign(newKeyRing(t, tokenConfigs[0]))
+
+	if _, err := UnpackSessionTokenAndVerify(signed, tokenConfigs[0]); err != SessionToken_invalid {
+		t.Fatalf("Confirmation token should not be valid as a session token: %#v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package user
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// generateTokenConfig returns a token config with a new ES256 or EdDSA key
+func generateTokenConfig(t *testing.T, algorithm string) TokenConfig {
+	var privateKey, publicKey interface{}
+	if algorithm == "EdDSA" {
+		publicKey, privateKey, _ = ed25519.GenerateKey(rand.Reader)
+	} else {
+		ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("there should be no error generating the key: %v", err)
+		}
+		privateKey, publicKey = ecKey, &ecKey.PublicKey
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatalf("there should be no error marshalling the private key: %v", err)
+	}
+	return TokenConfig{
+		DurationSecs: 3600,
+		EncodeKey:    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		DecodeKey:    encodePublicKeyPEM(t, publicKey),
+		Audience:     "localhost",
+		Issuer:       "localhost",
+		Algorithm:    algorithm,
+	}
+}
+
+func TestSigningMethodEdDSA(t *testing.T) {
+
+	config := generateTokenConfig(t, "EdDSA")
+	if jwt.GetSigningMethod("EdDSA") != SigningMethodEdDSA {
+		t.Fatal("the EdDSA signing method should be registered")
+	}
+	privateKey, err := ParseEdPrivateKeyFromPEM([]byte(config.EncodeKey))
+	if err != nil {
+		t.Fatalf("there should be no error parsing the private key: %v", err)
+	}
+	publicKey, err := ParseEdPublicKeyFromPEM([]byte(config.DecodeKey))
+	if err != nil {
+		t.Fatalf("there should be no error parsing the public key: %v", err)
+	}
+
+	signature, err := SigningMethodEdDSA.Sign("header.claims", privateKey)
+	if err != nil {
+		t.Fatalf("there should be no error signing: %v", err)
+	}
+	if err := SigningMethodEdDSA.Verify("header.claims", signature, publicKey); err != nil {
+		t.Fatalf("the signature should be valid: %v", err)
+	}
+	if err := SigningMethodEdDSA.Verify("header.other", signature, publicKey); err != jwt.ErrSignatureInvalid {
+		t.Fatalf("the signature should not be valid for other content, got %v", err)
+	}
+	if _, err := SigningMethodEdDSA.Sign("header.claims", []byte("my secret")); err != jwt.ErrInvalidKeyType {
+		t.Fatalf("a secret should not be accepted as an Ed25519 key, got %v", err)
+	}
+
+}
+
+func TestParseEdKeyFromPEM_Invalid(t *testing.T) {
+
+	if _, err := ParseEdPrivateKeyFromPEM([]byte("my secret")); err != jwt.ErrKeyMustBePEMEncoded {
+		t.Fatalf("a key that is not PEM encoded should be rejected, got %v", err)
+	}
+	if _, err := ParseEdPublicKeyFromPEM([]byte(tokenConfigs[0].DecodeKey)); err != EdDSA_error_not_public_key {
+		t.Fatalf("an RSA key should be rejected, got %v", err)
+	}
+	if _, err := ParseEdPrivateKeyFromPEM([]byte(generateTokenConfig(t, "ES256").EncodeKey)); err != EdDSA_error_not_private_key {
+		t.Fatalf("an EC key should be rejected, got %v", err)
+	}
+
+}
@@ -9,6 +9,14 @@ import (
 	sl "github.com/tidepool-org/go-common/clients/shoreline"
 	"github.com/tidepool-org/go-common/events"
 	"log"
+	"time"
+)
+
+const (
+	PasswordResetRequestedEventType     = "users:password_reset_requested"
+	EmailVerificationRequestedEventType = "users:email_verification_requested"
+	PasswordChangedEventType            = "users:password_changed"
+	SessionsRevokedEventType            = "users:sessions_revoked"
 )
 
 const (
@@ -26,6 +34,82 @@ type EventsNotifier interface {
 	NotifyUserDeleted(ctx context.Context, user User, profile Profile) error
 	NotifyUserCreated(ctx context.Context, user User) error
 	NotifyUserUpdated(ctx context.Context, before User, after User) error
+	NotifyPasswordResetRequested(ctx context.Context, user User, resetToken string, expiresAt time.Time) error
+	NotifyEmailVerificationRequested(ctx context.Context, user User, verificationToken string, expiresAt time.Time) error
+	NotifyPasswordChanged(ctx context.Context, user User, changedAt time.Time) error
+	NotifySessionsRevoked(ctx context.Context, user User, revokedBy string, revokedAt time.Time) error
+	NotifyTokensRevoked(ctx context.Context, revocation TokensRevokedEvent) error
+}
+
+var _ events.Event = PasswordResetRequestedEvent{}
+
+// PasswordResetRequestedEvent carries the signed reset token so that the mailer service can deliver the reset link
+type PasswordResetRequestedEvent struct {
+	UserID    string    `json:"userId"`
+	Email     string    `json:"email"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func (p PasswordResetRequestedEvent) GetEventType() string {
+	return PasswordResetRequestedEventType
+}
+
+func (p PasswordResetRequestedEvent) GetEventKey() string {
+	return p.UserID
+}
+
+var _ events.Event = EmailVerificationRequestedEvent{}
+
+// EmailVerificationRequestedEvent carries the signed verification token so that the mailer service can deliver the confirmation link
+type EmailVerificationRequestedEvent struct {
+	UserID    string    `json:"userId"`
+	Email     string    `json:"email"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func (e EmailVerificationRequestedEvent) GetEventType() string {
+	return EmailVerificationRequestedEventType
+}
+
+func (e EmailVerificationRequestedEvent) GetEventKey() string {
+	return e.UserID
+}
+
+var _ events.Event = PasswordChangedEvent{}
+
+// PasswordChangedEvent lets the mailer service tell the user that the password was changed, in case it was not them
+type PasswordChangedEvent struct {
+	UserID    string    `json:"userId"`
+	Email     string    `json:"email"`
+	ChangedAt time.Time `json:"changedAt"`
+}
+
+func (p PasswordChangedEvent) GetEventType() string {
+	return PasswordChangedEventType
+}
+
+func (p PasswordChangedEvent) GetEventKey() string {
+	return p.UserID
+}
+
+var _ events.Event = SessionsRevokedEvent{}
+
+// SessionsRevokedEvent tells the user, and services that cache sessions, that all sessions of the user were revoked
+type SessionsRevokedEvent struct {
+	UserID    string    `json:"userId"`
+	Email     string    `json:"email"`
+	RevokedBy string    `json:"revokedBy"` // the user id of the token that revoked the sessions
+	RevokedAt time.Time `json:"revokedAt"`
+}
+
+func (s SessionsRevokedEvent) GetEventType() string {
+	return SessionsRevokedEventType
+}
+
+func (s SessionsRevokedEvent) GetEventKey() string {
+	return s.UserID
 }
 
 var _ EventsNotifier = &userEventsNotifier{}
@@ -65,6 +149,45 @@ func (u *userEventsNotifier) NotifyUserUpdated(ctx context.Context, before User,
 	})
 }
 
+func (u *userEventsNotifier) NotifyPasswordResetRequested(ctx context.Context, user User, resetToken string, expiresAt time.Time) error {
+	return u.Send(ctx, &PasswordResetRequestedEvent{
+		UserID:    user.Id,
+		Email:     user.Email(),
+		Token:     resetToken,
+		ExpiresAt: expiresAt,
+	})
+}
+
+func (u *userEventsNotifier) NotifyEmailVerificationRequested(ctx context.Context, user User, verificationToken string, expiresAt time.Time) error {
+	return u.Send(ctx, &EmailVerificationRequestedEvent{
+		UserID:    user.Id,
+		Email:     user.Email(),
+		Token:     verificationToken,
+		ExpiresAt: expiresAt,
+	})
+}
+
+func (u *userEventsNotifier) NotifyPasswordChanged(ctx context.Context, user User, changedAt time.Time) error {
+	return u.Send(ctx, &PasswordChangedEvent{
+		UserID:    user.Id,
+		Email:     user.Email(),
+		ChangedAt: changedAt,
+	})
+}
+
+func (u *userEventsNotifier) NotifySessionsRevoked(ctx context.Context, user User, revokedBy string, revokedAt time.Time) error {
+	return u.Send(ctx, &SessionsRevokedEvent{
+		UserID:    user.Id,
+		Email:     user.Email(),
+		RevokedBy: revokedBy,
+		RevokedAt: revokedAt,
+	})
+}
+
+func (u *userEventsNotifier) NotifyTokensRevoked(ctx context.Context, revocation TokensRevokedEvent) error {
+	return u.Send(ctx, &revocation)
+}
+
 func toUserData(user User) sl.UserData {
 	return sl.UserData{
 		UserID:         user.Id,
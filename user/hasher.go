@@ -1,16 +1,70 @@
 package user
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"math/big"
 	"strconv"
+	"strings"
 	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	PasswordHashAlgorithmArgon2id = "argon2id"
+	PasswordHashAlgorithmBcrypt   = "bcrypt"
+
+	argon2idHashPrefix = "$argon2id$"
+	argon2SaltLength   = 16
+	argon2KeyLength    = 32
 )
 
+// PasswordHashConfig selects the algorithm and cost parameters used when hashing new passwords.
+// Zero values fall back to DefaultPasswordHashConfig.
+type PasswordHashConfig struct {
+	Algorithm     string `json:"algorithm"`     // argon2id (default) or bcrypt
+	Argon2Time    uint32 `json:"argon2Time"`    // number of passes over memory
+	Argon2Memory  uint32 `json:"argon2Memory"`  // memory in KiB
+	Argon2Threads uint8  `json:"argon2Threads"` // degree of parallelism
+	BcryptCost    int    `json:"bcryptCost"`
+}
+
+var DefaultPasswordHashConfig = PasswordHashConfig{
+	Algorithm:     PasswordHashAlgorithmArgon2id,
+	Argon2Time:    2,
+	Argon2Memory:  19 * 1024,
+	Argon2Threads: 1,
+	BcryptCost:    12,
+}
+
+func (c PasswordHashConfig) withDefaults() PasswordHashConfig {
+	if c.Algorithm == "" {
+		c.Algorithm = DefaultPasswordHashConfig.Algorithm
+	}
+	if c.Argon2Time == 0 {
+		c.Argon2Time = DefaultPasswordHashConfig.Argon2Time
+	}
+	if c.Argon2Memory == 0 {
+		c.Argon2Memory = DefaultPasswordHashConfig.Argon2Memory
+	}
+	if c.Argon2Threads == 0 {
+		c.Argon2Threads = DefaultPasswordHashConfig.Argon2Threads
+	}
+	if c.BcryptCost == 0 {
+		c.BcryptCost = DefaultPasswordHashConfig.BcryptCost
+	}
+	return c
+}
+
 func generateUniqueHash(strings []string, length int) (string, error) {
 
 	if len(strings) > 0 && length > 0 {
@@ -39,6 +93,8 @@ func generateUniqueHash(strings []string, length int) (string, error) {
 
 }
 
+// GeneratePasswordHash produces the legacy SHA-1 password hash. It is only kept so that
+// existing hashes can still be verified; new hashes are produced by GenerateVersionedPasswordHash.
 func GeneratePasswordHash(id, pw, salt string) (string, error) {
 
 	if salt == "" || id == "" {
@@ -55,3 +111,139 @@ func GeneratePasswordHash(id, pw, salt string) (string, error) {
 
 	return pwHash, nil
 }
+
+// GenerateVersionedPasswordHash hashes the password with the configured algorithm. The salt is used as a
+// server-side pepper; argon2id hashes also get a random per-password salt. The result is self-describing
+// so that VerifyPasswordHash does not need to know which algorithm or parameters produced it.
+func GenerateVersionedPasswordHash(pw, salt string, config PasswordHashConfig) (string, error) {
+	if salt == "" {
+		return "", errors.New("salt is required")
+	}
+
+	config = config.withDefaults()
+	peppered := pepperPassword(pw, salt)
+
+	switch config.Algorithm {
+	case PasswordHashAlgorithmArgon2id:
+		passwordSalt := make([]byte, argon2SaltLength)
+		if _, err := rand.Read(passwordSalt); err != nil {
+			return "", err
+		}
+		key := argon2.IDKey(peppered, passwordSalt, config.Argon2Time, config.Argon2Memory, config.Argon2Threads, argon2KeyLength)
+		return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2idHashPrefix,
+			argon2.Version,
+			config.Argon2Memory,
+			config.Argon2Time,
+			config.Argon2Threads,
+			base64.RawStdEncoding.EncodeToString(passwordSalt),
+			base64.RawStdEncoding.EncodeToString(key),
+		), nil
+	case PasswordHashAlgorithmBcrypt:
+		hash, err := bcrypt.GenerateFromPassword(peppered, config.BcryptCost)
+		if err != nil {
+			return "", err
+		}
+		return string(hash), nil
+	default:
+		return "", fmt.Errorf("unknown password hash algorithm %q", config.Algorithm)
+	}
+}
+
+// VerifyPasswordHash reports whether pw matches hash, which may be in any of the supported formats.
+func VerifyPasswordHash(hash, id, pw, salt string) bool {
+	if hash == "" || salt == "" {
+		return false
+	}
+
+	switch {
+	case strings.HasPrefix(hash, argon2idHashPrefix):
+		params, passwordSalt, key, err := decodeArgon2idHash(hash)
+		if err != nil {
+			return false
+		}
+		otherKey := argon2.IDKey(pepperPassword(pw, salt), passwordSalt, params.Argon2Time, params.Argon2Memory, params.Argon2Threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(key, otherKey) == 1
+	case isBcryptHash(hash):
+		return bcrypt.CompareHashAndPassword([]byte(hash), pepperPassword(pw, salt)) == nil
+	default:
+		legacyHash, err := GeneratePasswordHash(id, pw, salt)
+		if err != nil {
+			return false
+		}
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(legacyHash)) == 1
+	}
+}
+
+// PasswordHashNeedsUpgrade reports whether hash was produced by a different algorithm or
+// with different cost parameters than those currently configured.
+func PasswordHashNeedsUpgrade(hash string, config PasswordHashConfig) bool {
+	if hash == "" {
+		return false
+	}
+
+	config = config.withDefaults()
+
+	switch {
+	case strings.HasPrefix(hash, argon2idHashPrefix):
+		if config.Algorithm != PasswordHashAlgorithmArgon2id {
+			return true
+		}
+		params, _, _, err := decodeArgon2idHash(hash)
+		if err != nil {
+			return true
+		}
+		return params.Argon2Time != config.Argon2Time || params.Argon2Memory != config.Argon2Memory || params.Argon2Threads != config.Argon2Threads
+	case isBcryptHash(hash):
+		if config.Algorithm != PasswordHashAlgorithmBcrypt {
+			return true
+		}
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost != config.BcryptCost
+	default:
+		return true
+	}
+}
+
+// pepperPassword mixes the server-wide salt into the password before it is handed to the slow hash.
+// The HMAC output also keeps the input within the 72 byte limit of bcrypt.
+func pepperPassword(pw, salt string) []byte {
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte(pw))
+	return []byte(base64.RawStdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+func isBcryptHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func decodeArgon2idHash(hash string) (PasswordHashConfig, []byte, []byte, error) {
+	params := PasswordHashConfig{Algorithm: PasswordHashAlgorithmArgon2id}
+
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return params, nil, nil, errors.New("invalid argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return params, nil, nil, err
+	} else if version != argon2.Version {
+		return params, nil, nil, errors.New("unsupported argon2 version")
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Argon2Memory, &params.Argon2Time, &params.Argon2Threads); err != nil {
+		return params, nil, nil, err
+	}
+
+	passwordSalt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, err
+	}
+
+	return params, passwordSalt, key, nil
+}
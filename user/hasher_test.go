@@ -73,3 +73,90 @@ func TestGeneratePasswordHash(t *testing.T) {
 	}
 
 }
+
+func TestGenerateVersionedPasswordHash_NoSalt(t *testing.T) {
+
+	if _, err := GenerateVersionedPasswordHash("th3P0rd", "", DefaultPasswordHashConfig); err == nil {
+		t.Fatal("there should be an error when no salt is given")
+	}
+
+}
+
+func TestGenerateVersionedPasswordHash_UnknownAlgorithm(t *testing.T) {
+
+	if _, err := GenerateVersionedPasswordHash("th3P0rd", "some salt", PasswordHashConfig{Algorithm: "md5"}); err == nil {
+		t.Fatal("there should be an error when the algorithm is unknown")
+	}
+
+}
+
+func TestGenerateVersionedPasswordHash(t *testing.T) {
+
+	configs := []PasswordHashConfig{
+		{Algorithm: PasswordHashAlgorithmArgon2id},
+		{Algorithm: PasswordHashAlgorithmBcrypt, BcryptCost: 4},
+	}
+
+	for _, config := range configs {
+		pwHashed, err := GenerateVersionedPasswordHash("th3P0rd", "some salt", config)
+		if err != nil {
+			t.Fatalf("there should be no error hashing with %s: %v", config.Algorithm, err)
+		}
+
+		reHashed, _ := GenerateVersionedPasswordHash("th3P0rd", "some salt", config)
+		if pwHashed == reHashed {
+			t.Fatalf("the two %s hash's should NOT match as they are randomly salted", config.Algorithm)
+		}
+
+		if !VerifyPasswordHash(pwHashed, "1234", "th3P0rd", "some salt") {
+			t.Fatalf("the %s hash should verify", config.Algorithm)
+		}
+		if VerifyPasswordHash(pwHashed, "1234", "th3P0rD", "some salt") {
+			t.Fatalf("the %s hash should NOT verify with a different password", config.Algorithm)
+		}
+		if VerifyPasswordHash(pwHashed, "1234", "th3P0rd", "other salt") {
+			t.Fatalf("the %s hash should NOT verify with a different salt", config.Algorithm)
+		}
+		if PasswordHashNeedsUpgrade(pwHashed, config) {
+			t.Fatalf("the %s hash should NOT need an upgrade", config.Algorithm)
+		}
+	}
+
+}
+
+func TestVerifyPasswordHash_Legacy(t *testing.T) {
+
+	legacyHash, _ := GeneratePasswordHash("1234", "th3P0rd", "some salt")
+
+	if !VerifyPasswordHash(legacyHash, "1234", "th3P0rd", "some salt") {
+		t.Fatal("the legacy hash should verify")
+	}
+	if VerifyPasswordHash(legacyHash, "1235", "th3P0rd", "some salt") {
+		t.Fatal("the legacy hash should NOT verify with a different userid")
+	}
+
+}
+
+func TestPasswordHashNeedsUpgrade(t *testing.T) {
+
+	legacyHash, _ := GeneratePasswordHash("1234", "th3P0rd", "some salt")
+	if !PasswordHashNeedsUpgrade(legacyHash, DefaultPasswordHashConfig) {
+		t.Fatal("a legacy hash should need an upgrade")
+	}
+
+	argon2Hash, _ := GenerateVersionedPasswordHash("th3P0rd", "some salt", DefaultPasswordHashConfig)
+	if PasswordHashNeedsUpgrade(argon2Hash, PasswordHashConfig{}) {
+		t.Fatal("an empty config should use the default parameters")
+	}
+	if !PasswordHashNeedsUpgrade(argon2Hash, PasswordHashConfig{Argon2Time: DefaultPasswordHashConfig.Argon2Time + 1}) {
+		t.Fatal("a hash with different parameters should need an upgrade")
+	}
+	if !PasswordHashNeedsUpgrade(argon2Hash, PasswordHashConfig{Algorithm: PasswordHashAlgorithmBcrypt}) {
+		t.Fatal("a hash with a different algorithm should need an upgrade")
+	}
+
+	if PasswordHashNeedsUpgrade("", DefaultPasswordHashConfig) {
+		t.Fatal("a missing hash should not need an upgrade")
+	}
+
+}
@@ -4,8 +4,11 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"log"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func firstStringNotEmpty(strs ...string) string {
@@ -17,6 +20,15 @@ func firstStringNotEmpty(strs ...string) string {
 	return ""
 }
 
+func containsString(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
+
 //Docode the http.Request parsing out the user details
 func getGivenDetail(req *http.Request) (d map[string]string) {
 	if req.ContentLength > 0 {
@@ -48,6 +60,14 @@ func unpackAuth(authLine string) (usr *User, pw string) {
 	return nil, ""
 }
 
+// setRetryAfter tells the client how many seconds to wait before retrying
+func setRetryAfter(res http.ResponseWriter, at time.Time) {
+	seconds := int(math.Ceil(time.Until(at).Seconds()))
+	if seconds > 0 {
+		res.Header().Set("Retry-After", strconv.Itoa(seconds))
+	}
+}
+
 func sendModelAsRes(res http.ResponseWriter, model interface{}) {
 	sendModelAsResWithStatus(res, model, http.StatusOK)
 }
@@ -137,8 +157,12 @@ func (a *Api) asSerializableUser(user *User, isServerRequest bool) interface{} {
 	if len(user.Username) > 0 || len(user.Emails) > 0 {
 		serializable["emailVerified"] = user.EmailVerified
 	}
+	if user.IsMfaEnabled() {
+		serializable["mfaEnabled"] = true
+	}
 	if isServerRequest {
 		serializable["passwordExists"] = (user.PwHash != "")
+		serializable["locked"] = user.IsLocked()
 	}
 	return serializable
 }
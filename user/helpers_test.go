@@ -3,6 +3,7 @@ package user
 import (
 	"reflect"
 	"testing"
+	"time"
 )
 
 func Test_FirstStringNotEmpty_None(t *testing.T) {
@@ -102,7 +103,7 @@ func Test_AsSerializableUser_EmailVerified_False(t *testing.T) {
 func Test_AsSerializableUser_PasswordExists_True_Server(t *testing.T) {
 	user := &User{PwHash: "abcdefghijkl"}
 	serializableUser := shoreline.asSerializableUser(user, true).(map[string]interface{})
-	if len(serializableUser) != 1 || !serializableUser["passwordExists"].(bool) {
+	if len(serializableUser) != 2 || !serializableUser["passwordExists"].(bool) {
 		t.Fatalf("Serializable user [%#v] does not match User [%#v] for passwordExists as not server", serializableUser, user)
 	}
 }
@@ -118,11 +119,27 @@ func Test_AsSerializableUser_PasswordExists_True_NotServer(t *testing.T) {
 func Test_AsSerializableUser_PasswordExists_False_Server(t *testing.T) {
 	user := &User{}
 	serializableUser := shoreline.asSerializableUser(user, true).(map[string]interface{})
-	if len(serializableUser) != 1 || serializableUser["passwordExists"].(bool) {
+	if len(serializableUser) != 2 || serializableUser["passwordExists"].(bool) {
 		t.Fatalf("Serializable user [%#v] does not match User [%#v] for passwordExists as not server", serializableUser, user)
 	}
 }
 
+func Test_AsSerializableUser_Locked_Server(t *testing.T) {
+	user := &User{LockedUntil: time.Now().Add(time.Minute)}
+	serializableUser := shoreline.asSerializableUser(user, true).(map[string]interface{})
+	if len(serializableUser) != 2 || !serializableUser["locked"].(bool) {
+		t.Fatalf("Serializable user [%#v] does not match User [%#v] for locked as server", serializableUser, user)
+	}
+}
+
+func Test_AsSerializableUser_Locked_NotServer(t *testing.T) {
+	user := &User{LockedUntil: time.Now().Add(time.Minute)}
+	serializableUser := shoreline.asSerializableUser(user, false).(map[string]interface{})
+	if len(serializableUser) != 0 {
+		t.Fatalf("Serializable user [%#v] does not match User [%#v] for locked as not server", serializableUser, user)
+	}
+}
+
 func Test_AsSerializableUser_PasswordExists_False_NotServer(t *testing.T) {
 	user := &User{}
 	serializableUser := shoreline.asSerializableUser(user, false).(map[string]interface{})
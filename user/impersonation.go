@@ -0,0 +1,57 @@
+package user
+
+import (
+	"errors"
+	"time"
+)
+
+// TokenActor is the act claim of an impersonation token, see RFC 8693: the support agent acting as the user
+// the token is issued for
+type TokenActor struct {
+	Subject string `json:"sub"`
+}
+
+var errImpersonationForbidden = errors.New(STATUS_IMPERSONATED)
+
+// IsImpersonated reports whether the token was issued for support staff acting as the user
+func (t *TokenData) IsImpersonated() bool {
+	return t.Actor != nil
+}
+
+// subject returns the support agent of the act claim, or an empty string without one
+func (a *TokenActor) subject() string {
+	if a == nil {
+		return ""
+	}
+	return a.Subject
+}
+
+// impersonationDuration returns how long an impersonation token stays valid, the requested duration may only
+// shorten the configured one
+func impersonationDuration(configured int64, requested int64) int64 {
+	if configured <= 0 {
+		configured = defaultImpersonationDurationSecs
+	}
+	if requested > 0 && requested < configured {
+		return requested
+	}
+	return configured
+}
+
+// newImpersonationAuditRecord creates the record of an impersonation token. The actor is only claimed by the
+// service client that requested the token, so the client is recorded as well.
+func newImpersonationAuditRecord(sessionToken *SessionToken, reason string, server *TokenData) (*AuditRecord, error) {
+	record, err := NewAuditRecord(AuditTypeImpersonationStarted, sessionToken.UserID, map[string]string{
+		"reason":    reason,
+		"server":    server.UserId,
+		"clientId":  server.ClientID,
+		"sessionId": SessionID(sessionToken.ID),
+		"expiresAt": sessionToken.ExpiresAt.UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return nil, err
+	}
+	record.ActorID = sessionToken.Actor
+	record.SessionMetadata = sessionToken.SessionMetadata
+	return record, nil
+}
@@ -0,0 +1,41 @@
+package user
+
+import (
+	"testing"
+	"time"
+)
+
+func TestImpersonationDuration(t *testing.T) {
+
+	tests := []struct {
+		configured, requested, expected int64
+	}{
+		{0, 0, defaultImpersonationDurationSecs},
+		{1800, 0, 1800},
+		{1800, 600, 600},
+		{1800, 86400, 1800},
+		{0, -1, defaultImpersonationDurationSecs},
+	}
+	for _, test := range tests {
+		if duration := impersonationDuration(test.configured, test.requested); duration != test.expected {
+			t.Fatalf("impersonationDuration(%d, %d) should be %d, got %d", test.configured, test.requested, test.expected, duration)
+		}
+	}
+}
+
+func TestNewImpersonationAuditRecord(t *testing.T) {
+
+	sessionToken := &SessionToken{ID: "token", UserID: "1111111111", ExpiresAt: time.Unix(2000, 0), Actor: "support@tidepool.org"}
+	server := &TokenData{UserId: "support", IsServer: true, ClientID: "support", Scopes: []string{ServiceScopeImpersonate}}
+
+	record, err := newImpersonationAuditRecord(sessionToken, "Upload fails", server)
+	if err != nil {
+		t.Fatalf("Error creating the audit record: %v", err)
+	}
+	if record.Type != AuditTypeImpersonationStarted || record.UserID != "1111111111" || record.ActorID != "support@tidepool.org" {
+		t.Fatalf("Unexpected audit record %#v", record)
+	}
+	if record.Details["clientId"] != "support" || record.Details["reason"] != "Upload fails" || record.Details["sessionId"] != SessionID("token") {
+		t.Fatalf("The audit record should name the client along with the reason, got %v", record.Details)
+	}
+}
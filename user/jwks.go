@@ -0,0 +1,142 @@
+package user
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+type (
+	// JSONWebKey is the public part of a token signing key as described by RFC 7517
+	JSONWebKey struct {
+		Kty string `json:"kty"`
+		Use string `json:"use"`
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+		N   string `json:"n,omitempty"`
+		E   string `json:"e,omitempty"`
+		Crv string `json:"crv,omitempty"`
+		X   string `json:"x,omitempty"`
+		Y   string `json:"y,omitempty"`
+	}
+
+	// JSONWebKeySet lets other services verify session tokens without a copy of the public keys
+	JSONWebKeySet struct {
+		Keys []JSONWebKey `json:"keys"`
+	}
+)
+
+var (
+	TokenConfig_error_not_asymmetric = errors.New("TokenConfig: algorithm does not use a public key")
+	TokenConfig_error_unknown_key    = errors.New("TokenConfig: no token config matches the algorithm and key id of the token")
+)
+
+// IsAsymmetric reports whether the config signs tokens with a private key whose public key can be published
+func (c TokenConfig) IsAsymmetric() bool {
+	switch jwt.GetSigningMethod(c.Algorithm).(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS, *jwt.SigningMethodECDSA, *SigningMethodEd25519:
+		return true
+	}
+	return false
+}
+
+// JSONWebKey returns the public key of the config. The key id is the RFC 7638 thumbprint of the key, so it stays
+// the same across restarts and instances as long as the key does not change.
+func (c TokenConfig) JSONWebKey() (*JSONWebKey, error) {
+	var jwk *JSONWebKey
+	switch jwt.GetSigningMethod(c.Algorithm).(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		publicKey, err := jwt.ParseRSAPublicKeyFromPEM([]byte(c.DecodeKey))
+		if err != nil {
+			return nil, err
+		}
+		jwk = &JSONWebKey{
+			Kty: "RSA",
+			N:   base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes()),
+		}
+	case *jwt.SigningMethodECDSA:
+		publicKey, err := jwt.ParseECPublicKeyFromPEM([]byte(c.DecodeKey))
+		if err != nil {
+			return nil, err
+		}
+		size := (publicKey.Curve.Params().BitSize + 7) / 8
+		jwk = &JSONWebKey{
+			Kty: "EC",
+			Crv: publicKey.Curve.Params().Name,
+			X:   base64.RawURLEncoding.EncodeToString(publicKey.X.FillBytes(make([]byte, size))),
+			Y:   base64.RawURLEncoding.EncodeToString(publicKey.Y.FillBytes(make([]byte, size))),
+		}
+	case *SigningMethodEd25519:
+		publicKey, err := ParseEdPublicKeyFromPEM([]byte(c.DecodeKey))
+		if err != nil {
+			return nil, err
+		}
+		jwk = &JSONWebKey{
+			Kty: "OKP",
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(publicKey),
+		}
+	default:
+		return nil, TokenConfig_error_not_asymmetric
+	}
+
+	jwk.Use = "sig"
+	jwk.Alg = c.Algorithm
+	jwk.Kid = jwk.thumbprint()
+	return jwk, nil
+}
+
+// KeyID returns the id of the key tokens of the config are signed with, or an empty string for symmetric keys
+// which are never published
+func (c TokenConfig) KeyID() (string, error) {
+	if !c.IsAsymmetric() {
+		return "", nil
+	}
+	jwk, err := c.JSONWebKey()
+	if err != nil {
+		return "", err
+	}
+	return jwk.Kid, nil
+}
+
+func (k *JSONWebKey) thumbprint() string {
+	// the required members in lexicographic order, see RFC 7638 section 3.2
+	var members string
+	switch k.Kty {
+	case "EC":
+		members = fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, k.Crv, k.X, k.Y)
+	case "OKP":
+		// see RFC 8037 section 2
+		members = fmt.Sprintf(`{"crv":"%s","kty":"OKP","x":"%s"}`, k.Crv, k.X)
+	default:
+		members = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, k.E, k.N)
+	}
+	sum := sha256.Sum256([]byte(members))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// NewJSONWebKeySet publishes the public keys of all asymmetric token configs, so that tokens signed with
+// a previous key can still be verified during a rotation. Configs without a decode key are skipped.
+func NewJSONWebKeySet(tokenConfigs ...TokenConfig) (*JSONWebKeySet, error) {
+	keySet := &JSONWebKeySet{Keys: []JSONWebKey{}}
+	published := map[string]bool{}
+	for _, tokenConfig := range tokenConfigs {
+		if !tokenConfig.IsAsymmetric() || tokenConfig.DecodeKey == "" {
+			continue
+		}
+		jwk, err := tokenConfig.JSONWebKey()
+		if err != nil {
+			return nil, err
+		}
+		if !published[jwk.Kid] {
+			published[jwk.Kid] = true
+			keySet.Keys = append(keySet.Keys, *jwk)
+		}
+	}
+	return keySet, nil
+}
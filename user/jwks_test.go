@@ -0,0 +1,111 @@
+package user
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func encodePublicKeyPEM(t *testing.T, publicKey interface{}) string {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		t.Fatalf("there should be no error marshalling the public key: %v", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func TestTokenConfig_JSONWebKey_RSA(t *testing.T) {
+
+	// the example key of RFC 7638 section 3.1
+	n, _ := base64.RawURLEncoding.DecodeString("0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw")
+	config := TokenConfig{Algorithm: "RS256", DecodeKey: encodePublicKeyPEM(t, &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: 65537})}
+
+	jwk, err := config.JSONWebKey()
+	if err != nil {
+		t.Fatalf("there should be no error creating the key: %v", err)
+	}
+	if jwk.Kid != "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs" {
+		t.Fatalf("the key id %s should be the RFC 7638 thumbprint", jwk.Kid)
+	}
+	if jwk.Kty != "RSA" || jwk.E != "AQAB" || jwk.Alg != "RS256" || jwk.Use != "sig" {
+		t.Fatalf("unexpected key %#v", jwk)
+	}
+
+}
+
+func TestTokenConfig_JSONWebKey_EC(t *testing.T) {
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("there should be no error generating the key: %v", err)
+	}
+	config := TokenConfig{Algorithm: "ES256", DecodeKey: encodePublicKeyPEM(t, &privateKey.PublicKey)}
+
+	jwk, err := config.JSONWebKey()
+	if err != nil {
+		t.Fatalf("there should be no error creating the key: %v", err)
+	}
+	if jwk.Kty != "EC" || jwk.Crv != "P-256" || len(jwk.X) != 43 || len(jwk.Y) != 43 || jwk.Kid == "" {
+		t.Fatalf("unexpected key %#v", jwk)
+	}
+
+}
+
+func TestTokenConfig_JSONWebKey_OKP(t *testing.T) {
+
+	config := generateTokenConfig(t, "EdDSA")
+
+	jwk, err := config.JSONWebKey()
+	if err != nil {
+		t.Fatalf("there should be no error creating the key: %v", err)
+	}
+	if jwk.Kty != "OKP" || jwk.Crv != "Ed25519" || len(jwk.X) != 43 || jwk.Y != "" || jwk.Alg != "EdDSA" || jwk.Kid == "" {
+		t.Fatalf("unexpected key %#v", jwk)
+	}
+
+}
+
+func TestTokenConfig_KeyID(t *testing.T) {
+
+	if kid, err := tokenConfigs[1].KeyID(); err != nil || kid != "" {
+		t.Fatalf("a symmetric key should not have a key id, got %q %v", kid, err)
+	}
+	if _, err := (TokenConfig{Algorithm: "RS256", DecodeKey: "invalid"}).KeyID(); err == nil {
+		t.Fatal("there should be an error for an invalid public key")
+	}
+
+}
+
+func TestNewJSONWebKeySet(t *testing.T) {
+
+	previous := tokenConfigs[0]
+	previous.DecodeKey = ""
+	keySet, err := NewJSONWebKeySet(tokenConfigs[0], tokenConfigs[1], tokenConfigs[0], previous)
+	if err != nil {
+		t.Fatalf("there should be no error creating the key set: %v", err)
+	}
+	if len(keySet.Keys) != 1 {
+		t.Fatalf("only the RSA key should be published once, got %#v", keySet.Keys)
+	}
+
+	sessionToken, err := CreateSessionToken(&TokenData{UserId: "12-99-100", DurationSecs: 3600}, tokenConfigs[0])
+	if err != nil {
+		t.Fatalf("there should be no error creating the session token: %v", err)
+	}
+	parsed, _, err := new(jwt.Parser).ParseUnverified(sessionToken.ID, jwt.MapClaims{})
+	if err != nil {
+		t.Fatalf("there should be no error parsing the session token: %v", err)
+	}
+	if parsed.Header["kid"] != keySet.Keys[0].Kid {
+		t.Fatalf("the session token kid %v should be %s", parsed.Header["kid"], keySet.Keys[0].Kid)
+	}
+
+}
@@ -0,0 +1,79 @@
+package user
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// KeyDirectoryMetadataFile lists the keys of a key directory
+const KeyDirectoryMetadataFile = "keys.json"
+
+type (
+	// KeyDirectory is the metadata of a directory of token keys, such as a mounted Kubernetes secret. The first
+	// key signs new tokens, all keys verify them.
+	KeyDirectory struct {
+		Keys []KeyFile `json:"keys"`
+	}
+
+	// KeyFile describes a key of a key directory, the file names are relative to the directory
+	KeyFile struct {
+		Algorithm      string   `json:"algorithm"`
+		PrivateKeyFile string   `json:"privateKeyFile,omitempty"` // only needed by the signing key, holds the secret of HMAC keys
+		PublicKeyFile  string   `json:"publicKeyFile,omitempty"`  // not used by HMAC keys
+		Issuer         string   `json:"issuer"`
+		Audience       string   `json:"audience"`
+		ExtraAudiences []string `json:"extraAudiences,omitempty"`
+		DurationSecs   int64    `json:"durationSecs"`
+		ClockSkewSecs  int64    `json:"clockSkewSecs,omitempty"`
+	}
+)
+
+// LoadKeyDirectory reads the token configs of the keys listed in the metadata file of the directory
+func LoadKeyDirectory(directory string) ([]TokenConfig, error) {
+	var metadata KeyDirectory
+	if content, err := ioutil.ReadFile(filepath.Join(directory, KeyDirectoryMetadataFile)); err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(content, &metadata); err != nil {
+		return nil, fmt.Errorf("keys: invalid %s: %v", KeyDirectoryMetadataFile, err)
+	} else if len(metadata.Keys) == 0 {
+		return nil, fmt.Errorf("keys: %s lists no keys", KeyDirectoryMetadataFile)
+	} else if metadata.Keys[0].DurationSecs <= 0 {
+		return nil, fmt.Errorf("keys: the signing key needs a durationSecs")
+	}
+
+	tokenConfigs := make([]TokenConfig, 0, len(metadata.Keys))
+	for index, key := range metadata.Keys {
+		tokenConfig := TokenConfig{
+			Algorithm:      key.Algorithm,
+			Issuer:         key.Issuer,
+			Audience:       key.Audience,
+			ExtraAudiences: key.ExtraAudiences,
+			DurationSecs:   key.DurationSecs,
+			ClockSkewSecs:  key.ClockSkewSecs,
+		}
+		var err error
+		if tokenConfig.EncodeKey, err = readKeyFile(directory, key.PrivateKeyFile); err != nil {
+			return nil, fmt.Errorf("keys: key %d: %v", index, err)
+		}
+		if !tokenConfig.IsAsymmetric() {
+			tokenConfig.EncodeKey = strings.TrimRight(tokenConfig.EncodeKey, "\r\n")
+			tokenConfig.DecodeKey = tokenConfig.EncodeKey
+		} else if tokenConfig.DecodeKey, err = readKeyFile(directory, key.PublicKeyFile); err != nil {
+			return nil, fmt.Errorf("keys: key %d: %v", index, err)
+		}
+		tokenConfigs = append(tokenConfigs, tokenConfig)
+	}
+	return tokenConfigs, nil
+}
+
+// readKeyFile returns the content of the file, or an empty key if no file is given
+func readKeyFile(directory string, name string) (string, error) {
+	if name == "" {
+		return "", nil
+	}
+	content, err := ioutil.ReadFile(filepath.Join(directory, name))
+	return string(content), err
+}
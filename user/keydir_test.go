@@ -0,0 +1,75 @@
+package user
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeKeyDirectory writes the files and the metadata of the keys to the directory
+func writeKeyDirectory(t *testing.T, directory string, files map[string]string, keys ...KeyFile) {
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(directory, name), []byte(content), 0600); err != nil {
+			t.Fatalf("there should be no error writing %s: %v", name, err)
+		}
+	}
+	metadata, _ := json.Marshal(KeyDirectory{Keys: keys})
+	if err := ioutil.WriteFile(filepath.Join(directory, KeyDirectoryMetadataFile), metadata, 0600); err != nil {
+		t.Fatalf("there should be no error writing the metadata: %v", err)
+	}
+}
+
+func TestLoadKeyDirectory(t *testing.T) {
+
+	directory := t.TempDir()
+	current := generateTokenConfig(t, "ES256")
+	writeKeyDirectory(t, directory,
+		map[string]string{"current.pem": current.EncodeKey, "current.pub.pem": current.DecodeKey, "previous.pub.pem": tokenConfigs[0].DecodeKey, "secret": "my secret\n"},
+		KeyFile{Algorithm: "ES256", PrivateKeyFile: "current.pem", PublicKeyFile: "current.pub.pem", Issuer: "localhost", Audience: "localhost", DurationSecs: 3600},
+		KeyFile{Algorithm: "RS256", PublicKeyFile: "previous.pub.pem", Issuer: "localhost", Audience: "localhost", ExtraAudiences: []string{"old.tidepool.test"}},
+		KeyFile{Algorithm: "HS256", PrivateKeyFile: "secret", Issuer: "localhost", Audience: "localhost"},
+	)
+
+	loaded, err := LoadKeyDirectory(directory)
+	if err != nil {
+		t.Fatalf("there should be no error loading the keys: %v", err)
+	}
+	expected := []TokenConfig{
+		current,
+		{Algorithm: "RS256", DecodeKey: tokenConfigs[0].DecodeKey, Issuer: "localhost", Audience: "localhost", ExtraAudiences: []string{"old.tidepool.test"}},
+		{Algorithm: "HS256", EncodeKey: "my secret", DecodeKey: "my secret", Issuer: "localhost", Audience: "localhost"},
+	}
+	if !reflect.DeepEqual(loaded, expected) {
+		t.Fatalf("the token configs %#v should be %#v", loaded, expected)
+	}
+	if _, err := NewKeyRing(loaded...); err != nil {
+		t.Fatalf("there should be no error creating the key ring: %v", err)
+	}
+
+}
+
+func TestLoadKeyDirectory_Invalid(t *testing.T) {
+
+	if _, err := LoadKeyDirectory(t.TempDir()); err == nil {
+		t.Fatal("there should be an error without metadata")
+	}
+
+	directory := t.TempDir()
+	writeKeyDirectory(t, directory, nil)
+	if _, err := LoadKeyDirectory(directory); err == nil {
+		t.Fatal("there should be an error without keys")
+	}
+
+	writeKeyDirectory(t, directory, nil, KeyFile{Algorithm: "HS256", PrivateKeyFile: "secret", DurationSecs: 3600})
+	if _, err := LoadKeyDirectory(directory); err == nil {
+		t.Fatal("there should be an error for a missing key file")
+	}
+
+	writeKeyDirectory(t, directory, map[string]string{"secret": "my secret"}, KeyFile{Algorithm: "HS256", PrivateKeyFile: "secret"})
+	if _, err := LoadKeyDirectory(directory); err == nil {
+		t.Fatal("there should be an error for a signing key without duration")
+	}
+
+}
@@ -0,0 +1,254 @@
+package user
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+type (
+	// KeyRing holds the parsed keys of the token configs, so that signing and verifying tokens does not parse
+	// PEM keys every time. The first key signs new tokens, all keys verify them. A key ring does not change
+	// once created and is safe for concurrent use.
+	KeyRing struct {
+		tokenConfigs []TokenConfig
+		keys         []*ringKey
+		keySet       *JSONWebKeySet
+	}
+
+	// ringKey is a token config with its parsed keys
+	ringKey struct {
+		config          TokenConfig
+		method          jwt.SigningMethod
+		kid             string
+		signingKey      interface{} // only parsed for the first key
+		verificationKey interface{}
+		parser          *jwt.Parser
+	}
+)
+
+var (
+	KeyRing_error_no_keys      = errors.New("KeyRing: no token configs")
+	KeyRing_error_key_mismatch = errors.New("KeyRing: the encode key does not match the decode key")
+)
+
+// NewKeyRing parses the keys of the token configs, the first of which signs new tokens. Other configs without
+// a decode key are unused slots and skipped.
+func NewKeyRing(tokenConfigs ...TokenConfig) (*KeyRing, error) {
+	if len(tokenConfigs) == 0 {
+		return nil, KeyRing_error_no_keys
+	}
+
+	keyRing := &KeyRing{tokenConfigs: tokenConfigs}
+	configs := make([]TokenConfig, 0, len(tokenConfigs))
+	for index, tokenConfig := range tokenConfigs {
+		if index > 0 && tokenConfig.DecodeKey == "" {
+			continue
+		}
+		key, err := newRingKey(tokenConfig, index == 0)
+		if err != nil {
+			// never include the config, it holds the private key
+			return nil, fmt.Errorf("KeyRing: token config %d: %v", index, err)
+		}
+		keyRing.keys = append(keyRing.keys, key)
+		configs = append(configs, tokenConfig)
+	}
+
+	keySet, err := NewJSONWebKeySet(configs...)
+	if err != nil {
+		return nil, fmt.Errorf("KeyRing: %v", err)
+	}
+	keyRing.keySet = keySet
+	return keyRing, nil
+}
+
+func newRingKey(config TokenConfig, signs bool) (*ringKey, error) {
+	method := jwt.GetSigningMethod(config.Algorithm)
+	if method == nil {
+		return nil, fmt.Errorf("invalid signing method %q", config.Algorithm)
+	}
+
+	key := &ringKey{
+		config: config,
+		method: method,
+		parser: &jwt.Parser{ValidMethods: []string{method.Alg()}, SkipClaimsValidation: true},
+	}
+	var err error
+	if key.kid, err = config.KeyID(); err != nil {
+		return nil, err
+	}
+	if key.verificationKey, err = verificationKey(method, config); err != nil {
+		return nil, err
+	}
+	if signs {
+		if key.signingKey, err = signingKey(method, config); err != nil {
+			return nil, err
+		}
+		// catches a private key replaced without its public key
+		if signature, err := method.Sign("key check", key.signingKey); err != nil {
+			return nil, err
+		} else if err := method.Verify("key check", signature, key.verificationKey); err != nil {
+			return nil, KeyRing_error_key_mismatch
+		}
+	}
+	return key, nil
+}
+
+// Algorithm returns the algorithm new tokens are signed with
+func (r *KeyRing) Algorithm() string {
+	return r.keys[0].method.Alg()
+}
+
+// IsAsymmetric reports whether new tokens are signed with a private key, rather than a secret shared with every
+// party able to verify them
+func (r *KeyRing) IsAsymmetric() bool {
+	_, symmetric := r.keys[0].method.(*jwt.SigningMethodHMAC)
+	return !symmetric
+}
+
+// KeyIDs returns the ids of the asymmetric keys of the key ring, the signing key first
+func (r *KeyRing) KeyIDs() []string {
+	kids := []string{}
+	for _, key := range r.keys {
+		if key.kid != "" {
+			kids = append(kids, key.kid)
+		}
+	}
+	return kids
+}
+
+// JSONWebKeySet returns the public keys of the key ring, see NewJSONWebKeySet
+func (r *KeyRing) JSONWebKeySet() *JSONWebKeySet {
+	return r.keySet
+}
+
+// signingConfig returns the token config of the key that signs new tokens
+func (r *KeyRing) signingConfig() TokenConfig {
+	return r.keys[0].config
+}
+
+// sign signs the claims with the first key, identified by the kid header
+func (r *KeyRing) sign(claims jwt.MapClaims) (string, error) {
+	key := r.keys[0]
+	token := jwt.NewWithClaims(key.method, claims)
+	if key.kid != "" {
+		token.Header["kid"] = key.kid
+	}
+
+	tokenString, err := token.SignedString(key.signingKey)
+	if err != nil {
+		log.Printf("failed to sign with %s key", key.method.Alg())
+		return "", err
+	}
+	return tokenString, nil
+}
+
+// verify parses the JWT with the key named by its kid header. Tokens without a key id, issued before key ids
+// or signed with a symmetric key, are verified with the first of the keys of their algorithm able to verify
+// them. Besides the signature the token must carry the algorithm, issuer and an audience of the config of the
+// key, see verifyClaims.
+func (r *KeyRing) verify(tokenString string) (*jwt.Token, error) {
+	candidates, err := r.verificationKeys(tokenString)
+	if err != nil {
+		log.Printf("failed to Parse JWT: %v", err)
+		return nil, err
+	}
+
+	var jwtToken *jwt.Token
+	for _, key := range candidates {
+		jwtToken, err = key.parser.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+			return key.verificationKey, nil
+		})
+		if err == nil {
+			err = key.config.verifyClaims(jwtToken.Claims.(jwt.MapClaims), time.Now())
+		}
+
+		if err == nil {
+			break
+		}
+	}
+	if jwtToken == nil || err != nil {
+		log.Printf("failed to Parse JWT: %v", err)
+		return nil, err
+	}
+	if !jwtToken.Valid {
+		return nil, SessionToken_invalid
+	}
+	return jwtToken, nil
+}
+
+// verificationKeys returns the keys that may have signed the token
+func (r *KeyRing) verificationKeys(tokenString string) ([]*ringKey, error) {
+	token, _, err := new(jwt.Parser).ParseUnverified(tokenString, jwt.MapClaims{})
+	if err != nil {
+		return nil, err
+	}
+	algorithm, _ := token.Header["alg"].(string)
+	kid, _ := token.Header["kid"].(string)
+
+	var candidates []*ringKey
+	for _, key := range r.keys {
+		if key.method.Alg() != algorithm {
+			continue
+		} else if kid == "" {
+			candidates = append(candidates, key)
+		} else if key.kid == kid {
+			return []*ringKey{key}, nil
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, TokenConfig_error_unknown_key
+	}
+	return candidates, nil
+}
+
+// signingKey parses the private key of the config for the signing method, symmetric keys are used as they are
+func signingKey(signingMethod jwt.SigningMethod, config TokenConfig) (interface{}, error) {
+	switch signingMethod.(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		return jwt.ParseRSAPrivateKeyFromPEM([]byte(config.EncodeKey))
+	case *jwt.SigningMethodECDSA:
+		return parseECPrivateKeyFromPEM([]byte(config.EncodeKey))
+	case *SigningMethodEd25519:
+		return ParseEdPrivateKeyFromPEM([]byte(config.EncodeKey))
+	}
+	return []byte(config.EncodeKey), nil
+}
+
+// parseECPrivateKeyFromPEM parses a SEC 1 EC private key, as jwt-go does, or a PKCS #8 one as written by
+// `openssl genpkey -algorithm EC`
+func parseECPrivateKeyFromPEM(key []byte) (*ecdsa.PrivateKey, error) {
+	privateKey, err := jwt.ParseECPrivateKeyFromPEM(key)
+	if err == nil || err == jwt.ErrKeyMustBePEMEncoded {
+		return privateKey, err
+	}
+	block, _ := pem.Decode(key)
+	parsed, pkcs8Err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if pkcs8Err != nil {
+		return nil, err
+	}
+	privateKey, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, jwt.ErrNotECPrivateKey
+	}
+	return privateKey, nil
+}
+
+// verificationKey parses the public key of the config for the signing method, symmetric keys are used as they are
+func verificationKey(signingMethod jwt.SigningMethod, config TokenConfig) (interface{}, error) {
+	switch signingMethod.(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		return jwt.ParseRSAPublicKeyFromPEM([]byte(config.DecodeKey))
+	case *jwt.SigningMethodECDSA:
+		return jwt.ParseECPublicKeyFromPEM([]byte(config.DecodeKey))
+	case *SigningMethodEd25519:
+		return ParseEdPublicKeyFromPEM([]byte(config.DecodeKey))
+	}
+	return []byte(config.DecodeKey), nil
+}
@@ -0,0 +1,95 @@
+package user
+
+import (
+	"strings"
+	"testing"
+)
+
+func newKeyRing(t testing.TB, tokenConfigs ...TokenConfig) *KeyRing {
+	keyRing, err := NewKeyRing(tokenConfigs...)
+	if err != nil {
+		t.Fatalf("there should be no error creating the key ring: %v", err)
+	}
+	return keyRing
+}
+
+func TestNewKeyRing(t *testing.T) {
+
+	// an unset previous key, as when PREVIOUS_PUBLIC_KEY is not given, is skipped
+	keyRing := newKeyRing(t, tokenConfigs[0], TokenConfig{Algorithm: "RS256"}, tokenConfigs[1])
+	if len(keyRing.keys) != 2 || keyRing.Algorithm() != "RS256" || len(keyRing.JSONWebKeySet().Keys) != 1 {
+		t.Fatalf("unexpected key ring %#v", keyRing)
+	}
+	if keyRing.keys[0].kid == "" || keyRing.keys[1].kid != "" {
+		t.Fatal("only the RSA key should have a key id")
+	}
+
+	if _, err := NewKeyRing(); err != KeyRing_error_no_keys {
+		t.Fatalf("there should be an error without token configs, got %v", err)
+	}
+	if _, err := NewKeyRing(TokenConfig{Algorithm: "XS256"}); err == nil {
+		t.Fatal("there should be an error for an unknown algorithm")
+	}
+
+	invalid := tokenConfigs[0]
+	invalid.EncodeKey = invalid.EncodeKey[:100]
+	if _, err := NewKeyRing(invalid); err == nil || strings.Contains(err.Error(), invalid.EncodeKey[40:]) {
+		t.Fatalf("there should be an error for an invalid private key that does not include the key, got %v", err)
+	}
+	if _, err := NewKeyRing(tokenConfigs[1], invalid); err != nil {
+		t.Fatalf("the private key of a previous config should not be needed: %v", err)
+	}
+
+}
+
+func TestKeyRing_SignAndVerify(t *testing.T) {
+
+	keyRing := newKeyRing(t, generateTokenConfig(t, "ES256"), tokenConfigs[0], tokenConfigs[1])
+
+	token, err := keyRing.CreateSessionToken(&TokenData{UserId: "2341", DurationSecs: 1200})
+	if err != nil {
+		t.Fatalf("there should be no error creating the token: %v", err)
+	}
+	if data, err := keyRing.UnpackSessionTokenAndVerify(token.ID); err != nil || data.UserId != "2341" {
+		t.Fatalf("the token should be valid, got %#v %v", data, err)
+	}
+
+	for _, tokenConfig := range tokenConfigs {
+		token, _ := CreateSessionToken(&TokenData{UserId: "2341", DurationSecs: 1200}, tokenConfig)
+		if _, err := keyRing.UnpackSessionTokenAndVerify(token.ID); err != nil {
+			t.Fatalf("a token of a previous %s key should be valid: %v", tokenConfig.Algorithm, err)
+		}
+	}
+
+}
+
+func BenchmarkUnpackSessionTokenAndVerify(b *testing.B) {
+	token, _ := CreateSessionToken(&TokenData{UserId: "2341", DurationSecs: 1200}, tokenConfigs[0])
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := UnpackSessionTokenAndVerify(token.ID, tokenConfigs...); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkKeyRing_UnpackSessionTokenAndVerify(b *testing.B) {
+	keyRing := newKeyRing(b, tokenConfigs...)
+	token, _ := keyRing.CreateSessionToken(&TokenData{UserId: "2341", DurationSecs: 1200})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := keyRing.UnpackSessionTokenAndVerify(token.ID); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkKeyRing_CreateSessionToken(b *testing.B) {
+	keyRing := newKeyRing(b, tokenConfigs...)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := keyRing.CreateSessionToken(&TokenData{UserId: "2341", DurationSecs: 1200}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package user
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+type (
+	// KeyRotationConfig configures the automated rotation of the token signing keys. Each key signs tokens for
+	// IntervalSecs; it is generated and published OverlapSecs before, so that other services fetch it from the
+	// JWKS endpoint before they see tokens signed with it. The rotation is disabled without an interval.
+	KeyRotationConfig struct {
+		IntervalSecs      int64  `json:"intervalSecs"`      // how long each key signs tokens
+		OverlapSecs       int64  `json:"overlapSecs"`       // how long a new key is published before it signs tokens
+		RetentionSecs     int64  `json:"retentionSecs"`     // how long a key verifies tokens after it stopped signing, defaults to the longest token duration
+		CheckIntervalSecs int64  `json:"checkIntervalSecs"` // how often each replica checks the stored keys
+		Algorithm         string `json:"algorithm"`         // ES256, EdDSA or RS256
+		EncryptionKey     string `json:"encryptionKey"`     // base64 encoded AES-256 key the stored private keys are encrypted with
+	}
+
+	// SigningKey is a token signing key generated by the key rotation. The generation is the rotation period the
+	// key was generated for, only one key is stored per generation.
+	SigningKey struct {
+		Generation          int64     `bson:"_id"`
+		KeyID               string    `bson:"keyId"`
+		Algorithm           string    `bson:"algorithm"`
+		PublicKey           string    `bson:"publicKey"`           // PEM
+		EncryptedPrivateKey string    `bson:"encryptedPrivateKey"` // PEM, encrypted with KeyRotationConfig.EncryptionKey
+		CreatedAt           time.Time `bson:"createdAt"`
+		ActivatesAt         time.Time `bson:"activatesAt"` // when the key starts signing tokens, it stops when the next key starts
+	}
+)
+
+var DefaultKeyRotationConfig = KeyRotationConfig{
+	OverlapSecs:       60 * 60,
+	CheckIntervalSecs: 60,
+	Algorithm:         "ES256",
+}
+
+// rotationAlgorithms are the algorithms generatePrivateKey generates keys for
+var rotationAlgorithms = []string{"ES256", "EdDSA", "RS256"}
+
+var SigningKey_error_decryption = errors.New("SigningKey: the private key cannot be decrypted with the encryption key")
+
+func (c KeyRotationConfig) withDefaults(retentionSecs int64) KeyRotationConfig {
+	if c.OverlapSecs == 0 {
+		c.OverlapSecs = DefaultKeyRotationConfig.OverlapSecs
+	}
+	if c.RetentionSecs == 0 {
+		c.RetentionSecs = retentionSecs
+	}
+	if c.CheckIntervalSecs == 0 {
+		c.CheckIntervalSecs = DefaultKeyRotationConfig.CheckIntervalSecs
+	}
+	if c.Algorithm == "" {
+		c.Algorithm = DefaultKeyRotationConfig.Algorithm
+	}
+	return c
+}
+
+// IsEnabled reports whether the signing keys are rotated automatically
+func (c KeyRotationConfig) IsEnabled() bool {
+	return c.IntervalSecs > 0
+}
+
+// Validate checks the periods, the algorithm and the encryption key of an enabled rotation
+func (c KeyRotationConfig) Validate() error {
+	if !c.IsEnabled() {
+		return nil
+	}
+	c = c.withDefaults(0)
+	if c.OverlapSecs < 0 || c.OverlapSecs >= c.IntervalSecs {
+		return errors.New("key rotation: overlapSecs must be shorter than intervalSecs")
+	} else if c.RetentionSecs < 0 || c.CheckIntervalSecs < 0 {
+		return errors.New("key rotation: retentionSecs and checkIntervalSecs must not be negative")
+	} else if !containsString(rotationAlgorithms, c.Algorithm) {
+		return fmt.Errorf("key rotation: unsupported algorithm %q", c.Algorithm)
+	} else if _, err := c.encryptionKey(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c KeyRotationConfig) encryptionKey() ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(c.EncryptionKey)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("key rotation: encryptionKey must be 32 base64 encoded bytes")
+	}
+	return key, nil
+}
+
+// generation returns the rotation period of the time
+func (c KeyRotationConfig) generation(now time.Time) int64 {
+	return now.Unix() / c.IntervalSecs
+}
+
+// generationStart returns when the keys of the generation start signing tokens, unless they were generated late
+func (c KeyRotationConfig) generationStart(generation int64) time.Time {
+	return time.Unix(generation*c.IntervalSecs, 0)
+}
+
+// NewSigningKey generates the key of the generation with its private key encrypted with the encryption key
+func NewSigningKey(generation int64, algorithm string, activatesAt time.Time, encryptionKey []byte) (*SigningKey, error) {
+	privateKey, err := generatePrivateKey(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	privateDER, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(privateKey.(interface{ Public() crypto.PublicKey }).Public())
+	if err != nil {
+		return nil, err
+	}
+
+	key := &SigningKey{
+		Generation:  generation,
+		Algorithm:   algorithm,
+		PublicKey:   string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})),
+		CreatedAt:   time.Now(),
+		ActivatesAt: activatesAt,
+	}
+	if key.KeyID, err = (TokenConfig{Algorithm: algorithm, DecodeKey: key.PublicKey}).KeyID(); err != nil {
+		return nil, err
+	}
+	privatePEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER})
+	if key.EncryptedPrivateKey, err = encryptPrivateKey(privatePEM, key.KeyID, encryptionKey); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func generatePrivateKey(algorithm string) (interface{}, error) {
+	switch algorithm {
+	case "ES256":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "EdDSA":
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		return privateKey, err
+	case "RS256":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	}
+	return nil, fmt.Errorf("key rotation: unsupported algorithm %q", algorithm)
+}
+
+// tokenConfig returns the token config of the key, the other settings are those of the template. The private
+// key is only decrypted for the key that signs tokens.
+func (k *SigningKey) tokenConfig(template TokenConfig, encryptionKey []byte, signs bool) (TokenConfig, error) {
+	config := template
+	config.Algorithm = k.Algorithm
+	config.DecodeKey = k.PublicKey
+	config.EncodeKey = ""
+	if signs {
+		privateKey, err := decryptPrivateKey(k.EncryptedPrivateKey, k.KeyID, encryptionKey)
+		if err != nil {
+			return TokenConfig{}, err
+		}
+		config.EncodeKey = string(privateKey)
+	}
+	return config, nil
+}
+
+// encryptPrivateKey seals the key with AES-GCM, bound to the key id so that it cannot be swapped with another key
+func encryptPrivateKey(privateKey []byte, kid string, encryptionKey []byte) (string, error) {
+	aead, err := newKeyCipher(encryptionKey)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, privateKey, []byte(kid))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptPrivateKey(encrypted string, kid string, encryptionKey []byte) ([]byte, error) {
+	aead, err := newKeyCipher(encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, SigningKey_error_decryption
+	}
+	privateKey, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(kid))
+	if err != nil {
+		return nil, SigningKey_error_decryption
+	}
+	return privateKey, nil
+}
+
+func newKeyCipher(encryptionKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// activeSigningKey returns the latest of the keys that started signing, or nil if none did yet
+func activeSigningKey(keys []*SigningKey, now time.Time) *SigningKey {
+	var active *SigningKey
+	for _, key := range keys {
+		if !key.ActivatesAt.After(now) && (active == nil || key.ActivatesAt.After(active.ActivatesAt)) {
+			active = key
+		}
+	}
+	return active
+}
+
+// partitionSigningKeys splits the keys, ordered by generation, into those still needed and those whose tokens
+// have all expired: their successor started signing more than the retention ago
+func partitionSigningKeys(keys []*SigningKey, retention time.Duration, now time.Time) (retained []*SigningKey, retired []*SigningKey) {
+	for index, key := range keys {
+		if index < len(keys)-1 && !keys[index+1].ActivatesAt.Add(retention).After(now) {
+			retired = append(retired, key)
+		} else {
+			retained = append(retained, key)
+		}
+	}
+	return retained, retired
+}
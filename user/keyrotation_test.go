@@ -0,0 +1,123 @@
+package user
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+var (
+	testEncryptionKey      = []byte("0123456789abcdef0123456789abcdef")
+	testEncryptionKeyValue = base64.StdEncoding.EncodeToString(testEncryptionKey)
+)
+
+// newSigningKey generates a signing key encrypted with the test encryption key
+func newSigningKey(t *testing.T, generation int64, algorithm string, activatesAt time.Time) *SigningKey {
+	key, err := NewSigningKey(generation, algorithm, activatesAt, testEncryptionKey)
+	if err != nil {
+		t.Fatalf("there should be no error generating a %s key: %v", algorithm, err)
+	}
+	return key
+}
+
+func TestNewSigningKey(t *testing.T) {
+
+	template := TokenConfig{Issuer: "localhost", Audience: "localhost", DurationSecs: 3600}
+	for _, algorithm := range rotationAlgorithms {
+		key := newSigningKey(t, 7, algorithm, time.Now())
+		if key.KeyID == "" || key.Generation != 7 || key.Algorithm != algorithm {
+			t.Fatalf("the %s key should have a key id and its generation, got %+v", algorithm, key)
+		}
+
+		tokenConfig, err := key.tokenConfig(template, testEncryptionKey, true)
+		if err != nil {
+			t.Fatalf("there should be no error decrypting the %s key: %v", algorithm, err)
+		}
+		keyRing, err := NewKeyRing(tokenConfig)
+		if err != nil {
+			t.Fatalf("the decrypted %s key should match its public key: %v", algorithm, err)
+		}
+		sessionToken, err := keyRing.CreateSessionToken(&TokenData{UserId: "1111111111", DurationSecs: 3600})
+		if err != nil {
+			t.Fatalf("there should be no error signing with the %s key: %v", algorithm, err)
+		}
+		if _, err := keyRing.UnpackSessionTokenAndVerify(sessionToken.ID); err != nil {
+			t.Fatalf("the %s token should verify: %v", algorithm, err)
+		}
+		if keyRing.KeyIDs()[0] != key.KeyID {
+			t.Fatalf("the key ring should use the key id of the stored key, got %v", keyRing.KeyIDs())
+		}
+	}
+}
+
+func TestSigningKey_tokenConfig_Decryption(t *testing.T) {
+
+	key := newSigningKey(t, 1, "ES256", time.Now())
+	if verifying, err := key.tokenConfig(TokenConfig{}, nil, false); err != nil || verifying.EncodeKey != "" {
+		t.Fatalf("a verifying key should not need the encryption key, got %v", err)
+	}
+	if _, err := key.tokenConfig(TokenConfig{}, []byte("fedcba9876543210fedcba9876543210"), true); err != SigningKey_error_decryption {
+		t.Fatalf("another encryption key should not decrypt the private key, got %v", err)
+	}
+
+	// the private key of one key swapped into another
+	other := newSigningKey(t, 2, "ES256", time.Now())
+	other.EncryptedPrivateKey = key.EncryptedPrivateKey
+	if _, err := other.tokenConfig(TokenConfig{}, testEncryptionKey, true); err != SigningKey_error_decryption {
+		t.Fatalf("a private key should only decrypt for its own key id, got %v", err)
+	}
+}
+
+func TestKeyRotationConfig_Validate(t *testing.T) {
+
+	valid := KeyRotationConfig{IntervalSecs: 86400, EncryptionKey: testEncryptionKeyValue}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("there should be no error validating %+v: %v", valid, err)
+	}
+	if err := (KeyRotationConfig{}).Validate(); err != nil {
+		t.Fatalf("a disabled rotation should be valid: %v", err)
+	}
+
+	invalid := []KeyRotationConfig{
+		{IntervalSecs: 3600, EncryptionKey: testEncryptionKeyValue},
+		{IntervalSecs: 86400, OverlapSecs: 86400, EncryptionKey: testEncryptionKeyValue},
+		{IntervalSecs: 86400, RetentionSecs: -1, EncryptionKey: testEncryptionKeyValue},
+		{IntervalSecs: 86400, Algorithm: "HS256", EncryptionKey: testEncryptionKeyValue},
+		{IntervalSecs: 86400},
+		{IntervalSecs: 86400, EncryptionKey: base64.StdEncoding.EncodeToString([]byte("too short"))},
+	}
+	for _, config := range invalid {
+		if err := config.Validate(); err == nil {
+			t.Fatalf("there should be an error validating %+v", config)
+		}
+	}
+}
+
+func TestPartitionSigningKeys(t *testing.T) {
+
+	start := time.Unix(1000000, 0)
+	keys := []*SigningKey{
+		{Generation: 1, ActivatesAt: start},
+		{Generation: 2, ActivatesAt: start.Add(time.Hour)},
+		{Generation: 3, ActivatesAt: start.Add(2 * time.Hour)},
+		{Generation: 4, ActivatesAt: start.Add(3 * time.Hour)},
+	}
+
+	retained, retired := partitionSigningKeys(keys, time.Hour, start.Add(3*time.Hour))
+	if len(retired) != 2 || retired[0].Generation != 1 || retired[1].Generation != 2 {
+		t.Fatalf("the keys whose successor signed for the retention should be retired, got %v", retired)
+	}
+	if len(retained) != 2 || retained[0].Generation != 3 {
+		t.Fatalf("the other keys should be retained, got %v", retained)
+	}
+	if _, retired := partitionSigningKeys(keys[3:], 0, start.Add(time.Hour*24)); len(retired) != 0 {
+		t.Fatalf("the latest key should never be retired")
+	}
+
+	if active := activeSigningKey(keys, start.Add(90*time.Minute)); active != keys[1] {
+		t.Fatalf("the latest activated key should be active, got %v", active)
+	}
+	if active := activeSigningKey(keys, start.Add(-time.Minute)); active != nil {
+		t.Fatalf("no key should be active before the first activation, got %v", active)
+	}
+}
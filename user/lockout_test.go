@@ -0,0 +1,67 @@
+package user
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginLockoutConfig_ShouldLock(t *testing.T) {
+
+	config := LoginLockoutConfig{}
+	if config.ShouldLock(DefaultLoginLockoutConfig.MaxFailedLogins - 1) {
+		t.Fatal("the account should not be locked before the default threshold")
+	}
+	if !config.ShouldLock(DefaultLoginLockoutConfig.MaxFailedLogins) {
+		t.Fatal("the account should be locked at the default threshold")
+	}
+
+	disabled := LoginLockoutConfig{MaxFailedLogins: -1}
+	if disabled.ShouldLock(1000) {
+		t.Fatal("the account should never be locked when locking is disabled")
+	}
+
+}
+
+func TestLoginLockoutConfig_Backoff(t *testing.T) {
+
+	config := LoginLockoutConfig{BackoffBaseMillis: 100, BackoffMaxMillis: 1000}
+
+	expected := map[int]time.Duration{
+		0:  0,
+		1:  100 * time.Millisecond,
+		2:  200 * time.Millisecond,
+		4:  800 * time.Millisecond,
+		5:  time.Second,
+		64: time.Second,
+	}
+	for failedLogins, delay := range expected {
+		if backoff := config.Backoff(failedLogins); backoff != delay {
+			t.Fatalf("the backoff after %d failures should be %v, but was %v", failedLogins, delay, backoff)
+		}
+	}
+
+	disabled := LoginLockoutConfig{BackoffBaseMillis: -1}
+	if disabled.Backoff(5) != 0 {
+		t.Fatal("there should be no backoff when backoff is disabled")
+	}
+
+}
+
+func TestLoginLockoutConfig_NextLoginAllowedAt(t *testing.T) {
+
+	config := LoginLockoutConfig{BackoffBaseMillis: 1000, BackoffMaxMillis: 60000}
+	lastFailure := time.Now()
+
+	if next := config.NextLoginAllowedAt(&User{}); time.Now().Before(next) {
+		t.Fatal("a user without failures should be allowed to login immediately")
+	}
+	if next := config.NextLoginAllowedAt(&User{FailedLogins: 2, LastFailedLoginTime: lastFailure}); !next.Equal(lastFailure.Add(2 * time.Second)) {
+		t.Fatalf("the next login should be allowed after the backoff, but was %v", next)
+	}
+
+	lockedUntil := lastFailure.Add(time.Hour)
+	if next := config.NextLoginAllowedAt(&User{FailedLogins: 2, LastFailedLoginTime: lastFailure, LockedUntil: lockedUntil}); !next.Equal(lockedUntil) {
+		t.Fatalf("the next login should be allowed once the lock expires, but was %v", next)
+	}
+
+}
@@ -1,11 +1,20 @@
 package user
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 type MockEventsNotifier struct {
 	NotifyUserDeletedResponses []error
 	NotifyUserCreatedResponses []error
 	NotifyUserUpdatedResponses []error
+
+	NotifyPasswordResetRequestedResponses     []error
+	NotifyEmailVerificationRequestedResponses []error
+	NotifyPasswordChangedResponses            []error
+	NotifySessionsRevokedResponses            []error
+	NotifyTokensRevokedResponses              []error
 }
 
 func NewMockEventsNotifier() *MockEventsNotifier {
@@ -15,13 +24,23 @@ func NewMockEventsNotifier() *MockEventsNotifier {
 func (m *MockEventsNotifier) HasResponses() bool {
 	return len(m.NotifyUserDeletedResponses) > 0 ||
 		len(m.NotifyUserCreatedResponses) > 0 ||
-		len(m.NotifyUserUpdatedResponses) > 0
+		len(m.NotifyUserUpdatedResponses) > 0 ||
+		len(m.NotifyPasswordResetRequestedResponses) > 0 ||
+		len(m.NotifyEmailVerificationRequestedResponses) > 0 ||
+		len(m.NotifyPasswordChangedResponses) > 0 ||
+		len(m.NotifySessionsRevokedResponses) > 0 ||
+		len(m.NotifyTokensRevokedResponses) > 0
 }
 
 func (m *MockEventsNotifier) Reset() {
 	m.NotifyUserDeletedResponses = nil
 	m.NotifyUserCreatedResponses = nil
 	m.NotifyUserUpdatedResponses = nil
+	m.NotifyPasswordResetRequestedResponses = nil
+	m.NotifyEmailVerificationRequestedResponses = nil
+	m.NotifyPasswordChangedResponses = nil
+	m.NotifySessionsRevokedResponses = nil
+	m.NotifyTokensRevokedResponses = nil
 }
 
 func (m *MockEventsNotifier) NotifyUserDeleted(ctx context.Context, user User, profile Profile) (err error) {
@@ -48,4 +67,44 @@ func (m *MockEventsNotifier) NotifyUserUpdated(ctx context.Context, before User,
 	panic("NotifyUserUpdated unavailable")
 }
 
+func (m *MockEventsNotifier) NotifyPasswordResetRequested(ctx context.Context, user User, resetToken string, expiresAt time.Time) (err error) {
+	if len(m.NotifyPasswordResetRequestedResponses) > 0 {
+		err, m.NotifyPasswordResetRequestedResponses = m.NotifyPasswordResetRequestedResponses[0], m.NotifyPasswordResetRequestedResponses[1:]
+		return err
+	}
+	panic("NotifyPasswordResetRequested unavailable")
+}
+
+func (m *MockEventsNotifier) NotifyEmailVerificationRequested(ctx context.Context, user User, verificationToken string, expiresAt time.Time) (err error) {
+	if len(m.NotifyEmailVerificationRequestedResponses) > 0 {
+		err, m.NotifyEmailVerificationRequestedResponses = m.NotifyEmailVerificationRequestedResponses[0], m.NotifyEmailVerificationRequestedResponses[1:]
+		return err
+	}
+	panic("NotifyEmailVerificationRequested unavailable")
+}
+
+func (m *MockEventsNotifier) NotifyPasswordChanged(ctx context.Context, user User, changedAt time.Time) (err error) {
+	if len(m.NotifyPasswordChangedResponses) > 0 {
+		err, m.NotifyPasswordChangedResponses = m.NotifyPasswordChangedResponses[0], m.NotifyPasswordChangedResponses[1:]
+		return err
+	}
+	panic("NotifyPasswordChanged unavailable")
+}
+
+func (m *MockEventsNotifier) NotifySessionsRevoked(ctx context.Context, user User, revokedBy string, revokedAt time.Time) (err error) {
+	if len(m.NotifySessionsRevokedResponses) > 0 {
+		err, m.NotifySessionsRevokedResponses = m.NotifySessionsRevokedResponses[0], m.NotifySessionsRevokedResponses[1:]
+		return err
+	}
+	panic("NotifySessionsRevoked unavailable")
+}
+
+func (m *MockEventsNotifier) NotifyTokensRevoked(ctx context.Context, revocation TokensRevokedEvent) (err error) {
+	if len(m.NotifyTokensRevokedResponses) > 0 {
+		err, m.NotifyTokensRevokedResponses = m.NotifyTokensRevokedResponses[0], m.NotifyTokensRevokedResponses[1:]
+		return err
+	}
+	panic("NotifyTokensRevoked unavailable")
+}
+
 var _ EventsNotifier = &MockEventsNotifier{}
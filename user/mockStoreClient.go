@@ -52,7 +52,7 @@ func (d MockStoreClient) FindUsers(user *User) (found []*User, err error) {
 	}
 
 	if user.Username != "" {
-		found, err := NewUser(&NewUserDetails{Username: &user.Username, Password: &password, Emails: []string{}}, d.salt)
+		found, err := NewUser(&NewUserDetails{Username: &user.Username, Password: &password, Emails: []string{}}, d.salt, DefaultPasswordHashConfig, DefaultPasswordPolicy)
 		if err != nil {
 			return []*User{}, err
 		}
@@ -113,7 +113,7 @@ func (d MockStoreClient) FindUser(user *User) (found *User, err error) {
 	password := "123youknoWm3"
 
 	if d.returnDifferent {
-		other, err := NewUser(&NewUserDetails{Username: &username, Password: &password, Emails: []string{}}, d.salt)
+		other, err := NewUser(&NewUserDetails{Username: &username, Password: &password, Emails: []string{}}, d.salt, DefaultPasswordHashConfig, DefaultPasswordPolicy)
 		if err != nil {
 			return nil, err
 		}
@@ -122,7 +122,7 @@ func (d MockStoreClient) FindUser(user *User) (found *User, err error) {
 	}
 
 	if user.Username != "" {
-		found, err := NewUser(&NewUserDetails{Username: &user.Username, Password: &password, Emails: []string{}}, d.salt)
+		found, err := NewUser(&NewUserDetails{Username: &user.Username, Password: &password, Emails: []string{}}, d.salt, DefaultPasswordHashConfig, DefaultPasswordPolicy)
 		if err != nil {
 			return nil, err
 		}
@@ -140,6 +140,83 @@ func (d MockStoreClient) RemoveUser(user *User) error {
 	return nil
 }
 
+func (d MockStoreClient) IncrementFailedLogins(userId string) (int, error) {
+	if d.doBad {
+		return 0, errors.New("IncrementFailedLogins failure")
+	}
+	return 1, nil
+}
+
+func (d MockStoreClient) LockUser(userId string, until time.Time) error {
+	if d.doBad {
+		return errors.New("LockUser failure")
+	}
+	return nil
+}
+
+func (d MockStoreClient) ResetFailedLogins(userId string) error {
+	if d.doBad {
+		return errors.New("ResetFailedLogins failure")
+	}
+	return nil
+}
+
+func (d MockStoreClient) UpdateMfa(userId string, mfa *MfaSettings) error {
+	if d.doBad {
+		return errors.New("UpdateMfa failure")
+	}
+	return nil
+}
+
+func (d MockStoreClient) UseMfaStep(userId string, step int64) (bool, error) {
+	if d.doBad {
+		return false, errors.New("UseMfaStep failure")
+	}
+	return true, nil
+}
+
+func (d MockStoreClient) UpdateMfaRecoveryCodes(userId string, hashes []string) error {
+	if d.doBad {
+		return errors.New("UpdateMfaRecoveryCodes failure")
+	}
+	return nil
+}
+
+func (d MockStoreClient) UseMfaRecoveryCode(userId string, hash string) (bool, error) {
+	if d.doBad {
+		return false, errors.New("UseMfaRecoveryCode failure")
+	}
+	return true, nil
+}
+
+func (d MockStoreClient) FindPasswordHistory(userId string) ([]string, error) {
+	if d.doBad {
+		return nil, errors.New("FindPasswordHistory failure")
+	}
+	return []string{}, nil
+}
+
+func (d MockStoreClient) AddPasswordHistory(userId string, pwHash string, size int) error {
+	if d.doBad {
+		return errors.New("AddPasswordHistory failure")
+	}
+	return nil
+}
+
+func (d MockStoreClient) AddAuditRecord(record *AuditRecord) error {
+	if d.doBad {
+		return errors.New("AddAuditRecord failure")
+	}
+	return nil
+}
+
+func (d MockStoreClient) FindAuditRecords(userId string) ([]*AuditRecord, error) {
+	if d.doBad {
+		return nil, errors.New("FindAuditRecords failure")
+	}
+	return []*AuditRecord{}, nil
+}
+
 func (d MockStoreClient) AddToken(token *SessionToken) error {
 	if d.doBad {
 		return errors.New("AddToken failure")
@@ -155,6 +232,20 @@ func (d MockStoreClient) FindTokenByID(id string) (*SessionToken, error) {
 	return nil, nil
 }
 
+func (d MockStoreClient) FindTokensForUser(userId string) ([]*SessionToken, error) {
+	if d.doBad {
+		return nil, errors.New("FindTokensForUser failure")
+	}
+	return []*SessionToken{}, nil
+}
+
+func (d MockStoreClient) UpdateTokenLastUsed(id string, lastUsedAt time.Time) error {
+	if d.doBad {
+		return errors.New("UpdateTokenLastUsed failure")
+	}
+	return nil
+}
+
 func (d MockStoreClient) RemoveTokenByID(id string) error {
 	if d.doBad {
 		return errors.New("RemoveTokenByID failure")
@@ -168,3 +259,101 @@ func (d *MockStoreClient) RemoveTokensForUser(userId string) error {
 	}
 	return nil
 }
+
+func (d *MockStoreClient) RemoveTokensForUserExcept(userId string, tokenId string) error {
+	if d.doBad {
+		return errors.New("RemoveTokensForUserExcept failure")
+	}
+	return nil
+}
+
+func (d MockStoreClient) AddRefreshToken(token *RefreshToken) error {
+	if d.doBad {
+		return errors.New("AddRefreshToken failure")
+	}
+	return nil
+}
+
+func (d MockStoreClient) UseRefreshToken(id string) (*RefreshToken, bool, error) {
+	if d.doBad {
+		return nil, false, errors.New("UseRefreshToken failure")
+	}
+	return nil, false, nil
+}
+
+func (d MockStoreClient) FindRefreshToken(id string) (*RefreshToken, error) {
+	if d.doBad {
+		return nil, errors.New("FindRefreshToken failure")
+	}
+	return nil, nil
+}
+
+func (d MockStoreClient) RemoveRefreshTokenFamily(familyId string) error {
+	if d.doBad {
+		return errors.New("RemoveRefreshTokenFamily failure")
+	}
+	return nil
+}
+
+func (d MockStoreClient) AddAuthorizationCode(code *AuthorizationCode) error {
+	if d.doBad {
+		return errors.New("AddAuthorizationCode failure")
+	}
+	return nil
+}
+
+func (d MockStoreClient) AddSigningKey(key *SigningKey) (bool, error) {
+	if d.doBad {
+		return false, errors.New("AddSigningKey failure")
+	}
+	return true, nil
+}
+
+func (d MockStoreClient) FindSigningKeys() ([]*SigningKey, error) {
+	if d.doBad {
+		return nil, errors.New("FindSigningKeys failure")
+	}
+	return []*SigningKey{}, nil
+}
+
+func (d MockStoreClient) RemoveSigningKey(generation int64) error {
+	if d.doBad {
+		return errors.New("RemoveSigningKey failure")
+	}
+	return nil
+}
+
+func (d MockStoreClient) ConsumeAuthorizationCode(id string) (*AuthorizationCode, error) {
+	if d.doBad {
+		return nil, errors.New("ConsumeAuthorizationCode failure")
+	}
+	return nil, nil
+}
+
+func (d MockStoreClient) AddConfirmationToken(token *ConfirmationToken) error {
+	if d.doBad {
+		return errors.New("AddConfirmationToken failure")
+	}
+	return nil
+}
+
+func (d MockStoreClient) ConsumeConfirmationToken(id string, purpose string) (*ConfirmationToken, error) {
+	if d.doBad {
+		return nil, errors.New("ConsumeConfirmationToken failure")
+	}
+	return nil, nil
+}
+
+func (d MockStoreClient) FindLatestConfirmationToken(userId string, purpose string) (*ConfirmationToken, error) {
+	if d.doBad {
+		return nil, errors.New("FindLatestConfirmationToken failure")
+	}
+	return nil, nil
+}
+
+func (d MockStoreClient) RemoveConfirmationTokensForUser(userId string, purpose string) error {
+	if d.doBad {
+		return errors.New("RemoveConfirmationTokensForUser failure")
+	}
+	return nil
+}
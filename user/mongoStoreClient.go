@@ -16,9 +16,15 @@ import (
 )
 
 const (
-	usersCollectionName  = "users"
-	tokensCollectionName = "tokens"
-	userStoreAPIPrefix   = "api/user/store "
+	usersCollectionName              = "users"
+	tokensCollectionName             = "tokens"
+	confirmationsCollectionName      = "confirmations"
+	auditCollectionName              = "audit"
+	passwordHistoryCollectionName    = "passwordHistory"
+	refreshTokensCollectionName      = "refreshTokens"
+	authorizationCodesCollectionName = "authorizationCodes"
+	signingKeysCollectionName        = "signingKeys"
+	userStoreAPIPrefix               = "api/user/store "
 )
 
 // Because the `users` collection already exists on all environments (especially `prd`),
@@ -110,12 +116,92 @@ func (msc *MongoStoreClient) EnsureIndexes() error {
 				SetName("TokenUserId").
 				SetBackground(true),
 		},
+		{
+			Keys: bson.D{{Key: "familyId", Value: 1}},
+			Options: options.Index().
+				SetName("TokenFamilyId").
+				SetSparse(true).
+				SetBackground(true),
+		},
 	}
 
 	if _, err := tokensCollection(msc).Indexes().CreateMany(context.Background(), tokenIndexes); err != nil {
 		log.Fatal(userStoreAPIPrefix, fmt.Sprintf("Unable to create token indexes: %s", err))
 	}
 
+	refreshTokenIndexes := []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "expiresAt", Value: 1}},
+			Options: options.Index().
+				SetName("ExpireRefreshTokens").
+				SetExpireAfterSeconds(0).
+				SetBackground(true),
+		},
+		{
+			Keys: bson.D{{Key: "familyId", Value: 1}},
+			Options: options.Index().
+				SetName("RefreshTokenFamilyId").
+				SetBackground(true),
+		},
+		{
+			Keys: bson.D{{Key: "userId", Value: 1}},
+			Options: options.Index().
+				SetName("RefreshTokenUserId").
+				SetBackground(true),
+		},
+	}
+
+	if _, err := refreshTokensCollection(msc).Indexes().CreateMany(context.Background(), refreshTokenIndexes); err != nil {
+		log.Fatal(userStoreAPIPrefix, fmt.Sprintf("Unable to create refresh token indexes: %s", err))
+	}
+
+	confirmationIndexes := []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "expiresAt", Value: 1}},
+			Options: options.Index().
+				SetName("ExpireConfirmations").
+				SetExpireAfterSeconds(0).
+				SetBackground(true),
+		},
+		{
+			Keys: bson.D{{Key: "userId", Value: 1}, {Key: "purpose", Value: 1}},
+			Options: options.Index().
+				SetName("ConfirmationUserIdPurpose").
+				SetBackground(true),
+		},
+	}
+
+	if _, err := confirmationsCollection(msc).Indexes().CreateMany(context.Background(), confirmationIndexes); err != nil {
+		log.Fatal(userStoreAPIPrefix, fmt.Sprintf("Unable to create confirmation indexes: %s", err))
+	}
+
+	authorizationCodeIndexes := []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "expiresAt", Value: 1}},
+			Options: options.Index().
+				SetName("ExpireAuthorizationCodes").
+				SetExpireAfterSeconds(0).
+				SetBackground(true),
+		},
+	}
+
+	if _, err := authorizationCodesCollection(msc).Indexes().CreateMany(context.Background(), authorizationCodeIndexes); err != nil {
+		log.Fatal(userStoreAPIPrefix, fmt.Sprintf("Unable to create authorization code indexes: %s", err))
+	}
+
+	auditIndexes := []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "userId", Value: 1}, {Key: "time", Value: -1}},
+			Options: options.Index().
+				SetName("AuditUserIdTime").
+				SetBackground(true),
+		},
+	}
+
+	if _, err := auditCollection(msc).Indexes().CreateMany(context.Background(), auditIndexes); err != nil {
+		log.Fatal(userStoreAPIPrefix, fmt.Sprintf("Unable to create audit indexes: %s", err))
+	}
+
 	return nil
 }
 
@@ -127,6 +213,30 @@ func tokensCollection(msc *MongoStoreClient) *mongo.Collection {
 	return msc.client.Database(msc.database).Collection(tokensCollectionName)
 }
 
+func confirmationsCollection(msc *MongoStoreClient) *mongo.Collection {
+	return msc.client.Database(msc.database).Collection(confirmationsCollectionName)
+}
+
+func auditCollection(msc *MongoStoreClient) *mongo.Collection {
+	return msc.client.Database(msc.database).Collection(auditCollectionName)
+}
+
+func passwordHistoryCollection(msc *MongoStoreClient) *mongo.Collection {
+	return msc.client.Database(msc.database).Collection(passwordHistoryCollectionName)
+}
+
+func refreshTokensCollection(msc *MongoStoreClient) *mongo.Collection {
+	return msc.client.Database(msc.database).Collection(refreshTokensCollectionName)
+}
+
+func authorizationCodesCollection(msc *MongoStoreClient) *mongo.Collection {
+	return msc.client.Database(msc.database).Collection(authorizationCodesCollectionName)
+}
+
+func signingKeysCollection(msc *MongoStoreClient) *mongo.Collection {
+	return msc.client.Database(msc.database).Collection(signingKeysCollectionName)
+}
+
 // Ping the MongoDB database
 func (msc *MongoStoreClient) Ping() error {
 	// do we have a store session
@@ -279,12 +389,110 @@ func (msc *MongoStoreClient) FindUsersWithIds(ids []string) (results []*User, er
 func (msc *MongoStoreClient) RemoveUser(user *User) (err error) {
 	opts := options.FindOneAndDelete().SetCollation(usersCollation)
 	result := usersCollection(msc).FindOneAndDelete(msc.context, bson.M{"userid": user.Id}, opts)
-	if result.Err() != mongo.ErrNoDocuments {
+	if result.Err() != nil && result.Err() != mongo.ErrNoDocuments {
 		return result.Err()
 	}
+	if _, err := passwordHistoryCollection(msc).DeleteOne(msc.context, bson.M{"_id": user.Id}); err != nil {
+		return err
+	}
 	return nil
 }
 
+// IncrementFailedLogins - record a failed login attempt for the user and return the number of failures since the last reset
+func (msc *MongoStoreClient) IncrementFailedLogins(userId string) (int, error) {
+	opts := options.FindOneAndUpdate().SetCollation(usersCollation).SetReturnDocument(options.After)
+	update := bson.M{
+		"$inc": bson.M{"failedLogins": 1},
+		"$set": bson.M{"lastFailedLoginTime": time.Now()},
+	}
+	result := &User{}
+	if err := usersCollection(msc).FindOneAndUpdate(msc.context, bson.M{"userid": userId}, update, opts).Decode(result); err != nil {
+		return 0, err
+	}
+	return result.FailedLogins, nil
+}
+
+// LockUser - prevent the user from logging in until the given time
+func (msc *MongoStoreClient) LockUser(userId string, until time.Time) error {
+	opts := options.Update().SetCollation(usersCollation)
+	_, err := usersCollection(msc).UpdateOne(msc.context, bson.M{"userid": userId}, bson.M{"$set": bson.M{"lockedUntil": until}}, opts)
+	return err
+}
+
+// ResetFailedLogins - clear the failed login count and any lock of the user
+func (msc *MongoStoreClient) ResetFailedLogins(userId string) error {
+	opts := options.Update().SetCollation(usersCollation)
+	update := bson.M{"$unset": bson.M{"failedLogins": "", "lastFailedLoginTime": "", "lockedUntil": ""}}
+	_, err := usersCollection(msc).UpdateOne(msc.context, bson.M{"userid": userId}, update, opts)
+	return err
+}
+
+// UpdateMfa - replace the second factor of the user, a nil mfa removes it
+func (msc *MongoStoreClient) UpdateMfa(userId string, mfa *MfaSettings) error {
+	opts := options.Update().SetCollation(usersCollation)
+	update := bson.M{"$unset": bson.M{"mfa": ""}}
+	if mfa != nil {
+		update = bson.M{"$set": bson.M{"mfa": mfa}}
+	}
+	_, err := usersCollection(msc).UpdateOne(msc.context, bson.M{"userid": userId}, update, opts)
+	return err
+}
+
+// UseMfaStep - record the time step of an accepted code, returns false if the step or a later one was already used
+func (msc *MongoStoreClient) UseMfaStep(userId string, step int64) (bool, error) {
+	opts := options.Update().SetCollation(usersCollation)
+	selector := bson.M{
+		"userid":           userId,
+		"mfa.enabled":      true,
+		"mfa.lastUsedStep": bson.M{"$not": bson.M{"$gte": step}},
+	}
+	result, err := usersCollection(msc).UpdateOne(msc.context, selector, bson.M{"$set": bson.M{"mfa.lastUsedStep": step}}, opts)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+// UpdateMfaRecoveryCodes - replace the recovery codes of a user with enabled mfa
+func (msc *MongoStoreClient) UpdateMfaRecoveryCodes(userId string, hashes []string) error {
+	opts := options.Update().SetCollation(usersCollation)
+	selector := bson.M{"userid": userId, "mfa.enabled": true}
+	_, err := usersCollection(msc).UpdateOne(msc.context, selector, bson.M{"$set": bson.M{"mfa.recoveryCodes": hashes}}, opts)
+	return err
+}
+
+// UseMfaRecoveryCode - remove the recovery code from the user, returns false if the user does not have the code
+func (msc *MongoStoreClient) UseMfaRecoveryCode(userId string, hash string) (bool, error) {
+	opts := options.Update().SetCollation(usersCollation)
+	selector := bson.M{"userid": userId, "mfa.enabled": true, "mfa.recoveryCodes": hash}
+	result, err := usersCollection(msc).UpdateOne(msc.context, selector, bson.M{"$pull": bson.M{"mfa.recoveryCodes": hash}}, opts)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+// FindPasswordHistory - find the previous password hashes of the user, oldest first
+func (msc *MongoStoreClient) FindPasswordHistory(userId string) ([]string, error) {
+	history := struct {
+		Hashes []string `bson:"hashes"`
+	}{}
+	if err := passwordHistoryCollection(msc).FindOne(msc.context, bson.M{"_id": userId}).Decode(&history); err == mongo.ErrNoDocuments {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return history.Hashes, nil
+}
+
+// AddPasswordHistory - append the password hash to the history of the user, keeping only the most recent size hashes
+func (msc *MongoStoreClient) AddPasswordHistory(userId string, pwHash string, size int) error {
+	opts := options.Update().SetUpsert(true)
+	update := bson.M{"$push": bson.M{"hashes": bson.M{"$each": []string{pwHash}, "$slice": -size}}}
+	_, err := passwordHistoryCollection(msc).UpdateOne(msc.context, bson.M{"_id": userId}, update, opts)
+	return err
+}
+
 // AddToken to the token collection
 func (msc *MongoStoreClient) AddToken(st *SessionToken) error {
 	// if the token already exists we update otherwise we add
@@ -307,6 +515,32 @@ func (msc *MongoStoreClient) FindTokenByID(id string) (*SessionToken, error) {
 	return sessionToken, nil
 }
 
+// FindTokensForUser - find the unexpired auth tokens of a user, most recent first
+func (msc *MongoStoreClient) FindTokensForUser(userId string) (results []*SessionToken, err error) {
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}})
+	selector := bson.M{"userId": userId, "expiresAt": bson.M{"$gt": time.Now()}}
+	cursor, err := tokensCollection(msc).Find(msc.context, selector, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = cursor.All(msc.context, &results); err != nil {
+		return results, err
+	}
+
+	if results == nil {
+		results = []*SessionToken{}
+	}
+
+	return results, nil
+}
+
+// UpdateTokenLastUsed - record when an auth token was last used
+func (msc *MongoStoreClient) UpdateTokenLastUsed(id string, lastUsedAt time.Time) error {
+	_, err := tokensCollection(msc).UpdateOne(msc.context, bson.M{"_id": id}, bson.M{"$set": bson.M{"lastUsedAt": lastUsedAt}})
+	return err
+}
+
 // RemoveTokenByID - delete an auth token matching an ID
 func (msc *MongoStoreClient) RemoveTokenByID(id string) (err error) {
 	result := tokensCollection(msc).FindOneAndDelete(msc.context, bson.M{"_id": id})
@@ -316,8 +550,190 @@ func (msc *MongoStoreClient) RemoveTokenByID(id string) (err error) {
 	return nil
 }
 
-// RemoveTokensForUser - delete an auth token matching an ID
+// RemoveTokensForUser - delete all auth tokens and refresh tokens of the user
 func (msc *MongoStoreClient) RemoveTokensForUser(userId string) (err error) {
-	_, err = tokensCollection(msc).DeleteMany(msc.context, bson.M{"userId": userId})
+	if _, err = tokensCollection(msc).DeleteMany(msc.context, bson.M{"userId": userId}); err != nil {
+		return
+	}
+	_, err = refreshTokensCollection(msc).DeleteMany(msc.context, bson.M{"userId": userId})
+	return
+}
+
+// RemoveTokensForUserExcept - delete all auth tokens of the user except the one matching the ID, as well as
+// all refresh tokens except those of the family the remaining token was issued with
+func (msc *MongoStoreClient) RemoveTokensForUserExcept(userId string, tokenId string) (err error) {
+	kept := &SessionToken{}
+	if err = tokensCollection(msc).FindOne(msc.context, bson.M{"_id": tokenId}).Decode(kept); err != nil && err != mongo.ErrNoDocuments {
+		return
+	}
+	if _, err = tokensCollection(msc).DeleteMany(msc.context, bson.M{"userId": userId, "_id": bson.M{"$ne": tokenId}}); err != nil {
+		return
+	}
+	_, err = refreshTokensCollection(msc).DeleteMany(msc.context, bson.M{"userId": userId, "familyId": bson.M{"$ne": kept.FamilyID}})
+	return
+}
+
+// AddRefreshToken to the refresh tokens collection
+func (msc *MongoStoreClient) AddRefreshToken(rt *RefreshToken) error {
+	_, err := refreshTokensCollection(msc).InsertOne(msc.context, rt)
+	return err
+}
+
+// UseRefreshToken - mark the refresh token as used and return it, or nil if there is no such token. The
+// returned bool is true when the token had already been used before.
+func (msc *MongoStoreClient) UseRefreshToken(id string) (*RefreshToken, bool, error) {
+	refreshToken := &RefreshToken{}
+	selector := bson.M{"_id": id, "usedAt": nil}
+	err := refreshTokensCollection(msc).FindOneAndUpdate(msc.context, selector, bson.M{"$set": bson.M{"usedAt": time.Now()}}).Decode(refreshToken)
+	if err == nil {
+		return refreshToken, false, nil
+	} else if err != mongo.ErrNoDocuments {
+		return nil, false, err
+	}
+
+	if err := refreshTokensCollection(msc).FindOne(msc.context, bson.M{"_id": id}).Decode(refreshToken); err == mongo.ErrNoDocuments {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return refreshToken, true, nil
+}
+
+// FindRefreshToken - find a refresh token without using it, or nil if there is no such token
+func (msc *MongoStoreClient) FindRefreshToken(id string) (*RefreshToken, error) {
+	refreshToken := &RefreshToken{}
+	if err := refreshTokensCollection(msc).FindOne(msc.context, bson.M{"_id": id}).Decode(refreshToken); err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return refreshToken, nil
+}
+
+// AddAuthorizationCode to the authorization codes collection
+func (msc *MongoStoreClient) AddAuthorizationCode(code *AuthorizationCode) error {
+	_, err := authorizationCodesCollection(msc).InsertOne(msc.context, code)
+	return err
+}
+
+// ConsumeAuthorizationCode - find and delete an unexpired authorization code, so that it can only be exchanged once.
+// Returns nil if no matching code exists.
+func (msc *MongoStoreClient) ConsumeAuthorizationCode(id string) (*AuthorizationCode, error) {
+	code := &AuthorizationCode{}
+	selector := bson.M{"_id": id, "expiresAt": bson.M{"$gt": time.Now()}}
+	if err := authorizationCodesCollection(msc).FindOneAndDelete(msc.context, selector).Decode(code); err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return code, nil
+}
+
+// AddSigningKey - add the key unless there is a key of its generation already, so that of the replicas rotating
+// at the same time only one stores its key. Returns whether the key was added.
+func (msc *MongoStoreClient) AddSigningKey(key *SigningKey) (bool, error) {
+	opts := options.Update().SetUpsert(true)
+	result, err := signingKeysCollection(msc).UpdateOne(msc.context, bson.M{"_id": key.Generation}, bson.M{"$setOnInsert": key}, opts)
+	if err != nil {
+		return false, err
+	}
+	return result.UpsertedCount == 1, nil
+}
+
+// FindSigningKeys - find all signing keys, oldest generation first
+func (msc *MongoStoreClient) FindSigningKeys() (results []*SigningKey, err error) {
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+	cursor, err := signingKeysCollection(msc).Find(msc.context, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(msc.context)
+
+	results = []*SigningKey{}
+	if err = cursor.All(msc.context, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// RemoveSigningKey - delete the signing key of the generation
+func (msc *MongoStoreClient) RemoveSigningKey(generation int64) error {
+	_, err := signingKeysCollection(msc).DeleteOne(msc.context, bson.M{"_id": generation})
+	return err
+}
+
+// RemoveRefreshTokenFamily - delete all refresh tokens of the family and the auth tokens issued with them
+func (msc *MongoStoreClient) RemoveRefreshTokenFamily(familyId string) (err error) {
+	if _, err = refreshTokensCollection(msc).DeleteMany(msc.context, bson.M{"familyId": familyId}); err != nil {
+		return
+	}
+	_, err = tokensCollection(msc).DeleteMany(msc.context, bson.M{"familyId": familyId})
 	return
 }
+
+// AddConfirmationToken to the confirmations collection
+func (msc *MongoStoreClient) AddConfirmationToken(ct *ConfirmationToken) error {
+	_, err := confirmationsCollection(msc).InsertOne(msc.context, ct)
+	return err
+}
+
+// ConsumeConfirmationToken - find and delete an unexpired confirmation token, so that it can only be used once.
+// Returns nil if no matching token exists.
+func (msc *MongoStoreClient) ConsumeConfirmationToken(id string, purpose string) (*ConfirmationToken, error) {
+	confirmationToken := &ConfirmationToken{}
+	selector := bson.M{"_id": id, "purpose": purpose, "expiresAt": bson.M{"$gt": time.Now()}}
+	if err := confirmationsCollection(msc).FindOneAndDelete(msc.context, selector).Decode(confirmationToken); err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return confirmationToken, nil
+}
+
+// FindLatestConfirmationToken - find the most recently created, unexpired confirmation token of a user for
+// the given purpose. Returns nil if there is none.
+func (msc *MongoStoreClient) FindLatestConfirmationToken(userId string, purpose string) (*ConfirmationToken, error) {
+	confirmationToken := &ConfirmationToken{}
+	selector := bson.M{"userId": userId, "purpose": purpose, "expiresAt": bson.M{"$gt": time.Now()}}
+	opts := options.FindOne().SetSort(bson.D{{Key: "createdAt", Value: -1}})
+	if err := confirmationsCollection(msc).FindOne(msc.context, selector, opts).Decode(confirmationToken); err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return confirmationToken, nil
+}
+
+// RemoveConfirmationTokensForUser - delete all confirmation tokens of a user for the given purpose
+func (msc *MongoStoreClient) RemoveConfirmationTokensForUser(userId string, purpose string) (err error) {
+	_, err = confirmationsCollection(msc).DeleteMany(msc.context, bson.M{"userId": userId, "purpose": purpose})
+	return
+}
+
+// AddAuditRecord to the audit collection
+func (msc *MongoStoreClient) AddAuditRecord(record *AuditRecord) error {
+	_, err := auditCollection(msc).InsertOne(msc.context, record)
+	return err
+}
+
+// FindAuditRecords - find the audit records of a user, most recent first
+func (msc *MongoStoreClient) FindAuditRecords(userId string) (results []*AuditRecord, err error) {
+	opts := options.Find().SetSort(bson.D{{Key: "time", Value: -1}})
+	cursor, err := auditCollection(msc).Find(msc.context, bson.M{"userId": userId}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = cursor.All(msc.context, &results); err != nil {
+		return results, err
+	}
+
+	if results == nil {
+		results = []*AuditRecord{}
+	}
+
+	return results, nil
+}
@@ -43,7 +43,7 @@ func TestMongoStoreUserOperations(t *testing.T) {
 	/*
 	 * THE TESTS
 	 */
-	user, err := NewUser(originalUserDetail, testsFakeSalt)
+	user, err := NewUser(originalUserDetail, testsFakeSalt, DefaultPasswordHashConfig, DefaultPasswordPolicy)
 	if err != nil {
 		t.Fatalf("we could not create the user %v", err)
 	}
@@ -143,7 +143,7 @@ func TestMongoStoreUserOperations(t *testing.T) {
 	}
 
 	//Find many By Email - user and userTwo have the same emails addresses
-	userTwo, err := NewUser(otherUserDetail, testsFakeSalt)
+	userTwo, err := NewUser(otherUserDetail, testsFakeSalt, DefaultPasswordHashConfig, DefaultPasswordPolicy)
 	if err != nil {
 		t.Fatalf("we could not create the user %v", err)
 	}
@@ -182,10 +182,10 @@ func TestMongoStore_FindUsersByRole(t *testing.T) {
 	/*
 	 * THE TESTS
 	 */
-	userOne, _ := NewUser(userOneDetail, testsFakeSalt)
+	userOne, _ := NewUser(userOneDetail, testsFakeSalt, DefaultPasswordHashConfig, DefaultPasswordPolicy)
 	userOne.Roles = append(userOne.Roles, "clinic")
 
-	userTwo, _ := NewUser(userTwoDetail, testsFakeSalt)
+	userTwo, _ := NewUser(userTwoDetail, testsFakeSalt, DefaultPasswordHashConfig, DefaultPasswordPolicy)
 
 	if err := mc.UpsertUser(userOne); err != nil {
 		t.Fatalf("we could not create the user %v", err)
@@ -221,8 +221,8 @@ func TestMongoStore_FindUsersById(t *testing.T) {
 	/*
 	 * THE TESTS
 	 */
-	userOne, _ := NewUser(userOneDetail, testsFakeSalt)
-	userTwo, _ := NewUser(userTwoDetail, testsFakeSalt)
+	userOne, _ := NewUser(userOneDetail, testsFakeSalt, DefaultPasswordHashConfig, DefaultPasswordPolicy)
+	userTwo, _ := NewUser(userTwoDetail, testsFakeSalt, DefaultPasswordHashConfig, DefaultPasswordPolicy)
 
 	if err := mc.UpsertUser(userOne); err != nil {
 		t.Fatalf("we could not create the user %v", err)
@@ -324,6 +324,14 @@ xwIDAQAB
 		t.Fatalf("no token was returned when it should have been - err[%v]", err)
 	}
 
+	lastUsedAt := time.Now().Add(time.Minute).Truncate(time.Millisecond)
+	if err := mc.UpdateTokenLastUsed(sessionToken.ID, lastUsedAt); err != nil {
+		t.Fatalf("we could not update the token %v", err)
+	}
+	if foundToken, err := mc.FindTokenByID(sessionToken.ID); err != nil || !foundToken.LastUsed().Equal(lastUsedAt) {
+		t.Fatalf("the last use of the token should have been updated %v %v", foundToken, err)
+	}
+
 	if err := mc.RemoveTokenByID(sessionToken.ID); err != nil {
 		t.Fatalf("we could not remove the token %v", err)
 	}
@@ -335,3 +343,383 @@ xwIDAQAB
 	}
 
 }
+
+func TestMongoStoreRemoveTokensForUserExcept(t *testing.T) {
+
+	mc, err := mongoTestSetup()
+	if err != nil {
+		t.Fatalf("we initialise the test store %s", err.Error())
+	}
+
+	expiresAt := time.Now().Add(time.Hour)
+	for _, id := range []string{"keep", "remove1", "remove2"} {
+		if err := mc.AddToken(&SessionToken{ID: id, UserID: "2341", ExpiresAt: expiresAt}); err != nil {
+			t.Fatalf("we could not save the token %v", err)
+		}
+	}
+	if err := mc.AddToken(&SessionToken{ID: "other", UserID: "other", ExpiresAt: expiresAt}); err != nil {
+		t.Fatalf("we could not save the token %v", err)
+	}
+
+	if err := mc.AddToken(&SessionToken{ID: "expired", UserID: "2341", ExpiresAt: time.Now().Add(-time.Hour)}); err != nil {
+		t.Fatalf("we could not save the token %v", err)
+	}
+	if tokens, err := mc.FindTokensForUser("2341"); err != nil {
+		t.Fatalf("we could not find the tokens %v", err)
+	} else if len(tokens) != 3 {
+		t.Fatalf("only the unexpired tokens of the user should be found %#v", tokens)
+	}
+
+	if err := mc.RemoveTokensForUserExcept("2341", "keep"); err != nil {
+		t.Fatalf("we could not remove the tokens %v", err)
+	}
+
+	for _, id := range []string{"keep", "other"} {
+		if token, err := mc.FindTokenByID(id); err != nil || token == nil {
+			t.Fatalf("the token %s should not have been removed %v", id, err)
+		}
+	}
+	for _, id := range []string{"remove1", "remove2"} {
+		if _, err := mc.FindTokenByID(id); err == nil {
+			t.Fatalf("the token %s should have been removed", id)
+		}
+	}
+}
+
+func TestMongoStoreRefreshTokenOperations(t *testing.T) {
+
+	mc, err := mongoTestSetup()
+	if err != nil {
+		t.Fatalf("we initialise the test store %s", err.Error())
+	}
+	refreshTokensCollection(mc).Drop(context.Background())
+
+	refreshToken, _, err := NewRefreshToken("2341", "", 3600)
+	if err != nil {
+		t.Fatalf("we could not create the refresh token %v", err)
+	}
+	if err := mc.AddRefreshToken(refreshToken); err != nil {
+		t.Fatalf("we could not save the refresh token %v", err)
+	}
+	if err := mc.AddToken(&SessionToken{ID: "access", UserID: "2341", FamilyID: refreshToken.FamilyID, ExpiresAt: refreshToken.ExpiresAt}); err != nil {
+		t.Fatalf("we could not save the token %v", err)
+	}
+
+	if found, reused, err := mc.UseRefreshToken(refreshToken.ID); err != nil || reused {
+		t.Fatalf("we could not use the refresh token %v %v", reused, err)
+	} else if found == nil || found.UserID != "2341" || found.FamilyID != refreshToken.FamilyID {
+		t.Fatalf("the used refresh token doesn't match what we saved %v", found)
+	}
+
+	if found, reused, err := mc.UseRefreshToken(refreshToken.ID); err != nil || !reused || found == nil {
+		t.Fatalf("the refresh token should be reported as reused %v %v %v", found, reused, err)
+	}
+
+	if found, reused, err := mc.UseRefreshToken("missing"); err != nil || reused || found != nil {
+		t.Fatalf("an unknown refresh token should not be found %v %v %v", found, reused, err)
+	}
+
+	if found, err := mc.FindRefreshToken(refreshToken.ID); err != nil || found == nil || found.FamilyID != refreshToken.FamilyID {
+		t.Fatalf("the refresh token should be found %v %v", found, err)
+	}
+	if found, err := mc.FindRefreshToken("missing"); err != nil || found != nil {
+		t.Fatalf("an unknown refresh token should not be found %v %v", found, err)
+	}
+
+	if err := mc.RemoveRefreshTokenFamily(refreshToken.FamilyID); err != nil {
+		t.Fatalf("we could not remove the refresh token family %v", err)
+	}
+	if found, _, err := mc.UseRefreshToken(refreshToken.ID); err != nil || found != nil {
+		t.Fatalf("the refresh token should have been removed %v %v", found, err)
+	}
+	if _, err := mc.FindTokenByID("access"); err == nil {
+		t.Fatal("the token of the refresh token family should have been removed")
+	}
+}
+
+func TestMongoStoreAuthorizationCodeOperations(t *testing.T) {
+
+	mc, err := mongoTestSetup()
+	if err != nil {
+		t.Fatalf("we initialise the test store %s", err.Error())
+	}
+	authorizationCodesCollection(mc).Drop(context.Background())
+
+	code, value, err := NewAuthorizationCode("app", "2341", "https://app.test/callback", "openid", nil, "nonce", "challenge", 60)
+	if err != nil {
+		t.Fatalf("we could not create the authorization code %v", err)
+	}
+	if err := mc.AddAuthorizationCode(code); err != nil {
+		t.Fatalf("we could not save the authorization code %v", err)
+	}
+
+	if found, err := mc.ConsumeAuthorizationCode(HashAuthorizationCode(value)); err != nil {
+		t.Fatalf("we could not consume the authorization code %v", err)
+	} else if found == nil || found.UserID != "2341" || found.ClientID != "app" || found.Nonce != "nonce" {
+		t.Fatalf("the consumed authorization code doesn't match what we saved %v", found)
+	}
+
+	if found, err := mc.ConsumeAuthorizationCode(HashAuthorizationCode(value)); err != nil || found != nil {
+		t.Fatalf("the authorization code should only be consumed once %v %v", found, err)
+	}
+
+	expired, _, _ := NewAuthorizationCode("app", "2341", "https://app.test/callback", "openid", nil, "", "challenge", -60)
+	if err := mc.AddAuthorizationCode(expired); err != nil {
+		t.Fatalf("we could not save the authorization code %v", err)
+	}
+	if found, err := mc.ConsumeAuthorizationCode(expired.ID); err != nil || found != nil {
+		t.Fatalf("an expired authorization code should not be found %v %v", found, err)
+	}
+}
+
+func TestMongoStoreConfirmationTokenOperations(t *testing.T) {
+
+	mc, err := mongoTestSetup()
+	if err != nil {
+		t.Fatalf("we initialise the test store %s", err.Error())
+	}
+	confirmationsCollection(mc).Drop(context.Background())
+
+	confirmationToken, err := NewConfirmationToken(ConfirmationPurposePasswordReset, "2341", "test@foo.bar", 3600)
+	if err != nil {
+		t.Fatalf("we could not create the confirmation token %v", err)
+	}
+
+	if err := mc.AddConfirmationToken(confirmationToken); err != nil {
+		t.Fatalf("we could not save the confirmation token %v", err)
+	}
+
+	if found, err := mc.ConsumeConfirmationToken(confirmationToken.ID, "other_purpose"); err != nil || found != nil {
+		t.Fatalf("the confirmation token should not be found for another purpose %v %v", found, err)
+	}
+
+	if found, err := mc.ConsumeConfirmationToken(confirmationToken.ID, ConfirmationPurposePasswordReset); err != nil {
+		t.Fatalf("we could not consume the confirmation token %v", err)
+	} else if found == nil || found.UserID != "2341" {
+		t.Fatalf("the consumed confirmation token doesn't match what we saved %v", found)
+	}
+
+	if found, err := mc.ConsumeConfirmationToken(confirmationToken.ID, ConfirmationPurposePasswordReset); err != nil || found != nil {
+		t.Fatalf("the confirmation token has been consumed so we shouldn't find it %v %v", found, err)
+	}
+
+	if err := mc.AddConfirmationToken(confirmationToken); err != nil {
+		t.Fatalf("we could not save the confirmation token %v", err)
+	}
+	if err := mc.RemoveConfirmationTokensForUser("2341", ConfirmationPurposePasswordReset); err != nil {
+		t.Fatalf("we could not remove the confirmation tokens %v", err)
+	}
+	if found, err := mc.ConsumeConfirmationToken(confirmationToken.ID, ConfirmationPurposePasswordReset); err != nil || found != nil {
+		t.Fatalf("the confirmation token has been removed so we shouldn't find it %v %v", found, err)
+	}
+
+}
+
+func TestMongoStoreFailedLoginOperations(t *testing.T) {
+
+	var (
+		username   = "test@foo.bar"
+		password   = "myT35ter"
+		userDetail = &NewUserDetails{Username: &username, Emails: []string{username}, Password: &password}
+	)
+
+	const testsFakeSalt = "some fake salt for the tests"
+
+	mc, err := mongoTestSetup()
+	if err != nil {
+		t.Fatalf("we initialise the test store %s", err.Error())
+	}
+
+	user, err := NewUser(userDetail, testsFakeSalt, DefaultPasswordHashConfig, DefaultPasswordPolicy)
+	if err != nil {
+		t.Fatalf("we could not create the user %v", err)
+	}
+	if err := mc.UpsertUser(user); err != nil {
+		t.Fatalf("we could not upsert the user %v", err)
+	}
+
+	for expected := 1; expected <= 2; expected++ {
+		if failedLogins, err := mc.IncrementFailedLogins(user.Id); err != nil {
+			t.Fatalf("we could not record the failed login %v", err)
+		} else if failedLogins != expected {
+			t.Fatalf("we expected %d failed logins but got %d", expected, failedLogins)
+		}
+	}
+
+	if err := mc.LockUser(user.Id, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("we could not lock the user %v", err)
+	}
+	if found, err := mc.FindUser(&User{Id: user.Id}); err != nil {
+		t.Fatalf("we could not find the user %v", err)
+	} else if !found.IsLocked() || found.FailedLogins != 2 || found.LastFailedLoginTime.IsZero() {
+		t.Fatalf("the user should be locked after two failed logins %#v", found)
+	}
+
+	// upserting the user must not clear the failed login tracking
+	if err := mc.UpsertUser(user.DeepClone()); err != nil {
+		t.Fatalf("we could not upsert the user %v", err)
+	}
+	if found, err := mc.FindUser(&User{Id: user.Id}); err != nil {
+		t.Fatalf("we could not find the user %v", err)
+	} else if !found.IsLocked() {
+		t.Fatal("the user should still be locked after an upsert")
+	}
+
+	if err := mc.ResetFailedLogins(user.Id); err != nil {
+		t.Fatalf("we could not reset the failed logins %v", err)
+	}
+	if found, err := mc.FindUser(&User{Id: user.Id}); err != nil {
+		t.Fatalf("we could not find the user %v", err)
+	} else if found.IsLocked() || found.FailedLogins != 0 || !found.LastFailedLoginTime.IsZero() {
+		t.Fatalf("the failed logins should have been reset %#v", found)
+	}
+}
+
+func TestMongoStoreMfaOperations(t *testing.T) {
+
+	var (
+		username   = "test@foo.bar"
+		password   = "myT35ter"
+		userDetail = &NewUserDetails{Username: &username, Emails: []string{username}, Password: &password}
+	)
+
+	const testsFakeSalt = "some fake salt for the tests"
+
+	mc, err := mongoTestSetup()
+	if err != nil {
+		t.Fatalf("we initialise the test store %s", err.Error())
+	}
+
+	user, err := NewUser(userDetail, testsFakeSalt, DefaultPasswordHashConfig, DefaultPasswordPolicy)
+	if err != nil {
+		t.Fatalf("we could not create the user %v", err)
+	}
+	if err := mc.UpsertUser(user); err != nil {
+		t.Fatalf("we could not upsert the user %v", err)
+	}
+
+	if err := mc.UpdateMfa(user.Id, &MfaSettings{Secret: "ABCDEF"}); err != nil {
+		t.Fatalf("we could not update the mfa settings %v", err)
+	}
+	if used, err := mc.UseMfaStep(user.Id, 10); err != nil {
+		t.Fatalf("we could not use the mfa step %v", err)
+	} else if used {
+		t.Fatal("a step should not be usable before mfa is enabled")
+	}
+
+	if err := mc.UpdateMfa(user.Id, &MfaSettings{Secret: "ABCDEF", Enabled: true, LastUsedStep: 10}); err != nil {
+		t.Fatalf("we could not update the mfa settings %v", err)
+	}
+	if used, _ := mc.UseMfaStep(user.Id, 10); used {
+		t.Fatal("the same step should not be usable twice")
+	}
+	if used, _ := mc.UseMfaStep(user.Id, 11); !used {
+		t.Fatal("a later step should be usable")
+	}
+
+	// upserting the user must not clear the second factor
+	if err := mc.UpsertUser(user.DeepClone()); err != nil {
+		t.Fatalf("we could not upsert the user %v", err)
+	}
+	if found, err := mc.FindUser(&User{Id: user.Id}); err != nil {
+		t.Fatalf("we could not find the user %v", err)
+	} else if !found.IsMfaEnabled() || found.Mfa.LastUsedStep != 11 {
+		t.Fatalf("the mfa settings should have been kept %#v", found.Mfa)
+	}
+
+	if err := mc.UpdateMfaRecoveryCodes(user.Id, []string{"first", "second"}); err != nil {
+		t.Fatalf("we could not update the recovery codes %v", err)
+	}
+	if used, err := mc.UseMfaRecoveryCode(user.Id, "first"); err != nil || !used {
+		t.Fatalf("the recovery code should be usable %v", err)
+	}
+	if used, _ := mc.UseMfaRecoveryCode(user.Id, "first"); used {
+		t.Fatal("the recovery code should not be usable twice")
+	}
+	if found, err := mc.FindUser(&User{Id: user.Id}); err != nil {
+		t.Fatalf("we could not find the user %v", err)
+	} else if len(found.Mfa.RecoveryCodes) != 1 || found.Mfa.RecoveryCodes[0] != "second" {
+		t.Fatalf("only the unused recovery code should remain %#v", found.Mfa.RecoveryCodes)
+	}
+
+	if err := mc.UpdateMfa(user.Id, nil); err != nil {
+		t.Fatalf("we could not remove the mfa settings %v", err)
+	}
+	if found, err := mc.FindUser(&User{Id: user.Id}); err != nil {
+		t.Fatalf("we could not find the user %v", err)
+	} else if found.Mfa != nil {
+		t.Fatalf("the mfa settings should have been removed %#v", found.Mfa)
+	}
+}
+
+func TestMongoStoreAuditOperations(t *testing.T) {
+
+	mc, err := mongoTestSetup()
+	if err != nil {
+		t.Fatalf("we initialise the test store %s", err.Error())
+	}
+	auditCollection(mc).Drop(context.Background())
+
+	for _, auditType := range []string{AuditTypeMfaRecoveryCodesRegenerated, AuditTypeMfaRecoveryCodeUsed} {
+		record, err := NewAuditRecord(auditType, "2341", map[string]string{"remaining": "9"})
+		if err != nil {
+			t.Fatalf("we could not create the audit record %v", err)
+		}
+		if err := mc.AddAuditRecord(record); err != nil {
+			t.Fatalf("we could not save the audit record %v", err)
+		}
+	}
+
+	if records, err := mc.FindAuditRecords("2341"); err != nil {
+		t.Fatalf("we could not find the audit records %v", err)
+	} else if len(records) != 2 || records[0].Type != AuditTypeMfaRecoveryCodeUsed || records[0].Details["remaining"] != "9" {
+		t.Fatalf("the audit records should be returned most recent first %#v", records)
+	}
+
+	if records, err := mc.FindAuditRecords("other"); err != nil {
+		t.Fatalf("we could not find the audit records %v", err)
+	} else if len(records) != 0 {
+		t.Fatalf("there should be no audit records for another user %#v", records)
+	}
+}
+
+func TestMongoStorePasswordHistoryOperations(t *testing.T) {
+
+	mc, err := mongoTestSetup()
+	if err != nil {
+		t.Fatalf("we initialise the test store %s", err.Error())
+	}
+	passwordHistoryCollection(mc).Drop(context.Background())
+
+	user := &User{Id: "2341", Username: "history@z.co"}
+	if err := mc.UpsertUser(user); err != nil {
+		t.Fatalf("we could not save the user %v", err)
+	}
+
+	if hashes, err := mc.FindPasswordHistory(user.Id); err != nil {
+		t.Fatalf("we could not find the password history %v", err)
+	} else if len(hashes) != 0 {
+		t.Fatalf("there should be no password history yet %#v", hashes)
+	}
+
+	for _, hash := range []string{"one", "two", "three"} {
+		if err := mc.AddPasswordHistory(user.Id, hash, 2); err != nil {
+			t.Fatalf("we could not add to the password history %v", err)
+		}
+	}
+
+	if hashes, err := mc.FindPasswordHistory(user.Id); err != nil {
+		t.Fatalf("we could not find the password history %v", err)
+	} else if strings.Join(hashes, ",") != "two,three" {
+		t.Fatalf("only the most recent hashes should be kept %#v", hashes)
+	}
+
+	if err := mc.RemoveUser(user); err != nil {
+		t.Fatalf("we could not remove the user %v", err)
+	}
+	if hashes, err := mc.FindPasswordHistory(user.Id); err != nil {
+		t.Fatalf("we could not find the password history %v", err)
+	} else if len(hashes) != 0 {
+		t.Fatalf("the password history should be removed with the user %#v", hashes)
+	}
+}
@@ -0,0 +1,440 @@
+package user
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+const (
+	OidcScopeOpenID  = "openid"
+	OidcScopeProfile = "profile"
+	OidcScopeEmail   = "email"
+
+	// the only PKCE method accepted, "plain" does not protect a leaked code
+	pkceMethodS256 = "S256"
+
+	authorizationCodeLength = 32
+)
+
+// Error codes of RFC 6749 section 4.1.2.1 and 5.2
+const (
+	oauthErrorInvalidRequest          = "invalid_request"
+	oauthErrorInvalidClient           = "invalid_client"
+	oauthErrorInvalidGrant            = "invalid_grant"
+	oauthErrorInvalidScope            = "invalid_scope"
+	oauthErrorAccessDenied            = "access_denied"
+	oauthErrorUnsupportedGrantType    = "unsupported_grant_type"
+	oauthErrorUnsupportedResponseType = "unsupported_response_type"
+	oauthErrorServerError             = "server_error"
+)
+
+// Messages of the login form in addition to the status messages of Login
+const (
+	oidcLoginMissingCredentials = "Enter your email and password"
+	oidcLoginWrongCredentials   = "The email or password is not correct"
+	oidcLoginCodeRequired       = "Enter the code of your authenticator app"
+)
+
+// oidcAuthorizationParameters are the parameters of an authorization request that the login form posts back
+var oidcAuthorizationParameters = []string{"client_id", "redirect_uri", "response_type", "scope", "state", "nonce", "code_challenge", "code_challenge_method"}
+
+var AuthorizationCode_error_no_userid = errors.New("AuthorizationCode: userId not set")
+
+type (
+	// OidcConfig configures shoreline as an OpenID Connect provider. The provider is disabled without an issuer.
+	OidcConfig struct {
+		Issuer                        string       `json:"issuer"`                        // public base URL of shoreline, e.g. https://api.tidepool.org/auth
+		Clients                       []OidcClient `json:"clients"`                       // the applications allowed to login users
+		AuthorizationCodeDurationSecs int64        `json:"authorizationCodeDurationSecs"` // how long an authorization code can be exchanged
+		IDTokenDurationSecs           int64        `json:"idTokenDurationSecs"`           // lifetime of ID tokens
+	}
+
+	// OidcClient is an application that logs in users via the authorization code flow. Clients are public,
+	// they do not authenticate and must use PKCE instead.
+	OidcClient struct {
+		ID           string   `json:"id"`
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirectUris"` // compared exactly with the redirect_uri of requests
+	}
+
+	// AuthorizationCode is the single-use code an OIDC client exchanges for tokens. Only the hash is stored.
+	AuthorizationCode struct {
+		ID            string    `bson:"_id"` // see HashAuthorizationCode
+		ClientID      string    `bson:"clientId"`
+		UserID        string    `bson:"userId"`
+		RedirectURI   string    `bson:"redirectUri"`
+		Scope         string    `bson:"scope"`
+		Scopes        []string  `bson:"scopes,omitempty"` // the session scopes of the access token, see SessionScopes
+		Nonce         string    `bson:"nonce,omitempty"`
+		CodeChallenge string    `bson:"codeChallenge"`
+		CreatedAt     time.Time `bson:"createdAt"`
+		ExpiresAt     time.Time `bson:"expiresAt"`
+	}
+
+	oidcDiscovery struct {
+		Issuer                            string   `json:"issuer"`
+		AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+		TokenEndpoint                     string   `json:"token_endpoint"`
+		UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+		IntrospectionEndpoint             string   `json:"introspection_endpoint"`
+		RevocationEndpoint                string   `json:"revocation_endpoint"`
+		JwksURI                           string   `json:"jwks_uri"`
+		ScopesSupported                   []string `json:"scopes_supported"`
+		ResponseTypesSupported            []string `json:"response_types_supported"`
+		GrantTypesSupported               []string `json:"grant_types_supported"`
+		SubjectTypesSupported             []string `json:"subject_types_supported"`
+		IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+		TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+		CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+		ClaimsSupported                   []string `json:"claims_supported"`
+	}
+
+	oauthTokenResponse struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+		IDToken     string `json:"id_token,omitempty"`
+		Scope       string `json:"scope,omitempty"`
+	}
+
+	// tokenIntrospection is the response of RFC 7662 section 2.2, isserver tells server tokens apart
+	tokenIntrospection struct {
+		Active    bool        `json:"active"`
+		Sub       string      `json:"sub,omitempty"`
+		ClientID  string      `json:"client_id,omitempty"`
+		Scope     string      `json:"scope,omitempty"`
+		TokenType string      `json:"token_type,omitempty"`
+		Exp       int64       `json:"exp,omitempty"`
+		Iat       int64       `json:"iat,omitempty"`
+		Iss       string      `json:"iss,omitempty"`
+		Aud       string      `json:"aud,omitempty"`
+		IsServer  *bool       `json:"isserver,omitempty"`
+		Act       *TokenActor `json:"act,omitempty"`
+	}
+
+	// oidcLoginPage is rendered by oidcLoginTemplate
+	oidcLoginPage struct {
+		ClientName string
+		Message    string
+		Username   string
+		Parameters []oidcLoginParameter
+	}
+
+	oidcLoginParameter struct {
+		Name  string
+		Value string
+	}
+
+	// oauthError is the error response of the token endpoint
+	oauthError struct {
+		Error       string `json:"error"`
+		Description string `json:"error_description,omitempty"`
+	}
+)
+
+var DefaultOidcConfig = OidcConfig{
+	AuthorizationCodeDurationSecs: 60,
+	IDTokenDurationSecs:           60 * 60,
+}
+
+// userInfoClaimNames maps the fields of a serialized user to the standard claims of OpenID Connect Core
+// section 5.1, or to a claim of the same meaning where there is no standard one
+var userInfoClaimNames = map[string]string{
+	"userid":        "sub",
+	"username":      "preferred_username",
+	"emailVerified": "email_verified",
+	"emails":        "emails",
+	"roles":         "roles",
+	"termsAccepted": "terms_accepted",
+	"mfaEnabled":    "mfa_enabled",
+}
+
+// the claims added to ID tokens for each scope
+var oidcScopeClaims = map[string][]string{
+	OidcScopeProfile: {"preferred_username", "roles", "terms_accepted"},
+	OidcScopeEmail:   {"email", "email_verified"},
+}
+
+func (c OidcConfig) withDefaults() OidcConfig {
+	if c.AuthorizationCodeDurationSecs == 0 {
+		c.AuthorizationCodeDurationSecs = DefaultOidcConfig.AuthorizationCodeDurationSecs
+	}
+	if c.IDTokenDurationSecs == 0 {
+		c.IDTokenDurationSecs = DefaultOidcConfig.IDTokenDurationSecs
+	}
+	c.Issuer = strings.TrimSuffix(c.Issuer, "/")
+	return c
+}
+
+// IsEnabled reports whether shoreline acts as an OpenID Connect provider
+func (c OidcConfig) IsEnabled() bool {
+	return c.Issuer != ""
+}
+
+// Validate checks that the issuer and the redirect URIs of the clients are absolute URLs
+func (c OidcConfig) Validate() error {
+	if !c.IsEnabled() {
+		return nil
+	}
+	if issuer, err := url.Parse(c.Issuer); err != nil || !issuer.IsAbs() || issuer.RawQuery != "" || issuer.Fragment != "" {
+		return fmt.Errorf("oidc: issuer %q must be an absolute URL without query or fragment", c.Issuer)
+	}
+
+	clientIDs := map[string]bool{}
+	for _, client := range c.Clients {
+		if client.ID == "" {
+			return errors.New("oidc: client id must not be empty")
+		} else if clientIDs[client.ID] {
+			return fmt.Errorf("oidc: client id %q is not unique", client.ID)
+		} else if len(client.RedirectURIs) == 0 {
+			return fmt.Errorf("oidc: client %q must have a redirect URI", client.ID)
+		}
+		clientIDs[client.ID] = true
+
+		for _, redirectURI := range client.RedirectURIs {
+			if parsed, err := url.Parse(redirectURI); err != nil || !parsed.IsAbs() || parsed.Fragment != "" {
+				return fmt.Errorf("oidc: redirect URI %q of client %q must be an absolute URL without fragment", redirectURI, client.ID)
+			}
+		}
+	}
+	return nil
+}
+
+// ValidateKeyRing checks that ID tokens would be signed with an asymmetric key. Clients verify ID tokens, and with
+// a symmetric key they would need the secret that signs every session token.
+func (c OidcConfig) ValidateKeyRing(keyRing *KeyRing) error {
+	if c.IsEnabled() && !keyRing.IsAsymmetric() {
+		return fmt.Errorf("oidc: ID tokens cannot be signed with the symmetric algorithm %s, configure an asymmetric signing key", keyRing.Algorithm())
+	}
+	return nil
+}
+
+// Client returns the client with the id, or nil if there is none
+func (c OidcConfig) Client(id string) *OidcClient {
+	for index := range c.Clients {
+		if c.Clients[index].ID == id {
+			return &c.Clients[index]
+		}
+	}
+	return nil
+}
+
+// HasRedirectURI reports whether the redirect URI is registered for the client
+func (c *OidcClient) HasRedirectURI(redirectURI string) bool {
+	for _, registered := range c.RedirectURIs {
+		if registered == redirectURI {
+			return true
+		}
+	}
+	return false
+}
+
+// NewAuthorizationCode creates an authorization code and returns it along with the value handed to the client. The
+// scope is the granted OpenID Connect scope, the scopes limit the access token like the scopes of a session.
+func NewAuthorizationCode(clientID string, userID string, redirectURI string, scope string, scopes []string, nonce string, codeChallenge string, durationSecs int64) (*AuthorizationCode, string, error) {
+	if userID == "" {
+		return nil, "", AuthorizationCode_error_no_userid
+	}
+
+	value, err := newOpaqueToken(authorizationCodeLength)
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now().Truncate(time.Second)
+	return &AuthorizationCode{
+		ID:            HashAuthorizationCode(value),
+		ClientID:      clientID,
+		UserID:        userID,
+		RedirectURI:   redirectURI,
+		Scope:         scope,
+		Scopes:        scopes,
+		Nonce:         nonce,
+		CodeChallenge: codeChallenge,
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(time.Duration(durationSecs) * time.Second),
+	}, value, nil
+}
+
+// HashAuthorizationCode returns the stored representation of the authorization code
+func HashAuthorizationCode(value string) string {
+	return hashOpaqueToken(value)
+}
+
+// VerifyCodeVerifier checks the PKCE code verifier of RFC 7636 against the challenge of the authorization request
+func (c *AuthorizationCode) VerifyCodeVerifier(verifier string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(challenge), []byte(c.CodeChallenge)) == 1
+}
+
+// oidcAccessTokenScopes are the session scopes of the access tokens issued to OpenID Connect clients. The
+// supported OpenID Connect scopes only read the account, so the tokens must never be able to change it.
+var oidcAccessTokenScopes = []string{ScopeRead}
+
+// grantedOidcScope returns the supported scopes of the requested scope, or an empty string if openid is missing
+func grantedOidcScope(requested string) string {
+	var granted []string
+	hasOpenID := false
+	for _, scope := range strings.Fields(requested) {
+		switch scope {
+		case OidcScopeOpenID:
+			hasOpenID = true
+			granted = append(granted, scope)
+		case OidcScopeProfile, OidcScopeEmail:
+			granted = append(granted, scope)
+		}
+	}
+	if !hasOpenID {
+		return ""
+	}
+	return strings.Join(granted, " ")
+}
+
+// userInfoClaims converts a serialized user, see asSerializableUser, to OpenID Connect claims
+func userInfoClaims(serializable map[string]interface{}) map[string]interface{} {
+	claims := map[string]interface{}{}
+	for field, value := range serializable {
+		if claim, ok := userInfoClaimNames[field]; ok {
+			claims[claim] = value
+		}
+	}
+	if emails, ok := serializable["emails"].([]string); ok && len(emails) > 0 {
+		claims["email"] = emails[0]
+	} else if username, ok := serializable["username"].(string); ok {
+		claims["email"] = username
+	}
+	return claims
+}
+
+// NewIDToken creates the ID token of the user for the client that exchanged the authorization code. The claims
+// of the user are included according to the granted scope.
+func NewIDToken(code *AuthorizationCode, userClaims map[string]interface{}, issuer string, durationSecs int64, keyRing *KeyRing) (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss": issuer,
+		"sub": code.UserID,
+		"aud": code.ClientID,
+		"azp": code.ClientID,
+		"iat": now.Unix(),
+		"exp": now.Add(time.Duration(durationSecs) * time.Second).Unix(),
+	}
+	if code.Nonce != "" {
+		claims["nonce"] = code.Nonce
+	}
+	for _, scope := range strings.Fields(code.Scope) {
+		for _, claim := range oidcScopeClaims[scope] {
+			if value, ok := userClaims[claim]; ok {
+				claims[claim] = value
+			}
+		}
+	}
+	return keyRing.sign(claims)
+}
+
+// oidcLoginTemplate is the login form of the authorization endpoint. The form posts to the endpoint itself, the
+// relative action keeps working behind a proxy that serves shoreline under a path prefix.
+var oidcLoginTemplate = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Log in to {{.ClientName}}</title>
+<style>
+body { font-family: sans-serif; max-width: 22em; margin: 4em auto; padding: 0 1em; }
+label, input, button { display: block; width: 100%; box-sizing: border-box; }
+input { margin: 0.25em 0 1em; padding: 0.5em; }
+button { padding: 0.5em; }
+.message { color: #b00020; }
+</style>
+</head>
+<body>
+<h1>Log in to {{.ClientName}}</h1>
+{{if .Message}}<p class="message" role="alert">{{.Message}}</p>{{end}}
+<form method="post" action="authorize">
+{{range .Parameters}}<input type="hidden" name="{{.Name}}" value="{{.Value}}">
+{{end}}<label for="username">Email</label>
+<input id="username" name="username" type="email" autocomplete="username" value="{{.Username}}" required autofocus>
+<label for="password">Password</label>
+<input id="password" name="password" type="password" autocomplete="current-password" required>
+<label for="code">Authentication code, if enabled</label>
+<input id="code" name="code" type="text" inputmode="numeric" autocomplete="one-time-code">
+<button type="submit">Log in</button>
+</form>
+</body>
+</html>
+`))
+
+// newOidcLoginPage returns the login form for the authorization request
+func newOidcLoginPage(req *http.Request, client *OidcClient, message string) *oidcLoginPage {
+	page := &oidcLoginPage{ClientName: client.Name, Message: message, Username: req.PostFormValue("username")}
+	if page.ClientName == "" {
+		page.ClientName = client.ID
+	}
+	for _, name := range oidcAuthorizationParameters {
+		if value := req.FormValue(name); value != "" {
+			page.Parameters = append(page.Parameters, oidcLoginParameter{Name: name, Value: value})
+		}
+	}
+	return page
+}
+
+// newOidcDiscovery returns the discovery document of OpenID Connect Discovery section 3
+func newOidcDiscovery(config OidcConfig, algorithm string, serviceClients bool) *oidcDiscovery {
+	grantTypes := []string{"authorization_code"}
+	authMethods := []string{"none"}
+	if serviceClients {
+		grantTypes = append(grantTypes, "client_credentials")
+		authMethods = append(authMethods, "client_secret_basic", "client_secret_post")
+	}
+
+	return &oidcDiscovery{
+		Issuer:                            config.Issuer,
+		AuthorizationEndpoint:             config.Issuer + "/oauth/authorize",
+		TokenEndpoint:                     config.Issuer + "/oauth/token",
+		UserInfoEndpoint:                  config.Issuer + "/userinfo",
+		IntrospectionEndpoint:             config.Issuer + "/oauth/introspect",
+		RevocationEndpoint:                config.Issuer + "/oauth/revoke",
+		JwksURI:                           config.Issuer + "/.well-known/jwks.json",
+		ScopesSupported:                   []string{OidcScopeOpenID, OidcScopeProfile, OidcScopeEmail},
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               grantTypes,
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{algorithm},
+		TokenEndpointAuthMethodsSupported: authMethods,
+		CodeChallengeMethodsSupported:     []string{pkceMethodS256},
+		ClaimsSupported: []string{
+			"iss", "sub", "aud", "azp", "exp", "iat", "nonce",
+			"preferred_username", "email", "email_verified", "emails", "roles", "terms_accepted", "mfa_enabled",
+		},
+	}
+}
+
+// oidcRedirectURI returns the redirect URI with the parameters of the authorization response added
+func oidcRedirectURI(redirectURI string, params map[string]string) string {
+	parsed, err := url.Parse(redirectURI)
+	if err != nil {
+		return redirectURI
+	}
+	query := parsed.Query()
+	for key, value := range params {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+	parsed.RawQuery = query.Encode()
+	return parsed.String()
+}
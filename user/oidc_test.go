@@ -0,0 +1,180 @@
+package user
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// the example of RFC 7636 appendix B
+const (
+	pkceTestVerifier  = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	pkceTestChallenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+)
+
+func TestOidcConfig_Validate(t *testing.T) {
+
+	valid := []OidcConfig{
+		{},
+		{Issuer: "https://tidepool.test/auth", Clients: []OidcClient{{ID: "app", RedirectURIs: []string{"https://app.test/callback?source=oidc"}}}},
+	}
+	for _, config := range valid {
+		if err := config.Validate(); err != nil {
+			t.Fatalf("there should be no error for the config %#v: %v", config, err)
+		}
+	}
+
+	invalid := []OidcConfig{
+		{Issuer: "/auth"},
+		{Issuer: "https://tidepool.test/auth?query"},
+		{Issuer: "https://tidepool.test", Clients: []OidcClient{{RedirectURIs: []string{"https://app.test/callback"}}}},
+		{Issuer: "https://tidepool.test", Clients: []OidcClient{{ID: "app"}}},
+		{Issuer: "https://tidepool.test", Clients: []OidcClient{{ID: "app", RedirectURIs: []string{"/callback"}}}},
+		{Issuer: "https://tidepool.test", Clients: []OidcClient{{ID: "app", RedirectURIs: []string{"https://app.test/#callback"}}}},
+		{Issuer: "https://tidepool.test", Clients: []OidcClient{{ID: "app", RedirectURIs: []string{"https://a.test"}}, {ID: "app", RedirectURIs: []string{"https://b.test"}}}},
+	}
+	for _, config := range invalid {
+		if err := config.Validate(); err == nil {
+			t.Fatalf("there should be an error for the invalid config %#v", config)
+		}
+	}
+
+}
+
+func TestOidcConfig_ValidateKeyRing(t *testing.T) {
+
+	symmetric := TokenConfig{Algorithm: "HS256", EncodeKey: "my secret", DecodeKey: "my secret"}
+	config := OidcConfig{Issuer: "https://tidepool.test/auth"}
+	if err := config.ValidateKeyRing(newKeyRing(t, generateTokenConfig(t, "ES256"), symmetric)); err != nil {
+		t.Fatalf("there should be no error for an asymmetric signing key: %v", err)
+	}
+	if err := config.ValidateKeyRing(newKeyRing(t, symmetric)); err == nil {
+		t.Fatal("there should be an error for a symmetric signing key")
+	}
+	if err := (OidcConfig{}).ValidateKeyRing(newKeyRing(t, symmetric)); err != nil {
+		t.Fatalf("there should be no error while the provider is disabled: %v", err)
+	}
+
+}
+
+func TestOidcConfig_Client(t *testing.T) {
+
+	config := OidcConfig{Clients: []OidcClient{{ID: "app", RedirectURIs: []string{"https://app.test/callback"}}}}
+	if client := config.Client("app"); client == nil || !client.HasRedirectURI("https://app.test/callback") || client.HasRedirectURI("https://app.test/other") {
+		t.Fatalf("unexpected client %#v", client)
+	}
+	if client := config.Client("other"); client != nil {
+		t.Fatalf("there should be no client %#v", client)
+	}
+
+}
+
+func TestGrantedOidcScope(t *testing.T) {
+
+	expected := map[string]string{
+		"openid":                      "openid",
+		"openid email profile":        "openid email profile",
+		"openid offline_access email": "openid email",
+		"email profile":               "",
+		"":                            "",
+	}
+	for requested, granted := range expected {
+		if actual := grantedOidcScope(requested); actual != granted {
+			t.Fatalf("the granted scope of %q should be %q, not %q", requested, granted, actual)
+		}
+	}
+
+}
+
+func TestAuthorizationCode_VerifyCodeVerifier(t *testing.T) {
+
+	code, value, err := NewAuthorizationCode("app", "1234", "https://app.test/callback", "openid", nil, "", pkceTestChallenge, 60)
+	if err != nil {
+		t.Fatalf("there should be no error creating the authorization code: %v", err)
+	}
+	if code.ID != HashAuthorizationCode(value) {
+		t.Fatalf("the authorization code id %s should be the hash of the value", code.ID)
+	}
+
+	if !code.VerifyCodeVerifier(pkceTestVerifier) {
+		t.Fatal("the code verifier should match the challenge")
+	}
+	if code.VerifyCodeVerifier(pkceTestVerifier[1:] + "a") {
+		t.Fatal("another code verifier should not match the challenge")
+	}
+	if code.VerifyCodeVerifier("") {
+		t.Fatal("an empty code verifier should not match the challenge")
+	}
+
+	if _, _, err := NewAuthorizationCode("app", "", "https://app.test/callback", "openid", nil, "", pkceTestChallenge, 60); err != AuthorizationCode_error_no_userid {
+		t.Fatalf("the error %v should be %v", err, AuthorizationCode_error_no_userid)
+	}
+
+}
+
+func TestUserInfoClaims(t *testing.T) {
+
+	claims := userInfoClaims(map[string]interface{}{
+		"userid":         "1234",
+		"username":       "a@z.co",
+		"emails":         []string{"b@z.co"},
+		"emailVerified":  true,
+		"termsAccepted":  "2016-01-01T01:23:45-08:00",
+		"passwordExists": true,
+	})
+	expected := map[string]interface{}{
+		"sub":                "1234",
+		"preferred_username": "a@z.co",
+		"email":              "b@z.co",
+		"emails":             []string{"b@z.co"},
+		"email_verified":     true,
+		"terms_accepted":     "2016-01-01T01:23:45-08:00",
+	}
+	if !reflect.DeepEqual(claims, expected) {
+		t.Fatalf("the claims %#v should be %#v", claims, expected)
+	}
+
+}
+
+func TestNewIDToken(t *testing.T) {
+
+	code := &AuthorizationCode{ClientID: "app", UserID: "1234", Scope: "openid email", Nonce: "n-0S6_WzA2Mj"}
+	userClaims := map[string]interface{}{"sub": "1234", "preferred_username": "a@z.co", "email": "a@z.co", "email_verified": true}
+
+	idToken, err := NewIDToken(code, userClaims, "https://tidepool.test/auth", 3600, newKeyRing(t, tokenConfigs[0]))
+	if err != nil {
+		t.Fatalf("there should be no error creating the ID token: %v", err)
+	}
+
+	// the ID token is meant for the client, not for shoreline
+	verifier := tokenConfigs[0]
+	verifier.Issuer, verifier.Audience = "https://tidepool.test/auth", "app"
+	parsed, err := newKeyRing(t, verifier).verify(idToken)
+	if err != nil {
+		t.Fatalf("the ID token should be verified: %v", err)
+	}
+	claims := parsed.Claims.(jwt.MapClaims)
+	for claim, value := range map[string]interface{}{"iss": "https://tidepool.test/auth", "sub": "1234", "aud": "app", "nonce": "n-0S6_WzA2Mj", "email": "a@z.co", "email_verified": true} {
+		if claims[claim] != value {
+			t.Fatalf("the claim %s should be %v, not %v", claim, value, claims[claim])
+		}
+	}
+	if _, ok := claims["preferred_username"]; ok {
+		t.Fatal("the profile claims should only be included with the profile scope")
+	}
+
+}
+
+func TestOidcRedirectURI(t *testing.T) {
+
+	redirect, err := url.Parse(oidcRedirectURI("https://app.test/callback?source=oidc", map[string]string{"code": "abc", "state": ""}))
+	if err != nil {
+		t.Fatalf("there should be no error parsing the redirect URI: %v", err)
+	}
+	if query := redirect.Query(); query.Get("source") != "oidc" || query.Get("code") != "abc" || query["state"] != nil {
+		t.Fatalf("unexpected redirect URI %s", redirect)
+	}
+
+}
@@ -0,0 +1,325 @@
+package user
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var passwordDenyListErrorCount = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "tidepool_shoreline_password_deny_list_error_total",
+	Help: "The total number of failures to search the password deny-list",
+})
+
+// errPasswordPolicyUnavailable is returned when a password could not be checked, rather than was rejected
+var errPasswordPolicyUnavailable = errors.New("password policy unavailable")
+
+// Codes of the reasons a password is rejected, clients can use them to tell the user what to fix
+const (
+	PasswordRejectionTooShort          = "too_short"
+	PasswordRejectionTooLong           = "too_long"
+	PasswordRejectionWhitespace        = "whitespace"
+	PasswordRejectionCharacterClasses  = "character_classes"
+	PasswordRejectionSimilarToIdentity = "similar_to_identity"
+	PasswordRejectionBreached          = "breached"
+)
+
+// Bounds of the legacy password rule (see IsValidPassword) that no policy may relax
+const (
+	passwordMinLengthLimit = 8
+	passwordMaxLengthLimit = 72
+
+	// identity fragments shorter than this are too common to be meaningful, e.g. "a" of a@z.co
+	passwordMinIdentityFragment = 4
+)
+
+type (
+	// PasswordPolicy decides whether a password is acceptable for an account. Identifiers are the
+	// username and emails of the account so that the policy can reject passwords derived from them.
+	// An error means the password could not be checked.
+	PasswordPolicy interface {
+		Check(password string, identifiers ...string) ([]PasswordRejection, error)
+	}
+
+	// PasswordRejection is one reason why a password was rejected
+	PasswordRejection struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+
+	// PasswordPolicyError is returned by validation when the password policy rejects the password
+	PasswordPolicyError struct {
+		Rejections []PasswordRejection
+	}
+
+	// PasswordPolicyConfig configures the default password policy. Zero values fall back to DefaultPasswordPolicyConfig.
+	PasswordPolicyConfig struct {
+		MinLength              int  `json:"minLength"`              // minimum number of characters, at least 8
+		MaxLength              int  `json:"maxLength"`              // maximum number of characters, at most 72
+		MinCharacterClasses    int  `json:"minCharacterClasses"`    // how many of lowercase, uppercase, digits and symbols must be used
+		AllowSimilarToIdentity bool `json:"allowSimilarToIdentity"` // accept passwords that contain the username or email
+		// DenyListFile is a local file of SHA-1 hashes of breached passwords sorted in ascending order, one hex encoded
+		// hash per line optionally followed by ":<count>", the format of the Pwned Passwords SHA-1 "ordered by hash" downloads
+		DenyListFile string `json:"denyListFile"`
+		// DenyListFailOpen accepts passwords when the deny-list cannot be searched, by default the request fails
+		DenyListFailOpen bool `json:"denyListFailOpen"`
+	}
+
+	defaultPasswordPolicy struct {
+		config   PasswordPolicyConfig
+		denyList *passwordDenyList
+	}
+)
+
+var DefaultPasswordPolicyConfig = PasswordPolicyConfig{
+	MinLength:           passwordMinLengthLimit,
+	MaxLength:           passwordMaxLengthLimit,
+	MinCharacterClasses: 1,
+}
+
+// DefaultPasswordPolicy is used when no policy is configured
+var DefaultPasswordPolicy PasswordPolicy = &defaultPasswordPolicy{config: DefaultPasswordPolicyConfig}
+
+func (c PasswordPolicyConfig) withDefaults() PasswordPolicyConfig {
+	if c.MinLength == 0 {
+		c.MinLength = DefaultPasswordPolicyConfig.MinLength
+	}
+	if c.MaxLength == 0 {
+		c.MaxLength = DefaultPasswordPolicyConfig.MaxLength
+	}
+	if c.MinCharacterClasses == 0 {
+		c.MinCharacterClasses = DefaultPasswordPolicyConfig.MinCharacterClasses
+	}
+	return c
+}
+
+// NewPasswordPolicy creates the default password policy from the config and loads its deny-list
+func NewPasswordPolicy(config PasswordPolicyConfig) (PasswordPolicy, error) {
+	config = config.withDefaults()
+	if config.MinLength < passwordMinLengthLimit {
+		return nil, fmt.Errorf("password policy: minLength must be at least %d", passwordMinLengthLimit)
+	} else if config.MaxLength > passwordMaxLengthLimit {
+		return nil, fmt.Errorf("password policy: maxLength must be at most %d", passwordMaxLengthLimit)
+	} else if config.MinLength > config.MaxLength {
+		return nil, fmt.Errorf("password policy: minLength must not exceed maxLength")
+	} else if config.MinCharacterClasses > 4 {
+		return nil, fmt.Errorf("password policy: minCharacterClasses must be at most 4")
+	}
+
+	policy := &defaultPasswordPolicy{config: config}
+	if config.DenyListFile != "" {
+		denyList, err := openPasswordDenyList(config.DenyListFile)
+		if err != nil {
+			return nil, err
+		}
+		policy.denyList = denyList
+	}
+	return policy, nil
+}
+
+// passwordDenyList is a sorted file of SHA-1 hashes that is binary searched on disk, so that deny-lists of
+// hundreds of millions of hashes do not have to fit in memory
+type passwordDenyList struct {
+	file *os.File
+	size int64
+}
+
+const passwordDenyListHashLength = 2 * sha1.Size
+
+func openPasswordDenyList(path string) (*passwordDenyList, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("password policy: unable to open deny-list: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("password policy: unable to read deny-list: %w", err)
+	}
+
+	denyList := &passwordDenyList{file: file, size: info.Size()}
+
+	// the file is too large to check at startup, its first line catches the wrong file or format
+	if hash, _, err := denyList.hashAt(0); err != nil {
+		file.Close()
+		return nil, err
+	} else if hash == "" {
+		file.Close()
+		return nil, fmt.Errorf("password policy: deny-list is empty")
+	}
+	return denyList, nil
+}
+
+// hashAt returns the hash of the first line that starts at or after the offset, in upper case, and the offset of
+// the line that follows it. The hash is empty if no line starts at or after the offset.
+func (d *passwordDenyList) hashAt(offset int64) (string, int64, error) {
+	start := offset
+	if offset > 0 {
+		// the line starts at the offset only if the previous byte ends a line
+		start--
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(d.file, start, d.size-start))
+	if offset > 0 {
+		skipped, err := reader.ReadString('\n')
+		if err == io.EOF {
+			return "", d.size, nil
+		} else if err != nil {
+			return "", 0, fmt.Errorf("password policy: unable to read deny-list: %w", err)
+		}
+		start += int64(len(skipped))
+	}
+
+	line, err := reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", 0, fmt.Errorf("password policy: unable to read deny-list: %w", err)
+	} else if line == "" {
+		return "", d.size, nil
+	}
+	next := start + int64(len(line))
+
+	hash := strings.TrimSpace(line)
+	if index := strings.IndexByte(hash, ':'); index >= 0 {
+		hash = hash[:index]
+	}
+	if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != sha1.Size {
+		return "", 0, fmt.Errorf("password policy: invalid SHA-1 hash at offset %d of the deny-list", start)
+	}
+	return strings.ToUpper(hash), next, nil
+}
+
+// contains binary searches the deny-list for the SHA-1 hash of the password, the lines still to search are the ones
+// that start in [low, high)
+func (d *passwordDenyList) contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	target := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	low, high := int64(0), d.size
+	for low < high {
+		middle := low + (high-low)/2
+		hash, next, err := d.hashAt(middle)
+		if err != nil {
+			return false, err
+		}
+		switch {
+		case hash == "" || hash > target:
+			// no line starting in [middle, high) can match
+			high = middle
+		case hash < target:
+			low = next
+		default:
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (p *defaultPasswordPolicy) Check(password string, identifiers ...string) ([]PasswordRejection, error) {
+	var rejections []PasswordRejection
+
+	if length := utf8.RuneCountInString(password); length < p.config.MinLength {
+		rejections = append(rejections, PasswordRejection{PasswordRejectionTooShort, fmt.Sprintf("Password must have at least %d characters", p.config.MinLength)})
+	} else if length > p.config.MaxLength {
+		rejections = append(rejections, PasswordRejection{PasswordRejectionTooLong, fmt.Sprintf("Password must have at most %d characters", p.config.MaxLength)})
+	}
+
+	if strings.IndexFunc(password, unicode.IsSpace) >= 0 {
+		rejections = append(rejections, PasswordRejection{PasswordRejectionWhitespace, "Password must not contain whitespace"})
+	}
+
+	if passwordCharacterClasses(password) < p.config.MinCharacterClasses {
+		rejections = append(rejections, PasswordRejection{PasswordRejectionCharacterClasses, fmt.Sprintf("Password must use at least %d of lowercase letters, uppercase letters, digits and symbols", p.config.MinCharacterClasses)})
+	}
+
+	if !p.config.AllowSimilarToIdentity && isPasswordSimilarToIdentity(password, identifiers) {
+		rejections = append(rejections, PasswordRejection{PasswordRejectionSimilarToIdentity, "Password must not contain the username or email"})
+	}
+
+	if p.denyList != nil {
+		if breached, err := p.denyList.contains(password); err != nil {
+			passwordDenyListErrorCount.Inc()
+			if !p.config.DenyListFailOpen {
+				return nil, fmt.Errorf("error searching the password deny-list: %w", err)
+			}
+			log.Printf("Error searching the password deny-list, accepting the password: %v", err)
+		} else if breached {
+			rejections = append(rejections, PasswordRejection{PasswordRejectionBreached, "Password has appeared in a data breach and must not be used"})
+		}
+	}
+
+	return rejections, nil
+}
+
+func passwordCharacterClasses(password string) int {
+	var lower, upper, digit, symbol int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		case !unicode.IsSpace(r):
+			symbol = 1
+		}
+	}
+	return lower + upper + digit + symbol
+}
+
+// isPasswordSimilarToIdentity reports whether the password contains an identifier, or the local part
+// of an email identifier, ignoring case
+func isPasswordSimilarToIdentity(password string, identifiers []string) bool {
+	password = strings.ToLower(password)
+	for _, identifier := range identifiers {
+		identifier = strings.ToLower(strings.TrimSpace(identifier))
+		fragments := []string{identifier}
+		if index := strings.LastIndexByte(identifier, '@'); index > 0 {
+			fragments = append(fragments, identifier[:index])
+		}
+		for _, fragment := range fragments {
+			if utf8.RuneCountInString(fragment) >= passwordMinIdentityFragment && strings.Contains(password, fragment) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (e *PasswordPolicyError) Error() string {
+	messages := make([]string, len(e.Rejections))
+	for index, rejection := range e.Rejections {
+		messages[index] = rejection.Message
+	}
+	return fmt.Sprintf("%s: %s", User_error_password_invalid, strings.Join(messages, "; "))
+}
+
+// Unwrap allows callers to keep treating a policy rejection as User_error_password_invalid
+func (e *PasswordPolicyError) Unwrap() error {
+	return User_error_password_invalid
+}
+
+// checkPasswordPolicy returns a PasswordPolicyError if the policy, or DefaultPasswordPolicy if nil, rejects the password,
+// and an error wrapping errPasswordPolicyUnavailable if the password could not be checked
+func checkPasswordPolicy(policy PasswordPolicy, password string, identifiers ...string) error {
+	if policy == nil {
+		policy = DefaultPasswordPolicy
+	}
+	if rejections, err := policy.Check(password, identifiers...); err != nil {
+		return fmt.Errorf("%w: %v", errPasswordPolicyUnavailable, err)
+	} else if len(rejections) > 0 {
+		return &PasswordPolicyError{Rejections: rejections}
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package user
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func expectRejectionCodes(t *testing.T, rejections []PasswordRejection, expected ...string) {
+	codes := []string{}
+	for _, rejection := range rejections {
+		codes = append(codes, rejection.Code)
+	}
+	if expected == nil {
+		expected = []string{}
+	}
+	if !reflect.DeepEqual(codes, expected) {
+		t.Fatalf("the password rejections %v should be %v", codes, expected)
+	}
+}
+
+func checkRejections(t *testing.T, policy PasswordPolicy, password string, identifiers ...string) []PasswordRejection {
+	rejections, err := policy.Check(password, identifiers...)
+	if err != nil {
+		t.Fatalf("there should be no error checking the password: %v", err)
+	}
+	return rejections
+}
+
+func TestDefaultPasswordPolicy_Check(t *testing.T) {
+
+	expected := map[string][]string{
+		"12345678":        {},
+		"1234567":         {PasswordRejectionTooShort},
+		"1234 5678":       {PasswordRejectionWhitespace},
+		"jessica!!":       {PasswordRejectionSimilarToIdentity},
+		"my-JESSICA@Z.CO": {PasswordRejectionSimilarToIdentity},
+		"abcd":            {PasswordRejectionTooShort, PasswordRejectionSimilarToIdentity},
+		"12345678901234567890123456789012345678901234567890123456789012345678901234567890": {PasswordRejectionTooLong},
+	}
+	for password, codes := range expected {
+		expectRejectionCodes(t, checkRejections(t, DefaultPasswordPolicy, password, "abcd", "jessica@z.co"), codes...)
+	}
+
+}
+
+func TestPasswordPolicy_CharacterClasses(t *testing.T) {
+
+	policy, err := NewPasswordPolicy(PasswordPolicyConfig{MinCharacterClasses: 3})
+	if err != nil {
+		t.Fatalf("there should be no error creating the policy: %v", err)
+	}
+
+	expectRejectionCodes(t, checkRejections(t, policy, "password"), PasswordRejectionCharacterClasses)
+	expectRejectionCodes(t, checkRejections(t, policy, "Password"), PasswordRejectionCharacterClasses)
+	expectRejectionCodes(t, checkRejections(t, policy, "Passw0rd"))
+	expectRejectionCodes(t, checkRejections(t, policy, "passw0rd!"))
+
+}
+
+func TestPasswordPolicy_AllowSimilarToIdentity(t *testing.T) {
+
+	policy, err := NewPasswordPolicy(PasswordPolicyConfig{AllowSimilarToIdentity: true})
+	if err != nil {
+		t.Fatalf("there should be no error creating the policy: %v", err)
+	}
+
+	expectRejectionCodes(t, checkRejections(t, policy, "jessica!!", "jessica@z.co"))
+
+}
+
+func TestPasswordPolicy_DenyList(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "passwordPolicy")
+	if err != nil {
+		t.Fatalf("there should be no error creating the directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// SHA-1 of "password1" and "qwertyuiop"
+	path := filepath.Join(dir, "denylist.txt")
+	content := "b0399d2029f64d445bd131ffaa399a42d2f8e7dc\nE38AD214943DAAD1D64C102FAEC29DE4AFE9DA3D:2413945\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("there should be no error writing the deny-list: %v", err)
+	}
+
+	policy, err := NewPasswordPolicy(PasswordPolicyConfig{DenyListFile: path})
+	if err != nil {
+		t.Fatalf("there should be no error creating the policy: %v", err)
+	}
+
+	expectRejectionCodes(t, checkRejections(t, policy, "password1"), PasswordRejectionBreached)
+	expectRejectionCodes(t, checkRejections(t, policy, "qwertyuiop"), PasswordRejectionBreached)
+	expectRejectionCodes(t, checkRejections(t, policy, "password2"))
+
+	if err := ioutil.WriteFile(path, []byte("not a hash\n"), 0600); err != nil {
+		t.Fatalf("there should be no error writing the deny-list: %v", err)
+	}
+	if _, err := NewPasswordPolicy(PasswordPolicyConfig{DenyListFile: path}); err == nil {
+		t.Fatal("there should be an error when the deny-list is malformed")
+	}
+	if _, err := NewPasswordPolicy(PasswordPolicyConfig{DenyListFile: filepath.Join(dir, "missing.txt")}); err == nil {
+		t.Fatal("there should be an error when the deny-list is missing")
+	}
+
+}
+
+func TestPasswordPolicy_DenyList_Search(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "passwordPolicy")
+	if err != nil {
+		t.Fatalf("there should be no error creating the directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var hashes []string
+	for index := 0; index < 1000; index += 2 {
+		sum := sha1.Sum([]byte(fmt.Sprintf("breached-%d", index)))
+		hashes = append(hashes, fmt.Sprintf("%X:%d", sum, index))
+	}
+	sort.Strings(hashes)
+
+	path := filepath.Join(dir, "denylist.txt")
+	if err := ioutil.WriteFile(path, []byte(strings.Join(hashes, "\r\n")), 0600); err != nil {
+		t.Fatalf("there should be no error writing the deny-list: %v", err)
+	}
+
+	policy, err := NewPasswordPolicy(PasswordPolicyConfig{DenyListFile: path})
+	if err != nil {
+		t.Fatalf("there should be no error creating the policy: %v", err)
+	}
+
+	for index := 0; index < 1000; index++ {
+		password := fmt.Sprintf("breached-%d", index)
+		if index%2 == 0 {
+			expectRejectionCodes(t, checkRejections(t, policy, password), PasswordRejectionBreached)
+		} else {
+			expectRejectionCodes(t, checkRejections(t, policy, password))
+		}
+	}
+
+}
+
+func TestPasswordPolicy_DenyList_Error(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "passwordPolicy")
+	if err != nil {
+		t.Fatalf("there should be no error creating the directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "denylist.txt")
+	if err := ioutil.WriteFile(path, []byte("b0399d2029f64d445bd131ffaa399a42d2f8e7dc\n"), 0600); err != nil {
+		t.Fatalf("there should be no error writing the deny-list: %v", err)
+	}
+
+	for _, failOpen := range []bool{false, true} {
+		policy, err := NewPasswordPolicy(PasswordPolicyConfig{DenyListFile: path, DenyListFailOpen: failOpen})
+		if err != nil {
+			t.Fatalf("there should be no error creating the policy: %v", err)
+		}
+		policy.(*defaultPasswordPolicy).denyList.file.Close()
+
+		rejections, err := policy.Check("password1")
+		if failOpen && (err != nil || len(rejections) != 0) {
+			t.Fatalf("the password should be accepted when failing open: %v %v", rejections, err)
+		} else if !failOpen && err == nil {
+			t.Fatal("there should be an error when the deny-list cannot be searched")
+		}
+		if err := checkPasswordPolicy(policy, "password1"); !failOpen && !errors.Is(err, errPasswordPolicyUnavailable) {
+			t.Fatalf("the error should be errPasswordPolicyUnavailable: %v", err)
+		}
+	}
+
+}
+
+func TestNewPasswordPolicy_InvalidConfig(t *testing.T) {
+
+	invalid := []PasswordPolicyConfig{
+		{MinLength: 6},
+		{MaxLength: 128},
+		{MinLength: 20, MaxLength: 16},
+		{MinCharacterClasses: 5},
+	}
+	for _, config := range invalid {
+		if _, err := NewPasswordPolicy(config); err == nil {
+			t.Fatalf("there should be an error for the invalid config %#v", config)
+		}
+	}
+
+}
+
+func TestPasswordPolicyError(t *testing.T) {
+
+	err := checkPasswordPolicy(DefaultPasswordPolicy, "short")
+	if !errors.Is(err, User_error_password_invalid) {
+		t.Fatalf("the policy error %v should be a password invalid error", err)
+	}
+	if err.Error() != "Password is invalid: Password must have at least 8 characters" {
+		t.Fatalf("unexpected policy error message %s", err)
+	}
+	if err := checkPasswordPolicy(DefaultPasswordPolicy, "12345678"); err != nil {
+		t.Fatalf("there should be no error for a valid password: %v", err)
+	}
+
+}
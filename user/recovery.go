@@ -0,0 +1,47 @@
+package user
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"strings"
+)
+
+// Recovery codes replace a TOTP code once each, for users that lost access to their authenticator app
+const (
+	recoveryCodeCount  = 10
+	recoveryCodeLength = 10 // characters, i.e. 50 bits of entropy
+)
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewRecoveryCodes generates a set of recovery codes and returns them along with the hashes to store.
+// The codes are random enough that a keyed hash without a per-code salt is sufficient, which keeps
+// them searchable so that a code can be consumed atomically.
+func NewRecoveryCodes(salt string) ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+
+	for index := range codes {
+		random := make([]byte, recoveryCodeLength)
+		if _, err := rand.Read(random); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(recoveryCodeEncoding.EncodeToString(random))[:recoveryCodeLength]
+		codes[index] = code[:recoveryCodeLength/2] + "-" + code[recoveryCodeLength/2:]
+		hashes[index] = HashRecoveryCode(code, salt)
+	}
+
+	return codes, hashes, nil
+}
+
+// HashRecoveryCode returns the stored representation of the code, ignoring case, dashes and spaces
+func HashRecoveryCode(code string, salt string) string {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte(normalized))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,50 @@
+package user
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestNewRecoveryCodes(t *testing.T) {
+
+	codes, hashes, err := NewRecoveryCodes("some salt")
+	if err != nil {
+		t.Fatalf("there should be no error generating recovery codes: %v", err)
+	}
+	if len(codes) != recoveryCodeCount || len(hashes) != recoveryCodeCount {
+		t.Fatalf("there should be %d codes and hashes", recoveryCodeCount)
+	}
+
+	format := regexp.MustCompile(`\A[a-z2-7]{5}-[a-z2-7]{5}\z`)
+	unique := map[string]bool{}
+	for index, code := range codes {
+		if !format.MatchString(code) {
+			t.Fatalf("the recovery code %s does not have the expected format", code)
+		}
+		if hashes[index] != HashRecoveryCode(code, "some salt") {
+			t.Fatalf("the hash of recovery code %s does not match", code)
+		}
+		unique[code] = true
+	}
+	if len(unique) != recoveryCodeCount {
+		t.Fatal("the recovery codes should be unique")
+	}
+
+}
+
+func TestHashRecoveryCode(t *testing.T) {
+
+	hash := HashRecoveryCode("abcde-fghij", "some salt")
+
+	if HashRecoveryCode(strings.ToUpper("abcde fghij"), "some salt") != hash {
+		t.Fatal("the hash should ignore case, dashes and spaces")
+	}
+	if HashRecoveryCode("abcdefghij", "other salt") == hash {
+		t.Fatal("the hash should depend on the salt")
+	}
+	if HashRecoveryCode("abcdefghik", "some salt") == hash {
+		t.Fatal("different codes should have different hashes")
+	}
+
+}
@@ -0,0 +1,110 @@
+package user
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+const (
+	refreshTokenLength    = 32
+	refreshFamilyIDLength = 16
+)
+
+var RefreshToken_error_no_userid = errors.New("RefreshToken: userId not set")
+
+type (
+	// RefreshToken is an opaque, single-use token that is exchanged for a new access token and a new refresh token.
+	// Only the hash is stored. All refresh tokens that descend from the same login share a family, which is
+	// revoked as a whole once a refresh token is presented a second time.
+	RefreshToken struct {
+		ID        string     `bson:"_id"` // see HashRefreshToken
+		FamilyID  string     `bson:"familyId"`
+		UserID    string     `bson:"userId"`
+		CreatedAt time.Time  `bson:"createdAt"`
+		ExpiresAt time.Time  `bson:"expiresAt"`
+		UsedAt    *time.Time `bson:"usedAt,omitempty"`
+		Scopes    []string   `bson:"scopes,omitempty"` // the session scopes of the family, see SessionScopes
+	}
+
+	// RefreshTokenConfig controls the lifetime of the tokens handed out to clients that request a refresh token.
+	// Zero values fall back to DefaultRefreshTokenConfig.
+	RefreshTokenConfig struct {
+		AccessTokenDurationSecs  int64 `json:"accessTokenDurationSecs"`  // lifetime of the session token paired with a refresh token
+		RefreshTokenDurationSecs int64 `json:"refreshTokenDurationSecs"` // lifetime of a refresh token, renewed with every rotation
+	}
+)
+
+var DefaultRefreshTokenConfig = RefreshTokenConfig{
+	AccessTokenDurationSecs:  15 * 60,
+	RefreshTokenDurationSecs: 30 * 24 * 60 * 60,
+}
+
+func (c RefreshTokenConfig) withDefaults() RefreshTokenConfig {
+	if c.AccessTokenDurationSecs == 0 {
+		c.AccessTokenDurationSecs = DefaultRefreshTokenConfig.AccessTokenDurationSecs
+	}
+	if c.RefreshTokenDurationSecs == 0 {
+		c.RefreshTokenDurationSecs = DefaultRefreshTokenConfig.RefreshTokenDurationSecs
+	}
+	return c
+}
+
+// NewRefreshToken creates a refresh token for the user and returns it along with the opaque value handed to the client.
+// An empty familyID starts a new family.
+func NewRefreshToken(userID string, familyID string, durationSecs int64) (*RefreshToken, string, error) {
+	if userID == "" {
+		return nil, "", RefreshToken_error_no_userid
+	}
+
+	if familyID == "" {
+		family := make([]byte, refreshFamilyIDLength)
+		if _, err := rand.Read(family); err != nil {
+			return nil, "", err
+		}
+		familyID = hex.EncodeToString(family)
+	}
+
+	value, err := newOpaqueToken(refreshTokenLength)
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now().Truncate(time.Second)
+	return &RefreshToken{
+		ID:        HashRefreshToken(value),
+		FamilyID:  familyID,
+		UserID:    userID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Duration(durationSecs) * time.Second),
+	}, value, nil
+}
+
+// HashRefreshToken returns the stored representation of the opaque refresh token
+func HashRefreshToken(value string) string {
+	return hashOpaqueToken(value)
+}
+
+// newOpaqueToken returns a random value of length bytes that is handed to a client and only stored hashed
+func newOpaqueToken(length int) (string, error) {
+	random := make([]byte, length)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(random), nil
+}
+
+// hashOpaqueToken returns the stored representation of an opaque token. The token is random enough
+// that an unsalted hash is sufficient and keeps it searchable.
+func hashOpaqueToken(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// IsExpired reports whether the refresh token can no longer be used
+func (r *RefreshToken) IsExpired() bool {
+	return !time.Now().Before(r.ExpiresAt)
+}
@@ -0,0 +1,60 @@
+package user
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewRefreshToken(t *testing.T) {
+
+	refreshToken, value, err := NewRefreshToken("1234", "", 3600)
+	if err != nil {
+		t.Fatalf("there should be no error creating the refresh token: %v", err)
+	}
+	if value == "" || refreshToken.ID != HashRefreshToken(value) {
+		t.Fatalf("the refresh token id %s should be the hash of the value", refreshToken.ID)
+	}
+	if refreshToken.UserID != "1234" || refreshToken.FamilyID == "" {
+		t.Fatalf("unexpected refresh token %#v", refreshToken)
+	}
+	if refreshToken.ExpiresAt.Sub(refreshToken.CreatedAt) != time.Hour || refreshToken.IsExpired() {
+		t.Fatalf("the refresh token should expire in an hour, %#v", refreshToken)
+	}
+
+	rotated, rotatedValue, err := NewRefreshToken("1234", refreshToken.FamilyID, 3600)
+	if err != nil {
+		t.Fatalf("there should be no error creating the refresh token: %v", err)
+	}
+	if rotated.FamilyID != refreshToken.FamilyID || rotatedValue == value {
+		t.Fatalf("the rotated refresh token %#v should be new but of the same family", rotated)
+	}
+
+}
+
+func TestNewRefreshToken_NoUserID(t *testing.T) {
+
+	if _, _, err := NewRefreshToken("", "", 3600); err != RefreshToken_error_no_userid {
+		t.Fatalf("the error %v should be %v", err, RefreshToken_error_no_userid)
+	}
+
+}
+
+func TestRefreshToken_IsExpired(t *testing.T) {
+
+	refreshToken := &RefreshToken{ExpiresAt: time.Now().Add(-time.Second)}
+	if !refreshToken.IsExpired() {
+		t.Fatal("the refresh token should be expired")
+	}
+
+}
+
+func TestRefreshTokenConfig_WithDefaults(t *testing.T) {
+
+	if config := (RefreshTokenConfig{}).withDefaults(); config != DefaultRefreshTokenConfig {
+		t.Fatalf("the config %#v should be the default", config)
+	}
+	if config := (RefreshTokenConfig{AccessTokenDurationSecs: 60}).withDefaults(); config.AccessTokenDurationSecs != 60 || config.RefreshTokenDurationSecs != DefaultRefreshTokenConfig.RefreshTokenDurationSecs {
+		t.Fatalf("unexpected config %#v", config)
+	}
+
+}
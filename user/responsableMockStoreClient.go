@@ -35,19 +35,115 @@ type FindTokenByIDResponse struct {
 	Error        error
 }
 
+type FindTokensForUserResponse struct {
+	SessionTokens []*SessionToken
+	Error         error
+}
+
+type ConsumeConfirmationTokenResponse struct {
+	ConfirmationToken *ConfirmationToken
+	Error             error
+}
+
+type FindLatestConfirmationTokenResponse struct {
+	ConfirmationToken *ConfirmationToken
+	Error             error
+}
+
+type IncrementFailedLoginsResponse struct {
+	FailedLogins int
+	Error        error
+}
+
+type UseMfaStepResponse struct {
+	Used  bool
+	Error error
+}
+
+type UseMfaRecoveryCodeResponse struct {
+	Used  bool
+	Error error
+}
+
+type FindPasswordHistoryResponse struct {
+	Hashes []string
+	Error  error
+}
+
+type UseRefreshTokenResponse struct {
+	RefreshToken *RefreshToken
+	Reused       bool
+	Error        error
+}
+
+type FindRefreshTokenResponse struct {
+	RefreshToken *RefreshToken
+	Error        error
+}
+
+type ConsumeAuthorizationCodeResponse struct {
+	AuthorizationCode *AuthorizationCode
+	Error             error
+}
+
+type AddSigningKeyResponse struct {
+	Added bool
+	Error error
+}
+
+type FindSigningKeysResponse struct {
+	SigningKeys []*SigningKey
+	Error       error
+}
+
+type FindAuditRecordsResponse struct {
+	AuditRecords []*AuditRecord
+	Error        error
+}
+
 type ResponsableMockStoreClient struct {
-	PingResponses                   []error
-	UpsertUserResponses             []error
-	FindUsersResponses              []FindUsersResponse
-	FindUsersByRoleResponses        []FindUsersByRoleResponse
-	FindUsersByRoleAndDateResponses []FindUsersByRoleAndDateResponse
-	FindUsersWithIdsResponses       []FindUsersWithIdsResponse
-	FindUserResponses               []FindUserResponse
-	RemoveUserResponses             []error
-	AddTokenResponses               []error
-	FindTokenByIDResponses          []FindTokenByIDResponse
-	RemoveTokenByIDResponses        []error
-	RemoveTokensForUserResponses    []error
+	PingResponses                            []error
+	UpsertUserResponses                      []error
+	FindUsersResponses                       []FindUsersResponse
+	FindUsersByRoleResponses                 []FindUsersByRoleResponse
+	FindUsersByRoleAndDateResponses          []FindUsersByRoleAndDateResponse
+	FindUsersWithIdsResponses                []FindUsersWithIdsResponse
+	FindUserResponses                        []FindUserResponse
+	RemoveUserResponses                      []error
+	IncrementFailedLoginsResponses           []IncrementFailedLoginsResponse
+	LockUserResponses                        []error
+	ResetFailedLoginsResponses               []error
+	UpdateMfaResponses                       []error
+	UseMfaStepResponses                      []UseMfaStepResponse
+	UpdateMfaRecoveryCodesResponses          []error
+	UseMfaRecoveryCodeResponses              []UseMfaRecoveryCodeResponse
+	FindPasswordHistoryResponses             []FindPasswordHistoryResponse
+	AddPasswordHistoryResponses              []error
+	AddAuditRecordResponses                  []error
+	FindAuditRecordsResponses                []FindAuditRecordsResponse
+	AddTokenResponses                        []error
+	FindTokenByIDResponses                   []FindTokenByIDResponse
+	FindTokensForUserResponses               []FindTokensForUserResponse
+	UpdateTokenLastUsedResponses             []error
+	RemoveTokenByIDResponses                 []error
+	RemoveTokensForUserResponses             []error
+	RemoveTokensForUserExceptResponses       []error
+	AddRefreshTokenResponses                 []error
+	UseRefreshTokenResponses                 []UseRefreshTokenResponse
+	FindRefreshTokenResponses                []FindRefreshTokenResponse
+	RemoveRefreshTokenFamilyResponses        []error
+	AddAuthorizationCodeResponses            []error
+	ConsumeAuthorizationCodeResponses        []ConsumeAuthorizationCodeResponse
+	AddSigningKeyResponses                   []AddSigningKeyResponse
+	FindSigningKeysResponses                 []FindSigningKeysResponse
+	RemoveSigningKeyResponses                []error
+	AddConfirmationTokenResponses            []error
+	ConsumeConfirmationTokenResponses        []ConsumeConfirmationTokenResponse
+	FindLatestConfirmationTokenResponses     []FindLatestConfirmationTokenResponse
+	RemoveConfirmationTokensForUserResponses []error
+
+	// AddedAuthorizationCodes collects the codes passed to AddAuthorizationCode, so that tests can exchange them
+	AddedAuthorizationCodes []*AuthorizationCode
 }
 
 func NewResponsableMockStoreClient() *ResponsableMockStoreClient {
@@ -63,9 +159,37 @@ func (r *ResponsableMockStoreClient) HasResponses() bool {
 		len(r.FindUsersWithIdsResponses) > 0 ||
 		len(r.FindUserResponses) > 0 ||
 		len(r.RemoveUserResponses) > 0 ||
+		len(r.IncrementFailedLoginsResponses) > 0 ||
+		len(r.LockUserResponses) > 0 ||
+		len(r.ResetFailedLoginsResponses) > 0 ||
+		len(r.UpdateMfaResponses) > 0 ||
+		len(r.UseMfaStepResponses) > 0 ||
+		len(r.UpdateMfaRecoveryCodesResponses) > 0 ||
+		len(r.UseMfaRecoveryCodeResponses) > 0 ||
+		len(r.FindPasswordHistoryResponses) > 0 ||
+		len(r.AddPasswordHistoryResponses) > 0 ||
+		len(r.AddAuditRecordResponses) > 0 ||
+		len(r.FindAuditRecordsResponses) > 0 ||
 		len(r.AddTokenResponses) > 0 ||
 		len(r.FindTokenByIDResponses) > 0 ||
-		len(r.RemoveTokenByIDResponses) > 0
+		len(r.FindTokensForUserResponses) > 0 ||
+		len(r.UpdateTokenLastUsedResponses) > 0 ||
+		len(r.RemoveTokenByIDResponses) > 0 ||
+		len(r.RemoveTokensForUserResponses) > 0 ||
+		len(r.RemoveTokensForUserExceptResponses) > 0 ||
+		len(r.AddRefreshTokenResponses) > 0 ||
+		len(r.UseRefreshTokenResponses) > 0 ||
+		len(r.FindRefreshTokenResponses) > 0 ||
+		len(r.RemoveRefreshTokenFamilyResponses) > 0 ||
+		len(r.AddAuthorizationCodeResponses) > 0 ||
+		len(r.ConsumeAuthorizationCodeResponses) > 0 ||
+		len(r.AddSigningKeyResponses) > 0 ||
+		len(r.FindSigningKeysResponses) > 0 ||
+		len(r.RemoveSigningKeyResponses) > 0 ||
+		len(r.AddConfirmationTokenResponses) > 0 ||
+		len(r.ConsumeConfirmationTokenResponses) > 0 ||
+		len(r.FindLatestConfirmationTokenResponses) > 0 ||
+		len(r.RemoveConfirmationTokensForUserResponses) > 0
 }
 
 func (r *ResponsableMockStoreClient) Reset() {
@@ -77,9 +201,37 @@ func (r *ResponsableMockStoreClient) Reset() {
 	r.FindUsersWithIdsResponses = nil
 	r.FindUserResponses = nil
 	r.RemoveUserResponses = nil
+	r.IncrementFailedLoginsResponses = nil
+	r.LockUserResponses = nil
+	r.ResetFailedLoginsResponses = nil
+	r.UpdateMfaResponses = nil
+	r.UseMfaStepResponses = nil
+	r.UpdateMfaRecoveryCodesResponses = nil
+	r.UseMfaRecoveryCodeResponses = nil
+	r.FindPasswordHistoryResponses = nil
+	r.AddPasswordHistoryResponses = nil
+	r.AddAuditRecordResponses = nil
+	r.FindAuditRecordsResponses = nil
 	r.AddTokenResponses = nil
 	r.FindTokenByIDResponses = nil
+	r.FindTokensForUserResponses = nil
+	r.UpdateTokenLastUsedResponses = nil
 	r.RemoveTokenByIDResponses = nil
+	r.RemoveTokensForUserResponses = nil
+	r.RemoveTokensForUserExceptResponses = nil
+	r.AddRefreshTokenResponses = nil
+	r.UseRefreshTokenResponses = nil
+	r.FindRefreshTokenResponses = nil
+	r.RemoveRefreshTokenFamilyResponses = nil
+	r.AddAuthorizationCodeResponses = nil
+	r.ConsumeAuthorizationCodeResponses = nil
+	r.AddSigningKeyResponses = nil
+	r.FindSigningKeysResponses = nil
+	r.RemoveSigningKeyResponses = nil
+	r.AddConfirmationTokenResponses = nil
+	r.ConsumeConfirmationTokenResponses = nil
+	r.FindLatestConfirmationTokenResponses = nil
+	r.RemoveConfirmationTokensForUserResponses = nil
 }
 
 func (r *ResponsableMockStoreClient) EnsureIndexes() error { return nil }
@@ -159,6 +311,99 @@ func (r *ResponsableMockStoreClient) RemoveUser(user *User) (err error) {
 	panic("RemoveUserResponses unavailable")
 }
 
+func (r *ResponsableMockStoreClient) IncrementFailedLogins(userId string) (int, error) {
+	if len(r.IncrementFailedLoginsResponses) > 0 {
+		var response IncrementFailedLoginsResponse
+		response, r.IncrementFailedLoginsResponses = r.IncrementFailedLoginsResponses[0], r.IncrementFailedLoginsResponses[1:]
+		return response.FailedLogins, response.Error
+	}
+	panic("IncrementFailedLoginsResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) LockUser(userId string, until time.Time) (err error) {
+	if len(r.LockUserResponses) > 0 {
+		err, r.LockUserResponses = r.LockUserResponses[0], r.LockUserResponses[1:]
+		return err
+	}
+	panic("LockUserResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) ResetFailedLogins(userId string) (err error) {
+	if len(r.ResetFailedLoginsResponses) > 0 {
+		err, r.ResetFailedLoginsResponses = r.ResetFailedLoginsResponses[0], r.ResetFailedLoginsResponses[1:]
+		return err
+	}
+	panic("ResetFailedLoginsResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) UpdateMfa(userId string, mfa *MfaSettings) (err error) {
+	if len(r.UpdateMfaResponses) > 0 {
+		err, r.UpdateMfaResponses = r.UpdateMfaResponses[0], r.UpdateMfaResponses[1:]
+		return err
+	}
+	panic("UpdateMfaResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) UseMfaStep(userId string, step int64) (bool, error) {
+	if len(r.UseMfaStepResponses) > 0 {
+		var response UseMfaStepResponse
+		response, r.UseMfaStepResponses = r.UseMfaStepResponses[0], r.UseMfaStepResponses[1:]
+		return response.Used, response.Error
+	}
+	panic("UseMfaStepResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) UpdateMfaRecoveryCodes(userId string, hashes []string) (err error) {
+	if len(r.UpdateMfaRecoveryCodesResponses) > 0 {
+		err, r.UpdateMfaRecoveryCodesResponses = r.UpdateMfaRecoveryCodesResponses[0], r.UpdateMfaRecoveryCodesResponses[1:]
+		return err
+	}
+	panic("UpdateMfaRecoveryCodesResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) UseMfaRecoveryCode(userId string, hash string) (bool, error) {
+	if len(r.UseMfaRecoveryCodeResponses) > 0 {
+		var response UseMfaRecoveryCodeResponse
+		response, r.UseMfaRecoveryCodeResponses = r.UseMfaRecoveryCodeResponses[0], r.UseMfaRecoveryCodeResponses[1:]
+		return response.Used, response.Error
+	}
+	panic("UseMfaRecoveryCodeResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) FindPasswordHistory(userId string) ([]string, error) {
+	if len(r.FindPasswordHistoryResponses) > 0 {
+		var response FindPasswordHistoryResponse
+		response, r.FindPasswordHistoryResponses = r.FindPasswordHistoryResponses[0], r.FindPasswordHistoryResponses[1:]
+		return response.Hashes, response.Error
+	}
+	panic("FindPasswordHistoryResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) AddPasswordHistory(userId string, pwHash string, size int) (err error) {
+	if len(r.AddPasswordHistoryResponses) > 0 {
+		err, r.AddPasswordHistoryResponses = r.AddPasswordHistoryResponses[0], r.AddPasswordHistoryResponses[1:]
+		return err
+	}
+	panic("AddPasswordHistoryResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) AddAuditRecord(record *AuditRecord) (err error) {
+	if len(r.AddAuditRecordResponses) > 0 {
+		err, r.AddAuditRecordResponses = r.AddAuditRecordResponses[0], r.AddAuditRecordResponses[1:]
+		return err
+	}
+	panic("AddAuditRecordResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) FindAuditRecords(userId string) ([]*AuditRecord, error) {
+	if len(r.FindAuditRecordsResponses) > 0 {
+		var response FindAuditRecordsResponse
+		response, r.FindAuditRecordsResponses = r.FindAuditRecordsResponses[0], r.FindAuditRecordsResponses[1:]
+		return response.AuditRecords, response.Error
+	}
+	panic("FindAuditRecordsResponses unavailable")
+}
+
 func (r *ResponsableMockStoreClient) AddToken(token *SessionToken) (err error) {
 	if len(r.AddTokenResponses) > 0 {
 		err, r.AddTokenResponses = r.AddTokenResponses[0], r.AddTokenResponses[1:]
@@ -176,6 +421,23 @@ func (r *ResponsableMockStoreClient) FindTokenByID(id string) (*SessionToken, er
 	panic("FindTokenByIDResponses unavailable")
 }
 
+func (r *ResponsableMockStoreClient) FindTokensForUser(userId string) ([]*SessionToken, error) {
+	if len(r.FindTokensForUserResponses) > 0 {
+		var response FindTokensForUserResponse
+		response, r.FindTokensForUserResponses = r.FindTokensForUserResponses[0], r.FindTokensForUserResponses[1:]
+		return response.SessionTokens, response.Error
+	}
+	panic("FindTokensForUserResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) UpdateTokenLastUsed(id string, lastUsedAt time.Time) (err error) {
+	if len(r.UpdateTokenLastUsedResponses) > 0 {
+		err, r.UpdateTokenLastUsedResponses = r.UpdateTokenLastUsedResponses[0], r.UpdateTokenLastUsedResponses[1:]
+		return err
+	}
+	panic("UpdateTokenLastUsedResponses unavailable")
+}
+
 func (r *ResponsableMockStoreClient) RemoveTokenByID(id string) (err error) {
 	if len(r.RemoveTokenByIDResponses) > 0 {
 		err, r.RemoveTokenByIDResponses = r.RemoveTokenByIDResponses[0], r.RemoveTokenByIDResponses[1:]
@@ -186,8 +448,128 @@ func (r *ResponsableMockStoreClient) RemoveTokenByID(id string) (err error) {
 
 func (r *ResponsableMockStoreClient) RemoveTokensForUser(userId string) (err error) {
 	if len(r.RemoveTokensForUserResponses) > 0 {
-		err, r.RemoveTokenByIDResponses = r.RemoveTokenByIDResponses[0], r.RemoveTokenByIDResponses[1:]
+		err, r.RemoveTokensForUserResponses = r.RemoveTokensForUserResponses[0], r.RemoveTokensForUserResponses[1:]
 		return err
 	}
 	panic("RemoveTokensForUser unavailable")
 }
+
+func (r *ResponsableMockStoreClient) RemoveTokensForUserExcept(userId string, tokenId string) (err error) {
+	if len(r.RemoveTokensForUserExceptResponses) > 0 {
+		err, r.RemoveTokensForUserExceptResponses = r.RemoveTokensForUserExceptResponses[0], r.RemoveTokensForUserExceptResponses[1:]
+		return err
+	}
+	panic("RemoveTokensForUserExcept unavailable")
+}
+
+func (r *ResponsableMockStoreClient) AddRefreshToken(token *RefreshToken) (err error) {
+	if len(r.AddRefreshTokenResponses) > 0 {
+		err, r.AddRefreshTokenResponses = r.AddRefreshTokenResponses[0], r.AddRefreshTokenResponses[1:]
+		return err
+	}
+	panic("AddRefreshTokenResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) UseRefreshToken(id string) (*RefreshToken, bool, error) {
+	if len(r.UseRefreshTokenResponses) > 0 {
+		var response UseRefreshTokenResponse
+		response, r.UseRefreshTokenResponses = r.UseRefreshTokenResponses[0], r.UseRefreshTokenResponses[1:]
+		return response.RefreshToken, response.Reused, response.Error
+	}
+	panic("UseRefreshTokenResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) FindRefreshToken(id string) (*RefreshToken, error) {
+	if len(r.FindRefreshTokenResponses) > 0 {
+		var response FindRefreshTokenResponse
+		response, r.FindRefreshTokenResponses = r.FindRefreshTokenResponses[0], r.FindRefreshTokenResponses[1:]
+		return response.RefreshToken, response.Error
+	}
+	panic("FindRefreshTokenResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) RemoveRefreshTokenFamily(familyId string) (err error) {
+	if len(r.RemoveRefreshTokenFamilyResponses) > 0 {
+		err, r.RemoveRefreshTokenFamilyResponses = r.RemoveRefreshTokenFamilyResponses[0], r.RemoveRefreshTokenFamilyResponses[1:]
+		return err
+	}
+	panic("RemoveRefreshTokenFamilyResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) AddAuthorizationCode(code *AuthorizationCode) (err error) {
+	r.AddedAuthorizationCodes = append(r.AddedAuthorizationCodes, code)
+	if len(r.AddAuthorizationCodeResponses) > 0 {
+		err, r.AddAuthorizationCodeResponses = r.AddAuthorizationCodeResponses[0], r.AddAuthorizationCodeResponses[1:]
+		return err
+	}
+	panic("AddAuthorizationCodeResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) ConsumeAuthorizationCode(id string) (*AuthorizationCode, error) {
+	if len(r.ConsumeAuthorizationCodeResponses) > 0 {
+		var response ConsumeAuthorizationCodeResponse
+		response, r.ConsumeAuthorizationCodeResponses = r.ConsumeAuthorizationCodeResponses[0], r.ConsumeAuthorizationCodeResponses[1:]
+		return response.AuthorizationCode, response.Error
+	}
+	panic("ConsumeAuthorizationCodeResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) AddSigningKey(key *SigningKey) (bool, error) {
+	if len(r.AddSigningKeyResponses) > 0 {
+		var response AddSigningKeyResponse
+		response, r.AddSigningKeyResponses = r.AddSigningKeyResponses[0], r.AddSigningKeyResponses[1:]
+		return response.Added, response.Error
+	}
+	panic("AddSigningKeyResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) FindSigningKeys() ([]*SigningKey, error) {
+	if len(r.FindSigningKeysResponses) > 0 {
+		var response FindSigningKeysResponse
+		response, r.FindSigningKeysResponses = r.FindSigningKeysResponses[0], r.FindSigningKeysResponses[1:]
+		return response.SigningKeys, response.Error
+	}
+	panic("FindSigningKeysResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) RemoveSigningKey(generation int64) (err error) {
+	if len(r.RemoveSigningKeyResponses) > 0 {
+		err, r.RemoveSigningKeyResponses = r.RemoveSigningKeyResponses[0], r.RemoveSigningKeyResponses[1:]
+		return err
+	}
+	panic("RemoveSigningKeyResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) AddConfirmationToken(token *ConfirmationToken) (err error) {
+	if len(r.AddConfirmationTokenResponses) > 0 {
+		err, r.AddConfirmationTokenResponses = r.AddConfirmationTokenResponses[0], r.AddConfirmationTokenResponses[1:]
+		return err
+	}
+	panic("AddConfirmationTokenResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) ConsumeConfirmationToken(id string, purpose string) (*ConfirmationToken, error) {
+	if len(r.ConsumeConfirmationTokenResponses) > 0 {
+		var response ConsumeConfirmationTokenResponse
+		response, r.ConsumeConfirmationTokenResponses = r.ConsumeConfirmationTokenResponses[0], r.ConsumeConfirmationTokenResponses[1:]
+		return response.ConfirmationToken, response.Error
+	}
+	panic("ConsumeConfirmationTokenResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) FindLatestConfirmationToken(userId string, purpose string) (*ConfirmationToken, error) {
+	if len(r.FindLatestConfirmationTokenResponses) > 0 {
+		var response FindLatestConfirmationTokenResponse
+		response, r.FindLatestConfirmationTokenResponses = r.FindLatestConfirmationTokenResponses[0], r.FindLatestConfirmationTokenResponses[1:]
+		return response.ConfirmationToken, response.Error
+	}
+	panic("FindLatestConfirmationTokenResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) RemoveConfirmationTokensForUser(userId string, purpose string) (err error) {
+	if len(r.RemoveConfirmationTokensForUserResponses) > 0 {
+		err, r.RemoveConfirmationTokensForUserResponses = r.RemoveConfirmationTokensForUserResponses[0], r.RemoveConfirmationTokensForUserResponses[1:]
+		return err
+	}
+	panic("RemoveConfirmationTokensForUserResponses unavailable")
+}
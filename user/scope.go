@@ -0,0 +1,67 @@
+package user
+
+import (
+	"errors"
+	"strings"
+)
+
+// Session scopes limit what a user's session token may do, so that a client such as a data uploader can hold
+// a token that cannot change or delete the account. A token without any session scope is not limited, like
+// tokens issued before scopes existed or server tokens of service clients, whose scopes are their own.
+const (
+	ScopeUpload       = "upload"
+	ScopeRead         = "read"
+	ScopeAccountWrite = "account:write"
+	ScopeAdmin        = "admin" // grants all other scopes
+)
+
+// SessionScopes are the scopes a session token may be limited to
+var SessionScopes = []string{ScopeUpload, ScopeRead, ScopeAccountWrite, ScopeAdmin}
+
+var errInsufficientScope = errors.New(STATUS_INSUFFICIENT_SCOPE)
+
+// Service scopes limit what the server token of a service client may do. Server tokens of the legacy ServerLogin
+// belong to no client and are not limited.
+const (
+	ServiceScopeUsersRead   = "users:read"  // find users and read their sessions and audit records
+	ServiceScopeUsersWrite  = "users:write" // change, unlock and delete users and end their sessions
+	ServiceScopeTokensRead  = "tokens:read" // check and introspect the tokens of others
+	ServiceScopeImpersonate = "impersonate" // act as a user, see ImpersonateUser
+)
+
+// grantSessionScopes returns the requested session scopes, space separated, if the granted scopes allow all of
+// them. Nothing requested keeps the granted scopes; nil grants are not limited.
+func grantSessionScopes(granted []string, requested string) ([]string, bool) {
+	scopes := strings.Fields(requested)
+	if len(scopes) == 0 {
+		return granted, true
+	}
+	for _, scope := range scopes {
+		if !containsString(SessionScopes, scope) || !scopesAllow(granted, scope) {
+			return nil, false
+		}
+	}
+	return scopes, true
+}
+
+// HasScope reports whether the token may be used for what the session scope allows
+func (t *TokenData) HasScope(scope string) bool {
+	return scopesAllow(t.Scopes, scope)
+}
+
+// HasServiceScope reports whether the token is a server token that may be used for what the service scope allows
+func (t *TokenData) HasServiceScope(scope string) bool {
+	return t.IsServer && (t.ClientID == "" || containsString(t.Scopes, scope))
+}
+
+// scopesAllow reports whether the scopes allow the session scope, see HasScope
+func scopesAllow(scopes []string, scope string) bool {
+	limited := false
+	for _, granted := range scopes {
+		if granted == scope || granted == ScopeAdmin {
+			return true
+		}
+		limited = limited || containsString(SessionScopes, granted)
+	}
+	return !limited
+}
@@ -0,0 +1,46 @@
+package user
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGrantSessionScopes(t *testing.T) {
+
+	tests := []struct {
+		granted   []string
+		requested string
+		scopes    []string
+		ok        bool
+	}{
+		{nil, "", nil, true},
+		{nil, "upload read", []string{ScopeUpload, ScopeRead}, true},
+		{nil, "upload delete", nil, false},
+		{[]string{ScopeUpload, ScopeRead}, "", []string{ScopeUpload, ScopeRead}, true},
+		{[]string{ScopeUpload, ScopeRead}, "read", []string{ScopeRead}, true},
+		{[]string{ScopeUpload}, "account:write", nil, false},
+		{[]string{ScopeAdmin}, "account:write", []string{ScopeAccountWrite}, true},
+	}
+	for _, test := range tests {
+		if scopes, ok := grantSessionScopes(test.granted, test.requested); ok != test.ok || !reflect.DeepEqual(scopes, test.scopes) {
+			t.Fatalf("granting %q with %v should give %v %v, not %v %v", test.requested, test.granted, test.scopes, test.ok, scopes, ok)
+		}
+	}
+}
+
+func TestTokenData_HasScope(t *testing.T) {
+
+	if !(&TokenData{}).HasScope(ScopeAccountWrite) {
+		t.Fatalf("a token without scopes should not be limited")
+	}
+	if !(&TokenData{Scopes: []string{"openid", "profile"}}).HasScope(ScopeAccountWrite) {
+		t.Fatalf("a token without session scopes should not be limited")
+	}
+	uploader := &TokenData{Scopes: []string{ScopeUpload, ScopeRead}}
+	if !uploader.HasScope(ScopeUpload) || uploader.HasScope(ScopeAccountWrite) {
+		t.Fatalf("a token with session scopes should be limited to them")
+	}
+	if !(&TokenData{Scopes: []string{ScopeAdmin}}).HasScope(ScopeAccountWrite) {
+		t.Fatalf("the admin scope should grant all scopes")
+	}
+}
@@ -0,0 +1,120 @@
+package user
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ServiceClient is a service that authenticates with the OAuth2 client credentials grant. Its tokens are server
+// tokens limited to the scopes the client requested.
+type ServiceClient struct {
+	ID         string   `json:"id"`
+	SecretHash string   `json:"secretHash"` // bcrypt hash of the client secret
+	Scopes     []string `json:"scopes"`     // the scopes the client may request
+}
+
+// validateServiceClients checks that every client has a unique id and a bcrypt secret hash
+func validateServiceClients(serviceClients []ServiceClient) error {
+	clientIDs := map[string]bool{}
+	for _, client := range serviceClients {
+		if client.ID == "" {
+			return errors.New("service clients: client id must not be empty")
+		} else if clientIDs[client.ID] {
+			return fmt.Errorf("service clients: client id %q is not unique", client.ID)
+		} else if _, err := bcrypt.Cost([]byte(client.SecretHash)); err != nil {
+			return fmt.Errorf("service clients: secret hash of client %q is not a bcrypt hash", client.ID)
+		}
+		clientIDs[client.ID] = true
+	}
+	return nil
+}
+
+// findServiceClient returns the client with the id, or nil if there is none
+func findServiceClient(serviceClients []ServiceClient, id string) *ServiceClient {
+	for index := range serviceClients {
+		if serviceClients[index].ID == id {
+			return &serviceClients[index]
+		}
+	}
+	return nil
+}
+
+// VerifySecret reports whether the secret matches the secret hash of the client
+func (c *ServiceClient) VerifySecret(secret string) bool {
+	return secret != "" && bcrypt.CompareHashAndPassword([]byte(c.SecretHash), []byte(secret)) == nil
+}
+
+// serviceClientSecretCacheDuration is how long a verified client secret is accepted without bcrypt
+const serviceClientSecretCacheDuration = time.Minute
+
+// serviceClientSecretCache remembers recently verified client secrets. A bcrypt verification costs tens of
+// milliseconds of CPU, too much for introspection, which an ingress calls for every request. Only SHA-256
+// digests of verified secrets are kept, wrong secrets are never cached. A nil cache verifies every time.
+type serviceClientSecretCache struct {
+	lock     sync.Mutex
+	verified map[[sha256.Size]byte]time.Time // digest of the client and secret, to when the verification expires
+}
+
+func newServiceClientSecretCache() *serviceClientSecretCache {
+	return &serviceClientSecretCache{verified: map[[sha256.Size]byte]time.Time{}}
+}
+
+// verify reports whether the secret matches the secret hash of the client, see ServiceClient.VerifySecret
+func (c *serviceClientSecretCache) verify(client *ServiceClient, secret string) bool {
+	if c == nil {
+		return client.VerifySecret(secret)
+	}
+
+	// the secret hash is part of the digest so that a changed hash is verified again
+	digest := sha256.Sum256([]byte(client.ID + "\x00" + client.SecretHash + "\x00" + secret))
+	now := time.Now()
+
+	c.lock.Lock()
+	expiresAt, ok := c.verified[digest]
+	c.lock.Unlock()
+	if ok && now.Before(expiresAt) {
+		return true
+	} else if !client.VerifySecret(secret) {
+		return false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for cached, expiresAt := range c.verified {
+		if !now.Before(expiresAt) {
+			delete(c.verified, cached)
+		}
+	}
+	c.verified[digest] = now.Add(serviceClientSecretCacheDuration)
+	return true
+}
+
+// GrantedScopes returns the requested scopes, or all scopes of the client when none are requested. It fails
+// if any requested scope is not allowed for the client.
+func (c *ServiceClient) GrantedScopes(requested string) ([]string, bool) {
+	scopes := strings.Fields(requested)
+	if len(scopes) == 0 {
+		return c.Scopes, true
+	}
+	for _, scope := range scopes {
+		if !c.allowsScope(scope) {
+			return nil, false
+		}
+	}
+	return scopes, true
+}
+
+func (c *ServiceClient) allowsScope(scope string) bool {
+	for _, allowed := range c.Scopes {
+		if allowed == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+package user
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func createServiceClient(t *testing.T, id string, secret string, scopes ...string) ServiceClient {
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("there should be no error hashing the secret: %v", err)
+	}
+	return ServiceClient{ID: id, SecretHash: string(hash), Scopes: scopes}
+}
+
+func TestValidateServiceClients(t *testing.T) {
+
+	client := createServiceClient(t, "data", "secret")
+	if err := validateServiceClients([]ServiceClient{client}); err != nil {
+		t.Fatalf("there should be no error for a valid client: %v", err)
+	}
+
+	invalid := [][]ServiceClient{
+		{{SecretHash: client.SecretHash}},
+		{{ID: "data", SecretHash: "secret"}},
+		{client, client},
+	}
+	for _, serviceClients := range invalid {
+		if err := validateServiceClients(serviceClients); err == nil {
+			t.Fatalf("there should be an error for the invalid clients %#v", serviceClients)
+		}
+	}
+
+}
+
+func TestServiceClient_VerifySecret(t *testing.T) {
+
+	client := createServiceClient(t, "data", "secret")
+	if !client.VerifySecret("secret") {
+		t.Fatal("the secret should be verified")
+	}
+	if client.VerifySecret("wrong") || client.VerifySecret("") {
+		t.Fatal("a wrong secret should not be verified")
+	}
+
+}
+
+func TestServiceClientSecretCache(t *testing.T) {
+
+	client := createServiceClient(t, "data", "secret")
+	cache := newServiceClientSecretCache()
+	if cache.verify(&client, "wrong") || len(cache.verified) != 0 {
+		t.Fatal("a wrong secret should neither be verified nor cached")
+	}
+	if !cache.verify(&client, "secret") || !cache.verify(&client, "secret") || len(cache.verified) != 1 {
+		t.Fatal("the secret should be verified and cached once")
+	}
+
+	rotated := createServiceClient(t, "data", "rotated")
+	if cache.verify(&rotated, "secret") {
+		t.Fatal("the cached verification should not apply to another secret hash")
+	}
+
+	for digest := range cache.verified {
+		cache.verified[digest] = time.Now().Add(-time.Second)
+	}
+	if !cache.verify(&rotated, "rotated") || len(cache.verified) != 1 {
+		t.Fatal("expired verifications should be dropped")
+	}
+
+	var disabled *serviceClientSecretCache
+	if !disabled.verify(&client, "secret") || disabled.verify(&client, "wrong") {
+		t.Fatal("a nil cache should verify every time")
+	}
+}
+
+func TestServiceClient_GrantedScopes(t *testing.T) {
+
+	client := createServiceClient(t, "data", "secret", "users:read", "users:write")
+	expected := map[string][]string{
+		"":                        {"users:read", "users:write"},
+		"users:read":              {"users:read"},
+		" users:write users:read": {"users:write", "users:read"},
+	}
+	for requested, granted := range expected {
+		if scopes, ok := client.GrantedScopes(requested); !ok || !reflect.DeepEqual(scopes, granted) {
+			t.Fatalf("the granted scopes of %q should be %v, not %v", requested, granted, scopes)
+		}
+	}
+	if scopes, ok := client.GrantedScopes("users:read users:delete"); ok {
+		t.Fatalf("a scope that is not allowed should not be granted, got %v", scopes)
+	}
+
+}
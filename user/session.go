@@ -0,0 +1,145 @@
+package user
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// sessionLastUsedInterval throttles how often the last use of a session token is written
+	sessionLastUsedInterval = 5 * time.Minute
+
+	maxUserAgentLength  = 512
+	maxClientNameLength = 100
+)
+
+// SessionMetadata tells where a session token is used from, so that users can tell their sessions apart and
+// audits can tell where an action came from
+type SessionMetadata struct {
+	UserAgent  string `json:"userAgent,omitempty" bson:"userAgent,omitempty"`
+	ClientIP   string `json:"clientIp,omitempty" bson:"clientIp,omitempty"`
+	ClientName string `json:"clientName,omitempty" bson:"clientName,omitempty"` // as given in the x-tidepool-client-name header
+}
+
+// Session is an active session token as shown to its user. The token itself is a bearer credential and is
+// never exposed, the session is identified by a hash of it instead.
+type Session struct {
+	ID         string    `json:"id"`
+	CreatedAt  time.Time `json:"createdAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	LastUsedAt time.Time `json:"lastUsedAt"`         // accurate to sessionLastUsedInterval
+	ClientID   string    `json:"clientId,omitempty"` // the OAuth client the session was issued to, if any
+	Actor      string    `json:"actor,omitempty"`    // the support agent impersonating the user, if any
+	Current    bool      `json:"current"`            // whether the session is the one making the request
+	SessionMetadata
+}
+
+// SessionID returns the opaque id of the session of a session token
+func SessionID(tokenID string) string {
+	return hashOpaqueToken(tokenID)
+}
+
+// NewSession describes the session token, currentTokenID is the token of the request listing the sessions
+func NewSession(token *SessionToken, currentTokenID string) Session {
+	return Session{
+		ID:              SessionID(token.ID),
+		CreatedAt:       token.CreatedAt,
+		ExpiresAt:       token.ExpiresAt,
+		LastUsedAt:      token.LastUsed(),
+		ClientID:        token.ClientID,
+		Actor:           token.Actor,
+		Current:         token.ID == currentTokenID,
+		SessionMetadata: token.SessionMetadata,
+	}
+}
+
+// findSession returns the session token with the session id, or nil if there is none
+func findSession(tokens []*SessionToken, sessionID string) *SessionToken {
+	for _, token := range tokens {
+		if SessionID(token.ID) == sessionID {
+			return token
+		}
+	}
+	return nil
+}
+
+// LastUsed returns when the session token was last used, creating it counts as a use
+func (s *SessionToken) LastUsed() time.Time {
+	if s.LastUsedAt != nil && s.LastUsedAt.After(s.CreatedAt) {
+		return *s.LastUsedAt
+	}
+	return s.CreatedAt
+}
+
+// newSessionMetadata describes the client of the request, see clientIP for the address
+func newSessionMetadata(req *http.Request, trustedProxies []*net.IPNet) SessionMetadata {
+	return SessionMetadata{
+		UserAgent:  truncate(req.UserAgent(), maxUserAgentLength),
+		ClientIP:   clientIP(req, trustedProxies),
+		ClientName: truncate(strings.TrimSpace(req.Header.Get(TP_CLIENT_NAME)), maxClientNameLength),
+	}
+}
+
+// clientIP returns the address of the client. X-Forwarded-For is only believed as far as it was appended by
+// trusted proxies, so a client cannot choose its address by sending the header itself.
+func clientIP(req *http.Request, trustedProxies []*net.IPNet) string {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+
+	forwarded := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for index := len(forwarded) - 1; index >= 0 && isTrustedProxy(ip, trustedProxies); index-- {
+		hop := strings.TrimSpace(forwarded[index])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+	}
+	return ip
+}
+
+func isTrustedProxy(ip string, trustedProxies []*net.IPNet) bool {
+	if parsed := net.ParseIP(ip); parsed != nil {
+		for _, network := range trustedProxies {
+			if network.Contains(parsed) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies parses addresses and CIDR ranges of the proxies in front of shoreline
+func parseTrustedProxies(trustedProxies []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(trustedProxies))
+	for _, proxy := range trustedProxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("trusted proxies: %q is not an address or CIDR range", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		} else if _, network, err := net.ParseCIDR(proxy); err != nil {
+			return nil, fmt.Errorf("trusted proxies: %q is not an address or CIDR range", proxy)
+		} else {
+			networks = append(networks, network)
+		}
+	}
+	return networks, nil
+}
+
+// truncate shortens the value to at most length bytes without splitting a character
+func truncate(value string, length int) string {
+	if len(value) > length {
+		return strings.ToValidUTF8(value[:length], "")
+	}
+	return value
+}
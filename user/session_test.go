@@ -0,0 +1,119 @@
+package user
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewSession(t *testing.T) {
+
+	token := &SessionToken{ID: "token", UserID: "2341", CreatedAt: time.Unix(1000, 0), ExpiresAt: time.Unix(2000, 0), ClientID: "app"}
+
+	session := NewSession(token, "token")
+	if session.ID == "" || session.ID == token.ID {
+		t.Fatalf("the session id should be derived from the token without exposing it, got %q", session.ID)
+	}
+	if session.ID != SessionID(token.ID) {
+		t.Fatal("the session id should be stable")
+	}
+	if !session.CreatedAt.Equal(token.CreatedAt) || !session.ExpiresAt.Equal(token.ExpiresAt) || session.ClientID != "app" || !session.Current {
+		t.Fatalf("the session should describe the token, got %#v", session)
+	}
+
+	if NewSession(token, "other").Current {
+		t.Fatal("the session should not be current for another token")
+	}
+}
+
+func TestFindSession(t *testing.T) {
+
+	tokens := []*SessionToken{{ID: "token1"}, {ID: "token2"}}
+
+	if found := findSession(tokens, SessionID("token2")); found != tokens[1] {
+		t.Fatalf("the token of the session should be found, got %#v", found)
+	}
+	if found := findSession(tokens, "token2"); found != nil {
+		t.Fatalf("the raw token should not be accepted as a session id, got %#v", found)
+	}
+}
+
+func TestSessionTokenLastUsed(t *testing.T) {
+
+	token := &SessionToken{CreatedAt: time.Unix(1000, 0)}
+	if !token.LastUsed().Equal(token.CreatedAt) {
+		t.Fatalf("a token that was never used should count as used when created, got %v", token.LastUsed())
+	}
+
+	lastUsedAt := time.Unix(2000, 0)
+	token.LastUsedAt = &lastUsedAt
+	if !token.LastUsed().Equal(lastUsedAt) {
+		t.Fatalf("the last use should be returned, got %v", token.LastUsed())
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+
+	networks, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "::1"})
+	if err != nil {
+		t.Fatalf("there should be no error parsing valid proxies: %v", err)
+	}
+	for ip, trusted := range map[string]bool{"10.1.2.3": true, "192.168.1.1": true, "192.168.1.2": false, "::1": true, "not an ip": false} {
+		if isTrustedProxy(ip, networks) != trusted {
+			t.Fatalf("%s should be trusted %v", ip, trusted)
+		}
+	}
+
+	for _, invalid := range []string{"10.0.0.0/33", "proxy.local"} {
+		if _, err := parseTrustedProxies([]string{invalid}); err == nil {
+			t.Fatalf("there should be an error for %q", invalid)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+
+	trustedProxies, _ := parseTrustedProxies([]string{"10.0.0.0/8"})
+
+	tests := []struct {
+		remoteAddr string
+		forwarded  []string
+		expected   string
+	}{
+		{"203.0.113.1:1234", nil, "203.0.113.1"},
+		{"203.0.113.1:1234", []string{"198.51.100.1"}, "203.0.113.1"},
+		{"10.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"10.0.0.1:1234", []string{"192.0.2.1, 198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"10.0.0.1:1234", []string{"192.0.2.1", "198.51.100.1"}, "198.51.100.1"},
+		{"10.0.0.1:1234", []string{"garbage, 10.0.0.2"}, "10.0.0.2"},
+		{"10.0.0.1:1234", nil, "10.0.0.1"},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = test.remoteAddr
+		for _, forwarded := range test.forwarded {
+			req.Header.Add("X-Forwarded-For", forwarded)
+		}
+		if ip := clientIP(req, trustedProxies); ip != test.expected {
+			t.Fatalf("expected %s for %s forwarded for %v, got %s", test.expected, test.remoteAddr, test.forwarded, ip)
+		}
+	}
+}
+
+func TestNewSessionMetadata(t *testing.T) {
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "203.0.113.1:1234"
+	req.Header.Set("User-Agent", strings.Repeat("a", maxUserAgentLength+1))
+	req.Header.Set(TP_CLIENT_NAME, " uploader ")
+
+	metadata := newSessionMetadata(req, nil)
+	if len(metadata.UserAgent) != maxUserAgentLength || metadata.ClientIP != "203.0.113.1" || metadata.ClientName != "uploader" {
+		t.Fatalf("unexpected metadata %#v", metadata)
+	}
+
+	if truncated := truncate("aé", 2); truncated != "a" {
+		t.Fatalf("truncating should not split a character, got %q", truncated)
+	}
+}
@@ -17,8 +17,35 @@ type Storage interface {
 	FindUsersByRoleAndDate(role string, from time.Time, to time.Time) ([]*User, error)
 	FindUsersWithIds(role []string) ([]*User, error)
 	RemoveUser(user *User) error
+	IncrementFailedLogins(userId string) (int, error)
+	LockUser(userId string, until time.Time) error
+	ResetFailedLogins(userId string) error
+	UpdateMfa(userId string, mfa *MfaSettings) error
+	UseMfaStep(userId string, step int64) (bool, error)
+	UpdateMfaRecoveryCodes(userId string, hashes []string) error
+	UseMfaRecoveryCode(userId string, hash string) (bool, error)
+	FindPasswordHistory(userId string) ([]string, error)
+	AddPasswordHistory(userId string, pwHash string, size int) error
+	AddAuditRecord(record *AuditRecord) error
+	FindAuditRecords(userId string) ([]*AuditRecord, error)
 	AddToken(token *SessionToken) error
 	FindTokenByID(id string) (*SessionToken, error)
+	FindTokensForUser(userId string) ([]*SessionToken, error)
+	UpdateTokenLastUsed(id string, lastUsedAt time.Time) error
 	RemoveTokenByID(id string) error
 	RemoveTokensForUser(userId string) error
+	RemoveTokensForUserExcept(userId string, tokenId string) error
+	AddRefreshToken(token *RefreshToken) error
+	UseRefreshToken(id string) (*RefreshToken, bool, error)
+	FindRefreshToken(id string) (*RefreshToken, error)
+	RemoveRefreshTokenFamily(familyId string) error
+	AddAuthorizationCode(code *AuthorizationCode) error
+	ConsumeAuthorizationCode(id string) (*AuthorizationCode, error)
+	AddSigningKey(key *SigningKey) (bool, error)
+	FindSigningKeys() ([]*SigningKey, error)
+	RemoveSigningKey(generation int64) error
+	AddConfirmationToken(token *ConfirmationToken) error
+	ConsumeConfirmationToken(id string, purpose string) (*ConfirmationToken, error)
+	FindLatestConfirmationToken(userId string, purpose string) (*ConfirmationToken, error)
+	RemoveConfirmationTokensForUser(userId string, purpose string) error
 }
@@ -1,11 +1,12 @@
 package user
 
 import (
-	"crypto/rsa"
+	"encoding/json"
 	"errors"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
@@ -21,12 +22,30 @@ type (
 		ExpiresAt time.Time `json:"-" bson:"expiresAt"`
 		CreatedAt time.Time `json:"-" bson:"createdAt"`
 		Time      time.Time `json:"-" bson:"time"`
+		FamilyID  string    `json:"-" bson:"familyId,omitempty"` // the refresh token family the token was issued with, if any
+		ClientID  string    `json:"-" bson:"clientId,omitempty"` // the service client the server token was issued to, if any
+		Scopes    []string  `json:"-" bson:"scopes,omitempty"`
+		Actor     string    `json:"-" bson:"actor,omitempty"` // the support agent impersonating the user, if any
+		// LastUsedAt is updated at most every sessionLastUsedInterval, see LastUsed
+		LastUsedAt      *time.Time `json:"-" bson:"lastUsedAt,omitempty"`
+		SessionMetadata `json:"-" bson:",inline"`
 	}
 
 	TokenData struct {
-		IsServer     bool   `json:"isserver"`
-		UserId       string `json:"userid"`
-		DurationSecs int64  `json:"-"`
+		IsServer     bool     `json:"isserver"`
+		UserId       string   `json:"userid"`
+		DurationSecs int64    `json:"-"`
+		FamilyID     string   `json:"-"`
+		ClientID     string   `json:"-"`
+		Scopes       []string `json:"scopes,omitempty"`
+		// Actor is the support agent impersonating the user, see ImpersonateUser
+		Actor     *TokenActor `json:"act,omitempty"`
+		Issuer    string      `json:"-"`
+		Audience  string      `json:"-"`
+		IssuedAt  int64       `json:"-"`
+		ExpiresAt int64       `json:"-"`
+		// Metadata is recorded with a new session token, it is not part of the token
+		Metadata SessionMetadata `json:"-"`
 	}
 
 	TokenConfig struct {
@@ -36,6 +55,11 @@ type (
 		Audience     string
 		Issuer       string
 		Algorithm    string
+		// ExtraAudiences are accepted besides Audience when verifying tokens, so tokens minted for a previous
+		// host keep working while clients move to a new one
+		ExtraAudiences []string
+		// ClockSkewSecs is the leeway given to the exp, nbf and iat claims of tokens from hosts whose clocks differ
+		ClockSkewSecs int64
 	}
 )
 
@@ -47,12 +71,29 @@ var (
 	SessionToken_error_no_userid        = errors.New("SessionToken: userId not set")
 	SessionToken_invalid                = errors.New("SessionToken: is invalid")
 	SessionToken_error_duration_not_set = errors.New("SessionToken: duration not set")
+
+	TokenConfig_error_invalid_issuer   = errors.New("TokenConfig: token was not issued by the issuer of the key")
+	TokenConfig_error_invalid_audience = errors.New("TokenConfig: token is not meant for an accepted audience")
+	// the validity errors keep the messages of jwt-go
+	TokenConfig_error_expired       = errors.New("Token is expired")
+	TokenConfig_error_not_valid_yet = errors.New("Token is not valid yet")
 )
 
+// CreateSessionToken signs a session token with the key of the config, see KeyRing.CreateSessionToken
 func CreateSessionToken(data *TokenData, config TokenConfig) (*SessionToken, error) {
+	keyRing, err := NewKeyRing(config)
+	if err != nil {
+		return nil, err
+	}
+	return keyRing.CreateSessionToken(data)
+}
+
+// CreateSessionToken signs a session token with the first key of the key ring
+func (r *KeyRing) CreateSessionToken(data *TokenData) (*SessionToken, error) {
 	if data.UserId == "" {
 		return nil, SessionToken_error_no_userid
 	}
+	config := r.signingConfig()
 
 	if data.DurationSecs == 0 {
 		if data.IsServer {
@@ -73,54 +114,30 @@ func CreateSessionToken(data *TokenData, config TokenConfig) (*SessionToken, err
 		svrClaim = "no"
 	}
 
-	var issuerClaim string
-	if config.Issuer == "" {
-		issuerClaim = "localhost"
-	} else {
-		issuerClaim = config.Issuer
-	}
-
-	var audienceClaim string
-	if config.Audience == "" {
-		audienceClaim = "localhost"
-	} else {
-		audienceClaim = config.Audience
-	}
-
-	signingMethod := jwt.GetSigningMethod(config.Algorithm)
-	if signingMethod == nil {
-		log.Print("Invalid signing method")
-		return nil, errors.New("Invalid signing method")
-	}
-
-	token := jwt.NewWithClaims(signingMethod, jwt.MapClaims{
+	claims := jwt.MapClaims{
 		"svr": svrClaim,
 		"usr": data.UserId,
 		"dur": data.DurationSecs,
 		"exp": expiresAt,
-		"iss": issuerClaim,
+		"iss": config.issuer(),
 		"sub": data.UserId,
-		"aud": audienceClaim,
+		"aud": config.audience(),
 		"iat": createdAt,
-	})
-
-	var privateKey interface{}
-	if _, ok := token.Method.(*jwt.SigningMethodRSA); ok {
-		var err error
-		privateKey, err = jwt.ParseRSAPrivateKeyFromPEM([]byte(config.EncodeKey))
-		if err != nil {
-			log.Print("failed to parse RSA key")
-			log.Printf("config %+#v", config)
-			return nil, err
-		}
-	} else {
-		privateKey = []byte(config.EncodeKey)
 	}
-
-	tokenString, err := token.SignedString(privateKey)
+	if data.FamilyID != "" {
+		claims["fam"] = data.FamilyID
+	}
+	if data.ClientID != "" {
+		claims["cid"] = data.ClientID
+	}
+	if len(data.Scopes) > 0 {
+		claims["scope"] = strings.Join(data.Scopes, " ")
+	}
+	if data.Actor != nil {
+		claims["act"] = map[string]interface{}{"sub": data.Actor.Subject}
+	}
+	tokenString, err := r.sign(claims)
 	if err != nil {
-		log.Print("failed to sign")
-		log.Printf("config %+#v", config)
 		return nil, err
 	}
 
@@ -131,6 +148,12 @@ func CreateSessionToken(data *TokenData, config TokenConfig) (*SessionToken, err
 		ExpiresAt: time.Unix(expiresAt, 0),
 		CreatedAt: time.Unix(createdAt, 0),
 		Time:      time.Unix(createdAt, 0),
+		FamilyID:  data.FamilyID,
+		ClientID:  data.ClientID,
+		Scopes:    data.Scopes,
+		Actor:     data.Actor.subject(),
+
+		SessionMetadata: data.Metadata,
 	}
 	if data.IsServer {
 		sessionToken.ServerID = data.UserId
@@ -142,15 +165,22 @@ func CreateSessionToken(data *TokenData, config TokenConfig) (*SessionToken, err
 }
 
 func CreateSessionTokenAndSave(data *TokenData, config TokenConfig, store Storage) (*SessionToken, error) {
-	sessionToken, err := CreateSessionToken(data, config)
+	keyRing, err := NewKeyRing(config)
+	if err != nil {
+		return nil, err
+	}
+	return keyRing.CreateSessionTokenAndSave(data, store)
+}
+
+func (r *KeyRing) CreateSessionTokenAndSave(data *TokenData, store Storage) (*SessionToken, error) {
+	sessionToken, err := r.CreateSessionToken(data)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = UnpackSessionTokenAndVerify(sessionToken.ID, config)
+	_, err = r.UnpackSessionTokenAndVerify(sessionToken.ID)
 	if err != nil {
-		log.Printf("failed to verify new session token %v", sessionToken.ID)
-		log.Printf("config %v", config)
+		log.Printf("failed to verify new session token: %v", err)
 		return nil, err
 	}
 
@@ -162,65 +192,135 @@ func CreateSessionTokenAndSave(data *TokenData, config TokenConfig, store Storag
 	return sessionToken, nil
 }
 
+// UnpackSessionTokenAndVerify verifies the session token with the keys of the configs, see
+// KeyRing.UnpackSessionTokenAndVerify
 func UnpackSessionTokenAndVerify(id string, tokenConfigs ...TokenConfig) (*TokenData, error) {
+	keyRing, err := NewKeyRing(tokenConfigs...)
+	if err != nil {
+		return nil, err
+	}
+	return keyRing.UnpackSessionTokenAndVerify(id)
+}
+
+// UnpackSessionTokenAndVerify verifies the session token with the keys of the key ring and returns its claims
+func (r *KeyRing) UnpackSessionTokenAndVerify(id string) (*TokenData, error) {
 	if id == "" {
 		return nil, SessionToken_error_no_userid
 	}
 
-	var jwtToken *jwt.Token
-	var publicKey *rsa.PublicKey
-	var err error
-	for _, tokenConfig := range tokenConfigs {
-		signingMethod := jwt.GetSigningMethod(tokenConfig.Algorithm)
-		if signingMethod == nil {
-			log.Print("Invalid signing method")
-			return nil, errors.New("Invalid signing method")
-		}
-
-		if _, ok := signingMethod.(*jwt.SigningMethodRSA); ok {
-			publicKey, err = jwt.ParseRSAPublicKeyFromPEM([]byte(tokenConfig.DecodeKey))
-			if err != nil {
-				log.Print("failed to parse RSA key")
-				log.Printf("config %+#v", tokenConfig)
-				return nil, err
-			}
-			jwtToken, err = jwt.Parse(id, func(token *jwt.Token) (interface{}, error) {
-				return publicKey, nil
-			})
-		} else {
-			jwtToken, err = jwt.Parse(id, func(token *jwt.Token) (interface{}, error) {
-				return []byte(tokenConfig.DecodeKey), nil
-			})
-		}
-
-		if err == nil {
-			break
-		}
-	}
-	if jwtToken == nil || err != nil {
-		log.Printf("failed to Parse JWT: %v", err)
+	jwtToken, err := r.verify(id)
+	if err != nil {
 		return nil, err
 	}
-	if !jwtToken.Valid {
-		return nil, SessionToken_invalid
-	}
 
 	claims := jwtToken.Claims.(jwt.MapClaims)
 
 	isServer := claims["svr"] == "yes"
 	durationSecs, ok := claims["dur"].(int64)
 	if !ok {
-		durationSecs = int64(claims["dur"].(float64))
+		durationFloat, ok := claims["dur"].(float64)
+		if !ok {
+			return nil, SessionToken_invalid
+		}
+		durationSecs = int64(durationFloat)
+	}
+	userId, ok := claims["usr"].(string)
+	if !ok {
+		return nil, SessionToken_invalid
 	}
-	userId := claims["usr"].(string)
+	familyID, _ := claims["fam"].(string)
+	clientID, _ := claims["cid"].(string)
+	var scopes []string
+	if scope, _ := claims["scope"].(string); scope != "" {
+		scopes = strings.Fields(scope)
+	}
+	var actor *TokenActor
+	if act, ok := claims["act"].(map[string]interface{}); ok {
+		subject, _ := act["sub"].(string)
+		if subject == "" {
+			return nil, SessionToken_invalid
+		}
+		actor = &TokenActor{Subject: subject}
+	}
+	issuer, _ := claims["iss"].(string)
+	audience, _ := claims["aud"].(string)
 
 	return &TokenData{
 		IsServer:     isServer,
 		DurationSecs: durationSecs,
 		UserId:       userId,
+		FamilyID:     familyID,
+		ClientID:     clientID,
+		Scopes:       scopes,
+		Actor:        actor,
+		Issuer:       issuer,
+		Audience:     audience,
+		IssuedAt:     numericClaim(claims, "iat"),
+		ExpiresAt:    numericClaim(claims, "exp"),
 	}, nil
 }
 
+// numericClaim returns the claim in seconds, or 0 if it is missing
+func numericClaim(claims jwt.MapClaims, name string) int64 {
+	switch value := claims[name].(type) {
+	case float64:
+		return int64(value)
+	case int64:
+		return value
+	case json.Number:
+		number, _ := value.Int64()
+		return number
+	}
+	return 0
+}
+
+// verifyClaims checks the issuer, audience and validity period of a token signed with the key of the config.
+// Unlike jwt-go, which only checks claims that are present, the token must expire.
+func (c TokenConfig) verifyClaims(claims jwt.MapClaims, now time.Time) error {
+	skew := c.ClockSkewSecs
+	if issuer, _ := claims["iss"].(string); issuer != c.issuer() {
+		return TokenConfig_error_invalid_issuer
+	} else if !c.acceptsAudience(claims["aud"]) {
+		return TokenConfig_error_invalid_audience
+	} else if expiresAt := numericClaim(claims, "exp"); expiresAt == 0 || now.Unix() >= expiresAt+skew {
+		return TokenConfig_error_expired
+	} else if notBefore := numericClaim(claims, "nbf"); now.Unix() < notBefore-skew {
+		return TokenConfig_error_not_valid_yet
+	} else if issuedAt := numericClaim(claims, "iat"); now.Unix() < issuedAt-skew {
+		return TokenConfig_error_not_valid_yet
+	}
+	return nil
+}
+
+// acceptsAudience reports whether the aud claim, a string or an array of strings, names an accepted audience
+func (c TokenConfig) acceptsAudience(claim interface{}) bool {
+	var audiences []string
+	switch value := claim.(type) {
+	case string:
+		audiences = []string{value}
+	case []interface{}:
+		for _, audience := range value {
+			if audience, ok := audience.(string); ok {
+				audiences = append(audiences, audience)
+			}
+		}
+	}
+	for _, audience := range audiences {
+		if audience == c.audience() || containsString(c.ExtraAudiences, audience) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c TokenConfig) issuer() string {
+	return firstStringNotEmpty(c.Issuer, "localhost")
+}
+
+func (c TokenConfig) audience() string {
+	return firstStringNotEmpty(c.Audience, "localhost")
+}
+
 func extractTokenDuration(r *http.Request) int64 {
 
 	durString := r.Header.Get(TOKEN_DURATION_KEY)
@@ -235,8 +335,8 @@ func extractTokenDuration(r *http.Request) int64 {
 	return 0
 }
 
-func hasServerToken(tokenString string, tokenConfigs ...TokenConfig) bool {
-	td, err := UnpackSessionTokenAndVerify(tokenString, tokenConfigs...)
+func (r *KeyRing) hasServerToken(tokenString string) bool {
+	td, err := r.UnpackSessionTokenAndVerify(tokenString)
 	if err != nil {
 		return false
 	}
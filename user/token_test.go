@@ -1,10 +1,15 @@
 package user
 
 import (
+	"crypto/x509"
+	"encoding/pem"
 	"net/http"
+	"reflect"
 	"strconv"
 	"testing"
 	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
 )
 
 type tokenTestData struct {
@@ -204,6 +209,217 @@ func Test_UnpackedData(t *testing.T) {
 
 }
 
+func Test_UnpackedData_ClientScopes(t *testing.T) {
+
+	token, err := CreateSessionToken(&TokenData{UserId: "data", IsServer: true, ClientID: "data", Scopes: []string{"users:read", "users:write"}}, tokenConfigs[0])
+	if err != nil {
+		t.Fatal("there should be no error creating the token", err.Error())
+	}
+	if token.ClientID != "data" || !reflect.DeepEqual(token.Scopes, []string{"users:read", "users:write"}) {
+		t.Fatalf("the stored token should record the client and scopes, got %#v", token)
+	}
+
+	data, err := UnpackSessionTokenAndVerify(token.ID, tokenConfigs[0])
+	if err != nil {
+		t.Fatal("unpacked token should be valid", err.Error())
+	}
+	if data.ClientID != "data" || !reflect.DeepEqual(data.Scopes, []string{"users:read", "users:write"}) {
+		t.Fatalf("the client and scopes should have been what was given, got %#v", data)
+	}
+
+}
+
+func Test_UnpackedData_Actor(t *testing.T) {
+
+	token, err := CreateSessionToken(&TokenData{UserId: "2341", DurationSecs: 3600, Actor: &TokenActor{Subject: "support@tidepool.org"}}, tokenConfigs[0])
+	if err != nil {
+		t.Fatal("there should be no error creating the token", err.Error())
+	}
+	if token.Actor != "support@tidepool.org" {
+		t.Fatalf("the stored token should record the actor, got %#v", token)
+	}
+
+	data, err := UnpackSessionTokenAndVerify(token.ID, tokenConfigs[0])
+	if err != nil {
+		t.Fatal("unpacked token should be valid", err.Error())
+	}
+	if !data.IsImpersonated() || data.Actor.Subject != "support@tidepool.org" {
+		t.Fatalf("the actor should have been what was given, got %#v", data)
+	}
+
+	token, err = CreateSessionToken(&TokenData{UserId: "2341", DurationSecs: 3600}, tokenConfigs[0])
+	if err != nil {
+		t.Fatal("there should be no error creating the token", err.Error())
+	}
+	if data, err := UnpackSessionTokenAndVerify(token.ID, tokenConfigs[0]); err != nil || data.IsImpersonated() {
+		t.Fatalf("a token without an act claim should not be impersonated, got %#v, %v", data, err)
+	}
+
+}
+
+func Test_CreateSessionToken_Metadata(t *testing.T) {
+
+	metadata := SessionMetadata{UserAgent: "uploader/2.0", ClientIP: "203.0.113.1", ClientName: "uploader"}
+	token, err := CreateSessionToken(&TokenData{UserId: "2341", DurationSecs: 3600, Metadata: metadata}, tokenConfigs[0])
+	if err != nil {
+		t.Fatal("there should be no error creating the token", err.Error())
+	}
+	if token.SessionMetadata != metadata || token.LastUsedAt != nil {
+		t.Fatalf("the stored token should record the metadata, got %#v", token)
+	}
+
+}
+
+func Test_UnpackedData_RegisteredClaims(t *testing.T) {
+
+	token, err := CreateSessionToken(&TokenData{UserId: "2341", DurationSecs: 3600}, tokenConfigs[0])
+	if err != nil {
+		t.Fatal("there should be no error creating the token", err.Error())
+	}
+
+	data, err := UnpackSessionTokenAndVerify(token.ID, tokenConfigs[0])
+	if err != nil {
+		t.Fatal("unpacked token should be valid", err.Error())
+	}
+	if data.Issuer != tokenConfigs[0].Issuer || data.Audience != tokenConfigs[0].Audience {
+		t.Fatalf("the issuer and audience should have been those of the config, got %#v", data)
+	}
+	if data.IssuedAt != token.CreatedAt.Unix() || data.ExpiresAt != token.ExpiresAt.Unix() {
+		t.Fatalf("the issue and expiry times should match the token, got %#v", data)
+	}
+
+}
+
+func Test_UnpackAndVerify_AsymmetricAlgorithms(t *testing.T) {
+
+	for _, algorithm := range []string{"ES256", "EdDSA"} {
+		tokenConfig := generateTokenConfig(t, algorithm)
+
+		token, err := CreateSessionToken(&TokenData{UserId: "2341", DurationSecs: 1200}, tokenConfig)
+		if err != nil {
+			t.Fatalf("there should be no error creating the %s token: %v", algorithm, err)
+		}
+
+		data, err := UnpackSessionTokenAndVerify(token.ID, tokenConfig)
+		if err != nil || data.UserId != "2341" {
+			t.Fatalf("the %s token should be valid, got %#v %v", algorithm, data, err)
+		}
+	}
+
+}
+
+func Test_parseECPrivateKeyFromPEM(t *testing.T) {
+
+	pkcs8 := generateTokenConfig(t, "ES256").EncodeKey
+	privateKey, err := parseECPrivateKeyFromPEM([]byte(pkcs8))
+	if err != nil {
+		t.Fatalf("there should be no error parsing a PKCS #8 key: %v", err)
+	}
+
+	der, _ := x509.MarshalECPrivateKey(privateKey)
+	sec1 := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if parsed, err := parseECPrivateKeyFromPEM(sec1); err != nil || !parsed.Equal(privateKey) {
+		t.Fatalf("there should be no error parsing a SEC 1 key: %v", err)
+	}
+	if _, err := parseECPrivateKeyFromPEM([]byte(tokenConfigs[0].EncodeKey)); err == nil {
+		t.Fatal("an RSA key should be rejected")
+	}
+
+}
+
+func Test_UnpackAndVerify_KeyRotation(t *testing.T) {
+
+	current := generateTokenConfig(t, "ES256")
+	previous := tokenConfigs[0]
+
+	oldToken, err := CreateSessionToken(&TokenData{UserId: "2341", DurationSecs: 1200}, previous)
+	if err != nil {
+		t.Fatal("there should be no error creating the token", err.Error())
+	}
+	newToken, err := CreateSessionToken(&TokenData{UserId: "2341", DurationSecs: 1200}, current)
+	if err != nil {
+		t.Fatal("there should be no error creating the token", err.Error())
+	}
+
+	for _, token := range []*SessionToken{oldToken, newToken} {
+		if _, err := UnpackSessionTokenAndVerify(token.ID, current, previous); err != nil {
+			t.Fatalf("the token should be valid while the keys are rotated: %v", err)
+		}
+	}
+
+	other := generateTokenConfig(t, "ES256")
+	if _, err := UnpackSessionTokenAndVerify(newToken.ID, other, previous); err != TokenConfig_error_unknown_key {
+		t.Fatalf("a token signed with an unknown key should be rejected, got %v", err)
+	}
+
+}
+
+func Test_UnpackAndVerify_IssuerAndAudience(t *testing.T) {
+
+	otherHost := tokenConfigs[0]
+	otherHost.Issuer, otherHost.Audience = "other.tidepool.test", "other.tidepool.test"
+	token, _ := CreateSessionToken(&TokenData{UserId: "2341", DurationSecs: 1200}, otherHost)
+
+	if _, err := UnpackSessionTokenAndVerify(token.ID, tokenConfigs[0]); err != TokenConfig_error_invalid_issuer {
+		t.Fatalf("a token of another issuer should be rejected, got %v", err)
+	}
+
+	sameIssuer := otherHost
+	sameIssuer.Audience = "localhost"
+	if _, err := UnpackSessionTokenAndVerify(token.ID, sameIssuer); err != TokenConfig_error_invalid_audience {
+		t.Fatalf("a token for another audience should be rejected, got %v", err)
+	}
+
+	sameIssuer.ExtraAudiences = []string{"other.tidepool.test"}
+	if _, err := UnpackSessionTokenAndVerify(token.ID, sameIssuer); err != nil {
+		t.Fatalf("a token for an extra audience should be accepted: %v", err)
+	}
+
+}
+
+func Test_UnpackAndVerify_Algorithm(t *testing.T) {
+
+	// a token signed with the public key as an HMAC secret must not pass for one signed with the private key
+	forged := tokenConfigs[0]
+	forged.Algorithm, forged.EncodeKey = "HS256", forged.DecodeKey
+	token, err := CreateSessionToken(&TokenData{UserId: "2341", DurationSecs: 1200}, forged)
+	if err != nil {
+		t.Fatal("there should be no error creating the token", err.Error())
+	}
+
+	if _, err := UnpackSessionTokenAndVerify(token.ID, tokenConfigs[0]); err != TokenConfig_error_unknown_key {
+		t.Fatalf("a token of another algorithm should be rejected, got %v", err)
+	}
+
+}
+
+func Test_verifyClaims_ClockSkew(t *testing.T) {
+
+	now := time.Now()
+	config := tokenConfigs[0]
+	claims := jwt.MapClaims{"iss": "localhost", "aud": []interface{}{"localhost"}, "iat": now.Add(30 * time.Second).Unix(), "exp": now.Add(-30 * time.Second).Unix()}
+
+	if err := config.verifyClaims(claims, now); err != TokenConfig_error_expired {
+		t.Fatalf("an expired token should be rejected without leeway, got %v", err)
+	}
+	claims["exp"] = now.Add(time.Hour).Unix()
+	if err := config.verifyClaims(claims, now); err != TokenConfig_error_not_valid_yet {
+		t.Fatalf("a token issued in the future should be rejected without leeway, got %v", err)
+	}
+
+	config.ClockSkewSecs = 60
+	claims["exp"] = now.Add(-30 * time.Second).Unix()
+	if err := config.verifyClaims(claims, now); err != nil {
+		t.Fatalf("the token should be accepted within the clock skew: %v", err)
+	}
+
+	delete(claims, "exp")
+	if err := config.verifyClaims(claims, now); err != TokenConfig_error_expired {
+		t.Fatalf("a token without expiry should be rejected, got %v", err)
+	}
+
+}
+
 func Test_UnpackTokenExpires(t *testing.T) {
 
 	for _, tokenConfig := range tokenConfigs {
@@ -294,7 +510,7 @@ func Test_hasServerToken(t *testing.T) {
 
 		token, _ := CreateSessionToken(testData.data, tokenConfig)
 
-		if hasServerToken(token.ID, tokenConfig) == false {
+		if newKeyRing(t, tokenConfig).hasServerToken(token.ID) == false {
 			t.Fatal("We should have got a server Token")
 		}
 	}
@@ -309,7 +525,7 @@ func Test_hasServerToken_false(t *testing.T) {
 
 		token, _ := CreateSessionToken(testData.data, tokenConfig)
 
-		if hasServerToken(token.ID, tokenConfig) != false {
+		if newKeyRing(t, tokenConfig).hasServerToken(token.ID) != false {
 			t.Fatal("We should have not got a server Token")
 		}
 	}
@@ -0,0 +1,331 @@
+package user
+
+import (
+	"container/list"
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/cloudevents/sdk-go/protocol/kafka_sarama/v2"
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/tidepool-org/go-common/events"
+)
+
+const TokensRevokedEventType = "users:tokens_revoked"
+
+// tokenRevocationRetryDelay is how long the revocation consumer waits before it reconnects to Kafka
+const tokenRevocationRetryDelay = 30 * time.Second
+
+var (
+	tokenCacheHitCount = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tidepool_shoreline_token_cache_hit_total",
+		Help: "The total number of session tokens found in the token cache",
+	})
+	tokenCacheMissCount = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tidepool_shoreline_token_cache_miss_total",
+		Help: "The total number of session tokens looked up in storage because they were not in the token cache",
+	})
+)
+
+type (
+	// TokenCacheConfig configures the cache of session tokens found in storage. A revoked token stays valid on
+	// other replicas for at most MaxStalenessSecs if they miss the revocation broadcast. The cache is disabled
+	// without a staleness.
+	TokenCacheConfig struct {
+		MaxStalenessSecs int64 `json:"maxStalenessSecs"` // how long a token is used from the cache before it is looked up again
+		MaxEntries       int   `json:"maxEntries"`       // the least recently used tokens are dropped beyond this
+	}
+
+	// TokenCache is a bounded cache of the session tokens found in storage, keyed by their session id. It is
+	// safe for concurrent use.
+	TokenCache struct {
+		staleness  time.Duration
+		maxEntries int
+
+		lock    sync.Mutex
+		entries map[string]*list.Element // of *tokenCacheEntry
+		recency *list.List               // most recently used first
+	}
+
+	tokenCacheEntry struct {
+		sessionID string
+		token     SessionToken
+		expiresAt time.Time
+	}
+)
+
+var DefaultTokenCacheConfig = TokenCacheConfig{
+	MaxEntries: 10000,
+}
+
+func (c TokenCacheConfig) withDefaults() TokenCacheConfig {
+	if c.MaxEntries == 0 {
+		c.MaxEntries = DefaultTokenCacheConfig.MaxEntries
+	}
+	return c
+}
+
+// IsEnabled reports whether session tokens are cached
+func (c TokenCacheConfig) IsEnabled() bool {
+	return c.MaxStalenessSecs > 0
+}
+
+// NewTokenCache returns the cache of the config, or nil if it is disabled
+func NewTokenCache(config TokenCacheConfig) *TokenCache {
+	if !config.IsEnabled() {
+		return nil
+	}
+	config = config.withDefaults()
+	return &TokenCache{
+		staleness:  time.Duration(config.MaxStalenessSecs) * time.Second,
+		maxEntries: config.MaxEntries,
+		entries:    map[string]*list.Element{},
+		recency:    list.New(),
+	}
+}
+
+// Get returns a copy of the cached session token, or nil if it is not cached or has gone stale
+func (c *TokenCache) Get(tokenID string, now time.Time) *SessionToken {
+	sessionID := SessionID(tokenID)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	element, found := c.entries[sessionID]
+	if !found {
+		tokenCacheMissCount.Inc()
+		return nil
+	}
+	entry := element.Value.(*tokenCacheEntry)
+	if !now.Before(entry.expiresAt) {
+		c.removeElement(element)
+		tokenCacheMissCount.Inc()
+		return nil
+	}
+	c.recency.MoveToFront(element)
+	tokenCacheHitCount.Inc()
+	token := entry.token
+	return &token
+}
+
+// Add caches a copy of the session token found in storage until it goes stale or expires
+func (c *TokenCache) Add(token *SessionToken, now time.Time) {
+	entry := &tokenCacheEntry{sessionID: SessionID(token.ID), token: *token, expiresAt: now.Add(c.staleness)}
+	if !token.ExpiresAt.IsZero() && token.ExpiresAt.Before(entry.expiresAt) {
+		entry.expiresAt = token.ExpiresAt
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if element, found := c.entries[entry.sessionID]; found {
+		c.removeElement(element)
+	}
+	c.entries[entry.sessionID] = c.recency.PushFront(entry)
+	for c.recency.Len() > c.maxEntries {
+		c.removeElement(c.recency.Back())
+	}
+}
+
+// MarkUsed records the last use of a cached session token, without making it any less stale
+func (c *TokenCache) MarkUsed(tokenID string, usedAt time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if element, found := c.entries[SessionID(tokenID)]; found {
+		element.Value.(*tokenCacheEntry).token.LastUsedAt = &usedAt
+	}
+}
+
+// Revoke drops the session tokens of the revocation, see TokensRevokedEvent
+func (c *TokenCache) Revoke(revocation TokensRevokedEvent) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, sessionID := range revocation.SessionIDs {
+		if element, found := c.entries[sessionID]; found {
+			c.removeElement(element)
+		}
+	}
+	if len(revocation.SessionIDs) > 0 && revocation.FamilyID == "" {
+		return
+	}
+	for element := c.recency.Front(); element != nil; {
+		next := element.Next()
+		token := element.Value.(*tokenCacheEntry).token
+		if revocation.FamilyID != "" && token.FamilyID == revocation.FamilyID {
+			c.removeElement(element)
+		} else if revocation.FamilyID == "" && revocation.UserID != "" && token.UserID == revocation.UserID {
+			c.removeElement(element)
+		}
+		element = next
+	}
+}
+
+// Len returns the number of cached session tokens
+func (c *TokenCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.recency.Len()
+}
+
+func (c *TokenCache) removeElement(element *list.Element) {
+	delete(c.entries, element.Value.(*tokenCacheEntry).sessionID)
+	c.recency.Remove(element)
+}
+
+var _ events.Event = TokensRevokedEvent{}
+
+// TokensRevokedEvent tells every replica to drop revoked session tokens from its token cache: the sessions of
+// SessionIDs, all sessions of the refresh token family FamilyID, or all sessions of the user when neither is
+// given. Session ids rather than the tokens are sent, as the tokens are bearer credentials.
+type TokensRevokedEvent struct {
+	UserID     string    `json:"userId"`
+	SessionIDs []string  `json:"sessionIds,omitempty"`
+	FamilyID   string    `json:"familyId,omitempty"`
+	RevokedAt  time.Time `json:"revokedAt"`
+}
+
+func (t TokensRevokedEvent) GetEventType() string {
+	return TokensRevokedEventType
+}
+
+func (t TokensRevokedEvent) GetEventKey() string {
+	return t.UserID
+}
+
+var _ events.EventHandler = &tokenRevocationHandler{}
+
+// tokenRevocationHandler applies the revocations broadcast by other replicas to the token cache. Deleted users
+// are handled too, as only one replica removes their tokens.
+type tokenRevocationHandler struct {
+	cache *TokenCache
+}
+
+// NewTokenRevocationHandler returns the handler of the revocation broadcast for the token cache. Each replica
+// must consume the whole broadcast, see NewTokenRevocationConsumer.
+func NewTokenRevocationHandler(cache *TokenCache) events.EventHandler {
+	return &tokenRevocationHandler{cache: cache}
+}
+
+func (h *tokenRevocationHandler) CanHandle(ce cloudevents.Event) bool {
+	return ce.Type() == TokensRevokedEventType || ce.Type() == events.DeleteUserEventType
+}
+
+func (h *tokenRevocationHandler) Handle(ce cloudevents.Event) error {
+	switch ce.Type() {
+	case TokensRevokedEventType:
+		revocation := TokensRevokedEvent{}
+		if err := ce.DataAs(&revocation); err != nil {
+			return err
+		}
+		h.cache.Revoke(revocation)
+	case events.DeleteUserEventType:
+		payload := events.DeleteUserEvent{}
+		if err := ce.DataAs(&payload); err != nil {
+			return err
+		}
+		h.cache.Revoke(TokensRevokedEvent{UserID: payload.UserID})
+	}
+	return nil
+}
+
+var _ events.EventConsumer = &tokenRevocationConsumer{}
+
+// tokenRevocationConsumer reads the revocation broadcast from every partition of the topic without a consumer
+// group. Each replica needs every revocation, but only those published after it started as its token cache
+// starts empty, so there are no offsets worth committing and replicas that are gone leave no groups behind.
+type tokenRevocationConsumer struct {
+	config   *events.CloudEventsConfig
+	handlers []events.EventHandler
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewTokenRevocationConsumer returns the consumer of the revocation broadcast for NewTokenRevocationHandler. It
+// starts at the newest messages and reconnects after errors until stopped.
+func NewTokenRevocationConsumer(config *events.CloudEventsConfig) events.EventConsumer {
+	return &tokenRevocationConsumer{config: config, stop: make(chan struct{})}
+}
+
+func (c *tokenRevocationConsumer) RegisterHandler(handler events.EventHandler) {
+	c.handlers = append(c.handlers, handler)
+}
+
+func (c *tokenRevocationConsumer) Start() error {
+	for {
+		err := c.consume()
+		if err == events.ErrConsumerStopped {
+			return err
+		}
+		log.Printf("Token revocation consumer exited, reconnecting in %v: %v", tokenRevocationRetryDelay, err)
+		select {
+		case <-c.stop:
+			return events.ErrConsumerStopped
+		case <-time.After(tokenRevocationRetryDelay):
+		}
+	}
+}
+
+func (c *tokenRevocationConsumer) Stop() error {
+	c.stopOnce.Do(func() { close(c.stop) })
+	return nil
+}
+
+// consume handles the messages of all partitions until the consumer is stopped
+func (c *tokenRevocationConsumer) consume() error {
+	consumer, err := sarama.NewConsumer(c.config.KafkaBrokers, c.config.SaramaConfig)
+	if err != nil {
+		return err
+	}
+	defer consumer.Close()
+
+	topic := c.config.GetPrefixedTopic()
+	partitions, err := consumer.Partitions(topic)
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	var partitionConsumers []sarama.PartitionConsumer
+	defer func() {
+		for _, partitionConsumer := range partitionConsumers {
+			partitionConsumer.AsyncClose()
+		}
+		wg.Wait()
+	}()
+	for _, partition := range partitions {
+		partitionConsumer, err := consumer.ConsumePartition(topic, partition, sarama.OffsetNewest)
+		if err != nil {
+			return err
+		}
+		partitionConsumers = append(partitionConsumers, partitionConsumer)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for message := range partitionConsumer.Messages() {
+				c.handleMessage(message)
+			}
+		}()
+	}
+
+	<-c.stop
+	return events.ErrConsumerStopped
+}
+
+// handleMessage passes a cloud event to the handlers, other messages are ignored. A revocation that cannot be
+// applied is not retried, the cached tokens go stale eventually.
+func (c *tokenRevocationConsumer) handleMessage(message *sarama.ConsumerMessage) {
+	event, err := binding.ToEvent(context.Background(), kafka_sarama.NewMessageFromConsumerMessage(message))
+	if err != nil {
+		return
+	}
+	for _, handler := range c.handlers {
+		if handler.CanHandle(*event) {
+			if err := handler.Handle(*event); err != nil {
+				log.Printf("Error handling token revocation event %s: %v", event.ID(), err)
+			}
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package user
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/tidepool-org/go-common/events"
+)
+
+func newCachedToken(id string, userID string, familyID string) *SessionToken {
+	return &SessionToken{ID: id, UserID: userID, FamilyID: familyID, ExpiresAt: time.Now().Add(time.Hour)}
+}
+
+func TestTokenCache_Staleness(t *testing.T) {
+
+	if NewTokenCache(TokenCacheConfig{}) != nil {
+		t.Fatalf("the cache should be disabled without a staleness")
+	}
+	cache := NewTokenCache(TokenCacheConfig{MaxStalenessSecs: 60})
+	now := time.Now()
+	if cache.Get("a", now) != nil {
+		t.Fatalf("an unknown token should not be cached")
+	}
+
+	cache.Add(newCachedToken("a", "1111111111", ""), now)
+	if token := cache.Get("a", now.Add(59*time.Second)); token == nil || token.ID != "a" {
+		t.Fatalf("the token should be cached until it goes stale, got %v", token)
+	}
+	if cache.Get("a", now.Add(time.Minute)) != nil || cache.Len() != 0 {
+		t.Fatalf("a stale token should be dropped")
+	}
+
+	expiring := newCachedToken("b", "1111111111", "")
+	expiring.ExpiresAt = now.Add(time.Second)
+	cache.Add(expiring, now)
+	if cache.Get("b", now.Add(2*time.Second)) != nil {
+		t.Fatalf("an expired token should not be cached beyond its expiry")
+	}
+}
+
+func TestTokenCache_MaxEntries(t *testing.T) {
+
+	cache := NewTokenCache(TokenCacheConfig{MaxStalenessSecs: 60, MaxEntries: 2})
+	now := time.Now()
+	cache.Add(newCachedToken("a", "1111111111", ""), now)
+	cache.Add(newCachedToken("b", "1111111111", ""), now)
+	cache.Get("a", now)
+	cache.Add(newCachedToken("c", "1111111111", ""), now)
+	if cache.Len() != 2 || cache.Get("b", now) != nil || cache.Get("a", now) == nil {
+		t.Fatalf("the least recently used token should be dropped")
+	}
+}
+
+func TestTokenCache_MarkUsed(t *testing.T) {
+
+	cache := NewTokenCache(TokenCacheConfig{MaxStalenessSecs: 60})
+	now := time.Now()
+	cache.Add(newCachedToken("a", "1111111111", ""), now)
+	cache.MarkUsed("a", now)
+	if token := cache.Get("a", now); token == nil || !token.LastUsed().Equal(now) {
+		t.Fatalf("the last use of the cached token should be recorded, got %v", token)
+	}
+}
+
+func TestTokenCache_Revoke(t *testing.T) {
+
+	cache := NewTokenCache(TokenCacheConfig{MaxStalenessSecs: 60})
+	now := time.Now()
+	for _, token := range []*SessionToken{
+		newCachedToken("a", "1111111111", ""),
+		newCachedToken("b", "1111111111", "family"),
+		newCachedToken("c", "1111111111", "family"),
+		newCachedToken("d", "1111111111", ""),
+		newCachedToken("e", "2222222222", ""),
+	} {
+		cache.Add(token, now)
+	}
+
+	cache.Revoke(TokensRevokedEvent{UserID: "1111111111", SessionIDs: []string{SessionID("a")}})
+	if cache.Get("a", now) != nil || cache.Len() != 4 {
+		t.Fatalf("only the session should be dropped")
+	}
+	cache.Revoke(TokensRevokedEvent{UserID: "1111111111", FamilyID: "family"})
+	if cache.Get("b", now) != nil || cache.Get("c", now) != nil || cache.Len() != 2 {
+		t.Fatalf("only the sessions of the family should be dropped")
+	}
+	cache.Revoke(TokensRevokedEvent{UserID: "1111111111"})
+	if cache.Get("d", now) != nil || cache.Get("e", now) == nil {
+		t.Fatalf("only the sessions of the user should be dropped")
+	}
+}
+
+func TestTokenRevocationHandler(t *testing.T) {
+
+	cache := NewTokenCache(TokenCacheConfig{MaxStalenessSecs: 60})
+	now := time.Now()
+	cache.Add(newCachedToken("a", "1111111111", ""), now)
+	cache.Add(newCachedToken("b", "2222222222", ""), now)
+	handler := NewTokenRevocationHandler(cache)
+
+	revoked := cloudevents.NewEvent()
+	revoked.SetType(TokensRevokedEventType)
+	revoked.SetData(cloudevents.ApplicationJSON, TokensRevokedEvent{UserID: "1111111111", SessionIDs: []string{SessionID("a")}})
+	deleted := cloudevents.NewEvent()
+	deleted.SetType(events.DeleteUserEventType)
+	deleted.SetData(cloudevents.ApplicationJSON, events.DeleteUserEvent{UserData: toUserData(User{Id: "2222222222"})})
+
+	for _, event := range []cloudevents.Event{revoked, deleted} {
+		if !handler.CanHandle(event) {
+			t.Fatalf("the handler should handle %s events", event.Type())
+		} else if err := handler.Handle(event); err != nil {
+			t.Fatalf("there should be no error handling %s events: %v", event.Type(), err)
+		}
+	}
+	if cache.Len() != 0 {
+		t.Fatalf("the revoked session and the sessions of the deleted user should be dropped")
+	}
+}
+
+func TestTokenRevocationConsumer_HandleMessage(t *testing.T) {
+
+	cache := NewTokenCache(TokenCacheConfig{MaxStalenessSecs: 60})
+	cache.Add(newCachedToken("a", "1111111111", ""), time.Now())
+	consumer := NewTokenRevocationConsumer(events.NewConfig()).(*tokenRevocationConsumer)
+	consumer.RegisterHandler(NewTokenRevocationHandler(cache))
+
+	consumer.handleMessage(&sarama.ConsumerMessage{Value: []byte("not a cloud event")})
+	if cache.Len() != 1 {
+		t.Fatalf("other messages should be ignored")
+	}
+
+	data, err := json.Marshal(TokensRevokedEvent{UserID: "1111111111", SessionIDs: []string{SessionID("a")}})
+	if err != nil {
+		t.Fatalf("there should be no error encoding the event: %v", err)
+	}
+	headers := map[string]string{"ce_specversion": "1.0", "ce_id": "1", "ce_source": "shoreline", "ce_type": TokensRevokedEventType, "content-type": cloudevents.ApplicationJSON}
+	message := &sarama.ConsumerMessage{Value: data}
+	for key, value := range headers {
+		message.Headers = append(message.Headers, &sarama.RecordHeader{Key: []byte(key), Value: []byte(value)})
+	}
+	consumer.handleMessage(message)
+	if cache.Len() != 0 {
+		t.Fatalf("the revoked session should be dropped")
+	}
+}
+
+func TestTokenRevocationConsumer_Stop(t *testing.T) {
+
+	config := events.NewConfig()
+	config.KafkaBrokers = []string{"127.0.0.1:0"}
+	config.SaramaConfig.Metadata.Retry.Max = 0
+	consumer := NewTokenRevocationConsumer(config)
+
+	stopped := make(chan error)
+	go func() { stopped <- consumer.Start() }()
+	consumer.Stop()
+	select {
+	case err := <-stopped:
+		if err != events.ErrConsumerStopped {
+			t.Fatalf("the consumer should be stopped, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the consumer should stop while waiting to reconnect")
+	}
+}
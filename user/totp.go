@@ -0,0 +1,109 @@
+package user
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP as specified by RFC 6238 with the parameters every common authenticator app supports
+const (
+	totpDigits       = 6
+	totpPeriodSecs   = 30
+	totpSecretLength = 20
+	totpSkewSteps    = 1 // number of steps before and after the current one that are still accepted
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// MfaSettings is the second factor of a user. Until the enrollment is confirmed with a valid code
+// the settings are stored with Enabled false and are ignored during login.
+type MfaSettings struct {
+	Secret       string `bson:"secret"`                 // base32 encoded TOTP secret
+	Enabled      bool   `bson:"enabled"`                // set once the user confirmed the enrollment
+	EnabledTime  string `bson:"enabledTime,omitempty"`  // when the enrollment was confirmed
+	LastUsedStep int64  `bson:"lastUsedStep,omitempty"` // the time step of the last accepted code, to prevent replays
+	// Hashes of the unused recovery codes, see HashRecoveryCode
+	RecoveryCodes []string `bson:"recoveryCodes,omitempty"`
+}
+
+// NewTotpSecret generates a random base32 encoded TOTP secret
+func NewTotpSecret() (string, error) {
+	secret := make([]byte, totpSecretLength)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// TotpURI returns the otpauth URI that authenticator apps use to enroll the secret, usually presented as a QR code
+func TotpURI(issuer string, account string, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriodSecs))
+
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, query.Encode())
+}
+
+// TotpStep returns the time step that the given time falls into
+func TotpStep(at time.Time) int64 {
+	return at.Unix() / totpPeriodSecs
+}
+
+// TotpCode computes the code of the secret for the given time step
+func TotpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	} else if len(key) == 0 {
+		return "", errors.New("totp secret is empty")
+	}
+
+	message := make([]byte, 8)
+	binary.BigEndian.PutUint64(message, uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	modulo := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%modulo), nil
+}
+
+// ValidateTotpCode checks the code against the steps around the given time and returns the matching step
+func ValidateTotpCode(secret string, code string, at time.Time) (int64, bool) {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := TotpStep(at)
+	for step := current - totpSkewSteps; step <= current+totpSkewSteps; step++ {
+		expected, err := TotpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
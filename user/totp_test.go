@@ -0,0 +1,87 @@
+package user
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// The RFC 6238 test secret "12345678901234567890" in base32
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTotpCode_RFC6238(t *testing.T) {
+
+	expected := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+	for unix, code := range expected {
+		if actual, err := TotpCode(rfc6238Secret, TotpStep(time.Unix(unix, 0))); err != nil {
+			t.Fatalf("there should be no error computing the code: %v", err)
+		} else if actual != code {
+			t.Fatalf("the code at %d should be %s, but was %s", unix, code, actual)
+		}
+	}
+
+}
+
+func TestTotpCode_InvalidSecret(t *testing.T) {
+
+	if _, err := TotpCode("not base32!", 1); err == nil {
+		t.Fatal("there should be an error when the secret is not base32")
+	}
+	if _, err := TotpCode("", 1); err == nil {
+		t.Fatal("there should be an error when the secret is empty")
+	}
+
+}
+
+func TestValidateTotpCode(t *testing.T) {
+
+	secret, err := NewTotpSecret()
+	if err != nil {
+		t.Fatalf("there should be no error generating the secret: %v", err)
+	}
+
+	now := time.Now()
+	current := TotpStep(now)
+
+	for _, step := range []int64{current - 1, current, current + 1} {
+		code, _ := TotpCode(secret, step)
+		if matched, ok := ValidateTotpCode(secret, code, now); !ok || matched != step {
+			t.Fatalf("the code of step %d should be accepted", step)
+		}
+	}
+
+	code, _ := TotpCode(secret, current-2)
+	if _, ok := ValidateTotpCode(secret, code, now); ok {
+		t.Fatal("a code outside the accepted window should be rejected")
+	}
+	if _, ok := ValidateTotpCode(secret, "12345", now); ok {
+		t.Fatal("a code with the wrong number of digits should be rejected")
+	}
+
+	code, _ = TotpCode(secret, current)
+	if _, ok := ValidateTotpCode(secret, code[:3]+" "+code[3:], now); !ok {
+		t.Fatal("a code with a space should be accepted")
+	}
+
+}
+
+func TestTotpURI(t *testing.T) {
+
+	uri := TotpURI("Tidepool", "a@z.co", "ABCDEF")
+	if !strings.HasPrefix(uri, "otpauth://totp/Tidepool:a@z.co?") {
+		t.Fatalf("unexpected otpauth uri %s", uri)
+	}
+	for _, param := range []string{"secret=ABCDEF", "issuer=Tidepool", "digits=6", "period=30", "algorithm=SHA1"} {
+		if !strings.Contains(uri, param) {
+			t.Fatalf("otpauth uri %s should contain %s", uri, param)
+		}
+	}
+
+}
@@ -25,6 +25,12 @@ type User struct {
 	ModifiedUserID string                 `json:"modifiedUserId,omitempty" bson:"modifiedUserId,omitempty"`
 	DeletedTime    string                 `json:"deletedTime,omitempty" bson:"deletedTime,omitempty"`
 	DeletedUserID  string                 `json:"deletedUserId,omitempty" bson:"deletedUserId,omitempty"`
+	// Failed login tracking is only ever updated through the dedicated Storage methods
+	FailedLogins        int       `json:"-" bson:"failedLogins,omitempty"`
+	LastFailedLoginTime time.Time `json:"-" bson:"lastFailedLoginTime,omitempty"`
+	LockedUntil         time.Time `json:"-" bson:"lockedUntil,omitempty"`
+	// The second factor is only ever updated through the dedicated Storage methods
+	Mfa *MfaSettings `json:"-" bson:"mfa,omitempty"`
 }
 
 /*
@@ -205,7 +211,9 @@ func (details *NewUserDetails) ExtractFromJSON(reader io.Reader) error {
 	return nil
 }
 
-func (details *NewUserDetails) Validate() error {
+// Validate checks the details and evaluates the password policy against the username and emails, a nil policy
+// falls back to DefaultPasswordPolicy. A password rejected by the policy results in a PasswordPolicyError.
+func (details *NewUserDetails) Validate(policy PasswordPolicy) error {
 	if details.Username == nil {
 		return User_error_username_missing
 	} else if !IsValidEmail(*details.Username) {
@@ -224,8 +232,8 @@ func (details *NewUserDetails) Validate() error {
 
 	if details.Password == nil {
 		return User_error_password_missing
-	} else if !IsValidPassword(*details.Password) {
-		return User_error_password_invalid
+	} else if err := checkPasswordPolicy(policy, *details.Password, append([]string{*details.Username}, details.Emails...)...); err != nil {
+		return err
 	}
 
 	if details.Roles != nil {
@@ -248,10 +256,11 @@ func ParseNewUserDetails(reader io.Reader) (*NewUserDetails, error) {
 	}
 }
 
-func NewUser(details *NewUserDetails, salt string) (user *User, err error) {
+// NewUser creates a user with a password hashed per hashConfig from details that pass the password policy
+func NewUser(details *NewUserDetails, salt string, hashConfig PasswordHashConfig, policy PasswordPolicy) (user *User, err error) {
 	if details == nil {
 		return nil, errors.New("New user details is nil")
-	} else if err := details.Validate(); err != nil {
+	} else if err := details.Validate(policy); err != nil {
 		return nil, err
 	}
 
@@ -264,7 +273,7 @@ func NewUser(details *NewUserDetails, salt string) (user *User, err error) {
 		return nil, errors.New("User: error generating hash")
 	}
 
-	if err = user.HashPassword(*details.Password, salt); err != nil {
+	if err = user.HashPasswordWithConfig(*details.Password, salt, hashConfig); err != nil {
 		return nil, errors.New("User: error generating password hash")
 	}
 
@@ -403,7 +412,10 @@ func (details *UpdateUserDetails) ExtractFromJSON(reader io.Reader) error {
 	return nil
 }
 
-func (details *UpdateUserDetails) Validate() error {
+// Validate checks the details and evaluates the password policy against the updated username and emails as well
+// as the identifiers of the account being updated, a nil policy falls back to DefaultPasswordPolicy.
+// A password rejected by the policy results in a PasswordPolicyError.
+func (details *UpdateUserDetails) Validate(policy PasswordPolicy, identifiers ...string) error {
 	if details.Username != nil {
 		if !IsValidEmail(*details.Username) {
 			return User_error_username_invalid
@@ -419,8 +431,12 @@ func (details *UpdateUserDetails) Validate() error {
 	}
 
 	if details.Password != nil {
-		if !IsValidPassword(*details.Password) {
-			return User_error_password_invalid
+		if details.Username != nil {
+			identifiers = append(identifiers, *details.Username)
+		}
+		identifiers = append(identifiers, details.Emails...)
+		if err := checkPasswordPolicy(policy, *details.Password, identifiers...); err != nil {
+			return err
 		}
 	}
 
@@ -472,7 +488,11 @@ func (u *User) IsClinic() bool {
 }
 
 func (u *User) HashPassword(pw, salt string) error {
-	if passwordHash, err := GeneratePasswordHash(u.Id, pw, salt); err != nil {
+	return u.HashPasswordWithConfig(pw, salt, DefaultPasswordHashConfig)
+}
+
+func (u *User) HashPasswordWithConfig(pw, salt string, config PasswordHashConfig) error {
+	if passwordHash, err := GenerateVersionedPasswordHash(pw, salt, config); err != nil {
 		return err
 	} else {
 		u.PwHash = passwordHash
@@ -483,25 +503,39 @@ func (u *User) HashPassword(pw, salt string) error {
 func (u *User) PasswordsMatch(pw, salt string) bool {
 	if u.PwHash == "" || pw == "" {
 		return false
-	} else if pwMatch, err := GeneratePasswordHash(u.Id, pw, salt); err != nil {
-		return false
-	} else {
-		return u.PwHash == pwMatch
 	}
+	return VerifyPasswordHash(u.PwHash, u.Id, pw, salt)
 }
 
-func (u *User) IsEmailVerified(secret string) bool {
-	if secret != "" {
-		if strings.Contains(u.Username, secret) {
+// PasswordNeedsRehash is true when the stored hash is a legacy hash or was generated with
+// different parameters than config
+func (u *User) PasswordNeedsRehash(config PasswordHashConfig) bool {
+	return PasswordHashNeedsUpgrade(u.PwHash, config)
+}
+
+func (u *User) IsMfaEnabled() bool {
+	return u.Mfa != nil && u.Mfa.Enabled
+}
+
+func (u *User) IsLocked() bool {
+	return time.Now().Before(u.LockedUntil)
+}
+
+// HasVerificationSecret reports whether the username or an email of the user contains the secret, which test
+// environments use to sign up users that need no email verification, see ApiConfig.AllowVerificationSecret
+func (u *User) HasVerificationSecret(secret string) bool {
+	if secret == "" {
+		return false
+	}
+	if strings.Contains(u.Username, secret) {
+		return true
+	}
+	for i := range u.Emails {
+		if strings.Contains(u.Emails[i], secret) {
 			return true
 		}
-		for i := range u.Emails {
-			if strings.Contains(u.Emails[i], secret) {
-				return true
-			}
-		}
 	}
-	return u.EmailVerified
+	return false
 }
 
 func (u *User) DeepClone() *User {
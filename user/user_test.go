@@ -1,6 +1,7 @@
 package user
 
 import (
+	"errors"
 	"reflect"
 	"strings"
 	"testing"
@@ -339,7 +340,7 @@ func Test_NewUserDetails_ExtractFromJSON_ValidRoles(t *testing.T) {
 func Test_NewUserDetails_Validate_Username_Missing(t *testing.T) {
 	password := "12345678"
 	details := &NewUserDetails{Emails: []string{"b@y.co", "c@x.co"}, Password: &password}
-	err := details.Validate()
+	err := details.Validate(DefaultPasswordPolicy)
 	if err != User_error_username_missing {
 		t.Fatalf("Unexpected error for username missing: %#v", err)
 	}
@@ -349,7 +350,7 @@ func Test_NewUserDetails_Validate_Username_Invalid(t *testing.T) {
 	username := "a"
 	password := "12345678"
 	details := &NewUserDetails{Username: &username, Emails: []string{"b@y.co", "c@x.co"}, Password: &password}
-	err := details.Validate()
+	err := details.Validate(DefaultPasswordPolicy)
 	if err != User_error_username_invalid {
 		t.Fatalf("Unexpected error for username invalid: %#v", err)
 	}
@@ -359,7 +360,7 @@ func Test_NewUserDetails_Validate_Emails_Missing(t *testing.T) {
 	username := "a@z.co"
 	password := "12345678"
 	details := &NewUserDetails{Username: &username, Password: &password}
-	err := details.Validate()
+	err := details.Validate(DefaultPasswordPolicy)
 	if err != User_error_emails_missing {
 		t.Fatalf("Unexpected error for emails missing: %#v", err)
 	}
@@ -369,7 +370,7 @@ func Test_NewUserDetails_Validate_Emails_Invalid(t *testing.T) {
 	username := "a@z.co"
 	password := "12345678"
 	details := &NewUserDetails{Username: &username, Emails: []string{"b@y.co", "c"}, Password: &password}
-	err := details.Validate()
+	err := details.Validate(DefaultPasswordPolicy)
 	if err != User_error_emails_invalid {
 		t.Fatalf("Unexpected error for emails invalid: %#v", err)
 	}
@@ -378,7 +379,7 @@ func Test_NewUserDetails_Validate_Emails_Invalid(t *testing.T) {
 func Test_NewUserDetails_Validate_Password_Missing(t *testing.T) {
 	username := "a@z.co"
 	details := &NewUserDetails{Username: &username, Emails: []string{"b@y.co", "c@x.co"}}
-	err := details.Validate()
+	err := details.Validate(DefaultPasswordPolicy)
 	if err != User_error_password_missing {
 		t.Fatalf("Unexpected error for password missing: %#v", err)
 	}
@@ -388,17 +389,27 @@ func Test_NewUserDetails_Validate_Password_Invalid(t *testing.T) {
 	username := "a@z.co"
 	password := "1234567"
 	details := &NewUserDetails{Username: &username, Emails: []string{"b@y.co", "c@x.co"}, Password: &password}
-	err := details.Validate()
-	if err != User_error_password_invalid {
+	err := details.Validate(DefaultPasswordPolicy)
+	if !errors.Is(err, User_error_password_invalid) {
 		t.Fatalf("Unexpected error for password invalid: %#v", err)
 	}
 }
 
+func Test_NewUserDetails_Validate_Password_Rejected(t *testing.T) {
+	username := "jessica@z.co"
+	password := "jessica2016"
+	details := &NewUserDetails{Username: &username, Emails: []string{"jessica@z.co"}, Password: &password}
+	err := details.Validate(DefaultPasswordPolicy)
+	if policyErr, ok := err.(*PasswordPolicyError); !ok || len(policyErr.Rejections) != 1 || policyErr.Rejections[0].Code != PasswordRejectionSimilarToIdentity {
+		t.Fatalf("Unexpected error for password rejected: %#v", err)
+	}
+}
+
 func Test_NewUserDetails_Validate_Roles_Invalid(t *testing.T) {
 	username := "a@z.co"
 	password := "12345678"
 	details := &NewUserDetails{Username: &username, Emails: []string{"b@y.co", "c@x.co"}, Password: &password, Roles: []string{"invalid"}}
-	err := details.Validate()
+	err := details.Validate(DefaultPasswordPolicy)
 	if err != User_error_roles_invalid {
 		t.Fatalf("Unexpected error for roles invalid: %#v", err)
 	}
@@ -408,7 +419,7 @@ func Test_NewUserDetails_Validate_Valid(t *testing.T) {
 	username := "a@z.co"
 	password := "12345678"
 	details := &NewUserDetails{Username: &username, Emails: []string{"b@y.co", "c@x.co"}, Password: &password, Roles: []string{"clinic"}}
-	err := details.Validate()
+	err := details.Validate(DefaultPasswordPolicy)
 	if err != nil {
 		t.Fatalf("Unexpected error for valid: %#v", err)
 	}
@@ -441,7 +452,7 @@ func Test_ParseNewUserDetails_ValidAll(t *testing.T) {
 
 func Test_NewUser_MissingDetails(t *testing.T) {
 	salt := "abc"
-	user, err := NewUser(nil, salt)
+	user, err := NewUser(nil, salt, DefaultPasswordHashConfig, DefaultPasswordPolicy)
 	if err == nil {
 		t.Fatalf("Unexpected success for missing details")
 	}
@@ -454,7 +465,7 @@ func Test_NewUser_InvalidDetails(t *testing.T) {
 	username := "a"
 	details := &NewUserDetails{Username: &username}
 	salt := "abc"
-	user, err := NewUser(details, salt)
+	user, err := NewUser(details, salt, DefaultPasswordHashConfig, DefaultPasswordPolicy)
 	if err == nil {
 		t.Fatalf("Unexpected success for invalid details")
 	}
@@ -467,7 +478,7 @@ func Test_NewUser_MissingSalt(t *testing.T) {
 	username := "a@z.co"
 	password := "12345678"
 	details := &NewUserDetails{Username: &username, Emails: []string{"b@y.co", "c@x.co"}, Password: &password}
-	user, err := NewUser(details, "")
+	user, err := NewUser(details, "", DefaultPasswordHashConfig, DefaultPasswordPolicy)
 	if err == nil {
 		t.Fatalf("Unexpected success for missing salt")
 	}
@@ -476,12 +487,29 @@ func Test_NewUser_MissingSalt(t *testing.T) {
 	}
 }
 
+func Test_NewUser_HashConfig(t *testing.T) {
+	username := "a@z.co"
+	password := "12345678"
+	details := &NewUserDetails{Username: &username, Emails: []string{"a@z.co"}, Password: &password}
+	hashConfig := PasswordHashConfig{Algorithm: PasswordHashAlgorithmBcrypt, BcryptCost: 4}
+	user, err := NewUser(details, "abc", hashConfig, DefaultPasswordPolicy)
+	if err != nil {
+		t.Fatalf("Unexpected error for valid: %#v", err)
+	}
+	if user.PasswordNeedsRehash(hashConfig) {
+		t.Fatalf("Password should be hashed with the given config")
+	}
+	if !user.PasswordsMatch(password, "abc") {
+		t.Fatalf("Password does not match on success")
+	}
+}
+
 func Test_NewUser_Valid(t *testing.T) {
 	username := "a@z.co"
 	password := "12345678"
 	details := &NewUserDetails{Username: &username, Emails: []string{"b@y.co", "c@x.co"}, Password: &password, Roles: []string{"clinic"}}
 	salt := "abc"
-	user, err := NewUser(details, salt)
+	user, err := NewUser(details, salt, DefaultPasswordHashConfig, DefaultPasswordPolicy)
 	if err != nil {
 		t.Fatalf("Unexpected error for valid: %#v", err)
 	}
@@ -932,7 +960,7 @@ func Test_UpdateUserDetails_Validate_Username_Missing(t *testing.T) {
 	termsAccepted := "2016-01-01T12:00:00-08:00"
 	emailVerified := true
 	details := &UpdateUserDetails{Emails: []string{"b@y.co", "c@x.co"}, Password: &password, Roles: []string{"clinic"}, TermsAccepted: &termsAccepted, EmailVerified: &emailVerified}
-	err := details.Validate()
+	err := details.Validate(DefaultPasswordPolicy)
 	if err != nil {
 		t.Fatalf("Unexpected error for username missing: %#v", err)
 	}
@@ -944,7 +972,7 @@ func Test_UpdateUserDetails_Validate_Username_Invalid(t *testing.T) {
 	termsAccepted := "2016-01-01T12:00:00-08:00"
 	emailVerified := true
 	details := &UpdateUserDetails{Username: &username, Emails: []string{"b@y.co", "c@x.co"}, Password: &password, Roles: []string{"clinic"}, TermsAccepted: &termsAccepted, EmailVerified: &emailVerified}
-	err := details.Validate()
+	err := details.Validate(DefaultPasswordPolicy)
 	if err != User_error_username_invalid {
 		t.Fatalf("Unexpected error for username invalid: %#v", err)
 	}
@@ -956,7 +984,7 @@ func Test_UpdateUserDetails_Validate_Emails_Missing(t *testing.T) {
 	termsAccepted := "2016-01-01T12:00:00-08:00"
 	emailVerified := true
 	details := &UpdateUserDetails{Username: &username, Password: &password, Roles: []string{"clinic"}, TermsAccepted: &termsAccepted, EmailVerified: &emailVerified}
-	err := details.Validate()
+	err := details.Validate(DefaultPasswordPolicy)
 	if err != nil {
 		t.Fatalf("Unexpected error for emails missing: %#v", err)
 	}
@@ -968,7 +996,7 @@ func Test_UpdateUserDetails_Validate_Emails_Invalid(t *testing.T) {
 	termsAccepted := "2016-01-01T12:00:00-08:00"
 	emailVerified := true
 	details := &UpdateUserDetails{Username: &username, Emails: []string{"b@y.co", "c"}, Password: &password, Roles: []string{"clinic"}, TermsAccepted: &termsAccepted, EmailVerified: &emailVerified}
-	err := details.Validate()
+	err := details.Validate(DefaultPasswordPolicy)
 	if err != User_error_emails_invalid {
 		t.Fatalf("Unexpected error for emails invalid: %#v", err)
 	}
@@ -979,7 +1007,7 @@ func Test_UpdateUserDetails_Validate_Password_Missing(t *testing.T) {
 	termsAccepted := "2016-01-01T12:00:00-08:00"
 	emailVerified := true
 	details := &UpdateUserDetails{Username: &username, Emails: []string{"b@y.co", "c@x.co"}, Roles: []string{"clinic"}, TermsAccepted: &termsAccepted, EmailVerified: &emailVerified}
-	err := details.Validate()
+	err := details.Validate(DefaultPasswordPolicy)
 	if err != nil {
 		t.Fatalf("Unexpected error for password missing: %#v", err)
 	}
@@ -991,19 +1019,31 @@ func Test_UpdateUserDetails_Validate_Password_Invalid(t *testing.T) {
 	termsAccepted := "2016-01-01T12:00:00-08:00"
 	emailVerified := true
 	details := &UpdateUserDetails{Username: &username, Emails: []string{"b@y.co", "c@x.co"}, Password: &password, Roles: []string{"clinic"}, TermsAccepted: &termsAccepted, EmailVerified: &emailVerified}
-	err := details.Validate()
-	if err != User_error_password_invalid {
+	err := details.Validate(DefaultPasswordPolicy)
+	if !errors.Is(err, User_error_password_invalid) {
 		t.Fatalf("Unexpected error for password invalid: %#v", err)
 	}
 }
 
+func Test_UpdateUserDetails_Validate_Password_Rejected(t *testing.T) {
+	password := "jessica2016"
+	details := &UpdateUserDetails{Password: &password}
+	if err := details.Validate(DefaultPasswordPolicy); err != nil {
+		t.Fatalf("Unexpected error without identifiers: %#v", err)
+	}
+	err := details.Validate(DefaultPasswordPolicy, "jessica@z.co")
+	if policyErr, ok := err.(*PasswordPolicyError); !ok || len(policyErr.Rejections) != 1 || policyErr.Rejections[0].Code != PasswordRejectionSimilarToIdentity {
+		t.Fatalf("Unexpected error for password rejected: %#v", err)
+	}
+}
+
 func Test_UpdateUserDetails_Validate_Roles_Missing(t *testing.T) {
 	username := "a@z.co"
 	password := "12345678"
 	termsAccepted := "2016-01-01T12:00:00-08:00"
 	emailVerified := true
 	details := &UpdateUserDetails{Username: &username, Password: &password, TermsAccepted: &termsAccepted, EmailVerified: &emailVerified}
-	err := details.Validate()
+	err := details.Validate(DefaultPasswordPolicy)
 	if err != nil {
 		t.Fatalf("Unexpected error for roles missing: %#v", err)
 	}
@@ -1015,7 +1055,7 @@ func Test_UpdateUserDetails_Validate_Roles_Invalid(t *testing.T) {
 	termsAccepted := "2016-01-01T12:00:00-08:00"
 	emailVerified := true
 	details := &UpdateUserDetails{Username: &username, Emails: []string{"b@y.co", "c"}, Password: &password, Roles: []string{"invalid"}, TermsAccepted: &termsAccepted, EmailVerified: &emailVerified}
-	err := details.Validate()
+	err := details.Validate(DefaultPasswordPolicy)
 	if err != User_error_emails_invalid {
 		t.Fatalf("Unexpected error for roles invalid: %#v", err)
 	}
@@ -1026,7 +1066,7 @@ func Test_UpdateUserDetails_Validate_TermsAccepted_Missing(t *testing.T) {
 	password := "12345678"
 	emailVerified := true
 	details := &UpdateUserDetails{Username: &username, Emails: []string{"b@y.co", "c@x.co"}, Password: &password, Roles: []string{"clinic"}, EmailVerified: &emailVerified}
-	err := details.Validate()
+	err := details.Validate(DefaultPasswordPolicy)
 	if err != nil {
 		t.Fatalf("Unexpected error for password missing: %#v", err)
 	}
@@ -1038,7 +1078,7 @@ func Test_UpdateUserDetails_Validate_TermsAccepted_Invalid(t *testing.T) {
 	termsAccepted := "2016-13-32T24:65:65-24:30"
 	emailVerified := true
 	details := &UpdateUserDetails{Username: &username, Emails: []string{"b@y.co", "c@x.co"}, Password: &password, Roles: []string{"clinic"}, TermsAccepted: &termsAccepted, EmailVerified: &emailVerified}
-	err := details.Validate()
+	err := details.Validate(DefaultPasswordPolicy)
 	if err != User_error_terms_accepted_invalid {
 		t.Fatalf("Unexpected error for password invalid: %#v", err)
 	}
@@ -1049,7 +1089,7 @@ func Test_UpdateUserDetails_Validate_EmailVerified_Missing(t *testing.T) {
 	password := "12345678"
 	termsAccepted := "2016-01-01T12:00:00-08:00"
 	details := &UpdateUserDetails{Username: &username, Emails: []string{"b@y.co", "c@x.co"}, Password: &password, Roles: []string{"clinic"}, TermsAccepted: &termsAccepted}
-	err := details.Validate()
+	err := details.Validate(DefaultPasswordPolicy)
 	if err != nil {
 		t.Fatalf("Unexpected error for password missing: %#v", err)
 	}
@@ -1061,7 +1101,7 @@ func Test_UpdateUserDetails_Validate_Valid(t *testing.T) {
 	termsAccepted := "2016-01-01T12:00:00-08:00"
 	emailVerified := true
 	details := &UpdateUserDetails{Username: &username, Emails: []string{"b@y.co", "c@x.co"}, Password: &password, Roles: []string{"clinic"}, TermsAccepted: &termsAccepted, EmailVerified: &emailVerified}
-	err := details.Validate()
+	err := details.Validate(DefaultPasswordPolicy)
 	if err != nil {
 		t.Fatalf("Unexpected error for valid: %#v", err)
 	}
@@ -1242,37 +1282,53 @@ func Test_User_PasswordsMatch_NoMatch_MissingSalt(t *testing.T) {
 	}
 }
 
-func Test_User_IsVerified(t *testing.T) {
+func Test_User_PasswordNeedsRehash(t *testing.T) {
+	user := &User{Id: "1234567890", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5"}
+	if !user.PasswordNeedsRehash(DefaultPasswordHashConfig) {
+		t.Fatalf("PasswordNeedsRehash returned false for a legacy hash")
+	}
+	if err := user.HashPassword("3th3Hardw0y", "abc"); err != nil {
+		t.Fatalf("Failure hashing password")
+	}
+	if user.PasswordNeedsRehash(DefaultPasswordHashConfig) {
+		t.Fatalf("PasswordNeedsRehash returned true for a current hash")
+	}
+}
+
+func Test_User_HasVerificationSecret(t *testing.T) {
 	usernameWithSecret := "one@abc.com"
 	passwordWithSecret := "3th3Hardw0y"
-	userWithSecret, err := NewUser(&NewUserDetails{Username: &usernameWithSecret, Password: &passwordWithSecret, Emails: []string{"test+secret@foo.bar"}}, "some salt")
+	userWithSecret, err := NewUser(&NewUserDetails{Username: &usernameWithSecret, Password: &passwordWithSecret, Emails: []string{"test+secret@foo.bar"}}, "some salt", DefaultPasswordHashConfig, DefaultPasswordPolicy)
 	if err != nil {
 		t.Fatalf("Failure creating user with secret: %#v", err)
 	}
 
 	username := "two@abc.com"
 	password := "3th3Hardw0y"
-	user, err := NewUser(&NewUserDetails{Username: &username, Password: &password, Emails: []string{"test@foo.bar"}}, "some salt")
+	user, err := NewUser(&NewUserDetails{Username: &username, Password: &password, Emails: []string{"test@foo.bar"}}, "some salt", DefaultPasswordHashConfig, DefaultPasswordPolicy)
 	if err != nil {
 		t.Fatalf("Failure creating user: %#v", err)
 	}
 
 	//no secret
-	if userWithSecret.IsEmailVerified("") == true {
-		t.Fatalf("the user should not have been verified")
+	if userWithSecret.HasVerificationSecret("") == true {
+		t.Fatalf("an empty secret should never match")
 	}
 
-	if user.IsEmailVerified("") == true {
-		t.Fatalf("the user should not have been verified")
+	if user.HasVerificationSecret("") == true {
+		t.Fatalf("an empty secret should never match")
 	}
 
 	//with secret
-	if userWithSecret.IsEmailVerified("+secret") == false {
-		t.Fatalf("the user should say they are verified as we both have the secret")
+	if userWithSecret.HasVerificationSecret("+secret") == false {
+		t.Fatalf("the user should have the secret in their email")
 	}
 
-	if user.IsEmailVerified("+secret") == true {
-		t.Fatalf("the user should say they are verified as they don't have the secret")
+	if user.HasVerificationSecret("+secret") == true {
+		t.Fatalf("the user should not have the secret")
+	}
+	if user.EmailVerified || userWithSecret.EmailVerified {
+		t.Fatalf("new users should not be verified")
 	}
 }
 